@@ -60,8 +60,16 @@ func main() {
 	prefRepo := repositories.NewPreferenceRepo(db)
 	factRepo := repositories.NewFactRepo(db)
 	episodeRepo := repositories.NewEpisodeRepo(db)
+	documentRepo := repositories.NewDocumentRepo(db)
+	blobRepo := repositories.NewBlobRepo(db)
+	if err := blobRepo.MigrateInlineImages(); err != nil {
+		slog.ErrorContext(ctx, "Error moving inline images to blobs", "error", err)
+		return
+	}
 	reminderRepo := repositories.NewReminderRepo(db)
 	pendingInputRepo := repositories.NewPendingInputRepo(db)
+	usageRepo := repositories.NewUsageRepo(db)
+	toolConfirmationRepo := repositories.NewToolConfirmationRepo(db)
 
 	allowedUserIDsStr := os.Getenv("ALLOWED_USER_ID")
 	allowedUserIDs := make([]int64, 0)
@@ -73,26 +81,53 @@ func main() {
 		}
 		allowedUserIDs = append(allowedUserIDs, id)
 	}
+	adminUserIDs := make([]int64, 0)
+	for _, idStr := range strings.Split(os.Getenv("ADMIN_USER_ID"), ",") {
+		if strings.TrimSpace(idStr) == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSpace(idStr), 10, 0)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error parsing admin user ID", "error", err)
+			return
+		}
+		adminUserIDs = append(adminUserIDs, id)
+	}
+	if err := userRepo.PromoteAdmins(adminUserIDs); err != nil {
+		slog.ErrorContext(ctx, "Error promoting admins", "error", err)
+		return
+	}
+	if err := userRepo.DemoteAdminsExcept(adminUserIDs); err != nil {
+		slog.ErrorContext(ctx, "Error demoting admins", "error", err)
+		return
+	}
 	dialogTimeout := int64(appConfig.DialogTimeout)
 	maxConcurrentRequests := appConfig.MaxConcurrentRequests
 	rateLimiter := middleware.RateLimiter{MaxConcurrentRequests: maxConcurrentRequests}
-	authenticator := middleware.UserAuthenticator{UserRepo: userRepo, AllowedUserIds: allowedUserIDs, AppConfig: *appConfig}
+	authenticator := middleware.UserAuthenticator{UserRepo: userRepo, AllowedUserIds: allowedUserIDs, AdminUserIds: adminUserIDs, AppConfig: *appConfig}
 
-	llmClientProxy := services.NewClientProxyFromConfig(appConfig)
+	llmClientProxy, err := services.NewClientProxyFromConfig(appConfig)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error configuring models", "error", err)
+		return
+	}
 
+	imageStore := services.NewImageStore(blobRepo)
 	embedder := services.NewEmbedder(llmClientProxy.OpenaiClient, appConfig.Memory.Embedding.Model)
 	extractor := services.NewExtractor(llmClientProxy.OpenaiClient, appConfig.Memory.Extractor.Model)
 	summarizer := services.NewSummarizer(llmClientProxy.OpenaiClient, appConfig.Memory.Extractor.Model)
 
 	memoryManager := services.NewMemoryManager(
-		traceRepo, prefRepo, factRepo, episodeRepo,
+		traceRepo, prefRepo, factRepo, episodeRepo, documentRepo, imageStore,
 		embedder, extractor, summarizer,
 		services.MemoryConfig{
 			FactConfidenceMin:   appConfig.Memory.Thresholds.FactConfidenceMin,
 			PrefConfidenceMin:   appConfig.Memory.Thresholds.PreferenceConfidenceMin,
 			SemanticDedupCosine: appConfig.Memory.Thresholds.SemanticDedupCosine,
+			DocumentMinCosine:   appConfig.Memory.Thresholds.DocumentMinCosine,
 			FactsTopK:           appConfig.Memory.Retrieval.FactsTopK,
 			EpisodesTopK:        appConfig.Memory.Retrieval.EpisodesTopK,
+			DocumentsTopK:       appConfig.Memory.Retrieval.DocumentsTopK,
 			EpisodeMinTurns:     appConfig.Memory.Episode.MinTurns,
 			RecentTraceEvents:   appConfig.Memory.Retrieval.RecentTraceEvents,
 		},
@@ -111,23 +146,58 @@ func main() {
 		return
 	}
 
+	authenticator.OnPendingUser = tgbot.NewApprovalRequester(b, userRepo)
+
 	reminderService := services.NewReminderService(reminderRepo, userRepo, prefRepo, memoryManager, b)
 	webSearchService := services.NewWebSearchService(os.Getenv("TAVILY_API_KEY"))
+	usageService := services.NewUsageService(usageRepo, appConfig.Models, appConfig.Budget)
+	transcriber, err := services.NewTranscriberFromConfig(appConfig.Voice.STT, llmClientProxy.OpenaiClient)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error creating transcriber", "error", err)
+		return
+	}
+	voiceService := services.NewVoiceService(transcriber, llmClientProxy.OpenaiClient, appConfig.Voice.TTS, prefRepo)
+	toolRegistry := services.NewToolRegistryFromConfig(appConfig.Tools)
+	for _, provider := range []services.ToolProvider{memoryService, reminderService, webSearchService} {
+		if err := toolRegistry.Register(provider); err != nil {
+			slog.ErrorContext(ctx, "Error registering tools", "error", err)
+			return
+		}
+	}
+	for _, serverConfig := range appConfig.Tools.MCPServers {
+		mcpProvider, err := services.ConnectMCPServer(ctx, serverConfig)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error connecting to MCP server, its tools are unavailable", "server", serverConfig.Name, "error", err)
+			continue
+		}
+		defer mcpProvider.Close()
+		if err := toolRegistry.Register(mcpProvider); err != nil {
+			slog.ErrorContext(ctx, "Error registering MCP tools", "server", serverConfig.Name, "error", err)
+		}
+	}
+	toolRegistry.WarnUnknownTools()
 	textService := services.NewTextService(
 		llmClientProxy,
 		userRepo,
-		memoryService,
+		usageService,
+		toolRegistry,
 		memoryManager,
-		reminderService,
-		webSearchService,
+		voiceService,
 		dialogTimeout,
 		appConfig.DefaultModel.ModelId,
 	)
 	reminderService.SetScheduledActionRunner(textService)
-	voiceService := &services.VoiceService{
-		Client: llmClientProxy.OpenaiClient,
-	}
-	conversationRunner := services.NewConversationRunner(db, pendingInputRepo, traceRepo, textService)
+	toolConfirmationService := services.NewToolConfirmationService(
+		db,
+		toolConfirmationRepo,
+		traceRepo,
+		toolRegistry,
+		memoryManager,
+		b,
+		time.Duration(appConfig.Tools.ConfirmationTimeoutMinutes)*time.Minute,
+	)
+	textService.SetToolConfirmations(toolConfirmationService)
+	conversationRunner := services.NewConversationRunner(db, pendingInputRepo, traceRepo, imageStore, textService)
 
 	b.Use(func(next tele.HandlerFunc) tele.HandlerFunc {
 		return func(c tele.Context) error {
@@ -140,12 +210,15 @@ func main() {
 	})
 	b.Use(middleware.Logger())
 	b.Use(authenticator.Middleware())
+	b.Use(middleware.ForumTopics(userRepo))
 
 	err = b.SetCommands([]tele.Command{
 		{Text: "/retry", Description: "Retry the last message"},
 		{Text: "/new_chat", Description: "Start a new dialog"},
 		{Text: "/current_model", Description: "Currently selected model"},
 		{Text: "/change_model", Description: "Change the model"},
+		{Text: "/usage", Description: "Token usage and spending"},
+		{Text: "/voice", Description: "Turn voice replies on or off"},
 		{Text: "/cancel", Description: "Cancel the current request"},
 	})
 	if err != nil {
@@ -162,11 +235,15 @@ func main() {
 		userRepo,
 		memoryManager,
 		llmClientProxy,
+		usageService,
+		toolConfirmationService,
 	)
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	toolConfirmationService.StartExpiry(ctx)
+
 	if err := reminderService.StartScheduler(ctx); err != nil {
 		slog.ErrorContext(ctx, "Error starting reminder scheduler", "error", err)
 		return
@@ -7,6 +7,7 @@ toolchain go1.24.4
 require (
 	github.com/google/uuid v1.6.0
 	github.com/joho/godotenv v1.5.1
+	github.com/ledongthuc/pdf v0.0.0-20240201131950-da5b75280b06
 	github.com/olebedev/when v1.1.0
 	github.com/sashabaranov/go-openai v1.39.0
 	golang.org/x/exp v0.0.0-20250408133849-7e4ce0ab07d0
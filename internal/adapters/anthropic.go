@@ -2,11 +2,15 @@ package adapters
 
 import (
 	"context"
+	"encoding/json"
+	"strings"
 
 	"vadimgribanov.com/tg-gpt/internal/llm"
 	"vadimgribanov.com/tg-gpt/internal/vendors/anthropic"
 )
 
+const anthropicMaxTokens = 4096
+
 type AnthropicAdapter struct {
 	client *anthropic.Client
 }
@@ -20,32 +24,38 @@ func (a *AnthropicAdapter) Provider() llm.Provider {
 }
 
 func (a *AnthropicAdapter) Capabilities(model string) llm.Capabilities {
-	return llm.Capabilities{}
+	return llm.Capabilities{
+		FunctionTools: true,
+		Vision:        anthropicModelSupportsVision(model),
+		ToolChoice:    true,
+	}
 }
 
-func (a *AnthropicAdapter) Stream(ctx context.Context, request llm.Request) (llm.Stream, error) {
-	anthropicMessages := []anthropic.Message{}
-	systemPrompt := ""
-	for _, message := range request.Messages {
-		if message.Role == llm.RoleSystem {
-			systemPrompt = message.Content
-			continue
+// anthropicModelSupportsVision reports whether the model accepts image blocks. Every
+// Claude 3+ model does except 3.5 Haiku; older generations are text-only.
+func anthropicModelSupportsVision(model string) bool {
+	for _, prefix := range []string{"claude-2", "claude-instant", "claude-3-5-haiku"} {
+		if strings.HasPrefix(model, prefix) {
+			return false
 		}
-		if message.ToolResult != nil {
-			continue
-		}
-		anthropicMessages = append(anthropicMessages, anthropic.Message{
-			Role:    string(message.Role),
-			Content: message.Content,
-		})
 	}
+	return true
+}
 
-	stream, err := a.client.CreateMessagesStream(ctx, anthropic.CreateMessageRequest{
+func (a *AnthropicAdapter) Stream(ctx context.Context, request llm.Request) (llm.Stream, error) {
+	systemPrompt, messages := toAnthropicMessages(request.Messages)
+	anthropicReq := anthropic.CreateMessageRequest{
 		System:    systemPrompt,
 		Model:     request.Model,
-		Messages:  anthropicMessages,
-		MaxTokens: 4096,
-	})
+		Messages:  messages,
+		MaxTokens: anthropicMaxTokens,
+		Tools:     toAnthropicTools(request.Tools),
+	}
+	if len(anthropicReq.Tools) > 0 {
+		anthropicReq.ToolChoice = toAnthropicToolChoice(request.ToolChoice)
+	}
+
+	stream, err := a.client.CreateMessagesStream(ctx, anthropicReq)
 	if err != nil {
 		return nil, err
 	}
@@ -53,6 +63,165 @@ func (a *AnthropicAdapter) Stream(ctx context.Context, request llm.Request) (llm
 	return &AnthropicStreamAdapter{stream: stream}, nil
 }
 
+// toAnthropicMessages splits out the leading system prompt and converts the rest of
+// the history into Anthropic's user/assistant content-block form. Tool results become
+// tool_result blocks on a user turn, and any later system messages (e.g. mid-turn
+// notices) are folded in as user text since the API only accepts one system prompt.
+// Consecutive messages with the same role are merged so every tool_result for an
+// assistant turn lands in the single user message that follows it.
+func toAnthropicMessages(messages []llm.Message) (string, []anthropic.Message) {
+	systemPrompt := ""
+	out := make([]anthropic.Message, 0, len(messages))
+	appendBlocks := func(role string, blocks []anthropic.ContentBlock) {
+		if len(blocks) == 0 {
+			return
+		}
+		if n := len(out); n > 0 && out[n-1].Role == role {
+			out[n-1].Content = append(out[n-1].Content, blocks...)
+			return
+		}
+		out = append(out, anthropic.Message{Role: role, Content: blocks})
+	}
+
+	for i, msg := range messages {
+		switch msg.Role {
+		case llm.RoleSystem:
+			if i == 0 {
+				systemPrompt = msg.Content
+				continue
+			}
+			appendBlocks("user", textBlocks(msg.Content))
+		case llm.RoleTool:
+			if msg.ToolResult == nil {
+				continue
+			}
+			appendBlocks("user", []anthropic.ContentBlock{{
+				Type:      anthropic.ContentBlockTypeToolResult,
+				ToolUseID: msg.ToolResult.CallID,
+				Content:   msg.ToolResult.Output,
+				IsError:   msg.ToolResult.IsError,
+			}})
+		case llm.RoleAssistant:
+			blocks := textBlocks(msg.Content)
+			for _, call := range msg.ToolCalls {
+				blocks = append(blocks, anthropic.ContentBlock{
+					Type:  anthropic.ContentBlockTypeToolUse,
+					ID:    call.ID,
+					Name:  call.Name,
+					Input: toolInputJSON(call.Arguments),
+				})
+			}
+			appendBlocks("assistant", blocks)
+		default:
+			appendBlocks("user", toAnthropicUserBlocks(msg))
+		}
+	}
+	return systemPrompt, out
+}
+
+func toAnthropicUserBlocks(msg llm.Message) []anthropic.ContentBlock {
+	if len(msg.Parts) == 0 {
+		return textBlocks(msg.Content)
+	}
+	blocks := make([]anthropic.ContentBlock, 0, len(msg.Parts))
+	for _, part := range msg.Parts {
+		switch part.Type {
+		case llm.ContentPartImageURL:
+			if source := toAnthropicImageSource(part.ImageURL); source != nil {
+				blocks = append(blocks, anthropic.ContentBlock{
+					Type:   anthropic.ContentBlockTypeImage,
+					Source: source,
+				})
+			}
+		case llm.ContentPartDocument:
+			if part.Document != nil {
+				blocks = append(blocks, textBlocks(part.Document.Text())...)
+			}
+		default:
+			blocks = append(blocks, textBlocks(part.Text)...)
+		}
+	}
+	return blocks
+}
+
+var anthropicImageMediaTypes = map[string]struct{}{
+	"image/jpeg": {},
+	"image/png":  {},
+	"image/gif":  {},
+	"image/webp": {},
+}
+
+// toAnthropicImageSource converts an image URL into an Anthropic image source.
+// Base64 data URLs ("data:image/png;base64,...") become inline sources; http(s)
+// URLs are passed by reference. Anything else, including media types the API does
+// not accept, yields nil and the part is dropped.
+func toAnthropicImageSource(imageURL string) *anthropic.ImageSource {
+	if strings.HasPrefix(imageURL, "http://") || strings.HasPrefix(imageURL, "https://") {
+		return &anthropic.ImageSource{Type: anthropic.ImageSourceTypeURL, URL: imageURL}
+	}
+	mediaType, data, ok := llm.ParseBase64DataURL(imageURL)
+	if !ok {
+		return nil
+	}
+	if _, ok := anthropicImageMediaTypes[mediaType]; !ok {
+		return nil
+	}
+	return &anthropic.ImageSource{
+		Type:      anthropic.ImageSourceTypeBase64,
+		MediaType: mediaType,
+		Data:      data,
+	}
+}
+
+func textBlocks(text string) []anthropic.ContentBlock {
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	return []anthropic.ContentBlock{{Type: anthropic.ContentBlockTypeText, Text: text}}
+}
+
+// toolInputJSON returns the tool call arguments as a JSON object. Anthropic rejects
+// tool_use blocks whose input is missing or not an object, which is what an empty or
+// truncated argument string would otherwise produce.
+func toolInputJSON(arguments string) json.RawMessage {
+	trimmed := strings.TrimSpace(arguments)
+	var obj map[string]any
+	if trimmed == "" || json.Unmarshal([]byte(trimmed), &obj) != nil || obj == nil {
+		return json.RawMessage(`{}`)
+	}
+	return json.RawMessage(trimmed)
+}
+
+func toAnthropicTools(tools []llm.Tool) []anthropic.Tool {
+	if len(tools) == 0 {
+		return nil
+	}
+	out := make([]anthropic.Tool, 0, len(tools))
+	for _, tool := range tools {
+		schema := tool.Parameters
+		if schema == nil {
+			schema = map[string]any{"type": "object", "properties": map[string]any{}}
+		}
+		out = append(out, anthropic.Tool{
+			Name:        tool.Name,
+			Description: tool.Description,
+			InputSchema: schema,
+		})
+	}
+	return out
+}
+
+func toAnthropicToolChoice(choice llm.ToolChoice) *anthropic.ToolChoice {
+	switch choice {
+	case llm.ToolChoiceNone:
+		return &anthropic.ToolChoice{Type: anthropic.ToolChoiceNone}
+	case llm.ToolChoiceAuto:
+		return &anthropic.ToolChoice{Type: anthropic.ToolChoiceAuto}
+	default:
+		return nil
+	}
+}
+
 type AnthropicStreamAdapter struct {
 	stream  *anthropic.StreamedResponse
 	current llm.StreamEvent
@@ -67,12 +236,40 @@ func (a *AnthropicStreamAdapter) Next() bool {
 	}
 	a.current = llm.StreamEvent{}
 	switch typedData := resp.(type) {
+	case anthropic.ContentBlockStartData:
+		if typedData.ContentBlock.Type == anthropic.ContentBlockTypeToolUse {
+			a.current.ToolCall = &llm.ToolCall{
+				ID:    typedData.ContentBlock.ID,
+				Index: typedData.Index,
+				Name:  typedData.ContentBlock.Name,
+			}
+		}
 	case anthropic.ContentBlockDeltaData:
-		a.current.TextDelta = typedData.Delta.Text
+		switch typedData.Delta.Type {
+		case anthropic.DeltaTypeInputJSON:
+			a.current.ToolCall = &llm.ToolCall{
+				Index:     typedData.Index,
+				Arguments: typedData.Delta.PartialJSON,
+			}
+		default:
+			a.current.TextDelta = typedData.Delta.Text
+		}
 	case anthropic.MessageDeltaData:
 		a.current.Usage = &llm.Usage{OutputTokens: int64(typedData.Usage.OutputTokens)}
 	case anthropic.MessageStartData:
-		a.current.Usage = &llm.Usage{InputTokens: int64(typedData.Message.Usage.InputTokens)}
+		// input_tokens excludes cache reads and writes; report the full prompt size
+		// like the other providers do.
+		usage := typedData.Message.Usage
+		a.current.Usage = &llm.Usage{
+			InputTokens:       int64(usage.InputTokens + usage.CacheCreationInputTokens + usage.CacheReadInputTokens),
+			CachedInputTokens: int64(usage.CacheReadInputTokens),
+		}
+	case anthropic.MessageStopData:
+		a.current.Done = true
+	case anthropic.ErrorData:
+		streamErr := typedData.Error
+		a.err = &streamErr
+		return false
 	}
 	return true
 }
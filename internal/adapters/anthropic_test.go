@@ -0,0 +1,267 @@
+package adapters
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"vadimgribanov.com/tg-gpt/internal/llm"
+	"vadimgribanov.com/tg-gpt/internal/vendors/anthropic"
+)
+
+func TestAnthropicStreamToolUseFixture(t *testing.T) {
+	adapter, requests := newAnthropicFixtureAdapter(t, "anthropic_tool_use.sse")
+
+	stream, err := adapter.Stream(context.Background(), llm.Request{
+		Model: "claude-sonnet-4-5",
+		Messages: []llm.Message{
+			{Role: llm.RoleSystem, Content: "system prompt"},
+			{Role: llm.RoleUser, Content: "when was go 1.24 released?"},
+		},
+		Tools: []llm.Tool{{
+			Name:        "web_search",
+			Description: "Search the web",
+			Parameters: map[string]any{
+				"type":       "object",
+				"properties": map[string]any{"query": map[string]any{"type": "string"}},
+			},
+		}},
+		ToolChoice: llm.ToolChoiceAuto,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accumulator := drainStream(t, stream)
+
+	if got := accumulator.AccumulatedResponse(); got != "Let me check that." {
+		t.Fatalf("text: got %q", got)
+	}
+	if accumulator.InputTokens() != 472 || accumulator.OutputTokens() != 89 {
+		t.Fatalf("usage: got input=%d output=%d", accumulator.InputTokens(), accumulator.OutputTokens())
+	}
+	calls := accumulator.GetToolCalls()
+	if len(calls) != 2 {
+		t.Fatalf("tool calls: got %#v", calls)
+	}
+	if calls[0].ID != "toolu_01" || calls[0].Name != "web_search" || calls[0].Arguments != `{"query": "go 1.24 release"}` {
+		t.Fatalf("first tool call: %#v", calls[0])
+	}
+	if calls[1].ID != "toolu_02" || calls[1].Name != "list_memories" || calls[1].Arguments != "" {
+		t.Fatalf("second tool call: %#v", calls[1])
+	}
+
+	body := (*requests)[0]
+	if body["system"] != "system prompt" {
+		t.Fatalf("system: got %#v", body["system"])
+	}
+	tools, _ := body["tools"].([]any)
+	if len(tools) != 1 || tools[0].(map[string]any)["name"] != "web_search" {
+		t.Fatalf("tools: got %#v", body["tools"])
+	}
+	if _, ok := tools[0].(map[string]any)["input_schema"]; !ok {
+		t.Fatalf("tool must carry input_schema: %#v", tools[0])
+	}
+	if choice, _ := body["tool_choice"].(map[string]any); choice["type"] != "auto" {
+		t.Fatalf("tool_choice: got %#v", body["tool_choice"])
+	}
+}
+
+func TestAnthropicStreamSendsToolResultHistory(t *testing.T) {
+	adapter, requests := newAnthropicFixtureAdapter(t, "anthropic_text.sse")
+
+	stream, err := adapter.Stream(context.Background(), llm.Request{
+		Model: "claude-sonnet-4-5",
+		Messages: []llm.Message{
+			{Role: llm.RoleSystem, Content: "system prompt"},
+			{Role: llm.RoleUser, Content: "when was go 1.24 released?"},
+			{
+				Role:    llm.RoleAssistant,
+				Content: "Let me check that.",
+				ToolCalls: []llm.ToolCall{
+					{ID: "toolu_01", Name: "web_search", Arguments: `{"query":"go 1.24 release"}`},
+					{ID: "toolu_02", Name: "list_memories", Arguments: ""},
+				},
+			},
+			{Role: llm.RoleTool, ToolResult: &llm.ToolResult{CallID: "toolu_01", Name: "web_search", Output: "February 2025"}},
+			{Role: llm.RoleTool, ToolResult: &llm.ToolResult{CallID: "toolu_02", Name: "list_memories", Output: `{"ok":false,"error":"boom"}`, IsError: true}},
+			{Role: llm.RoleSystem, Content: "The user sent this additional message while you were working"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accumulator := drainStream(t, stream)
+	if got := accumulator.AccumulatedResponse(); got != "Go 1.24 was released in February 2025." {
+		t.Fatalf("text: got %q", got)
+	}
+	if accumulator.HasToolCalls() {
+		t.Fatalf("unexpected tool calls: %#v", accumulator.GetToolCalls())
+	}
+	if accumulator.InputTokens() != 610 || accumulator.CachedInputTokens() != 600 {
+		t.Fatalf("cache reads must count as input: input=%d cached=%d", accumulator.InputTokens(), accumulator.CachedInputTokens())
+	}
+
+	body := (*requests)[0]
+	if body["system"] != "system prompt" {
+		t.Fatalf("system: got %#v", body["system"])
+	}
+	if _, ok := body["tool_choice"]; ok {
+		t.Fatalf("tool_choice must be omitted without tools: %#v", body["tool_choice"])
+	}
+	messages := body["messages"].([]any)
+	if len(messages) != 3 {
+		t.Fatalf("messages: got %d want 3: %#v", len(messages), messages)
+	}
+
+	assistant := messages[1].(map[string]any)
+	if assistant["role"] != "assistant" {
+		t.Fatalf("second message role: %#v", assistant["role"])
+	}
+	assistantBlocks := assistant["content"].([]any)
+	if len(assistantBlocks) != 3 {
+		t.Fatalf("assistant blocks: %#v", assistantBlocks)
+	}
+	toolUse := assistantBlocks[2].(map[string]any)
+	if toolUse["type"] != "tool_use" || toolUse["id"] != "toolu_02" {
+		t.Fatalf("tool_use block: %#v", toolUse)
+	}
+	if input, ok := toolUse["input"].(map[string]any); !ok || len(input) != 0 {
+		t.Fatalf("empty arguments must become an empty object: %#v", toolUse["input"])
+	}
+
+	results := messages[2].(map[string]any)
+	if results["role"] != "user" {
+		t.Fatalf("tool results role: %#v", results["role"])
+	}
+	resultBlocks := results["content"].([]any)
+	if len(resultBlocks) != 3 {
+		t.Fatalf("tool result blocks: %#v", resultBlocks)
+	}
+	for i, id := range []string{"toolu_01", "toolu_02"} {
+		block := resultBlocks[i].(map[string]any)
+		if block["type"] != "tool_result" || block["tool_use_id"] != id {
+			t.Fatalf("tool result %d: %#v", i, block)
+		}
+	}
+	if _, ok := resultBlocks[0].(map[string]any)["is_error"]; ok {
+		t.Fatalf("successful result must not be marked as an error: %#v", resultBlocks[0])
+	}
+	if resultBlocks[1].(map[string]any)["is_error"] != true {
+		t.Fatalf("failed result must be marked as an error: %#v", resultBlocks[1])
+	}
+	if resultBlocks[2].(map[string]any)["type"] != "text" {
+		t.Fatalf("mid-turn system message must follow tool results as text: %#v", resultBlocks[2])
+	}
+}
+
+func TestAnthropicStreamErrorEvent(t *testing.T) {
+	adapter, _ := newAnthropicFixtureAdapter(t, "anthropic_error.sse")
+
+	stream, err := adapter.Stream(context.Background(), llm.Request{
+		Model:    "claude-sonnet-4-5",
+		Messages: []llm.Message{{Role: llm.RoleUser, Content: "hi"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	for stream.Next() {
+	}
+	if err := stream.Err(); err == nil || errors.Is(err, io.EOF) || !strings.Contains(err.Error(), "overloaded_error") {
+		t.Fatalf("expected overloaded stream error, got %v", err)
+	}
+}
+
+func newAnthropicFixtureAdapter(t *testing.T, fixture string) (*AnthropicAdapter, *[]map[string]any) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests []map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" || r.Header.Get("x-api-key") != "test-key" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requests = append(requests, body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+
+	config := anthropic.DefaultConfig("test-key")
+	config.BaseURL = server.URL
+	return NewAnthropicAdapter(anthropic.NewClientWithConfig(config)), &requests
+}
+
+func drainStream(t *testing.T, stream llm.Stream) *StreamAccumulator {
+	t.Helper()
+	defer stream.Close()
+	accumulator := NewStreamAccumulator()
+	for stream.Next() {
+		accumulator.AddEvent(stream.Event())
+	}
+	if err := stream.Err(); err != nil && !errors.Is(err, io.EOF) {
+		t.Fatal(err)
+	}
+	return accumulator
+}
+
+func TestAnthropicStreamSendsImageBlocks(t *testing.T) {
+	adapter, requests := newAnthropicFixtureAdapter(t, "anthropic_text.sse")
+
+	stream, err := adapter.Stream(context.Background(), llm.Request{
+		Model: "claude-sonnet-4-5",
+		Messages: []llm.Message{{
+			Role: llm.RoleUser,
+			Parts: []llm.ContentPart{
+				{Type: llm.ContentPartText, Text: "what is on this screenshot?"},
+				{Type: llm.ContentPartImageURL, ImageURL: "data:image/png;base64,iVBORw0KGgo="},
+				{Type: llm.ContentPartImageURL, ImageURL: "https://example.com/cat.jpg"},
+				{Type: llm.ContentPartImageURL, ImageURL: "data:image/tiff;base64,AAAA"},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainStream(t, stream)
+
+	messages := (*requests)[0]["messages"].([]any)
+	blocks := messages[0].(map[string]any)["content"].([]any)
+	if len(blocks) != 3 {
+		t.Fatalf("expected text + two supported images, got %#v", blocks)
+	}
+	inline := blocks[1].(map[string]any)
+	source := inline["source"].(map[string]any)
+	if inline["type"] != "image" || source["type"] != "base64" || source["media_type"] != "image/png" || source["data"] != "iVBORw0KGgo=" {
+		t.Fatalf("inline image block: %#v", inline)
+	}
+	remote := blocks[2].(map[string]any)["source"].(map[string]any)
+	if remote["type"] != "url" || remote["url"] != "https://example.com/cat.jpg" {
+		t.Fatalf("url image block: %#v", remote)
+	}
+}
+
+func TestAnthropicVisionCapabilityByModel(t *testing.T) {
+	adapter := NewAnthropicAdapter(nil)
+	if !adapter.Capabilities("claude-sonnet-4-5").Vision {
+		t.Fatal("claude-sonnet-4-5 should support vision")
+	}
+	if adapter.Capabilities("claude-3-5-haiku-latest").Vision {
+		t.Fatal("claude-3-5-haiku should not support vision")
+	}
+}
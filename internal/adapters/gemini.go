@@ -0,0 +1,286 @@
+package adapters
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/google/uuid"
+	"vadimgribanov.com/tg-gpt/internal/llm"
+	"vadimgribanov.com/tg-gpt/internal/vendors/gemini"
+)
+
+type GeminiAdapter struct {
+	client *gemini.Client
+}
+
+func NewGeminiAdapter(client *gemini.Client) *GeminiAdapter {
+	return &GeminiAdapter{client: client}
+}
+
+func (a *GeminiAdapter) Provider() llm.Provider {
+	return llm.ProviderGemini
+}
+
+func (a *GeminiAdapter) Capabilities(model string) llm.Capabilities {
+	return llm.Capabilities{
+		FunctionTools: true,
+		Vision:        true,
+		ToolChoice:    true,
+	}
+}
+
+func (a *GeminiAdapter) Stream(ctx context.Context, request llm.Request) (llm.Stream, error) {
+	systemInstruction, contents := toGeminiContents(request.Messages)
+	geminiReq := gemini.GenerateContentRequest{
+		Contents:          contents,
+		SystemInstruction: systemInstruction,
+		Tools:             toGeminiTools(request.Tools),
+	}
+	if len(geminiReq.Tools) > 0 {
+		geminiReq.ToolConfig = toGeminiToolConfig(request.ToolChoice)
+	}
+
+	stream, err := a.client.StreamGenerateContent(ctx, request.Model, geminiReq)
+	if err != nil {
+		return nil, err
+	}
+	return &GeminiStreamAdapter{stream: stream}, nil
+}
+
+// toGeminiContents mirrors toAnthropicMessages: the leading system message becomes
+// the system instruction, later system messages are folded in as user text, tool
+// results become functionResponse parts on a user turn, and consecutive same-role
+// turns are merged.
+func toGeminiContents(messages []llm.Message) (*gemini.Content, []gemini.Content) {
+	var systemInstruction *gemini.Content
+	out := make([]gemini.Content, 0, len(messages))
+	appendParts := func(role string, parts []gemini.Part) {
+		if len(parts) == 0 {
+			return
+		}
+		if n := len(out); n > 0 && out[n-1].Role == role {
+			out[n-1].Parts = append(out[n-1].Parts, parts...)
+			return
+		}
+		out = append(out, gemini.Content{Role: role, Parts: parts})
+	}
+
+	for i, msg := range messages {
+		switch msg.Role {
+		case llm.RoleSystem:
+			if i == 0 {
+				if parts := geminiTextParts(msg.Content); len(parts) > 0 {
+					systemInstruction = &gemini.Content{Parts: parts}
+				}
+				continue
+			}
+			appendParts(gemini.RoleUser, geminiTextParts(msg.Content))
+		case llm.RoleTool:
+			if msg.ToolResult == nil {
+				continue
+			}
+			appendParts(gemini.RoleUser, []gemini.Part{{
+				FunctionResponse: &gemini.FunctionResponse{
+					Name:     msg.ToolResult.Name,
+					Response: geminiFunctionResponse(msg.ToolResult.Output),
+				},
+			}})
+		case llm.RoleAssistant:
+			parts := geminiTextParts(msg.Content)
+			for _, call := range msg.ToolCalls {
+				parts = append(parts, gemini.Part{
+					FunctionCall: &gemini.FunctionCall{
+						Name: call.Name,
+						Args: toolInputJSON(call.Arguments),
+					},
+					ThoughtSignature: call.Signature,
+				})
+			}
+			appendParts(gemini.RoleModel, parts)
+		default:
+			appendParts(gemini.RoleUser, toGeminiUserParts(msg))
+		}
+	}
+	return systemInstruction, out
+}
+
+func toGeminiUserParts(msg llm.Message) []gemini.Part {
+	if len(msg.Parts) == 0 {
+		return geminiTextParts(msg.Content)
+	}
+	parts := make([]gemini.Part, 0, len(msg.Parts))
+	for _, part := range msg.Parts {
+		switch part.Type {
+		case llm.ContentPartImageURL:
+			mediaType, data, ok := llm.ParseBase64DataURL(part.ImageURL)
+			if !ok {
+				continue
+			}
+			parts = append(parts, gemini.Part{InlineData: &gemini.Blob{MimeType: mediaType, Data: data}})
+		case llm.ContentPartDocument:
+			if part.Document != nil {
+				parts = append(parts, geminiTextParts(part.Document.Text())...)
+			}
+		default:
+			parts = append(parts, geminiTextParts(part.Text)...)
+		}
+	}
+	return parts
+}
+
+func geminiTextParts(text string) []gemini.Part {
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	return []gemini.Part{{Text: text}}
+}
+
+// geminiFunctionResponse wraps a tool output into the JSON object Gemini expects.
+// Outputs that already are JSON objects are passed through as-is.
+func geminiFunctionResponse(output string) json.RawMessage {
+	trimmed := strings.TrimSpace(output)
+	var obj map[string]any
+	if json.Unmarshal([]byte(trimmed), &obj) == nil && obj != nil {
+		return json.RawMessage(trimmed)
+	}
+	data, err := json.Marshal(map[string]string{"result": output})
+	if err != nil {
+		return json.RawMessage(`{}`)
+	}
+	return data
+}
+
+func toGeminiTools(tools []llm.Tool) []gemini.Tool {
+	if len(tools) == 0 {
+		return nil
+	}
+	declarations := make([]gemini.FunctionDeclaration, 0, len(tools))
+	for _, tool := range tools {
+		declarations = append(declarations, gemini.FunctionDeclaration{
+			Name:        tool.Name,
+			Description: tool.Description,
+			Parameters:  geminiSchema(tool.Parameters),
+		})
+	}
+	return []gemini.Tool{{FunctionDeclarations: declarations}}
+}
+
+// geminiSchema drops object schemas without properties: Gemini rejects
+// {"type":"object","properties":{}} for parameterless functions.
+func geminiSchema(params map[string]any) map[string]any {
+	if params == nil {
+		return nil
+	}
+	if props, ok := params["properties"].(map[string]any); ok && len(props) == 0 {
+		return nil
+	}
+	return params
+}
+
+func toGeminiToolConfig(choice llm.ToolChoice) *gemini.ToolConfig {
+	switch choice {
+	case llm.ToolChoiceNone:
+		return &gemini.ToolConfig{FunctionCallingConfig: gemini.FunctionCallingConfig{Mode: gemini.FunctionCallingModeNone}}
+	case llm.ToolChoiceAuto:
+		return &gemini.ToolConfig{FunctionCallingConfig: gemini.FunctionCallingConfig{Mode: gemini.FunctionCallingModeAuto}}
+	default:
+		return nil
+	}
+}
+
+type GeminiStreamAdapter struct {
+	stream  *gemini.StreamedResponse
+	current llm.StreamEvent
+	err     error
+
+	toolCallIndex  int
+	reportedInput  int64
+	reportedOutput int64
+	reportedCached int64
+}
+
+func (a *GeminiStreamAdapter) Next() bool {
+	chunk, err := a.stream.Recv()
+	if err != nil {
+		a.err = err
+		return false
+	}
+	a.current = llm.StreamEvent{}
+	if len(chunk.Candidates) > 0 {
+		candidate := chunk.Candidates[0]
+		var text strings.Builder
+		for _, part := range candidate.Content.Parts {
+			if part.FunctionCall != nil {
+				a.current.ToolCalls = append(a.current.ToolCalls, a.toolCallFromPart(part))
+				continue
+			}
+			text.WriteString(part.Text)
+		}
+		a.current.TextDelta = text.String()
+		a.current.Done = candidate.FinishReason != ""
+	}
+	if chunk.UsageMetadata != nil {
+		a.current.Usage = a.usageDelta(*chunk.UsageMetadata)
+	}
+	return true
+}
+
+// toolCallFromPart converts a complete functionCall part. Gemini does not stream
+// partial arguments and may omit call ids, so each call gets its own accumulator
+// index and a generated id when none is provided.
+func (a *GeminiStreamAdapter) toolCallFromPart(part gemini.Part) llm.ToolCall {
+	id := part.FunctionCall.ID
+	if id == "" {
+		id = "call_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	}
+	arguments := "{}"
+	if len(part.FunctionCall.Args) > 0 {
+		arguments = string(part.FunctionCall.Args)
+	}
+	call := llm.ToolCall{
+		ID:        id,
+		Index:     a.toolCallIndex,
+		Name:      part.FunctionCall.Name,
+		Arguments: arguments,
+		Signature: part.ThoughtSignature,
+	}
+	a.toolCallIndex++
+	return call
+}
+
+// usageDelta turns Gemini's cumulative usage metadata into the per-event deltas that
+// StreamAccumulator sums up.
+func (a *GeminiStreamAdapter) usageDelta(usage gemini.UsageMetadata) *llm.Usage {
+	input := int64(usage.PromptTokenCount)
+	output := int64(usage.CandidatesTokenCount + usage.ThoughtsTokenCount)
+	cached := int64(usage.CachedContentTokenCount)
+	delta := &llm.Usage{
+		InputTokens:       input - a.reportedInput,
+		OutputTokens:      output - a.reportedOutput,
+		CachedInputTokens: cached - a.reportedCached,
+	}
+	a.reportedInput = input
+	a.reportedOutput = output
+	a.reportedCached = cached
+	if delta.InputTokens == 0 && delta.OutputTokens == 0 && delta.CachedInputTokens == 0 {
+		return nil
+	}
+	return delta
+}
+
+func (a *GeminiStreamAdapter) Event() llm.StreamEvent {
+	return a.current
+}
+
+func (a *GeminiStreamAdapter) Err() error {
+	return a.err
+}
+
+func (a *GeminiStreamAdapter) Close() error {
+	if a.stream == nil {
+		return nil
+	}
+	a.stream.Close()
+	return nil
+}
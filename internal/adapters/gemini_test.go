@@ -0,0 +1,168 @@
+package adapters
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"vadimgribanov.com/tg-gpt/internal/llm"
+	"vadimgribanov.com/tg-gpt/internal/vendors/gemini"
+)
+
+func TestGeminiStreamFunctionCallFixture(t *testing.T) {
+	adapter, requests := newGeminiFixtureAdapter(t, "gemini_function_call.sse")
+
+	stream, err := adapter.Stream(context.Background(), llm.Request{
+		Model: "gemini-2.5-flash",
+		Messages: []llm.Message{
+			{Role: llm.RoleSystem, Content: "system prompt"},
+			{Role: llm.RoleUser, Content: "when was go 1.24 released?"},
+		},
+		Tools: []llm.Tool{
+			{
+				Name: "web_search",
+				Parameters: map[string]any{
+					"type":       "object",
+					"properties": map[string]any{"query": map[string]any{"type": "string"}},
+				},
+			},
+			{
+				Name:       "list_memories",
+				Parameters: map[string]any{"type": "object", "properties": map[string]any{}},
+			},
+		},
+		ToolChoice: llm.ToolChoiceAuto,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accumulator := drainStream(t, stream)
+
+	if got := accumulator.AccumulatedResponse(); got != "Let me look that up." {
+		t.Fatalf("text: got %q", got)
+	}
+	if accumulator.InputTokens() != 210 || accumulator.OutputTokens() != 43 {
+		t.Fatalf("usage must not double count cumulative metadata: input=%d output=%d", accumulator.InputTokens(), accumulator.OutputTokens())
+	}
+	calls := accumulator.GetToolCalls()
+	if len(calls) != 2 {
+		t.Fatalf("tool calls: %#v", calls)
+	}
+	if calls[0].Name != "web_search" || calls[0].Arguments != `{"query": "go 1.24 release date"}` || calls[0].Signature != "c2lnLTE=" {
+		t.Fatalf("first tool call: %#v", calls[0])
+	}
+	if calls[1].Name != "list_memories" || calls[0].ID == "" || calls[0].ID == calls[1].ID {
+		t.Fatalf("tool calls need distinct generated ids: %#v", calls)
+	}
+
+	req := (*requests)[0]
+	if req.path != "/v1beta/models/gemini-2.5-flash:streamGenerateContent" || req.query != "alt=sse" {
+		t.Fatalf("endpoint: %s?%s", req.path, req.query)
+	}
+	var body gemini.GenerateContentRequest
+	if err := json.Unmarshal(req.body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.SystemInstruction == nil || body.SystemInstruction.Parts[0].Text != "system prompt" {
+		t.Fatalf("system instruction: %#v", body.SystemInstruction)
+	}
+	if len(body.Tools) != 1 || len(body.Tools[0].FunctionDeclarations) != 2 {
+		t.Fatalf("tools: %#v", body.Tools)
+	}
+	if body.Tools[0].FunctionDeclarations[1].Parameters != nil {
+		t.Fatalf("parameterless function must omit its schema: %#v", body.Tools[0].FunctionDeclarations[1])
+	}
+	if body.ToolConfig == nil || body.ToolConfig.FunctionCallingConfig.Mode != gemini.FunctionCallingModeAuto {
+		t.Fatalf("tool config: %#v", body.ToolConfig)
+	}
+}
+
+func TestGeminiStreamSendsHistoryWithImagesAndToolResults(t *testing.T) {
+	adapter, requests := newGeminiFixtureAdapter(t, "gemini_text.sse")
+
+	stream, err := adapter.Stream(context.Background(), llm.Request{
+		Model: "gemini-2.5-flash",
+		Messages: []llm.Message{
+			{Role: llm.RoleSystem, Content: "system prompt"},
+			{Role: llm.RoleUser, Parts: []llm.ContentPart{
+				{Type: llm.ContentPartText, Text: "what is this?"},
+				{Type: llm.ContentPartImageURL, ImageURL: "data:image/jpeg;base64,/9j/4AAQ"},
+			}},
+			{Role: llm.RoleAssistant, ToolCalls: []llm.ToolCall{
+				{ID: "call_1", Name: "web_search", Arguments: `{"query":"x"}`, Signature: "c2lnLTE="},
+			}},
+			{Role: llm.RoleTool, ToolResult: &llm.ToolResult{CallID: "call_1", Name: "web_search", Output: "plain text result"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accumulator := drainStream(t, stream)
+	if got := accumulator.AccumulatedResponse(); got != "Go 1.24 was released in February 2025." {
+		t.Fatalf("text: got %q", got)
+	}
+	if accumulator.InputTokens() != 320 || accumulator.OutputTokens() != 11 || accumulator.CachedInputTokens() != 256 {
+		t.Fatalf("usage: input=%d output=%d cached=%d", accumulator.InputTokens(), accumulator.OutputTokens(), accumulator.CachedInputTokens())
+	}
+
+	var body gemini.GenerateContentRequest
+	if err := json.Unmarshal((*requests)[0].body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.ToolConfig != nil {
+		t.Fatalf("tool config must be omitted without tools: %#v", body.ToolConfig)
+	}
+	if len(body.Contents) != 3 {
+		t.Fatalf("contents: %#v", body.Contents)
+	}
+	user := body.Contents[0]
+	if user.Role != gemini.RoleUser || len(user.Parts) != 2 || user.Parts[1].InlineData == nil || user.Parts[1].InlineData.MimeType != "image/jpeg" || user.Parts[1].InlineData.Data != "/9j/4AAQ" {
+		t.Fatalf("user content: %#v", user)
+	}
+	model := body.Contents[1]
+	if model.Role != gemini.RoleModel || model.Parts[0].FunctionCall == nil || model.Parts[0].ThoughtSignature != "c2lnLTE=" {
+		t.Fatalf("model content: %#v", model)
+	}
+	result := body.Contents[2].Parts[0].FunctionResponse
+	if result == nil || result.Name != "web_search" || string(result.Response) != `{"result":"plain text result"}` {
+		t.Fatalf("function response: %#v", body.Contents[2])
+	}
+}
+
+type geminiRecordedRequest struct {
+	path  string
+	query string
+	body  []byte
+}
+
+func newGeminiFixtureAdapter(t *testing.T, fixture string) (*GeminiAdapter, *[]geminiRecordedRequest) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests []geminiRecordedRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-goog-api-key") != "test-key" {
+			http.Error(w, "missing api key", http.StatusUnauthorized)
+			return
+		}
+		var body json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requests = append(requests, geminiRecordedRequest{path: r.URL.Path, query: r.URL.RawQuery, body: body})
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+
+	config := gemini.DefaultConfig("test-key")
+	config.BaseURL = server.URL
+	return NewGeminiAdapter(gemini.NewClientWithConfig(config)), &requests
+}
@@ -8,15 +8,22 @@ import (
 )
 
 type OpenaiAdapter struct {
-	client *openai.Client
+	client   *openai.Client
+	provider llm.Provider
 }
 
 func NewOpenaiAdapter(client *openai.Client) *OpenaiAdapter {
-	return &OpenaiAdapter{client: client}
+	return NewOpenaiCompatibleAdapter(llm.ProviderOpenAI, client)
+}
+
+// NewOpenaiCompatibleAdapter wraps a client pointed at a third-party
+// OpenAI-compatible backend and registers it under its own provider name.
+func NewOpenaiCompatibleAdapter(provider llm.Provider, client *openai.Client) *OpenaiAdapter {
+	return &OpenaiAdapter{client: client, provider: provider}
 }
 
 func (a *OpenaiAdapter) Provider() llm.Provider {
-	return llm.ProviderOpenAI
+	return a.provider
 }
 
 func (a *OpenaiAdapter) Capabilities(model string) llm.Capabilities {
@@ -133,6 +140,13 @@ func toOpenAIMessageParts(parts []llm.ContentPart) []openai.ChatMessagePart {
 					Detail: openai.ImageURLDetailLow,
 				},
 			})
+		case llm.ContentPartDocument:
+			if part.Document != nil {
+				out = append(out, openai.ChatMessagePart{
+					Type: openai.ChatMessagePartTypeText,
+					Text: part.Document.Text(),
+				})
+			}
 		default:
 			out = append(out, openai.ChatMessagePart{
 				Type: openai.ChatMessagePartTypeText,
@@ -201,6 +215,9 @@ func fromOpenAIStreamResponse(response openai.ChatCompletionStreamResponse) llm.
 			InputTokens:  int64(response.Usage.PromptTokens),
 			OutputTokens: int64(response.Usage.CompletionTokens),
 		}
+		if details := response.Usage.PromptTokensDetails; details != nil {
+			event.Usage.CachedInputTokens = int64(details.CachedTokens)
+		}
 	}
 	return event
 }
@@ -10,6 +10,7 @@ type StreamAccumulator struct {
 	accumulatedResponse string
 	promptTokens        int64
 	completionTokens    int64
+	cachedPromptTokens  int64
 	toolCalls           map[int]llm.ToolCall
 }
 
@@ -32,6 +33,7 @@ func (s *StreamAccumulator) AddEvent(event llm.StreamEvent) {
 	if event.Usage != nil {
 		s.promptTokens += event.Usage.InputTokens
 		s.completionTokens += event.Usage.OutputTokens
+		s.cachedPromptTokens += event.Usage.CachedInputTokens
 	}
 }
 
@@ -48,6 +50,9 @@ func (s *StreamAccumulator) addToolCallDelta(call llm.ToolCall) {
 	if call.Name != "" {
 		existing.Name = call.Name
 	}
+	if call.Signature != "" {
+		existing.Signature = call.Signature
+	}
 	existing.Arguments += call.Arguments
 	s.toolCalls[idx] = existing
 }
@@ -64,6 +69,10 @@ func (s *StreamAccumulator) InputTokens() int64 {
 	return s.promptTokens
 }
 
+func (s *StreamAccumulator) CachedInputTokens() int64 {
+	return s.cachedPromptTokens
+}
+
 func (s *StreamAccumulator) HasToolCalls() bool {
 	return len(s.toolCalls) > 0
 }
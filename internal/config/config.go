@@ -12,17 +12,46 @@ type LLMModel struct {
 	Name     string `yaml:"name"`
 	ModelId  string `yaml:"model_id"`
 	Provider string `yaml:"provider"`
+	// BaseURL points the model at an OpenAI-compatible endpoint (Ollama, vLLM,
+	// LM Studio, ...). Models sharing a provider name share one client.
+	BaseURL   string            `yaml:"base_url"`
+	APIKeyEnv string            `yaml:"api_key_env"`
+	Headers   map[string]string `yaml:"headers"`
+	// Capabilities overrides what the provider adapter reports for this model;
+	// unset fields keep the adapter's answer.
+	Capabilities ModelCapabilities `yaml:"capabilities"`
+	// Fallbacks lists model ids tried in order when this model keeps failing.
+	Fallbacks []string   `yaml:"fallbacks"`
+	Price     ModelPrice `yaml:"price"`
+}
+
+// ModelPrice is in USD per million tokens. A zero cached input price means cached
+// tokens are billed like regular input.
+type ModelPrice struct {
+	InputPerMillion       float64 `yaml:"input_per_million"`
+	CachedInputPerMillion float64 `yaml:"cached_input_per_million"`
+	OutputPerMillion      float64 `yaml:"output_per_million"`
+}
+
+type ModelCapabilities struct {
+	FunctionTools *bool `yaml:"function_tools"`
+	Vision        *bool `yaml:"vision"`
+	ToolChoice    *bool `yaml:"tool_choice"`
 }
 
 type MemoryThresholds struct {
 	FactConfidenceMin       float64 `yaml:"fact_confidence_min"`
 	PreferenceConfidenceMin float64 `yaml:"preference_confidence_min"`
 	SemanticDedupCosine     float64 `yaml:"semantic_dedup_cosine"`
+	// DocumentMinCosine is how similar a document excerpt has to be to the message
+	// to be found by meaning rather than by its words.
+	DocumentMinCosine float64 `yaml:"document_min_cosine"`
 }
 
 type MemoryRetrieval struct {
 	FactsTopK         int `yaml:"facts_top_k"`
 	EpisodesTopK      int `yaml:"episodes_top_k"`
+	DocumentsTopK     int `yaml:"documents_top_k"`
 	RecentTraceEvents int `yaml:"recent_trace_events"`
 }
 
@@ -42,12 +71,123 @@ type MemoryConfig struct {
 	Episode    MemoryEpisode    `yaml:"episode"`
 }
 
+// BudgetLimits caps a user's spending. Zero means unlimited.
+type BudgetLimits struct {
+	DailyTokens   int64   `yaml:"daily_tokens"`
+	MonthlyTokens int64   `yaml:"monthly_tokens"`
+	DailyUSD      float64 `yaml:"daily_usd"`
+	MonthlyUSD    float64 `yaml:"monthly_usd"`
+	// Minutes of voice messages, video notes and audio files transcribed.
+	DailyTranscriptionMinutes   float64 `yaml:"daily_transcription_minutes"`
+	MonthlyTranscriptionMinutes float64 `yaml:"monthly_transcription_minutes"`
+}
+
+type BudgetConfig struct {
+	Default BudgetLimits `yaml:"default"`
+	// Users replaces the default limits for individual Telegram user ids. Limits
+	// set with /admin budget take precedence over both.
+	Users map[int64]BudgetLimits `yaml:"users"`
+	// DowngradeModel keeps answering once a budget is used up instead of refusing.
+	DowngradeModel string  `yaml:"downgrade_model"`
+	WarnAt         float64 `yaml:"warn_at"`
+}
+
+type RetryConfig struct {
+	MaxAttempts      int `yaml:"max_attempts"`
+	InitialBackoffMs int `yaml:"initial_backoff_ms"`
+	MaxBackoffMs     int `yaml:"max_backoff_ms"`
+}
+
+// GroupAccess decides who may talk to the bot in a group chat.
+type GroupAccess string
+
+const (
+	// GroupAccessDisabled ignores the group entirely.
+	GroupAccessDisabled GroupAccess = "disabled"
+	// GroupAccessMembers answers only members who are approved users of the bot.
+	GroupAccessMembers GroupAccess = "members"
+	// GroupAccessEveryone answers any member of the group.
+	GroupAccessEveryone GroupAccess = "everyone"
+)
+
+type GroupConfig struct {
+	Default GroupAccess `yaml:"default"`
+	// Chats replaces the default access for individual group chat ids.
+	Chats map[int64]GroupAccess `yaml:"chats"`
+}
+
+// Access returns the access policy of the given group chat.
+func (g GroupConfig) Access(chatID int64) GroupAccess {
+	if access, ok := g.Chats[chatID]; ok {
+		return access
+	}
+	return g.Default
+}
+
+// TTSConfig selects the speech endpoint for voice replies. Without a base URL the
+// OpenAI client is used.
+type TTSConfig struct {
+	Model     string `yaml:"model"`
+	Voice     string `yaml:"voice"`
+	BaseURL   string `yaml:"base_url"`
+	APIKeyEnv string `yaml:"api_key_env"`
+}
+
+// STTConfig selects the speech-to-text backend: "openai" (the default) uses the
+// OpenAI transcription endpoint, "whispercpp" a whisper.cpp server at BaseURL.
+type STTConfig struct {
+	Backend string `yaml:"backend"`
+	Model   string `yaml:"model"`
+	BaseURL string `yaml:"base_url"`
+}
+
+type VoiceConfig struct {
+	TTS TTSConfig `yaml:"tts"`
+	STT STTConfig `yaml:"stt"`
+}
+
+// ToolsConfig declares by name which tools each mode offers: chat for
+// conversations, scheduled_action for reminder actions. A mode left out offers
+// every registered tool.
+type ToolsConfig struct {
+	Modes map[string][]string `yaml:"modes"`
+	// ParallelCalls caps how many tool calls of one model step run at once.
+	ParallelCalls int `yaml:"parallel_calls"`
+	// CallTimeoutSeconds limits each tool call.
+	CallTimeoutSeconds int `yaml:"call_timeout_seconds"`
+	// ConfirmationTimeoutMinutes is how long a destructive tool call waits for
+	// the user's confirmation before it is dropped.
+	ConfirmationTimeoutMinutes int               `yaml:"confirmation_timeout_minutes"`
+	MCPServers                 []MCPServerConfig `yaml:"mcp_servers"`
+}
+
+// MCPServerConfig connects to a Model Context Protocol server whose tools are
+// offered to the model as <name>__<tool>. Set Command to start the server as a
+// subprocess speaking over stdio, or URL for a streamable HTTP server.
+type MCPServerConfig struct {
+	Name    string            `yaml:"name"`
+	Command string            `yaml:"command"`
+	Args    []string          `yaml:"args"`
+	Env     map[string]string `yaml:"env"`
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	// APIKeyEnv names the variable holding a bearer token for an HTTP server.
+	APIKeyEnv string `yaml:"api_key_env"`
+	// TimeoutSeconds limits connecting and each tool call.
+	TimeoutSeconds int `yaml:"timeout_seconds"`
+}
+
 type Config struct {
 	DialogTimeout         int          `yaml:"dialog_timeout"`
 	MaxConcurrentRequests int          `yaml:"max_concurrent_requests"`
 	DefaultModel          LLMModel     `yaml:"default_model"`
 	Models                []LLMModel   `yaml:"models"`
 	Memory                MemoryConfig `yaml:"memory"`
+	Retry                 RetryConfig  `yaml:"retry"`
+	Budget                BudgetConfig `yaml:"budget"`
+	Groups                GroupConfig  `yaml:"groups"`
+	Voice                 VoiceConfig  `yaml:"voice"`
+	Tools                 ToolsConfig  `yaml:"tools"`
 }
 
 func LoadConfig() (*Config, error) {
@@ -71,6 +211,15 @@ func LoadConfig() (*Config, error) {
 	}
 
 	applyMemoryDefaults(&config.Memory)
+	applyRetryDefaults(&config.Retry)
+	applyVoiceDefaults(&config.Voice)
+	applyToolDefaults(&config.Tools)
+	if config.Budget.WarnAt == 0 {
+		config.Budget.WarnAt = 0.8
+	}
+	if config.Groups.Default == "" {
+		config.Groups.Default = GroupAccessMembers
+	}
 	return &config, nil
 }
 
@@ -90,12 +239,18 @@ func applyMemoryDefaults(m *MemoryConfig) {
 	if m.Thresholds.SemanticDedupCosine == 0 {
 		m.Thresholds.SemanticDedupCosine = 0.92
 	}
+	if m.Thresholds.DocumentMinCosine == 0 {
+		m.Thresholds.DocumentMinCosine = 0.35
+	}
 	if m.Retrieval.FactsTopK == 0 {
 		m.Retrieval.FactsTopK = 5
 	}
 	if m.Retrieval.EpisodesTopK == 0 {
 		m.Retrieval.EpisodesTopK = 2
 	}
+	if m.Retrieval.DocumentsTopK == 0 {
+		m.Retrieval.DocumentsTopK = 3
+	}
 	if m.Retrieval.RecentTraceEvents == 0 {
 		m.Retrieval.RecentTraceEvents = 8
 	}
@@ -103,3 +258,55 @@ func applyMemoryDefaults(m *MemoryConfig) {
 		m.Episode.MinTurns = 3
 	}
 }
+
+func applyRetryDefaults(r *RetryConfig) {
+	if r.MaxAttempts == 0 {
+		r.MaxAttempts = 3
+	}
+	if r.InitialBackoffMs == 0 {
+		r.InitialBackoffMs = 500
+	}
+	if r.MaxBackoffMs == 0 {
+		r.MaxBackoffMs = 8000
+	}
+}
+
+func applyVoiceDefaults(v *VoiceConfig) {
+	if v.TTS.Model == "" {
+		v.TTS.Model = "gpt-4o-mini-tts"
+	}
+	if v.TTS.Voice == "" {
+		v.TTS.Voice = "alloy"
+	}
+	if v.STT.Backend == "" {
+		v.STT.Backend = "openai"
+	}
+	if v.STT.Model == "" {
+		v.STT.Model = "whisper-1"
+	}
+}
+
+func applyToolDefaults(t *ToolsConfig) {
+	if t.Modes == nil {
+		t.Modes = make(map[string][]string)
+	}
+	// Scheduled actions run unattended, so they only search the web unless
+	// configured otherwise.
+	if _, ok := t.Modes["scheduled_action"]; !ok {
+		t.Modes["scheduled_action"] = []string{"web_search"}
+	}
+	if t.ParallelCalls == 0 {
+		t.ParallelCalls = 4
+	}
+	if t.CallTimeoutSeconds == 0 {
+		t.CallTimeoutSeconds = 60
+	}
+	if t.ConfirmationTimeoutMinutes == 0 {
+		t.ConfirmationTimeoutMinutes = 15
+	}
+	for i := range t.MCPServers {
+		if t.MCPServers[i].TimeoutSeconds == 0 {
+			t.MCPServers[i].TimeoutSeconds = 30
+		}
+	}
+}
@@ -56,6 +56,31 @@ func (db *DB) WithTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
 	return tx.Commit()
 }
 
+// RunOnce runs a data migration unless the one with that name already ran. The
+// migration and the record that it ran commit together.
+func (db *DB) RunOnce(name string, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var applied int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM data_migrations WHERE name = ?`, name).Scan(&applied); err != nil {
+		return err
+	}
+	if applied > 0 {
+		return nil
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO data_migrations (name) VALUES (?)`, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (db *DB) Migrate() error {
 	slog.Info("Running database migrations")
 
@@ -71,6 +96,16 @@ func (db *DB) Migrate() error {
 		createEpisodicMemoryFTS,
 		createEpisodicMemoryFTSTriggers,
 		createRemindersTable,
+		createUsageLedgerTable,
+		createChatThreadsTable,
+		createDialogBranchesTable,
+		createDocumentsTables,
+		createDocumentChunksFTS,
+		createDocumentChunksFTSTriggers,
+		createBlobsTable,
+		createToolConfirmationsTable,
+		createBudgetOverridesTable,
+		createDataMigrationsTable,
 	}
 
 	for i, migration := range schemaMigrations {
@@ -91,6 +126,22 @@ func (db *DB) Migrate() error {
 		return fmt.Errorf("failed to add reminder action columns: %w", err)
 	}
 
+	if err := db.addUserRoleColumnIfMissing(); err != nil {
+		return fmt.Errorf("failed to add users.role column: %w", err)
+	}
+
+	if err := db.addGroupChatColumnsIfMissing(); err != nil {
+		return fmt.Errorf("failed to add group chat columns: %w", err)
+	}
+
+	if err := db.addLastDialogIDColumnIfMissing(); err != nil {
+		return fmt.Errorf("failed to add users.last_dialog_id column: %w", err)
+	}
+
+	if err := db.addUsageTranscriptionColumnIfMissing(); err != nil {
+		return fmt.Errorf("failed to add usage_ledger.transcribed_seconds column: %w", err)
+	}
+
 	slog.Info("Database migrations completed successfully")
 	return nil
 }
@@ -121,6 +172,80 @@ func (db *DB) addReminderActionColumnsIfMissing() error {
 	return nil
 }
 
+func (db *DB) addUserRoleColumnIfMissing() error {
+	has, err := columnExists(db.DB, "users", "role")
+	if err != nil {
+		return err
+	}
+	if has {
+		return nil
+	}
+	slog.Info("Adding users.role column")
+	_, err = db.Exec(`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user' CHECK (role IN ('user','admin'))`)
+	return err
+}
+
+// addGroupChatColumnsIfMissing adds the group flag on users and the speaker of
+// user messages, which group chats need to attribute a shared dialog.
+func (db *DB) addGroupChatColumnsIfMissing() error {
+	columns := []struct {
+		table string
+		name  string
+		sql   string
+	}{
+		{"users", "is_group", `ALTER TABLE users ADD COLUMN is_group BOOLEAN NOT NULL DEFAULT false`},
+		{"trace_events", "speaker_id", `ALTER TABLE trace_events ADD COLUMN speaker_id INTEGER`},
+		{"pending_user_inputs", "speaker_id", `ALTER TABLE pending_user_inputs ADD COLUMN speaker_id INTEGER`},
+	}
+	for _, column := range columns {
+		has, err := columnExists(db.DB, column.table, column.name)
+		if err != nil {
+			return err
+		}
+		if has {
+			continue
+		}
+		slog.Info("Adding column", "table", column.table, "column", column.name)
+		if _, err := db.Exec(column.sql); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addLastDialogIDColumnIfMissing adds the dialog id counter shared by a chat and its
+// forum topics, starting it at the current dialog.
+func (db *DB) addLastDialogIDColumnIfMissing() error {
+	has, err := columnExists(db.DB, "users", "last_dialog_id")
+	if err != nil {
+		return err
+	}
+	if has {
+		return nil
+	}
+	slog.Info("Adding users.last_dialog_id column")
+	if _, err := db.Exec(`ALTER TABLE users ADD COLUMN last_dialog_id INTEGER NOT NULL DEFAULT 0`); err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE users SET last_dialog_id = current_dialog_id`)
+	return err
+}
+
+// addUsageTranscriptionColumnIfMissing lets the usage ledger record seconds of
+// transcribed speech next to tokens.
+func (db *DB) addUsageTranscriptionColumnIfMissing() error {
+	has, err := columnExists(db.DB, "usage_ledger", "transcribed_seconds")
+	if err != nil {
+		return err
+	}
+	if has {
+		return nil
+	}
+	slog.Info("Adding usage_ledger.transcribed_seconds column")
+	_, err = db.Exec(`ALTER TABLE usage_ledger ADD COLUMN transcribed_seconds INTEGER NOT NULL DEFAULT 0`)
+	return err
+}
+
 func (db *DB) dropRemindersTimezoneIfExists() error {
 	has, err := columnExists(db.DB, "reminders", "timezone")
 	if err != nil {
@@ -270,8 +395,11 @@ CREATE TABLE IF NOT EXISTS users (
 	number_of_input_tokens INTEGER DEFAULT 0,
 	number_of_output_tokens INTEGER DEFAULT 0,
 	current_dialog_id INTEGER DEFAULT 0,
+	last_dialog_id INTEGER NOT NULL DEFAULT 0,
 	last_interaction INTEGER NOT NULL,
 	active BOOLEAN DEFAULT true,
+	role TEXT NOT NULL DEFAULT 'user' CHECK (role IN ('user','admin')),
+	is_group BOOLEAN NOT NULL DEFAULT false,
 	current_model TEXT NOT NULL,
 	created_at INTEGER DEFAULT (strftime('%s', 'now')),
 	updated_at INTEGER DEFAULT (strftime('%s', 'now'))
@@ -287,11 +415,13 @@ CREATE TABLE IF NOT EXISTS trace_events (
 	payload TEXT NOT NULL,
 	tg_message_id INTEGER,
 	model TEXT,
+	speaker_id INTEGER,
 	created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
 	FOREIGN KEY (user_id) REFERENCES users(id)
 );
 CREATE INDEX IF NOT EXISTS idx_trace_user_dialog ON trace_events(user_id, dialog_id, turn_index);
 CREATE INDEX IF NOT EXISTS idx_trace_user_created ON trace_events(user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_trace_user_tg_message ON trace_events(user_id, tg_message_id);
 CREATE UNIQUE INDEX IF NOT EXISTS idx_trace_turn_unique ON trace_events(user_id, dialog_id, turn_index);
 `
 
@@ -304,6 +434,7 @@ CREATE TABLE IF NOT EXISTS pending_user_inputs (
 	payload TEXT NOT NULL,
 	status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending','attached','discarded')),
 	attached_trace_id INTEGER,
+	speaker_id INTEGER,
 	created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
 	updated_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
 	FOREIGN KEY (user_id) REFERENCES users(id),
@@ -438,3 +569,149 @@ WHERE is_fired = false AND is_cancelled = false;
 
 CREATE INDEX IF NOT EXISTS idx_reminders_user ON reminders(user_id, is_cancelled);
 `
+
+const createUsageLedgerTable = `
+CREATE TABLE IF NOT EXISTS usage_ledger (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	dialog_id INTEGER NOT NULL,
+	model TEXT NOT NULL,
+	input_tokens INTEGER NOT NULL DEFAULT 0,
+	output_tokens INTEGER NOT NULL DEFAULT 0,
+	cached_input_tokens INTEGER NOT NULL DEFAULT 0,
+	cost_usd REAL NOT NULL DEFAULT 0,
+	transcribed_seconds INTEGER NOT NULL DEFAULT 0,
+	created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS idx_usage_user_created ON usage_ledger(user_id, created_at);
+`
+
+const createChatThreadsTable = `
+CREATE TABLE IF NOT EXISTS chat_threads (
+	user_id INTEGER NOT NULL,
+	thread_id INTEGER NOT NULL,
+	current_dialog_id INTEGER NOT NULL,
+	last_interaction INTEGER NOT NULL,
+	created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+	updated_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+	PRIMARY KEY (user_id, thread_id),
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);`
+
+const createDialogBranchesTable = `
+CREATE TABLE IF NOT EXISTS dialog_branches (
+	user_id INTEGER NOT NULL,
+	dialog_id INTEGER NOT NULL,
+	parent_dialog_id INTEGER NOT NULL,
+	parent_turn_index INTEGER NOT NULL,
+	created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+	PRIMARY KEY (user_id, dialog_id),
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+`
+
+const createDocumentsTables = `
+CREATE TABLE IF NOT EXISTS documents (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	mime_type TEXT NOT NULL DEFAULT '',
+	chunk_count INTEGER NOT NULL,
+	created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS idx_documents_user ON documents(user_id);
+CREATE TABLE IF NOT EXISTS document_chunks (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	document_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	chunk_index INTEGER NOT NULL,
+	content TEXT NOT NULL,
+	embedding BLOB NOT NULL,
+	embedding_model TEXT NOT NULL,
+	UNIQUE(document_id, chunk_index),
+	FOREIGN KEY (document_id) REFERENCES documents(id),
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS idx_document_chunks_user ON document_chunks(user_id);
+`
+
+const createDocumentChunksFTS = `
+CREATE VIRTUAL TABLE IF NOT EXISTS document_chunks_fts USING fts5(
+	content,
+	content='document_chunks',
+	content_rowid='id'
+);`
+
+const createDocumentChunksFTSTriggers = `
+CREATE TRIGGER IF NOT EXISTS document_chunks_ai AFTER INSERT ON document_chunks BEGIN
+	INSERT INTO document_chunks_fts(rowid, content) VALUES (new.id, new.content);
+END;
+CREATE TRIGGER IF NOT EXISTS document_chunks_ad AFTER DELETE ON document_chunks BEGIN
+	INSERT INTO document_chunks_fts(document_chunks_fts, rowid, content) VALUES('delete', old.id, old.content);
+END;
+CREATE TRIGGER IF NOT EXISTS document_chunks_au AFTER UPDATE ON document_chunks BEGIN
+	INSERT INTO document_chunks_fts(document_chunks_fts, rowid, content) VALUES('delete', old.id, old.content);
+	INSERT INTO document_chunks_fts(rowid, content) VALUES (new.id, new.content);
+END;
+`
+
+// blobs holds images once per content, keyed by the SHA-256 hash of their bytes.
+// Messages reference them with blob URLs instead of inline data URLs.
+const createBlobsTable = `
+CREATE TABLE IF NOT EXISTS blobs (
+	hash TEXT PRIMARY KEY,
+	media_type TEXT NOT NULL,
+	data BLOB NOT NULL,
+	size INTEGER NOT NULL,
+	created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+);
+`
+
+const createToolConfirmationsTable = `
+CREATE TABLE IF NOT EXISTS tool_confirmations (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	dialog_id INTEGER NOT NULL,
+	member_id INTEGER NOT NULL DEFAULT 0,
+	user_trace_id INTEGER NOT NULL,
+	tool_call_id TEXT NOT NULL,
+	tool_name TEXT NOT NULL,
+	arguments TEXT NOT NULL,
+	chat_id INTEGER NOT NULL DEFAULT 0,
+	tg_message_id INTEGER NOT NULL DEFAULT 0,
+	status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending','confirmed','rejected','expired','superseded')),
+	expires_at INTEGER NOT NULL,
+	created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+	updated_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS idx_tool_confirmations_dialog_status
+	ON tool_confirmations(user_id, dialog_id, status);
+CREATE INDEX IF NOT EXISTS idx_tool_confirmations_status_expiry
+	ON tool_confirmations(status, expires_at);
+`
+
+const createBudgetOverridesTable = `
+CREATE TABLE IF NOT EXISTS budget_overrides (
+	user_id INTEGER PRIMARY KEY,
+	daily_tokens INTEGER NOT NULL DEFAULT 0,
+	monthly_tokens INTEGER NOT NULL DEFAULT 0,
+	daily_usd REAL NOT NULL DEFAULT 0,
+	monthly_usd REAL NOT NULL DEFAULT 0,
+	daily_transcription_minutes REAL NOT NULL DEFAULT 0,
+	monthly_transcription_minutes REAL NOT NULL DEFAULT 0,
+	updated_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+`
+
+// data_migrations records the data migrations that ran, so that rewriting rows
+// happens once rather than on every start.
+const createDataMigrationsTable = `
+CREATE TABLE IF NOT EXISTS data_migrations (
+	name TEXT PRIMARY KEY,
+	applied_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+);
+`
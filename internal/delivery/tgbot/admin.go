@@ -0,0 +1,322 @@
+package tgbot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+	"vadimgribanov.com/tg-gpt/internal/config"
+	"vadimgribanov.com/tg-gpt/internal/models"
+	"vadimgribanov.com/tg-gpt/internal/repositories"
+	"vadimgribanov.com/tg-gpt/internal/telegram_utils"
+)
+
+const adminHelp = `Admin commands:
+/admin users — list users
+/admin approve <id> — activate a user
+/admin block <id> — deactivate a user
+/admin usage <id> — a user's spending
+/admin budget <id> — a user's limits
+/admin budget <id> key=value ... — change them, e.g. monthly_usd=20 (0 is unlimited)
+/admin budget <id> reset — back to the configured limits
+/admin broadcast <text> — message all active users`
+
+// broadcastInterval keeps broadcasts under Telegram's ~30 messages per second limit.
+const broadcastInterval = 50 * time.Millisecond
+
+var (
+	approveUserBtn = &tele.Btn{Unique: "admin_approve"}
+	blockUserBtn   = &tele.Btn{Unique: "admin_block"}
+)
+
+func (h *BotHandler) HandleAdmin(c tele.Context) error {
+	ctx := c.Get("requestContext").(context.Context)
+	args := c.Args()
+	if len(args) == 0 {
+		return c.Send(adminHelp)
+	}
+	slog.InfoContext(ctx, "Admin command", "command", args[0])
+
+	switch args[0] {
+	case "users":
+		return h.adminListUsers(c)
+	case "approve", "block", "usage", "budget":
+		if len(args) < 2 {
+			return c.Send(fmt.Sprintf("Usage: /admin %s <id>", args[0]))
+		}
+		userID, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return c.Send("User id must be a number")
+		}
+		switch args[0] {
+		case "approve":
+			return c.Send(h.setUserActive(c, userID, true))
+		case "block":
+			return c.Send(h.setUserActive(c, userID, false))
+		case "budget":
+			return h.adminBudget(c, userID, args[2:])
+		default:
+			return h.adminShowUsage(c, userID)
+		}
+	case "broadcast":
+		text := strings.TrimSpace(strings.TrimPrefix(c.Message().Payload, "broadcast"))
+		if text == "" {
+			return c.Send("Usage: /admin broadcast <text>")
+		}
+		return h.adminBroadcast(c, text)
+	default:
+		return c.Send(adminHelp)
+	}
+}
+
+func (h *BotHandler) adminListUsers(c tele.Context) error {
+	users, err := h.userRepo.ListUsers()
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return c.Send("No users")
+	}
+	lines := make([]string, 0, len(users))
+	for _, user := range users {
+		status := "active"
+		if !user.Active {
+			status = "inactive"
+		}
+		if user.IsAdmin() {
+			status += ", admin"
+		}
+		if user.IsGroup {
+			status += ", group"
+		}
+		lines = append(lines, fmt.Sprintf("%d %s — %s, %s tokens", user.Id, displayName(user), status,
+			formatTokens(user.NumberOfInputTokens+user.NumberOfOutputTokens)))
+	}
+	return sendLines(c, lines)
+}
+
+func (h *BotHandler) adminShowUsage(c tele.Context, userID int64) error {
+	user, err := h.userRepo.GetUser(userID)
+	if err != nil {
+		return c.Send("User not found")
+	}
+	report, err := h.usageService.Report(userID, time.Now())
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Usage of %s\n\n", displayName(user))
+	writeUsageSection(&b, "Today (UTC)", report.Today)
+	b.WriteString("\n")
+	writeUsageSection(&b, "This month", report.Month)
+	return c.Send(b.String())
+}
+
+// adminBudget shows a user's limits, or first changes them. Changes start from the
+// effective limits and are kept in the database until reset.
+func (h *BotHandler) adminBudget(c tele.Context, userID int64, changes []string) error {
+	user, err := h.userRepo.GetUser(userID)
+	if err != nil {
+		return c.Send("User not found")
+	}
+	if len(changes) == 1 && changes[0] == "reset" {
+		if _, err := h.usageService.ResetLimits(userID); err != nil {
+			return err
+		}
+		changes = nil
+	}
+	limits, overridden, err := h.usageService.Limits(userID)
+	if err != nil {
+		return err
+	}
+	if len(changes) > 0 {
+		for _, change := range changes {
+			key, value, ok := strings.Cut(change, "=")
+			if !ok {
+				return c.Send(fmt.Sprintf("Expected key=value, got %q", change))
+			}
+			if err := setBudgetLimit(&limits, key, value); err != nil {
+				return c.Send(err.Error())
+			}
+		}
+		if err := h.usageService.SetLimits(userID, limits); err != nil {
+			return err
+		}
+		overridden = true
+	}
+
+	source := "from the config"
+	if overridden {
+		source = "set by an admin"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Budget of %s (%s, 0 is unlimited)\n\n", displayName(user), source)
+	fmt.Fprintf(&b, "daily_tokens=%d\nmonthly_tokens=%d\n", limits.DailyTokens, limits.MonthlyTokens)
+	fmt.Fprintf(&b, "daily_usd=%g\nmonthly_usd=%g\n", limits.DailyUSD, limits.MonthlyUSD)
+	fmt.Fprintf(&b, "daily_transcription_minutes=%g\nmonthly_transcription_minutes=%g",
+		limits.DailyTranscriptionMinutes, limits.MonthlyTranscriptionMinutes)
+	return c.Send(b.String())
+}
+
+// setBudgetLimit sets the limit named like its key in the budget config.
+func setBudgetLimit(limits *config.BudgetLimits, key, value string) error {
+	switch key {
+	case "daily_tokens", "monthly_tokens":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%s must be a whole number of tokens", key)
+		}
+		if key == "daily_tokens" {
+			limits.DailyTokens = n
+		} else {
+			limits.MonthlyTokens = n
+		}
+		return nil
+	}
+	var field *float64
+	switch key {
+	case "daily_usd":
+		field = &limits.DailyUSD
+	case "monthly_usd":
+		field = &limits.MonthlyUSD
+	case "daily_transcription_minutes":
+		field = &limits.DailyTranscriptionMinutes
+	case "monthly_transcription_minutes":
+		field = &limits.MonthlyTranscriptionMinutes
+	default:
+		return fmt.Errorf("unknown limit %q", key)
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 {
+		return fmt.Errorf("%s must be a non-negative number", key)
+	}
+	*field = f
+	return nil
+}
+
+func (h *BotHandler) adminBroadcast(c tele.Context, text string) error {
+	ctx := c.Get("requestContext").(context.Context)
+	users, err := h.userRepo.ListActive()
+	if err != nil {
+		return err
+	}
+	sent := 0
+	for i, user := range users {
+		if i > 0 {
+			time.Sleep(broadcastInterval)
+		}
+		if _, err := c.Bot().Send(&tele.User{ID: user.ChatId}, text); err != nil {
+			slog.WarnContext(ctx, "Failed to deliver broadcast", "error", err, "user_id", user.Id)
+			continue
+		}
+		sent++
+	}
+	return c.Send(fmt.Sprintf("Broadcast delivered to %d of %d users", sent, len(users)))
+}
+
+// setUserActive approves or blocks a user and returns a summary for the admin.
+// Approved users are told they can start chatting.
+func (h *BotHandler) setUserActive(c tele.Context, userID int64, active bool) string {
+	ctx := c.Get("requestContext").(context.Context)
+	admin := c.Get("user").(models.User)
+	if !active && userID == admin.Id {
+		return "You can't block yourself"
+	}
+	user, err := h.userRepo.GetUser(userID)
+	if err != nil {
+		return "User not found"
+	}
+	if err := h.userRepo.SetActive(userID, active); err != nil {
+		slog.ErrorContext(ctx, "Failed to update user", "error", err, "user_id", userID)
+		return "Failed to update user"
+	}
+	if !active {
+		return fmt.Sprintf("%s is blocked", displayName(user))
+	}
+	if _, err := c.Bot().Send(&tele.User{ID: user.ChatId}, "Your access has been approved. Send me a message to start."); err != nil {
+		slog.WarnContext(ctx, "Failed to notify approved user", "error", err, "user_id", userID)
+	}
+	return fmt.Sprintf("%s is approved", displayName(user))
+}
+
+func (h *BotHandler) ApproveUserCallback(c tele.Context) error {
+	return h.respondToApproval(c, true)
+}
+
+func (h *BotHandler) BlockUserCallback(c tele.Context) error {
+	return h.respondToApproval(c, false)
+}
+
+func (h *BotHandler) respondToApproval(c tele.Context, approve bool) error {
+	args := c.Args()
+	if len(args) == 0 {
+		return c.Respond()
+	}
+	userID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return c.Respond(&tele.CallbackResponse{Text: "Invalid user id"})
+	}
+	result := h.setUserActive(c, userID, approve)
+	if err := c.Respond(&tele.CallbackResponse{Text: result}); err != nil {
+		return err
+	}
+	return c.Edit(fmt.Sprintf("%s\n\n%s", c.Message().Text, result))
+}
+
+// NewApprovalRequester returns a callback for UserAuthenticator.OnPendingUser that
+// asks every admin to approve or block a newly registered user.
+func NewApprovalRequester(bot *tele.Bot, userRepo *repositories.UserRepo) func(context.Context, models.User) {
+	return func(ctx context.Context, user models.User) {
+		admins, err := userRepo.ListAdmins()
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to list admins for approval request", "error", err)
+			return
+		}
+		if len(admins) == 0 {
+			slog.WarnContext(ctx, "No admins to approve pending user", "user_id", user.Id)
+			return
+		}
+		markup := &tele.ReplyMarkup{}
+		id := strconv.FormatInt(user.Id, 10)
+		markup.Inline(markup.Row(
+			markup.Data("Approve", approveUserBtn.Unique, id),
+			markup.Data("Block", blockUserBtn.Unique, id),
+		))
+		text := fmt.Sprintf("New user %s (id %d) is waiting for approval.", displayName(user), user.Id)
+		for _, admin := range admins {
+			if _, err := bot.Send(&tele.User{ID: admin.ChatId}, text, markup); err != nil {
+				slog.WarnContext(ctx, "Failed to send approval request", "error", err, "admin_id", admin.Id)
+			}
+		}
+	}
+}
+
+func displayName(user models.User) string {
+	name := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	if user.Username != "" {
+		name += " (@" + user.Username + ")"
+	}
+	return name
+}
+
+// sendLines sends lines joined by newlines, split into as few messages as fit.
+func sendLines(c tele.Context, lines []string) error {
+	var b strings.Builder
+	for _, line := range lines {
+		if b.Len() > 0 && b.Len()+len(line)+1 > telegram_utils.MaxTelegramMessageLength {
+			if err := c.Send(b.String()); err != nil {
+				return err
+			}
+			b.Reset()
+		}
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(line)
+	}
+	return c.Send(b.String())
+}
@@ -0,0 +1,219 @@
+package tgbot
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	tele "gopkg.in/telebot.v3"
+	"vadimgribanov.com/tg-gpt/internal/database"
+	"vadimgribanov.com/tg-gpt/internal/models"
+	"vadimgribanov.com/tg-gpt/internal/repositories"
+)
+
+type telegramCall struct {
+	method  string
+	payload map[string]any
+}
+
+// fakeTelegram records the Bot API calls and answers each one with a message.
+type fakeTelegram struct {
+	mu    sync.Mutex
+	calls []telegramCall
+}
+
+func newFakeTelegramBot(t *testing.T) (*tele.Bot, *fakeTelegram) {
+	t.Helper()
+	fake := &fakeTelegram{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		fake.mu.Lock()
+		fake.calls = append(fake.calls, telegramCall{method: r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:], payload: payload})
+		fake.mu.Unlock()
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1,"date":0,"chat":{"id":1}}}`))
+	}))
+	t.Cleanup(server.Close)
+	bot, err := tele.NewBot(tele.Settings{URL: server.URL, Token: "test", Offline: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bot, fake
+}
+
+// sentTo returns the texts of the messages sent or edited in chatID.
+func (f *fakeTelegram) sentTo(chatID string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var texts []string
+	for _, call := range f.calls {
+		if call.payload["chat_id"] == chatID {
+			text, _ := call.payload["text"].(string)
+			texts = append(texts, text)
+		}
+	}
+	return texts
+}
+
+func (f *fakeTelegram) callsTo(method string) []telegramCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var calls []telegramCall
+	for _, call := range f.calls {
+		if call.method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+type adminHarness struct {
+	bot      *tele.Bot
+	telegram *fakeTelegram
+	userRepo *repositories.UserRepo
+	handler  *BotHandler
+	admin    models.User
+	pending  models.User
+}
+
+func newAdminHarness(t *testing.T) *adminHarness {
+	t.Helper()
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Logf("close db: %v", err)
+		}
+	})
+	if err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	userRepo := repositories.NewUserRepo(db)
+	if _, err := userRepo.Register(1, "Ada", "", "ada", 1, true, "test-model"); err != nil {
+		t.Fatal(err)
+	}
+	if err := userRepo.PromoteAdmins([]int64{1}); err != nil {
+		t.Fatal(err)
+	}
+	admin, err := userRepo.GetUser(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := userRepo.Register(2, "Bob", "", "bob", 2, false, "test-model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot, telegram := newFakeTelegramBot(t)
+	return &adminHarness{
+		bot:      bot,
+		telegram: telegram,
+		userRepo: userRepo,
+		handler:  NewBotHandler(nil, nil, nil, nil, userRepo, nil, nil, nil, nil),
+		admin:    admin,
+		pending:  pending,
+	}
+}
+
+func (h *adminHarness) context(update tele.Update) tele.Context {
+	c := h.bot.NewContext(update)
+	c.Set("requestContext", context.Background())
+	c.Set("user", h.admin)
+	return c
+}
+
+func (h *adminHarness) command(payload string) tele.Context {
+	return h.context(tele.Update{Message: &tele.Message{
+		ID:      10,
+		Text:    "/admin " + payload,
+		Payload: payload,
+		Sender:  &tele.User{ID: h.admin.Id},
+		Chat:    &tele.Chat{ID: h.admin.ChatId},
+	}})
+}
+
+func (h *adminHarness) isActive(t *testing.T, userID int64) bool {
+	t.Helper()
+	user, err := h.userRepo.GetUser(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user.Active
+}
+
+func TestAdminApproveAndBlockCommands(t *testing.T) {
+	h := newAdminHarness(t)
+
+	if err := h.handler.HandleAdmin(h.command("approve 2")); err != nil {
+		t.Fatal(err)
+	}
+	if !h.isActive(t, 2) {
+		t.Fatal("approved user must be active")
+	}
+	if sent := h.telegram.sentTo("2"); len(sent) != 1 || !strings.Contains(sent[0], "approved") {
+		t.Fatalf("approved user must be told: %q", sent)
+	}
+	if sent := h.telegram.sentTo("1"); len(sent) != 1 || sent[0] != "Bob (@bob) is approved" {
+		t.Fatalf("admin reply: %q", sent)
+	}
+
+	if err := h.handler.HandleAdmin(h.command("block 2")); err != nil {
+		t.Fatal(err)
+	}
+	if h.isActive(t, 2) {
+		t.Fatal("blocked user must be inactive")
+	}
+
+	if err := h.handler.HandleAdmin(h.command("block 1")); err != nil {
+		t.Fatal(err)
+	}
+	if !h.isActive(t, 1) {
+		t.Fatal("admins must not block themselves")
+	}
+	if sent := h.telegram.sentTo("1"); sent[len(sent)-1] != "You can't block yourself" {
+		t.Fatalf("admin reply: %q", sent)
+	}
+}
+
+func TestApprovalRequestIsAnsweredWithButtons(t *testing.T) {
+	h := newAdminHarness(t)
+
+	NewApprovalRequester(h.bot, h.userRepo)(context.Background(), h.pending)
+	requests := h.telegram.sentTo("1")
+	if len(requests) != 1 || !strings.Contains(requests[0], "id 2") {
+		t.Fatalf("admin must be asked about the new user: %q", requests)
+	}
+	markup, _ := json.Marshal(h.telegram.callsTo("sendMessage")[0].payload["reply_markup"])
+	if !strings.Contains(string(markup), approveUserBtn.Unique+"|2") || !strings.Contains(string(markup), blockUserBtn.Unique+"|2") {
+		t.Fatalf("approval request buttons: %s", markup)
+	}
+
+	press := tele.Update{Callback: &tele.Callback{
+		ID:      "press",
+		Data:    "2",
+		Sender:  &tele.User{ID: h.admin.Id},
+		Message: &tele.Message{ID: 1, Text: requests[0], Chat: &tele.Chat{ID: h.admin.ChatId}},
+	}}
+	if err := h.handler.ApproveUserCallback(h.context(press)); err != nil {
+		t.Fatal(err)
+	}
+	if !h.isActive(t, 2) {
+		t.Fatal("approved user must be active")
+	}
+	if err := h.handler.BlockUserCallback(h.context(press)); err != nil {
+		t.Fatal(err)
+	}
+	if h.isActive(t, 2) {
+		t.Fatal("blocked user must be inactive")
+	}
+	edits := h.telegram.callsTo("editMessageText")
+	if len(edits) != 2 || !strings.HasSuffix(edits[1].payload["text"].(string), "Bob (@bob) is blocked") {
+		t.Fatalf("request must show the outcome: %#v", edits)
+	}
+}
@@ -0,0 +1,149 @@
+package tgbot
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+	"vadimgribanov.com/tg-gpt/internal/middleware"
+	"vadimgribanov.com/tg-gpt/internal/models"
+)
+
+// albumDelay is how long an album waits for more of its items. Telegram delivers
+// the items of a media group as separate updates in quick succession.
+const albumDelay = 1500 * time.Millisecond
+
+// imageMediaTypes lists the image files the models can view.
+var imageMediaTypes = map[string]struct{}{
+	"image/jpeg": {},
+	"image/png":  {},
+	"image/webp": {},
+	"image/gif":  {},
+}
+
+func isImageMediaType(mediaType string) bool {
+	_, ok := imageMediaTypes[mediaType]
+	return ok
+}
+
+// albumImage is one image of an album, kept with the update that carried it.
+type albumImage struct {
+	c        tele.Context
+	imageURL string
+}
+
+// albumTimer is the wait for more items of an album, a *time.Timer outside tests.
+type albumTimer interface {
+	Reset(d time.Duration) bool
+}
+
+type album struct {
+	user   models.User
+	images []albumImage
+	timer  albumTimer
+}
+
+// albumCollector gathers the images of a media group and submits them as one
+// message once no more items arrive.
+type albumCollector struct {
+	mu     sync.Mutex
+	albums map[string]*album
+	submit func(c tele.Context, user models.User, caption string, imageURLs []string) error
+	// afterFunc starts the wait of a new album.
+	afterFunc func(d time.Duration, f func()) albumTimer
+}
+
+func newAlbumCollector(submit func(c tele.Context, user models.User, caption string, imageURLs []string) error) *albumCollector {
+	return &albumCollector{
+		albums: make(map[string]*album),
+		submit: submit,
+		afterFunc: func(d time.Duration, f func()) albumTimer {
+			return time.AfterFunc(d, f)
+		},
+	}
+}
+
+func (a *albumCollector) Add(c tele.Context, user models.User, imageURL string) {
+	albumID := c.Message().AlbumID
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pending := a.albums[albumID]
+	if pending == nil {
+		pending = &album{user: user}
+		pending.timer = a.afterFunc(albumDelay, func() { a.flush(albumID) })
+		a.albums[albumID] = pending
+	} else {
+		pending.timer.Reset(albumDelay)
+	}
+	pending.images = append(pending.images, albumImage{c: c, imageURL: imageURL})
+}
+
+func (a *albumCollector) flush(albumID string) {
+	a.mu.Lock()
+	pending := a.albums[albumID]
+	delete(a.albums, albumID)
+	a.mu.Unlock()
+	if pending == nil || len(pending.images) == 0 {
+		return
+	}
+
+	images := pending.images
+	if middleware.IsGroupChat(images[0].c) && !albumAddressesBot(images) {
+		return
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].c.Message().ID < images[j].c.Message().ID })
+	caption := ""
+	imageURLs := make([]string, 0, len(images))
+	for _, image := range images {
+		if caption == "" {
+			caption = image.c.Message().Caption
+		}
+		imageURLs = append(imageURLs, image.imageURL)
+	}
+
+	// The album is answered as a reply to its first item.
+	c := images[0].c
+	if err := a.submit(c, pending.user, caption, imageURLs); err != nil {
+		ctx := c.Get("requestContext").(context.Context)
+		slog.ErrorContext(ctx, "Error submitting album", "error", err, "album_id", albumID, "images", len(imageURLs))
+		if sendErr := c.Send("Failed to answer the message"); sendErr != nil {
+			slog.ErrorContext(ctx, "Error sending notice", "error", sendErr)
+		}
+	}
+}
+
+// albumAddressesBot reports whether any item of a group album is meant for the bot.
+func albumAddressesBot(images []albumImage) bool {
+	for _, image := range images {
+		if middleware.AddressesBot(image.c) {
+			return true
+		}
+	}
+	return false
+}
+
+// downloadImage fetches a Telegram file as a base64 data URL. An empty mediaType is
+// sniffed from the file's content.
+func downloadImage(c tele.Context, file *tele.File, mediaType string) (string, error) {
+	reader, err := c.Bot().File(file)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	if mediaType == "" {
+		mediaType = http.DetectContentType(content)
+	}
+	return fmt.Sprintf("data:%s;base64,%s", mediaType, base64.StdEncoding.EncodeToString(content)), nil
+}
@@ -0,0 +1,121 @@
+package tgbot
+
+import (
+	"testing"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+	"vadimgribanov.com/tg-gpt/internal/models"
+)
+
+type submittedAlbum struct {
+	messageID int
+	caption   string
+	imageURLs []string
+}
+
+// fakeAlbumTimer stands in for the wait of an album; tests fire it by hand.
+type fakeAlbumTimer struct {
+	fire   func()
+	resets int
+}
+
+func (t *fakeAlbumTimer) Reset(time.Duration) bool {
+	t.resets++
+	return true
+}
+
+func TestAlbumCollectorSubmitsSortedAlbumOnceComplete(t *testing.T) {
+	bot, err := tele.NewBot(tele.Settings{Offline: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var submitted []submittedAlbum
+	collector := newAlbumCollector(func(c tele.Context, user models.User, caption string, imageURLs []string) error {
+		submitted = append(submitted, submittedAlbum{messageID: c.Message().ID, caption: caption, imageURLs: imageURLs})
+		return nil
+	})
+	var timer *fakeAlbumTimer
+	collector.afterFunc = func(d time.Duration, f func()) albumTimer {
+		if d != albumDelay {
+			t.Fatalf("album wait: %v", d)
+		}
+		timer = &fakeAlbumTimer{fire: f}
+		return timer
+	}
+	item := func(id int, caption string) tele.Context {
+		return bot.NewContext(tele.Update{Message: &tele.Message{ID: id, AlbumID: "album", Caption: caption}})
+	}
+	user := models.User{Id: 1}
+
+	// Items arrive out of order and only the last one carries the caption.
+	collector.Add(item(12, ""), user, "url-12")
+	collector.Add(item(11, ""), user, "url-11")
+	collector.Add(item(13, "what is on these?"), user, "url-13")
+
+	// Every further item restarts the wait instead of starting another one.
+	if timer == nil || timer.resets != 2 {
+		t.Fatalf("album wait must be restarted by each item: %#v", timer)
+	}
+	if len(submitted) != 0 {
+		t.Fatalf("album submitted before its wait ran out: %#v", submitted)
+	}
+
+	timer.fire()
+	if len(submitted) != 1 {
+		t.Fatalf("album must be submitted once: %#v", submitted)
+	}
+	got := submitted[0]
+	if got.messageID != 11 {
+		t.Fatalf("album must answer its first item, got message %d", got.messageID)
+	}
+	if got.caption != "what is on these?" {
+		t.Fatalf("caption: %q", got.caption)
+	}
+	if len(got.imageURLs) != 3 || got.imageURLs[0] != "url-11" || got.imageURLs[1] != "url-12" || got.imageURLs[2] != "url-13" {
+		t.Fatalf("images: %v", got.imageURLs)
+	}
+	if len(collector.albums) != 0 {
+		t.Fatalf("submitted album must be forgotten: %v", collector.albums)
+	}
+}
+
+func TestAlbumCollectorAnswersGroupAlbumsOnlyWhenAddressed(t *testing.T) {
+	bot, err := tele.NewBot(tele.Settings{Offline: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot.Me.Username = "gptbot"
+	var submitted []submittedAlbum
+	collector := newAlbumCollector(func(c tele.Context, user models.User, caption string, imageURLs []string) error {
+		submitted = append(submitted, submittedAlbum{messageID: c.Message().ID, caption: caption, imageURLs: imageURLs})
+		return nil
+	})
+	collector.afterFunc = func(d time.Duration, f func()) albumTimer {
+		return &fakeAlbumTimer{fire: f}
+	}
+	item := func(albumID string, id int, caption string) tele.Context {
+		msg := &tele.Message{ID: id, AlbumID: albumID, Caption: caption, Chat: &tele.Chat{ID: -1001, Type: tele.ChatSuperGroup}}
+		if caption != "" {
+			msg.CaptionEntities = tele.Entities{{Type: tele.EntityMention, Offset: 0, Length: len("@gptbot")}}
+		}
+		return bot.NewContext(tele.Update{Message: msg})
+	}
+	group := models.User{Id: -1001, IsGroup: true}
+
+	// Only the captioned item mentions the bot, yet the album is answered whole.
+	collector.Add(item("addressed", 21, ""), group, "url-21")
+	collector.Add(item("addressed", 22, "@gptbot what is this?"), group, "url-22")
+	collector.flush("addressed")
+	// Albums members share with each other are not for the bot.
+	collector.Add(item("shared", 31, ""), group, "url-31")
+	collector.Add(item("shared", 32, ""), group, "url-32")
+	collector.flush("shared")
+
+	if len(submitted) != 1 {
+		t.Fatalf("submitted albums: %#v", submitted)
+	}
+	if got := submitted[0]; got.messageID != 21 || len(got.imageURLs) != 2 || got.caption != "@gptbot what is this?" {
+		t.Fatalf("group album: %#v", got)
+	}
+}
@@ -0,0 +1,57 @@
+package tgbot
+
+import (
+	"strings"
+
+	tele "gopkg.in/telebot.v3"
+	"vadimgribanov.com/tg-gpt/internal/llm"
+	"vadimgribanov.com/tg-gpt/internal/models"
+)
+
+// attributeToSpeaker prepares a group message for the shared dialog: the bot's
+// mention is dropped and the text is prefixed with the sender's name so the trace
+// records who said what. It also returns the sender's id, which is zero in
+// private chats where msg is returned unchanged.
+func attributeToSpeaker(c tele.Context, msg llm.Message) (llm.Message, int64) {
+	speaker, ok := c.Get("speaker").(models.User)
+	if !ok {
+		return msg, 0
+	}
+	mention := "@" + c.Bot().Me.Username
+	label := speakerLabel(speaker)
+	attribute := func(text string) string {
+		text = strings.TrimSpace(strings.ReplaceAll(text, mention, ""))
+		return label + ": " + text
+	}
+	if len(msg.Parts) == 0 {
+		msg.Content = attribute(msg.Content)
+		return msg, speaker.Id
+	}
+	parts := make([]llm.ContentPart, len(msg.Parts))
+	copy(parts, msg.Parts)
+	for i := range parts {
+		if parts[i].Type == llm.ContentPartText {
+			parts[i].Text = attribute(parts[i].Text)
+			break
+		}
+	}
+	msg.Parts = parts
+	return msg, speaker.Id
+}
+
+func speakerLabel(user models.User) string {
+	name := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	if name == "" {
+		name = user.Username
+	}
+	return name
+}
+
+// memoryUser returns whose preferences a message uses: the member who wrote it in
+// group chats, otherwise the user.
+func memoryUser(c tele.Context) models.User {
+	if speaker, ok := c.Get("speaker").(models.User); ok {
+		return speaker
+	}
+	return c.Get("user").(models.User)
+}
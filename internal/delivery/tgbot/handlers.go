@@ -2,13 +2,15 @@ package tgbot
 
 import (
 	"context"
-	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"strings"
 	"time"
 
 	tele "gopkg.in/telebot.v3"
+	"vadimgribanov.com/tg-gpt/internal/documents"
 	"vadimgribanov.com/tg-gpt/internal/llm"
 	"vadimgribanov.com/tg-gpt/internal/middleware"
 	"vadimgribanov.com/tg-gpt/internal/models"
@@ -26,6 +28,8 @@ func RegisterHandlers(
 	userRepo *repositories.UserRepo,
 	memoryManager *services.MemoryManager,
 	llmClientProxy *services.LLMClientProxy,
+	usageService *services.UsageService,
+	toolConfirmations *services.ToolConfirmationService,
 ) {
 	handler := NewBotHandler(
 		rateLimiter,
@@ -35,6 +39,8 @@ func RegisterHandlers(
 		userRepo,
 		memoryManager,
 		llmClientProxy,
+		usageService,
+		toolConfirmations,
 	)
 
 	bot.Handle("/cancel", func(c tele.Context) error {
@@ -51,10 +57,24 @@ func RegisterHandlers(
 	protected.Handle("/retry", handler.RetryLastMessage)
 	protected.Handle("/change_model", handler.ListModels)
 	protected.Handle("/current_model", handler.GetCurrentModel)
+	protected.Handle("/usage", handler.ShowUsage)
+	protected.Handle("/voice", handler.SetVoiceReplies)
 	protected.Handle(tele.OnVoice, handler.HandleVoice)
+	protected.Handle(tele.OnVideoNote, handler.HandleVideoNote)
+	protected.Handle(tele.OnAudio, handler.HandleAudio)
 	protected.Handle(tele.OnText, handler.HandleText)
+	protected.Handle(tele.OnEdited, handler.HandleEdited)
 	protected.Handle(tele.OnPhoto, handler.HandlePhoto)
+	protected.Handle(tele.OnDocument, handler.HandleDocument)
 	protected.Handle(&tele.Btn{Unique: "model"}, handler.ChangeModel)
+	protected.Handle(toolConfirmBtn, handler.ConfirmToolCallback)
+	protected.Handle(toolRejectBtn, handler.RejectToolCallback)
+
+	admin := bot.Group()
+	admin.Use(middleware.AdminOnly())
+	admin.Handle("/admin", handler.HandleAdmin)
+	admin.Handle(approveUserBtn, handler.ApproveUserCallback)
+	admin.Handle(blockUserBtn, handler.BlockUserCallback)
 }
 
 type BotHandler struct {
@@ -65,6 +85,11 @@ type BotHandler struct {
 	userRepo       *repositories.UserRepo
 	memoryManager  *services.MemoryManager
 	llmClientProxy *services.LLMClientProxy
+	usageService   *services.UsageService
+	// toolConfirmations answers the Confirm/Reject buttons of destructive tool
+	// calls.
+	toolConfirmations *services.ToolConfirmationService
+	albums            *albumCollector
 }
 
 func NewBotHandler(
@@ -75,16 +100,22 @@ func NewBotHandler(
 	userRepo *repositories.UserRepo,
 	memoryManager *services.MemoryManager,
 	llmClientProxy *services.LLMClientProxy,
+	usageService *services.UsageService,
+	toolConfirmations *services.ToolConfirmationService,
 ) *BotHandler {
-	return &BotHandler{
-		rateLimiter:    rateLimiter,
-		textService:    textService,
-		voiceService:   voiceService,
-		runner:         conversationRunner,
-		userRepo:       userRepo,
-		memoryManager:  memoryManager,
-		llmClientProxy: llmClientProxy,
+	h := &BotHandler{
+		rateLimiter:       rateLimiter,
+		textService:       textService,
+		voiceService:      voiceService,
+		runner:            conversationRunner,
+		userRepo:          userRepo,
+		memoryManager:     memoryManager,
+		llmClientProxy:    llmClientProxy,
+		usageService:      usageService,
+		toolConfirmations: toolConfirmations,
 	}
+	h.albums = newAlbumCollector(h.submitImages)
+	return h
 }
 
 func (h *BotHandler) HandleText(c tele.Context) error {
@@ -96,14 +127,20 @@ func (h *BotHandler) HandleText(c tele.Context) error {
 	if err != nil {
 		return err
 	}
+	user, err = h.branchOnReply(c, user)
+	if err != nil {
+		return err
+	}
 	userInput := c.Message().Text
 	streamer := telegram_utils.NewTelegramStreamer(c, c.Message())
+	msg, speakerID := attributeToSpeaker(c, llmUserMessage(userInput))
 
 	err = h.runner.Submit(
 		ctx,
 		user,
+		speakerID,
 		int64(c.Message().ID),
-		llmUserMessage(userInput),
+		msg,
 		streamer,
 	)
 	if err != nil {
@@ -114,23 +151,112 @@ func (h *BotHandler) HandleText(c tele.Context) error {
 	return nil
 }
 
+// HandleEdited re-runs the turn of an edited text message. The answer to the latest
+// message is rewritten in place; an older message starts a branch from that point.
+func (h *BotHandler) HandleEdited(c tele.Context) error {
+	ctx := c.Get("requestContext").(context.Context)
+	slog.DebugContext(ctx, "Got edited message")
+	user := c.Get("user").(models.User)
+	edited := c.Message()
+	if edited.Text == "" {
+		return nil
+	}
+
+	if h.runner.IsActive(user.Id, user.CurrentDialogId) {
+		return c.Reply("Cannot re-run an edited message while a response is being generated. Use /cancel and edit it again.")
+	}
+	turn, ok, err := h.textService.PrepareEdit(ctx, user, int64(edited.ID))
+	if errors.Is(err, services.ErrGroupEditNotLatest) {
+		return c.Reply("Only the latest message can be edited and answered again in a group chat.")
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error preparing edited message", "error", err)
+		return err
+	}
+	if !ok {
+		return nil
+	}
+
+	if err := c.Notify(tele.Typing); err != nil {
+		return err
+	}
+	streamer := telegram_utils.NewTelegramStreamer(c, edited)
+	replaced := make([]*tele.Message, 0, len(turn.AnswerTgMessageIDs))
+	for _, id := range turn.AnswerTgMessageIDs {
+		replaced = append(replaced, &tele.Message{ID: int(id), Chat: c.Chat()})
+	}
+	streamer.ReplaceMessages(replaced)
+	msg, speakerID := attributeToSpeaker(c, llmUserMessage(edited.Text))
+	return h.runner.Submit(
+		ctx,
+		turn.User,
+		speakerID,
+		int64(edited.ID),
+		msg,
+		streamer,
+	)
+}
+
+// maxTranscriptionFileSize is the largest recording that is transcribed; bots
+// cannot download bigger files.
+const maxTranscriptionFileSize = 20 << 20
+
 func (h *BotHandler) HandleVoice(c tele.Context) error {
+	voice := c.Message().Voice
+	return h.transcribeAndSubmit(c, &voice.File, "voice.ogg", voice.Duration)
+}
+
+func (h *BotHandler) HandleVideoNote(c tele.Context) error {
+	note := c.Message().VideoNote
+	return h.transcribeAndSubmit(c, &note.File, "video_note.mp4", note.Duration)
+}
+
+func (h *BotHandler) HandleAudio(c tele.Context) error {
+	audio := c.Message().Audio
+	fileName := audio.FileName
+	if fileName == "" {
+		fileName = "audio.mp3"
+	}
+	return h.transcribeAndSubmit(c, &audio.File, fileName, audio.Duration)
+}
+
+// transcribeAndSubmit answers a recording by its transcription. fileName tells the
+// transcriber the audio format; duration, in seconds, counts against the
+// transcription quota of the dialog's owner.
+func (h *BotHandler) transcribeAndSubmit(c tele.Context, file *tele.File, fileName string, duration int) error {
 	ctx := c.Get("requestContext").(context.Context)
-	slog.DebugContext(ctx, "Got voice message")
-	voiceFile := c.Message().Voice
+	slog.DebugContext(ctx, "Got recording", "file_name", fileName, "size", file.FileSize, "duration", duration)
+	if file.FileSize > maxTranscriptionFileSize {
+		return c.Reply(fmt.Sprintf("The recording is too large, I can transcribe files up to %d MB.", maxTranscriptionFileSize>>20))
+	}
+	user := c.Get("user").(models.User)
+	seconds := int64(duration)
+	period, err := h.usageService.TranscriptionQuotaExceeded(user.Id, seconds, time.Now())
+	if err != nil {
+		return err
+	}
+	if period != "" {
+		slog.InfoContext(ctx, "Transcription quota exceeded", "period", period, "duration", duration)
+		return c.Reply(services.TranscriptionRefusal(period))
+	}
 
-	reader, err := c.Bot().File(&voiceFile.File)
+	reader, err := c.Bot().File(file)
 	if err != nil {
 		return err
 	}
 	defer reader.Close()
 
-	user := c.Get("user").(models.User)
-	transcriptionText, err := h.voiceService.OnVoiceHandler(ctx, reader)
+	transcriptionText, err := h.voiceService.Transcribe(ctx, memoryUser(c).Id, reader, fileName)
 	if err != nil {
 		c.Reply("Failed to transcribe voice message")
 		return err
 	}
+	if err := h.usageService.RecordTranscription(user.Id, user.CurrentDialogId, seconds); err != nil {
+		slog.ErrorContext(ctx, "Error recording transcription usage", "error", err)
+	}
+	if err := h.userRepo.AddTranscribedSeconds(user.Id, seconds); err != nil {
+		slog.ErrorContext(ctx, "Error updating transcribed seconds", "error", err)
+	}
 
 	err = c.Reply(fmt.Sprintf("Transcription: _%s_", transcriptionText), &tele.SendOptions{
 		ParseMode: tele.ModeMarkdown,
@@ -139,55 +265,157 @@ func (h *BotHandler) HandleVoice(c tele.Context) error {
 		return err
 	}
 
+	user, err = h.branchOnReply(c, user)
+	if err != nil {
+		return err
+	}
 	streamer := telegram_utils.NewTelegramStreamer(c, c.Message())
+	msg, speakerID := attributeToSpeaker(c, llmUserMessage(transcriptionText))
 
 	return h.runner.Submit(
 		ctx,
 		user,
+		speakerID,
 		int64(c.Message().ID),
-		llmUserMessage(transcriptionText),
+		msg,
 		streamer,
 	)
 }
 
+// HandlePhoto answers a photo. Photos of an album are collected and answered
+// together as one message.
 func (h *BotHandler) HandlePhoto(c tele.Context) error {
 	ctx := c.Get("requestContext").(context.Context)
 	slog.DebugContext(ctx, "Got photo message")
 	user := c.Get("user").(models.User)
 
-	photoFile := c.Message().Photo
-	reader, err := c.Bot().File(&photoFile.File)
+	imageURL, err := downloadImage(c, &c.Message().Photo.File, "")
 	if err != nil {
 		return err
 	}
-	defer reader.Close()
+	return h.answerImage(c, user, imageURL)
+}
+
+// answerImage submits a single image, or hands it to the album collector when it is
+// part of a media group.
+func (h *BotHandler) answerImage(c tele.Context, user models.User, imageURL string) error {
+	if c.Message().AlbumID != "" {
+		h.albums.Add(c, user, imageURL)
+		return nil
+	}
+	return h.submitImages(c, user, c.Message().Caption, []string{imageURL})
+}
 
-	fileContent, err := io.ReadAll(reader)
+// submitImages answers one or more images as a single message replying to c's.
+func (h *BotHandler) submitImages(c tele.Context, user models.User, caption string, imageURLs []string) error {
+	ctx := c.Get("requestContext").(context.Context)
+	if err := c.Notify(tele.Typing); err != nil {
+		return err
+	}
+	user, err := h.branchOnReply(c, user)
 	if err != nil {
 		return err
 	}
-	encodedStr := base64.StdEncoding.EncodeToString(fileContent)
+	streamer := telegram_utils.NewTelegramStreamer(c, c.Message())
+	msg, speakerID := attributeToSpeaker(c, llmVisionMessage(caption, imageURLs))
+	return h.runner.Submit(
+		ctx,
+		user,
+		speakerID,
+		int64(c.Message().ID),
+		msg,
+		streamer,
+	)
+}
 
-	err = c.Notify(tele.Typing)
+// HandleDocument answers a message with a PDF, text or source file attached. The
+// file's text is extracted locally, sent to the model as a document part and kept
+// in the user's knowledge base for later questions.
+func (h *BotHandler) HandleDocument(c tele.Context) error {
+	ctx := c.Get("requestContext").(context.Context)
+	slog.DebugContext(ctx, "Got document message")
+	user := c.Get("user").(models.User)
+
+	doc := c.Message().Document
+	mediaType := strings.ToLower(doc.MIME)
+	// Every item of a group album gets here so its images can be collected. Files
+	// that do not address the bot themselves are dropped quietly otherwise.
+	if middleware.IsGroupChat(c) && !middleware.AddressesBot(c) &&
+		(!isImageMediaType(mediaType) || doc.FileSize > documents.MaxFileSize) {
+		return nil
+	}
+	if doc.FileSize > documents.MaxFileSize {
+		return c.Reply(fmt.Sprintf("The file is too large, I can read files up to %d MB.", documents.MaxFileSize>>20))
+	}
+	// Images sent as files keep their original format, e.g. PNG screenshots.
+	if isImageMediaType(mediaType) {
+		imageURL, err := downloadImage(c, &doc.File, mediaType)
+		if err != nil {
+			return err
+		}
+		return h.answerImage(c, user, imageURL)
+	}
+	reader, err := c.Bot().File(&doc.File)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, documents.MaxFileSize))
 	if err != nil {
 		return err
 	}
-	userInput := c.Message().Caption
 
-	if len(userInput) == 0 {
-		return c.Send("Provide image caption")
+	text, err := documents.Extract(doc.FileName, doc.MIME, data)
+	if errors.Is(err, documents.ErrUnsupported) {
+		return c.Reply("I can only read PDF, text, Markdown, CSV and source code files.")
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error extracting document text", "error", err, "file_name", doc.FileName, "mime", doc.MIME)
+		return c.Reply("Failed to read the document")
+	}
+	if text == "" {
+		return c.Reply("The document has no text I could read.")
 	}
 
+	if err := c.Notify(tele.Typing); err != nil {
+		return err
+	}
+	user, err = h.branchOnReply(c, user)
+	if err != nil {
+		return err
+	}
+	chunks := documents.Chunk(text, documents.ChunkSize)
+	go h.memoryManager.AddDocument(context.WithoutCancel(ctx), user.Id, doc.FileName, doc.MIME, chunks)
+
 	streamer := telegram_utils.NewTelegramStreamer(c, c.Message())
+	document := documents.NewDocument(doc.FileName, doc.MIME, chunks)
+	msg, speakerID := attributeToSpeaker(c, llmDocumentMessage(c.Message().Caption, document))
 	return h.runner.Submit(
 		ctx,
 		user,
+		speakerID,
 		int64(c.Message().ID),
-		llmVisionMessage(userInput, fmt.Sprintf("data:image/jpeg;base64,%s", encodedStr)),
+		msg,
 		streamer,
 	)
 }
 
+// branchOnReply continues the conversation from an older answer of the bot when the
+// message replies to it. Group chats keep their one shared dialog.
+func (h *BotHandler) branchOnReply(c tele.Context, user models.User) (models.User, error) {
+	replyTo := c.Message().ReplyTo
+	if replyTo == nil || replyTo.Sender == nil || replyTo.Sender.ID != c.Bot().Me.ID {
+		return user, nil
+	}
+	ctx := c.Get("requestContext").(context.Context)
+	user, _, err := h.textService.BranchFromReply(ctx, user, int64(replyTo.ID))
+	if err != nil {
+		slog.ErrorContext(ctx, "Error branching dialog", "error", err, "reply_to", replyTo.ID)
+		return models.User{}, err
+	}
+	return user, nil
+}
+
 func (h *BotHandler) RetryLastMessage(c tele.Context) error {
 	ctx := c.Get("requestContext").(context.Context)
 	slog.DebugContext(ctx, "Retrying last message")
@@ -199,20 +427,24 @@ func (h *BotHandler) RetryLastMessage(c tele.Context) error {
 	if h.runner.IsActive(user.Id, user.CurrentDialogId) {
 		return c.Send("Cannot retry while a response is being generated. Use /cancel first.")
 	}
-	userMsg, tgMsgID, err := h.memoryManager.PopForRetry(user.Id, user.CurrentDialogId)
+	// Close unanswered confirmations first so that the retried turn drops them too.
+	if err := h.textService.SupersedeConfirmations(ctx, user.Id, user.CurrentDialogId); err != nil {
+		return err
+	}
+	input, err := h.memoryManager.PopForRetry(user.Id, user.CurrentDialogId)
 	if err != nil {
 		return c.Send("No messages found")
 	}
 
-	if len(userMsg.Parts) > 0 {
+	if len(input.Message.Parts) > 0 {
 		return c.Send("Cannot retry multi-content messages")
 	}
 
 	streamer := telegram_utils.NewTelegramStreamer(c, &tele.Message{
-		ID:   int(tgMsgID),
+		ID:   int(input.TgMessageID),
 		Chat: c.Chat(),
 	})
-	return h.textService.RetryWithMessage(ctx, user, tgMsgID, userMsg, streamer)
+	return h.textService.RetryWithMessage(ctx, user, input, streamer)
 }
 
 func (h *BotHandler) ListModels(c tele.Context) error {
@@ -256,6 +488,37 @@ func (h *BotHandler) GetCurrentModel(c tele.Context) error {
 	return c.Send(fmt.Sprintf("Current model is %s", user.CurrentModel))
 }
 
+// SetVoiceReplies turns spoken answers on or off with "/voice on|off". In group
+// chats the setting belongs to the member who sent the command.
+func (h *BotHandler) SetVoiceReplies(c tele.Context) error {
+	ctx := c.Get("requestContext").(context.Context)
+	slog.DebugContext(ctx, "Setting voice replies", "payload", c.Message().Payload)
+
+	user := memoryUser(c)
+	switch strings.ToLower(strings.TrimSpace(c.Message().Payload)) {
+	case "on":
+		if err := h.voiceService.SetVoiceReplies(user.Id, true); err != nil {
+			return err
+		}
+		return c.Send("Voice replies are on: answers will also come as voice messages.")
+	case "off":
+		if err := h.voiceService.SetVoiceReplies(user.Id, false); err != nil {
+			return err
+		}
+		return c.Send("Voice replies are off.")
+	case "":
+		enabled, err := h.voiceService.VoiceRepliesEnabled(user.Id)
+		if err != nil {
+			return err
+		}
+		if enabled {
+			return c.Send("Voice replies are on. Use /voice off to turn them off.")
+		}
+		return c.Send("Voice replies are off. Use /voice on to turn them on.")
+	}
+	return c.Send("Usage: /voice on|off")
+}
+
 func (h *BotHandler) NewDialog(c tele.Context) error {
 	ctx := c.Get("requestContext").(context.Context)
 	slog.DebugContext(ctx, "Starting new dialog")
@@ -265,15 +528,21 @@ func (h *BotHandler) NewDialog(c tele.Context) error {
 	if err := h.runner.CancelDialog(ctx, user.Id, oldDialogID); err != nil {
 		return err
 	}
+	if err := h.textService.SupersedeConfirmations(ctx, user.Id, oldDialogID); err != nil {
+		return err
+	}
 	go h.memoryManager.CloseDialog(context.WithoutCancel(ctx), user.Id, oldDialogID)
 
-	_, ok, err := h.userRepo.StartNewDialogCAS(user.Id, oldDialogID, time.Now().Unix())
+	_, ok, err := h.userRepo.StartNewDialogCAS(user.Id, user.ThreadID, oldDialogID, time.Now().Unix())
 	if err != nil {
 		return err
 	}
 	if !ok {
 		return c.Send("Dialog already changed")
 	}
+	if user.ThreadID != 0 {
+		return c.Send("New dialog started in this topic")
+	}
 	return c.Send("New dialog started")
 
 }
@@ -282,12 +551,36 @@ func llmUserMessage(text string) llm.Message {
 	return llm.Message{Role: llm.RoleUser, Content: text}
 }
 
-func llmVisionMessage(text string, imageURL string) llm.Message {
+const defaultDocumentPrompt = "Read this document and tell me briefly what it is about."
+
+func llmDocumentMessage(text string, document *llm.Document) llm.Message {
+	if text == "" {
+		text = defaultDocumentPrompt
+	}
 	return llm.Message{
 		Role: llm.RoleUser,
 		Parts: []llm.ContentPart{
 			{Type: llm.ContentPartText, Text: text},
-			{Type: llm.ContentPartImageURL, ImageURL: imageURL},
+			{Type: llm.ContentPartDocument, Document: document},
 		},
 	}
 }
+
+const (
+	defaultImagePrompt  = "What is in this picture?"
+	defaultImagesPrompt = "What is in these pictures?"
+)
+
+func llmVisionMessage(text string, imageURLs []string) llm.Message {
+	if text == "" {
+		text = defaultImagePrompt
+		if len(imageURLs) > 1 {
+			text = defaultImagesPrompt
+		}
+	}
+	parts := []llm.ContentPart{{Type: llm.ContentPartText, Text: text}}
+	for _, imageURL := range imageURLs {
+		parts = append(parts, llm.ContentPart{Type: llm.ContentPartImageURL, ImageURL: imageURL})
+	}
+	return llm.Message{Role: llm.RoleUser, Parts: parts}
+}
@@ -0,0 +1,58 @@
+package tgbot
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+
+	tele "gopkg.in/telebot.v3"
+	"vadimgribanov.com/tg-gpt/internal/models"
+	"vadimgribanov.com/tg-gpt/internal/services"
+	"vadimgribanov.com/tg-gpt/internal/telegram_utils"
+)
+
+var (
+	toolConfirmBtn = &tele.Btn{Unique: services.ToolConfirmButton}
+	toolRejectBtn  = &tele.Btn{Unique: services.ToolRejectButton}
+)
+
+func (h *BotHandler) ConfirmToolCallback(c tele.Context) error {
+	return h.answerToolConfirmation(c, true)
+}
+
+func (h *BotHandler) RejectToolCallback(c tele.Context) error {
+	return h.answerToolConfirmation(c, false)
+}
+
+// answerToolConfirmation hands the answer to the dialog the confirmation belongs
+// to, which resumes the paused turn once nothing else is waiting.
+func (h *BotHandler) answerToolConfirmation(c tele.Context, approve bool) error {
+	ctx := c.Get("requestContext").(context.Context)
+	user := c.Get("user").(models.User)
+	args := c.Args()
+	if len(args) == 0 {
+		return c.Respond()
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return c.Respond(&tele.CallbackResponse{Text: "Invalid confirmation"})
+	}
+
+	confirmation, err := h.toolConfirmations.Authorize(ctx, id, user.Id, c.Sender().ID)
+	switch {
+	case errors.Is(err, services.ErrConfirmationNotPending):
+		return c.Respond(&tele.CallbackResponse{Text: "This request is already closed"})
+	case errors.Is(err, services.ErrNotConfirmationOwner):
+		return c.Respond(&tele.CallbackResponse{Text: "Only the person who asked can answer this"})
+	case err != nil:
+		return err
+	}
+	if err := c.Respond(); err != nil {
+		slog.WarnContext(ctx, "Failed to answer callback", "error", err)
+	}
+
+	user.CurrentDialogId = confirmation.DialogID
+	streamer := telegram_utils.NewTelegramStreamer(c, c.Message())
+	return h.runner.Decide(ctx, user, id, approve, streamer)
+}
@@ -0,0 +1,71 @@
+package tgbot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+	"vadimgribanov.com/tg-gpt/internal/models"
+	"vadimgribanov.com/tg-gpt/internal/services"
+)
+
+func (h *BotHandler) ShowUsage(c tele.Context) error {
+	ctx := c.Get("requestContext").(context.Context)
+	slog.DebugContext(ctx, "Showing usage")
+	user := c.Get("user").(models.User)
+
+	report, err := h.usageService.Report(user.Id, time.Now())
+	if err != nil {
+		slog.ErrorContext(ctx, "Error building usage report", "error", err)
+		return c.Send("Failed to load usage")
+	}
+
+	var b strings.Builder
+	writeUsageSection(&b, "Today (UTC)", report.Today)
+	b.WriteString("\n")
+	writeUsageSection(&b, "This month", report.Month)
+	return c.Send(b.String())
+}
+
+func writeUsageSection(b *strings.Builder, title string, summaries []models.UsageSummary) {
+	fmt.Fprintf(b, "%s:\n", title)
+	if len(summaries) == 0 {
+		b.WriteString("no usage\n")
+		return
+	}
+	total := 0.0
+	for _, s := range summaries {
+		if s.Model == services.TranscriptionUsageModel {
+			fmt.Fprintf(b, "• voice transcription: %s\n", formatDuration(s.TranscribedSeconds))
+			continue
+		}
+		fmt.Fprintf(b, "• %s: %s in", s.Model, formatTokens(s.InputTokens))
+		if s.CachedInputTokens > 0 {
+			fmt.Fprintf(b, " (%s cached)", formatTokens(s.CachedInputTokens))
+		}
+		fmt.Fprintf(b, ", %s out — $%.4f\n", formatTokens(s.OutputTokens), s.CostUSD)
+		total += s.CostUSD
+	}
+	fmt.Fprintf(b, "Total: $%.4f\n", total)
+}
+
+func formatTokens(n int64) string {
+	switch {
+	case n >= 1_000_000:
+		return fmt.Sprintf("%.1fM", float64(n)/1_000_000)
+	case n >= 1_000:
+		return fmt.Sprintf("%.1fk", float64(n)/1_000)
+	default:
+		return fmt.Sprintf("%d", n)
+	}
+}
+
+func formatDuration(seconds int64) string {
+	if seconds < 60 {
+		return fmt.Sprintf("%ds", seconds)
+	}
+	return fmt.Sprintf("%dm %02ds", seconds/60, seconds%60)
+}
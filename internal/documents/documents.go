@@ -0,0 +1,124 @@
+package documents
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ledongthuc/pdf"
+	"vadimgribanov.com/tg-gpt/internal/llm"
+)
+
+const (
+	// MaxFileSize is the largest file that is downloaded and extracted.
+	MaxFileSize = 10 << 20
+	// ChunkSize is the maximum length of a chunk in runes.
+	ChunkSize = 4000
+	// MaxMessageChunks is how many leading chunks of a document go into a message.
+	MaxMessageChunks = 8
+)
+
+var ErrUnsupported = errors.New("unsupported document type")
+
+// textExtensions lists the extensions read as plain text besides text/* MIME types:
+// markup, data and source files that Telegram often sends as application/octet-stream.
+var textExtensions = map[string]struct{}{
+	".txt": {}, ".md": {}, ".markdown": {}, ".csv": {}, ".tsv": {}, ".log": {},
+	".json": {}, ".yaml": {}, ".yml": {}, ".toml": {}, ".ini": {}, ".xml": {}, ".html": {}, ".css": {},
+	".go": {}, ".mod": {}, ".py": {}, ".js": {}, ".jsx": {}, ".ts": {}, ".tsx": {}, ".java": {},
+	".kt": {}, ".swift": {}, ".c": {}, ".h": {}, ".cpp": {}, ".hpp": {}, ".cs": {}, ".rs": {},
+	".rb": {}, ".php": {}, ".sh": {}, ".sql": {}, ".lua": {}, ".scala": {}, ".proto": {},
+}
+
+// Extract returns the text of a file. PDFs are parsed locally; text, Markdown, CSV
+// and source files are read as UTF-8. Other files fail with ErrUnsupported.
+func Extract(name, mimeType string, data []byte) (string, error) {
+	ext := strings.ToLower(filepath.Ext(name))
+	if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+		mimeType = mediaType
+	}
+
+	switch {
+	case mimeType == "application/pdf" || ext == ".pdf":
+		return extractPDF(data)
+	case isText(mimeType, ext):
+		if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+			return "", fmt.Errorf("%w: %s is not UTF-8 text", ErrUnsupported, name)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return "", fmt.Errorf("%w: %s (%s)", ErrUnsupported, name, mimeType)
+}
+
+func isText(mimeType, ext string) bool {
+	if strings.HasPrefix(mimeType, "text/") {
+		return true
+	}
+	_, ok := textExtensions[ext]
+	return ok
+}
+
+func extractPDF(data []byte) (text string, err error) {
+	// The PDF parser panics on some malformed files.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("parse pdf: %v", r)
+		}
+	}()
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("open pdf: %w", err)
+	}
+	plain, err := reader.GetPlainText()
+	if err != nil {
+		return "", fmt.Errorf("read pdf text: %w", err)
+	}
+	out, err := io.ReadAll(plain)
+	if err != nil {
+		return "", fmt.Errorf("read pdf text: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// NewDocument turns the chunks of a file into a document for a message, keeping the
+// first MaxMessageChunks chunks.
+func NewDocument(name, mimeType string, chunks []string) *llm.Document {
+	doc := &llm.Document{Name: name, MimeType: mimeType, Chunks: chunks, TotalChunks: len(chunks)}
+	if len(chunks) > MaxMessageChunks {
+		doc.Chunks = chunks[:MaxMessageChunks]
+	}
+	return doc
+}
+
+// Chunk splits text into pieces of at most size runes, preferring to break at
+// paragraph and then line boundaries.
+func Chunk(text string, size int) []string {
+	var chunks []string
+	for text != "" {
+		end := 0
+		for i := 0; i < size && end < len(text); i++ {
+			_, width := utf8.DecodeRuneInString(text[end:])
+			end += width
+		}
+		if end == len(text) {
+			chunks = append(chunks, text)
+			break
+		}
+		head := text[:end]
+		cut := strings.LastIndex(head, "\n\n")
+		if cut < len(head)/2 {
+			cut = strings.LastIndex(head, "\n")
+		}
+		if cut < len(head)/2 {
+			cut = len(head)
+		}
+		chunks = append(chunks, strings.TrimSpace(head[:cut]))
+		text = strings.TrimSpace(text[cut:])
+	}
+	return chunks
+}
@@ -0,0 +1,59 @@
+package documents
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestExtractReadsSourceFilesAsText(t *testing.T) {
+	text, err := Extract("main.go", "application/octet-stream", []byte("package main\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "package main" {
+		t.Fatalf("text: got %q", text)
+	}
+}
+
+func TestExtractRejectsBinaryFiles(t *testing.T) {
+	if _, err := Extract("photo.zip", "application/zip", []byte("PK\x03\x04")); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("zip: got %v, want ErrUnsupported", err)
+	}
+	if _, err := Extract("data.txt", "text/plain", []byte("a\x00b")); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("binary txt: got %v, want ErrUnsupported", err)
+	}
+}
+
+func TestChunkBreaksAtParagraphs(t *testing.T) {
+	first := strings.Repeat("a", 60)
+	second := strings.Repeat("b", 60)
+	chunks := Chunk(first+"\n\n"+second, 100)
+	if len(chunks) != 2 || chunks[0] != first || chunks[1] != second {
+		t.Fatalf("chunks: %q", chunks)
+	}
+}
+
+func TestChunkCountsRunes(t *testing.T) {
+	chunks := Chunk(strings.Repeat("ж", 250), 100)
+	if len(chunks) != 3 {
+		t.Fatalf("chunks len: got %d want 3", len(chunks))
+	}
+	for _, chunk := range chunks {
+		if n := utf8.RuneCountInString(chunk); n > 100 || !utf8.ValidString(chunk) {
+			t.Fatalf("chunk of %d runes, valid=%v", n, utf8.ValidString(chunk))
+		}
+	}
+}
+
+func TestNewDocumentKeepsLeadingChunks(t *testing.T) {
+	text := strings.Repeat(strings.Repeat("x", ChunkSize)+"\n\n", MaxMessageChunks+2)
+	doc := NewDocument("big.txt", "text/plain", Chunk(text, ChunkSize))
+	if len(doc.Chunks) != MaxMessageChunks || doc.TotalChunks != MaxMessageChunks+2 {
+		t.Fatalf("chunks: kept %d of %d", len(doc.Chunks), doc.TotalChunks)
+	}
+	if !strings.Contains(doc.Text(), "2 more parts of big.txt were omitted") {
+		t.Fatalf("rendered document must mention omitted parts")
+	}
+}
@@ -0,0 +1,45 @@
+package llm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// blobURLPrefix marks an image URL that references a stored blob by the SHA-256
+// hash of its content instead of carrying the image inline.
+const blobURLPrefix = "blob:sha256:"
+
+// ParseBase64DataURL splits a "data:<media type>;base64,<data>" URL into its media
+// type and payload. It reports false for anything that is not a base64 data URL.
+func ParseBase64DataURL(dataURL string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(dataURL, "data:")
+	if !ok {
+		return "", "", false
+	}
+	meta, data, ok := strings.Cut(rest, ",")
+	if !ok || data == "" {
+		return "", "", false
+	}
+	mediaType, encoding, _ := strings.Cut(meta, ";")
+	if encoding != "base64" {
+		return "", "", false
+	}
+	return strings.ToLower(mediaType), data, true
+}
+
+// BlobHash returns the content address of a blob.
+func BlobHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// BlobURL returns the image URL referencing the blob with the given hash.
+func BlobURL(hash string) string {
+	return blobURLPrefix + hash
+}
+
+// ParseBlobURL returns the hash referenced by a blob URL.
+func ParseBlobURL(url string) (string, bool) {
+	return strings.CutPrefix(url, blobURLPrefix)
+}
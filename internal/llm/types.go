@@ -3,6 +3,8 @@ package llm
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"strings"
 )
 
 type Provider string
@@ -27,12 +29,41 @@ type ContentPartType string
 const (
 	ContentPartText     ContentPartType = "text"
 	ContentPartImageURL ContentPartType = "image_url"
+	ContentPartDocument ContentPartType = "document"
 )
 
 type ContentPart struct {
 	Type     ContentPartType `json:"type"`
 	Text     string          `json:"text,omitempty"`
 	ImageURL string          `json:"image_url,omitempty"`
+	Document *Document       `json:"document,omitempty"`
+}
+
+// Document is the text extracted from a file the user sent. Large files are split
+// into chunks and only the leading ones are kept in the message.
+type Document struct {
+	Name     string   `json:"name"`
+	MimeType string   `json:"mime_type,omitempty"`
+	Chunks   []string `json:"chunks"`
+	// TotalChunks is the number of chunks of the whole file, including the ones
+	// left out of Chunks.
+	TotalChunks int `json:"total_chunks"`
+}
+
+// Text renders the document as plain text for models, which see documents as part
+// of the user's message.
+func (d Document) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Document: %s]\n", d.Name)
+	for _, chunk := range d.Chunks {
+		b.WriteString(chunk)
+		b.WriteString("\n")
+	}
+	if omitted := d.TotalChunks - len(d.Chunks); omitted > 0 {
+		fmt.Fprintf(&b, "[%d more parts of %s were omitted because the document is too long]\n", omitted, d.Name)
+	}
+	fmt.Fprintf(&b, "[End of document: %s]", d.Name)
+	return b.String()
 }
 
 func (p *ContentPart) UnmarshalJSON(data []byte) error {
@@ -40,12 +71,14 @@ func (p *ContentPart) UnmarshalJSON(data []byte) error {
 		Type     ContentPartType `json:"type"`
 		Text     string          `json:"text,omitempty"`
 		ImageURL json.RawMessage `json:"image_url,omitempty"`
+		Document *Document       `json:"document,omitempty"`
 	}
 	if err := json.Unmarshal(data, &raw); err != nil {
 		return err
 	}
 	p.Type = raw.Type
 	p.Text = raw.Text
+	p.Document = raw.Document
 	if len(raw.ImageURL) > 0 {
 		var url string
 		if err := json.Unmarshal(raw.ImageURL, &url); err == nil {
@@ -97,6 +130,9 @@ type ToolCall struct {
 	Index     int    `json:"index,omitempty"`
 	Name      string `json:"name"`
 	Arguments string `json:"arguments"`
+	// Signature is an opaque provider token that must be echoed back together with
+	// the call on the next request (Gemini thought signatures).
+	Signature string `json:"signature,omitempty"`
 }
 
 func (c *ToolCall) UnmarshalJSON(data []byte) error {
@@ -105,6 +141,7 @@ func (c *ToolCall) UnmarshalJSON(data []byte) error {
 		Index     *int   `json:"index,omitempty"`
 		Name      string `json:"name"`
 		Arguments string `json:"arguments"`
+		Signature string `json:"signature,omitempty"`
 		Function  *struct {
 			Name      string `json:"name"`
 			Arguments string `json:"arguments"`
@@ -119,6 +156,7 @@ func (c *ToolCall) UnmarshalJSON(data []byte) error {
 	}
 	c.Name = raw.Name
 	c.Arguments = raw.Arguments
+	c.Signature = raw.Signature
 	if raw.Function != nil {
 		if c.Name == "" {
 			c.Name = raw.Function.Name
@@ -134,11 +172,16 @@ type ToolResult struct {
 	CallID string `json:"call_id"`
 	Name   string `json:"name"`
 	Output string `json:"output"`
+	// IsError marks a failed call, for providers that tell failures apart.
+	IsError bool `json:"is_error,omitempty"`
 }
 
 type Usage struct {
 	InputTokens  int64
 	OutputTokens int64
+	// CachedInputTokens is the part of InputTokens served from the provider's
+	// prompt cache, which is billed at a lower rate.
+	CachedInputTokens int64
 }
 
 type StreamEvent struct {
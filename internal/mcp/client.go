@@ -0,0 +1,326 @@
+// Package mcp is a client for Model Context Protocol servers. It covers what the
+// bot needs to use a server's tools: the initialize handshake, tools/list and
+// tools/call, over the stdio and streamable HTTP transports.
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ProtocolVersion is the protocol revision the client asks for. Servers answering
+// with an older revision are accepted: tools work the same way in all of them.
+const ProtocolVersion = "2025-06-18"
+
+const (
+	clientName    = "tg-gpt"
+	clientVersion = "1.0.0"
+)
+
+// Tool is a tool as a server lists it.
+type Tool struct {
+	Name        string           `json:"name"`
+	Description string           `json:"description"`
+	InputSchema map[string]any   `json:"inputSchema"`
+	Annotations *ToolAnnotations `json:"annotations,omitempty"`
+}
+
+// ToolAnnotations are hints a server gives about a tool. They come from the
+// server and are not guaranteed to be accurate.
+type ToolAnnotations struct {
+	// ReadOnlyHint says the tool does not change its environment.
+	ReadOnlyHint bool `json:"readOnlyHint,omitempty"`
+	// DestructiveHint says whether a tool that changes its environment may delete
+	// or overwrite things. Unset means it may.
+	DestructiveHint *bool `json:"destructiveHint,omitempty"`
+}
+
+// ReadOnly reports whether the server marked the tool as read-only.
+func (t Tool) ReadOnly() bool {
+	return t.Annotations != nil && t.Annotations.ReadOnlyHint
+}
+
+// Destructive reports whether the tool may delete or overwrite things, with the
+// protocol's defaults for missing hints.
+func (t Tool) Destructive() bool {
+	if t.ReadOnly() {
+		return false
+	}
+	return t.Annotations == nil || t.Annotations.DestructiveHint == nil || *t.Annotations.DestructiveHint
+}
+
+// Content is one item of a tool result. Text is set for text content, Data and
+// MimeType for images and audio, Resource for embedded resources and URI for
+// resource links.
+type Content struct {
+	Type     string            `json:"type"`
+	Text     string            `json:"text,omitempty"`
+	Data     string            `json:"data,omitempty"`
+	MimeType string            `json:"mimeType,omitempty"`
+	URI      string            `json:"uri,omitempty"`
+	Resource *ResourceContents `json:"resource,omitempty"`
+}
+
+type ResourceContents struct {
+	URI      string `json:"uri"`
+	MimeType string `json:"mimeType,omitempty"`
+	Text     string `json:"text,omitempty"`
+}
+
+// CallToolResult is the outcome of a tool call. IsError marks a failure the tool
+// itself reported, which is meant to be shown to the model.
+type CallToolResult struct {
+	Content           []Content       `json:"content"`
+	StructuredContent json.RawMessage `json:"structuredContent,omitempty"`
+	IsError           bool            `json:"isError"`
+}
+
+// Text renders the result as plain text. Binary content is described rather than
+// included.
+func (r CallToolResult) Text() string {
+	var parts []string
+	for _, content := range r.Content {
+		switch content.Type {
+		case "text":
+			parts = append(parts, content.Text)
+		case "resource":
+			if content.Resource == nil {
+				continue
+			}
+			if content.Resource.Text != "" {
+				parts = append(parts, content.Resource.Text)
+			} else {
+				parts = append(parts, fmt.Sprintf("[resource %s]", content.Resource.URI))
+			}
+		case "resource_link":
+			parts = append(parts, fmt.Sprintf("[resource %s]", content.URI))
+		default:
+			parts = append(parts, fmt.Sprintf("[%s content omitted: %s]", content.Type, content.MimeType))
+		}
+	}
+	if len(parts) == 0 && len(r.StructuredContent) > 0 {
+		return string(r.StructuredContent)
+	}
+	return strings.Join(parts, "\n")
+}
+
+// RPCError is a JSON-RPC error returned by the server.
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("mcp error %d: %s", e.Code, e.Message)
+}
+
+type request struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      *int64 `json:"id,omitempty"`
+	Method  string `json:"method"`
+	Params  any    `json:"params,omitempty"`
+}
+
+// message is anything a server sends: a response to one of our requests, or a
+// request or notification of its own.
+type message struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+// errSessionLost is returned by a transport whose session is gone before the
+// request reached the server: the stdio process exited or the HTTP server forgot
+// the session. The client starts a new session and sends the request again.
+var errSessionLost = errors.New("mcp session lost")
+
+// transport carries JSON-RPC messages to a server and back.
+type transport interface {
+	// call sends a request and waits for the response with the same id.
+	call(ctx context.Context, req request) (*message, error)
+	notify(ctx context.Context, req request) error
+	// initialized passes on the protocol revision agreed on in the handshake.
+	initialized(protocolVersion string)
+	close() error
+}
+
+// Client is a connection to one MCP server. It is safe for concurrent use. When
+// the session is lost it connects again on the next request.
+type Client struct {
+	// dial opens a new, not yet initialized connection.
+	dial   func() (transport, error)
+	nextID atomic.Int64
+
+	mu         sync.Mutex
+	transport  transport
+	serverName string
+}
+
+func newClient(ctx context.Context, dial func() (transport, error)) (*Client, error) {
+	c := &Client{dial: dial}
+	t, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.transport = t
+	return c, nil
+}
+
+// connect opens a connection and runs the handshake on it.
+func (c *Client) connect(ctx context.Context) (transport, error) {
+	t, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.initialize(ctx, t); err != nil {
+		t.close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// reconnect replaces the lost connection failed, unless another request already
+// did.
+func (c *Client) reconnect(ctx context.Context, failed transport) (transport, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.transport != failed {
+		return c.transport, nil
+	}
+	slog.WarnContext(ctx, "MCP session lost, connecting again", "server", c.serverName)
+	t, err := c.connect(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reconnect: %w", err)
+	}
+	failed.close()
+	c.transport = t
+	return t, nil
+}
+
+func (c *Client) initialize(ctx context.Context, t transport) error {
+	var result struct {
+		ProtocolVersion string `json:"protocolVersion"`
+		ServerInfo      struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"serverInfo"`
+	}
+	err := c.roundTrip(ctx, t, "initialize", map[string]any{
+		"protocolVersion": ProtocolVersion,
+		"capabilities":    map[string]any{},
+		"clientInfo":      map[string]string{"name": clientName, "version": clientVersion},
+	}, &result)
+	if err != nil {
+		return fmt.Errorf("initialize: %w", err)
+	}
+	c.serverName = result.ServerInfo.Name
+	t.initialized(result.ProtocolVersion)
+	if err := t.notify(ctx, request{JSONRPC: "2.0", Method: "notifications/initialized"}); err != nil {
+		return fmt.Errorf("initialized notification: %w", err)
+	}
+	return nil
+}
+
+// ServerName is the name the server introduced itself with.
+func (c *Client) ServerName() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.serverName
+}
+
+// ListTools returns all tools of the server, following pagination.
+func (c *Client) ListTools(ctx context.Context) ([]Tool, error) {
+	var tools []Tool
+	cursor := ""
+	for {
+		params := map[string]any{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		var page struct {
+			Tools      []Tool `json:"tools"`
+			NextCursor string `json:"nextCursor"`
+		}
+		if err := c.call(ctx, "tools/list", params, &page); err != nil {
+			return nil, fmt.Errorf("list tools: %w", err)
+		}
+		tools = append(tools, page.Tools...)
+		if page.NextCursor == "" {
+			return tools, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// CallTool calls a tool with arguments, a JSON object. A tool failing on its own
+// terms is not an error: it comes back as a result with IsError set.
+func (c *Client) CallTool(ctx context.Context, name string, arguments json.RawMessage) (*CallToolResult, error) {
+	if len(arguments) == 0 {
+		arguments = json.RawMessage("{}")
+	}
+	var result CallToolResult
+	err := c.call(ctx, "tools/call", map[string]any{"name": name, "arguments": arguments}, &result)
+	if err != nil {
+		return nil, fmt.Errorf("call tool %s: %w", name, err)
+	}
+	return &result, nil
+}
+
+// Close ends the session and, for stdio servers, stops the process.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.transport.close()
+}
+
+func (c *Client) call(ctx context.Context, method string, params any, result any) error {
+	c.mu.Lock()
+	t := c.transport
+	c.mu.Unlock()
+	err := c.roundTrip(ctx, t, method, params, result)
+	if !errors.Is(err, errSessionLost) {
+		return err
+	}
+	t, err = c.reconnect(ctx, t)
+	if err != nil {
+		return err
+	}
+	return c.roundTrip(ctx, t, method, params, result)
+}
+
+func (c *Client) roundTrip(ctx context.Context, t transport, method string, params any, result any) error {
+	id := c.nextID.Add(1)
+	resp, err := t.call(ctx, request{JSONRPC: "2.0", ID: &id, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if err := json.Unmarshal(resp.Result, result); err != nil {
+		return fmt.Errorf("decode %s result: %w", method, err)
+	}
+	return nil
+}
+
+// responseID returns the id of a response to one of our requests, which are
+// always numbered.
+func responseID(msg *message) (int64, bool) {
+	if len(msg.ID) == 0 || msg.Method != "" {
+		return 0, false
+	}
+	var id int64
+	if err := json.Unmarshal(msg.ID, &id); err != nil {
+		return 0, false
+	}
+	return id, true
+}
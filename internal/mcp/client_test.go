@@ -0,0 +1,321 @@
+package mcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testServerEnv = "TG_GPT_MCP_TEST_SERVER"
+
+// answer is the tiny MCP server used by the tests: two pages of tools, an echo
+// tool, a tool that reports an error and one that never answers.
+func answer(method string, params json.RawMessage) (any, *RPCError) {
+	switch method {
+	case "initialize":
+		return map[string]any{
+			"protocolVersion": "2025-03-26",
+			"capabilities":    map[string]any{"tools": map[string]any{}},
+			"serverInfo":      map[string]any{"name": "test-server", "version": "0.1"},
+		}, nil
+	case "tools/list":
+		var p struct {
+			Cursor string `json:"cursor"`
+		}
+		json.Unmarshal(params, &p)
+		if p.Cursor == "" {
+			return map[string]any{
+				"tools": []map[string]any{{
+					"name":        "echo",
+					"description": "Echoes the text",
+					"inputSchema": map[string]any{"type": "object", "properties": map[string]any{"text": map[string]any{"type": "string"}}},
+				}},
+				"nextCursor": "page-2",
+			}, nil
+		}
+		return map[string]any{"tools": []map[string]any{{"name": "fail"}, {"name": "hang"}}}, nil
+	case "tools/call":
+		var p struct {
+			Name      string `json:"name"`
+			Arguments struct {
+				Text string `json:"text"`
+			} `json:"arguments"`
+		}
+		json.Unmarshal(params, &p)
+		switch p.Name {
+		case "echo":
+			return map[string]any{"content": []map[string]any{{"type": "text", "text": "echo: " + p.Arguments.Text}}}, nil
+		case "fail":
+			return map[string]any{"content": []map[string]any{{"type": "text", "text": "boom"}}, "isError": true}, nil
+		}
+		return nil, &RPCError{Code: -32602, Message: "unknown tool " + p.Name}
+	}
+	return nil, &RPCError{Code: -32601, Message: "method not found"}
+}
+
+// TestMain turns the test binary into a stdio MCP server when a test starts it
+// as a subprocess.
+func TestMain(m *testing.M) {
+	if os.Getenv(testServerEnv) == "1" {
+		serveStdio()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func serveStdio() {
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var msg message
+		if err := json.Unmarshal(line, &msg); err != nil || len(msg.ID) == 0 {
+			continue
+		}
+		if msg.Method == "tools/call" && string(msg.Params) != "" {
+			var p struct {
+				Name string `json:"name"`
+			}
+			json.Unmarshal(msg.Params, &p)
+			if p.Name == "hang" {
+				continue
+			}
+			if p.Name == "exit" {
+				// The server crashes in the middle of a call.
+				os.Exit(1)
+			}
+		}
+		result, rpcErr := answer(msg.Method, msg.Params)
+		reply, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": msg.ID, "result": result, "error": rpcErr})
+		// A notification first, which the client has to skip.
+		fmt.Println(`{"jsonrpc":"2.0","method":"notifications/message","params":{"level":"info","data":"working"}}`)
+		fmt.Println(string(reply))
+	}
+}
+
+func startStdioServer(t *testing.T) *Client {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := NewStdioClient(ctx, os.Args[0], nil, map[string]string{testServerEnv: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestStdioClientListsAndCallsTools(t *testing.T) {
+	client := startStdioServer(t)
+	ctx := context.Background()
+	if client.ServerName() != "test-server" {
+		t.Fatalf("server name: %q", client.ServerName())
+	}
+
+	tools, err := client.ListTools(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tools) != 3 || tools[0].Name != "echo" || tools[0].InputSchema["type"] != "object" || tools[2].Name != "hang" {
+		t.Fatalf("tools: %#v", tools)
+	}
+
+	result, err := client.CallTool(ctx, "echo", json.RawMessage(`{"text":"hi"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.IsError || result.Text() != "echo: hi" {
+		t.Fatalf("echo result: %#v", result)
+	}
+
+	result, err = client.CallTool(ctx, "fail", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.IsError || result.Text() != "boom" {
+		t.Fatalf("fail result: %#v", result)
+	}
+
+	_, err = client.CallTool(ctx, "missing", nil)
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != -32602 {
+		t.Fatalf("missing tool error: %v", err)
+	}
+}
+
+func TestStdioClientCallTimesOut(t *testing.T) {
+	client := startStdioServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := client.CallTool(ctx, "hang", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("hang: %v", err)
+	}
+	// The connection stays usable.
+	result, err := client.CallTool(context.Background(), "echo", json.RawMessage(`{"text":"still here"}`))
+	if err != nil || result.Text() != "echo: still here" {
+		t.Fatalf("echo after timeout: %#v %v", result, err)
+	}
+}
+
+func TestStdioClientRestartsExitedServer(t *testing.T) {
+	client := startStdioServer(t)
+	ctx := context.Background()
+
+	// The call the server died on is not repeated: it may have done something.
+	if _, err := client.CallTool(ctx, "exit", nil); err == nil {
+		t.Fatal("call to a crashing server must fail")
+	}
+	result, err := client.CallTool(ctx, "echo", json.RawMessage(`{"text":"back again"}`))
+	if err != nil || result.Text() != "echo: back again" {
+		t.Fatalf("echo after restart: %#v %v", result, err)
+	}
+}
+
+func TestHTTPClientStartsNewSessionWhenServerForgetsIt(t *testing.T) {
+	var mu sync.Mutex
+	sessions := 0
+	live := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodDelete {
+			return
+		}
+		var msg message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if msg.Method == "initialize" {
+			sessions++
+			live = fmt.Sprintf("session-%d", sessions)
+			w.Header().Set(sessionIDHeader, live)
+		} else if r.Header.Get(sessionIDHeader) != live {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if len(msg.ID) == 0 {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		result, rpcErr := answer(msg.Method, msg.Params)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": msg.ID, "result": result, "error": rpcErr})
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	client, err := NewHTTPClient(ctx, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	mu.Lock()
+	live = "" // The server restarts and forgets session-1.
+	mu.Unlock()
+	result, err := client.CallTool(ctx, "echo", json.RawMessage(`{"text":"new session"}`))
+	if err != nil || result.Text() != "echo: new session" {
+		t.Fatalf("echo: %#v %v", result, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if sessions != 2 || live != "session-2" {
+		t.Fatalf("sessions: %d, live %q", sessions, live)
+	}
+}
+
+func TestHTTPClientKeepsSessionAndReadsEventStreams(t *testing.T) {
+	var sessions []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			sessions = append(sessions, "deleted "+r.Header.Get(sessionIDHeader))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var msg message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if msg.Method == "initialize" {
+			w.Header().Set(sessionIDHeader, "session-1")
+		} else {
+			sessions = append(sessions, r.Header.Get(sessionIDHeader)+" "+r.Header.Get(protocolVersionHeader))
+		}
+		if len(msg.ID) == 0 {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		result, rpcErr := answer(msg.Method, msg.Params)
+		reply, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": msg.ID, "result": result, "error": rpcErr})
+		if msg.Method != "tools/call" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(reply)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: message\ndata: {\"jsonrpc\":\"2.0\",\"method\":\"notifications/progress\",\"params\":{}}\n\n")
+		fmt.Fprintf(w, "event: message\ndata: %s\n\n", reply)
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	client, err := NewHTTPClient(ctx, server.URL, map[string]string{"Authorization": "Bearer secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools, err := client.ListTools(ctx)
+	if err != nil || len(tools) != 3 {
+		t.Fatalf("tools: %#v %v", tools, err)
+	}
+	result, err := client.CallTool(ctx, "echo", json.RawMessage(`{"text":"over http"}`))
+	if err != nil || result.Text() != "echo: over http" {
+		t.Fatalf("echo: %#v %v", result, err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"session-1 2025-03-26", // notifications/initialized
+		"session-1 2025-03-26", // tools/list, first page
+		"session-1 2025-03-26", // tools/list, second page
+		"session-1 2025-03-26", // tools/call
+		"deleted session-1",
+	}
+	if fmt.Sprint(sessions) != fmt.Sprint(want) {
+		t.Fatalf("requests: %q, want %q", sessions, want)
+	}
+}
+
+func TestCallToolResultText(t *testing.T) {
+	result := CallToolResult{Content: []Content{
+		{Type: "text", Text: "first"},
+		{Type: "image", Data: "aGk=", MimeType: "image/png"},
+		{Type: "resource", Resource: &ResourceContents{URI: "file:///a.txt", Text: "file body"}},
+		{Type: "resource_link", URI: "file:///b.txt"},
+	}}
+	want := "first\n[image content omitted: image/png]\nfile body\n[resource file:///b.txt]"
+	if got := result.Text(); got != want {
+		t.Fatalf("text: %q", got)
+	}
+
+	structured := CallToolResult{StructuredContent: json.RawMessage(`{"temperature":21}`)}
+	if got := structured.Text(); got != `{"temperature":21}` {
+		t.Fatalf("structured text: %q", got)
+	}
+}
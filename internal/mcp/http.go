@@ -0,0 +1,179 @@
+package mcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	sessionIDHeader       = "Mcp-Session-Id"
+	protocolVersionHeader = "MCP-Protocol-Version"
+)
+
+// NewHTTPClient connects to an MCP server over the streamable HTTP transport at
+// url. headers are sent with every request, e.g. for authorization. When the
+// server no longer knows the session a new one is started.
+func NewHTTPClient(ctx context.Context, url string, headers map[string]string) (*Client, error) {
+	return newClient(ctx, func() (transport, error) {
+		return &httpTransport{
+			url:     url,
+			headers: headers,
+			client:  http.DefaultClient,
+		}, nil
+	})
+}
+
+// httpTransport posts every message to the server's endpoint and reads the
+// response either as JSON or from an event stream.
+type httpTransport struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+
+	mu              sync.Mutex
+	sessionID       string
+	protocolVersion string
+}
+
+func (t *httpTransport) call(ctx context.Context, req request) (*message, error) {
+	resp, err := t.post(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if sessionID := resp.Header.Get(sessionIDHeader); sessionID != "" && req.Method == "initialize" {
+		t.mu.Lock()
+		t.sessionID = sessionID
+		t.mu.Unlock()
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/event-stream" {
+		return readEventStream(resp.Body, *req.ID)
+	}
+	var msg message
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return &msg, nil
+}
+
+func (t *httpTransport) notify(ctx context.Context, req request) error {
+	resp, err := t.post(ctx, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (t *httpTransport) initialized(protocolVersion string) {
+	t.mu.Lock()
+	t.protocolVersion = protocolVersion
+	t.mu.Unlock()
+}
+
+// close ends the session. Servers that do not support ending sessions answer 405,
+// which is fine.
+func (t *httpTransport) close() error {
+	t.mu.Lock()
+	sessionID := t.sessionID
+	t.mu.Unlock()
+	if sessionID == "" {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodDelete, t.url, nil)
+	if err != nil {
+		return err
+	}
+	t.setHeaders(req)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (t *httpTransport) post(ctx context.Context, msg request) (*http.Response, error) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	t.setHeaders(req)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("mcp request: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound && req.Header.Get(sessionIDHeader) != "" {
+		// The server ended the session; the spec has the client start a new one.
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: server does not know session %s", errSessionLost, req.Header.Get(sessionIDHeader))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("mcp server: status %d: %s", resp.StatusCode, strings.TrimSpace(string(text)))
+	}
+	return resp, nil
+}
+
+func (t *httpTransport) setHeaders(req *http.Request) {
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sessionID != "" {
+		req.Header.Set(sessionIDHeader, t.sessionID)
+	}
+	if t.protocolVersion != "" {
+		req.Header.Set(protocolVersionHeader, t.protocolVersion)
+	}
+}
+
+// readEventStream reads server-sent events until the response to request id
+// arrives. Other messages on the stream, like progress notifications, are skipped.
+func readEventStream(body io.Reader, id int64) (*message, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		if value, ok := strings.CutPrefix(line, "data:"); ok {
+			data.WriteString(strings.TrimPrefix(value, " "))
+			data.WriteByte('\n')
+			continue
+		}
+		if line != "" || data.Len() == 0 {
+			continue
+		}
+		var msg message
+		err := json.Unmarshal([]byte(data.String()), &msg)
+		data.Reset()
+		if err != nil {
+			return nil, fmt.Errorf("decode event: %w", err)
+		}
+		if got, ok := responseID(&msg); ok && got == id {
+			return &msg, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read event stream: %w", err)
+	}
+	return nil, fmt.Errorf("event stream ended without a response")
+}
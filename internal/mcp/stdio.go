@@ -0,0 +1,207 @@
+package mcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// stdioShutdownGrace is how long a server gets to exit after its stdin is closed
+// before it is killed.
+const stdioShutdownGrace = 2 * time.Second
+
+// NewStdioClient starts command as a subprocess and connects to the MCP server it
+// runs over its stdin and stdout. env is added to the bot's own environment; the
+// server's stderr goes to the log. A server that exits is started again on the
+// next request.
+func NewStdioClient(ctx context.Context, command string, args []string, env map[string]string) (*Client, error) {
+	return newClient(ctx, func() (transport, error) {
+		return startStdio(command, args, env)
+	})
+}
+
+func startStdio(command string, args []string, env map[string]string) (*stdioTransport, error) {
+	cmd := exec.Command(command, args...)
+	cmd.Env = os.Environ()
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start %s: %w", command, err)
+	}
+
+	t := &stdioTransport{
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: make(map[int64]chan *message),
+		done:    make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+	go t.readLoop(stdout)
+	go logStderr(command, stderr)
+	go func() {
+		// Wait closes the pipes, so it has to wait for the reader to finish.
+		<-t.done
+		cmd.Wait()
+		close(t.exited)
+	}()
+	return t, nil
+}
+
+// stdioTransport speaks newline-delimited JSON-RPC with a subprocess.
+type stdioTransport struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[int64]chan *message
+	// done is closed once the server's stdout ends; readErr tells why.
+	done    chan struct{}
+	readErr error
+	// exited is closed once the process is gone.
+	exited chan struct{}
+}
+
+func (t *stdioTransport) call(ctx context.Context, req request) (*message, error) {
+	select {
+	case <-t.done:
+		return nil, fmt.Errorf("%w: server exited: %v", errSessionLost, t.readErr)
+	default:
+	}
+	ch := make(chan *message, 1)
+	t.mu.Lock()
+	t.pending[*req.ID] = ch
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, *req.ID)
+		t.mu.Unlock()
+	}()
+
+	if err := t.write(req); err != nil {
+		return nil, fmt.Errorf("%w: %v", errSessionLost, err)
+	}
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-t.done:
+		// The request may have been carried out, so it is not sent again.
+		return nil, fmt.Errorf("server closed the connection: %w", t.readErr)
+	case <-ctx.Done():
+		// Let the server stop working on a request nobody waits for anymore.
+		t.write(request{
+			JSONRPC: "2.0",
+			Method:  "notifications/cancelled",
+			Params:  map[string]any{"requestId": *req.ID, "reason": ctx.Err().Error()},
+		})
+		return nil, ctx.Err()
+	}
+}
+
+func (t *stdioTransport) notify(ctx context.Context, req request) error {
+	return t.write(req)
+}
+
+func (t *stdioTransport) initialized(string) {}
+
+func (t *stdioTransport) write(msg any) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if _, err := t.stdin.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("write to server: %w", err)
+	}
+	return nil
+}
+
+func (t *stdioTransport) readLoop(stdout io.Reader) {
+	reader := bufio.NewReader(stdout)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			t.handle(line)
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			t.readErr = err
+			close(t.done)
+			return
+		}
+	}
+}
+
+func (t *stdioTransport) handle(line []byte) {
+	var msg message
+	if err := json.Unmarshal(line, &msg); err != nil {
+		slog.Warn("Ignoring malformed MCP message", "error", err)
+		return
+	}
+	if id, ok := responseID(&msg); ok {
+		t.mu.Lock()
+		ch := t.pending[id]
+		t.mu.Unlock()
+		if ch != nil {
+			ch <- &msg
+		}
+		return
+	}
+	if msg.Method == "" || len(msg.ID) == 0 {
+		// Notifications such as progress or log messages are not used.
+		return
+	}
+	// The client declares no capabilities, so the only server request it answers
+	// is ping.
+	reply := map[string]any{"jsonrpc": "2.0", "id": msg.ID}
+	if msg.Method == "ping" {
+		reply["result"] = map[string]any{}
+	} else {
+		reply["error"] = RPCError{Code: -32601, Message: "method not found"}
+	}
+	if err := t.write(reply); err != nil {
+		slog.Warn("Error answering MCP server request", "method", msg.Method, "error", err)
+	}
+}
+
+func (t *stdioTransport) close() error {
+	t.stdin.Close()
+	select {
+	case <-t.exited:
+	case <-time.After(stdioShutdownGrace):
+		t.cmd.Process.Kill()
+		<-t.exited
+	}
+	return nil
+}
+
+func logStderr(command string, stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		slog.Info("MCP server stderr", "command", command, "line", scanner.Text())
+	}
+}
@@ -0,0 +1,20 @@
+package middleware
+
+import (
+	tele "gopkg.in/telebot.v3"
+	"vadimgribanov.com/tg-gpt/internal/models"
+)
+
+// AdminOnly lets through only users with the admin role. It must run after
+// UserAuthenticator.
+func AdminOnly() tele.MiddlewareFunc {
+	return func(next tele.HandlerFunc) tele.HandlerFunc {
+		return func(c tele.Context) error {
+			user, ok := c.Get("user").(models.User)
+			if !ok || !user.IsAdmin() {
+				return c.Send("This command is only available to administrators.")
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	tele "gopkg.in/telebot.v3"
+	"vadimgribanov.com/tg-gpt/internal/models"
+)
+
+// newFakeTelegramBot returns a bot whose API calls are answered with a message
+// and recorded as their JSON payloads.
+func newFakeTelegramBot(t *testing.T) (*tele.Bot, func() []map[string]any) {
+	t.Helper()
+	var mu sync.Mutex
+	var calls []map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		calls = append(calls, payload)
+		mu.Unlock()
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":1,"date":0,"chat":{"id":1}}}`))
+	}))
+	t.Cleanup(server.Close)
+	bot, err := tele.NewBot(tele.Settings{URL: server.URL, Token: "test", Offline: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bot, func() []map[string]any {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]map[string]any(nil), calls...)
+	}
+}
+
+func TestAdminOnlyRejectsNonAdmins(t *testing.T) {
+	bot, calls := newFakeTelegramBot(t)
+	sent := func() []string {
+		var texts []string
+		for _, call := range calls() {
+			text, _ := call["text"].(string)
+			texts = append(texts, text)
+		}
+		return texts
+	}
+
+	called := 0
+	handler := AdminOnly()(func(tele.Context) error {
+		called++
+		return nil
+	})
+	run := func(user *models.User) error {
+		c := bot.NewContext(tele.Update{Message: &tele.Message{ID: 1, Text: "/admin", Chat: &tele.Chat{ID: 1}}})
+		if user != nil {
+			c.Set("user", *user)
+		}
+		return handler(c)
+	}
+
+	for _, user := range []*models.User{nil, {Id: 1, Role: models.UserRoleUser}} {
+		if err := run(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if called != 0 || len(sent()) != 2 || sent()[0] != "This command is only available to administrators." {
+		t.Fatalf("non-admins must be turned away: called=%d sent=%q", called, sent())
+	}
+
+	if err := run(&models.User{Id: 1, Role: models.UserRoleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	if called != 1 || len(sent()) != 2 {
+		t.Fatalf("admins must get through: called=%d sent=%q", called, sent())
+	}
+}
@@ -13,37 +13,56 @@ import (
 
 type UserRepo interface {
 	Register(int64, string, string, string, int64, bool, string) (models.User, error)
+	RegisterGroup(int64, string, string) (models.User, error)
 	CheckIfUserExists(int64) bool
 	GetUser(int64) (models.User, error)
+	PromoteAdmins([]int64) error
 }
 
 type UserAuthenticator struct {
 	UserRepo       UserRepo
 	AllowedUserIds []int64
+	AdminUserIds   []int64
 	AppConfig      config.Config
+	// OnPendingUser is called once for every new user who is not allowed up front,
+	// so admins can approve them.
+	OnPendingUser func(ctx context.Context, user models.User)
 }
 
 func (u *UserAuthenticator) Middleware() tele.MiddlewareFunc {
 	return func(next tele.HandlerFunc) tele.HandlerFunc {
 		return func(c tele.Context) error {
 			ctx := c.Get("requestContext").(context.Context)
+			if IsGroupChat(c) {
+				return u.authenticateGroup(c, next)
+			}
 
 			var user models.User
+			pending := false
 			if !u.UserRepo.CheckIfUserExists(c.Sender().ID) {
 				userId := c.Sender().ID
 				firstName := c.Sender().FirstName
 				lastName := c.Sender().LastName
 				username := c.Sender().Username
-				chatId := c.Update().Message.Chat.ID
+				// A private chat's id is the user's id, whichever chat the first update came from.
+				chatId := c.Sender().ID
+				isAdmin := slices.Contains(u.AdminUserIds, userId)
 				user, _ = u.UserRepo.Register(
 					userId,
 					firstName,
 					lastName,
 					username,
 					chatId,
-					slices.Contains(u.AllowedUserIds, userId),
+					isAdmin || slices.Contains(u.AllowedUserIds, userId),
 					u.AppConfig.DefaultModel.ModelId,
 				)
+				if isAdmin {
+					if err := u.UserRepo.PromoteAdmins([]int64{userId}); err != nil {
+						slog.ErrorContext(ctx, "Error promoting admin", "error", err)
+					}
+					user.Role = models.UserRoleAdmin
+				}
+				pending = !user.Active
 			} else {
 				user, _ = u.UserRepo.GetUser(c.Sender().ID)
 			}
@@ -54,6 +73,11 @@ func (u *UserAuthenticator) Middleware() tele.MiddlewareFunc {
 				c.Set("requestContext", ctx)
 				return next(c)
 			}
+			if pending && u.OnPendingUser != nil {
+				u.OnPendingUser(ctx, user)
+				c.Send("Your access request has been sent to the administrators.")
+				return nil
+			}
 			c.Send("You are not registered. Please contact the administrator.")
 			return nil
 		}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+
+	tele "gopkg.in/telebot.v3"
+	"vadimgribanov.com/tg-gpt/internal/models"
+)
+
+type ThreadRepo interface {
+	ApplyThread(user models.User, threadID int64) (models.User, error)
+}
+
+// ForumTopics gives every forum topic its own dialog: the context user is switched
+// to the topic's dialog and replies sent with c.Send stay in the topic. It must
+// run after UserAuthenticator.
+func ForumTopics(repo ThreadRepo) tele.MiddlewareFunc {
+	return func(next tele.HandlerFunc) tele.HandlerFunc {
+		return func(c tele.Context) error {
+			msg := c.Message()
+			user, ok := c.Get("user").(models.User)
+			if msg == nil || !msg.TopicMessage || msg.ThreadID == 0 || !ok {
+				return next(c)
+			}
+			ctx := c.Get("requestContext").(context.Context)
+			user, err := repo.ApplyThread(user, int64(msg.ThreadID))
+			if err != nil {
+				slog.ErrorContext(ctx, "Error resolving topic dialog", "error", err, "thread_id", msg.ThreadID)
+				return err
+			}
+			c.Set("user", user)
+			c.Set("requestContext", context.WithValue(ctx, "thread_id", user.ThreadID))
+			return next(&threadContext{Context: c, threadID: msg.ThreadID})
+		}
+	}
+}
+
+// threadContext sends into the topic of the update; telebot's Send would post to
+// the chat's general topic instead.
+type threadContext struct {
+	tele.Context
+	threadID int
+}
+
+func (c *threadContext) Send(what interface{}, opts ...interface{}) error {
+	_, err := c.Bot().Send(c.Recipient(), what, withThread(opts, c.threadID)...)
+	return err
+}
+
+func withThread(opts []interface{}, threadID int) []interface{} {
+	for i, opt := range opts {
+		if sendOpts, ok := opt.(*tele.SendOptions); ok && sendOpts != nil {
+			withThread := *sendOpts
+			withThread.ThreadID = threadID
+			out := append([]interface{}{}, opts...)
+			out[i] = &withThread
+			return out
+		}
+	}
+	// Later options refine this one, so it has to come first.
+	return append([]interface{}{&tele.SendOptions{ThreadID: threadID}}, opts...)
+}
@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	tele "gopkg.in/telebot.v3"
+	"vadimgribanov.com/tg-gpt/internal/models"
+)
+
+type fakeThreadRepo map[int64]int64
+
+func (r fakeThreadRepo) ApplyThread(user models.User, threadID int64) (models.User, error) {
+	user.ThreadID = threadID
+	user.CurrentDialogId = r[threadID]
+	return user, nil
+}
+
+func TestForumTopicsSwitchesDialogAndRepliesInTopic(t *testing.T) {
+	bot, calls := newFakeTelegramBot(t)
+	var seen models.User
+	handler := ForumTopics(fakeThreadRepo{7: 42})(func(c tele.Context) error {
+		seen = c.Get("user").(models.User)
+		return c.Send("hi")
+	})
+	run := func(msg *tele.Message) {
+		t.Helper()
+		c := bot.NewContext(tele.Update{Message: msg})
+		c.Set("requestContext", context.Background())
+		c.Set("user", models.User{Id: -1001, CurrentDialogId: 3})
+		if err := handler(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run(&tele.Message{ID: 1, TopicMessage: true, ThreadID: 7, Chat: &tele.Chat{ID: -1001}})
+	if seen.ThreadID != 7 || seen.CurrentDialogId != 42 {
+		t.Fatalf("topic user: %#v", seen)
+	}
+	if thread := calls()[0]["message_thread_id"]; fmt.Sprint(thread) != "7" {
+		t.Fatalf("reply must stay in the topic: %v", calls()[0])
+	}
+
+	run(&tele.Message{ID: 2, Chat: &tele.Chat{ID: -1001}})
+	if seen.ThreadID != 0 || seen.CurrentDialogId != 3 {
+		t.Fatalf("general chat user: %#v", seen)
+	}
+	if _, ok := calls()[1]["message_thread_id"]; ok {
+		t.Fatalf("general chat reply must not name a topic: %v", calls()[1])
+	}
+}
@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	tele "gopkg.in/telebot.v3"
+	"vadimgribanov.com/tg-gpt/internal/config"
+	"vadimgribanov.com/tg-gpt/internal/models"
+)
+
+// IsGroupChat reports whether the update comes from a group or supergroup.
+func IsGroupChat(c tele.Context) bool {
+	chat := c.Chat()
+	return chat != nil && (chat.Type == tele.ChatGroup || chat.Type == tele.ChatSuperGroup)
+}
+
+// AddressesBot reports whether a group message is meant for the bot: it mentions
+// the bot, replies to one of its messages, is a command or presses its button.
+func AddressesBot(c tele.Context) bool {
+	if c.Callback() != nil {
+		return true
+	}
+	msg := c.Message()
+	if msg == nil {
+		return false
+	}
+	me := c.Bot().Me
+	if msg.ReplyTo != nil && msg.ReplyTo.Sender != nil && msg.ReplyTo.Sender.ID == me.ID {
+		return true
+	}
+	entities := append(append(tele.Entities{}, msg.Entities...), msg.CaptionEntities...)
+	for _, entity := range entities {
+		switch entity.Type {
+		case tele.EntityCommand:
+			return true
+		case tele.EntityMention:
+			if strings.EqualFold(msg.EntityText(entity), "@"+me.Username) {
+				return true
+			}
+		case tele.EntityTMention:
+			if entity.User != nil && entity.User.ID == me.ID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isAlbumItem reports whether msg is a photo or file of a media group, which the
+// bot answers as one message.
+func isAlbumItem(msg *tele.Message) bool {
+	return msg != nil && msg.AlbumID != "" && (msg.Photo != nil || msg.Document != nil)
+}
+
+// authenticateGroup resolves a group message to the group's shared account, set as
+// "user", and the member who wrote it, set as "speaker". Messages that do not
+// address the bot are dropped silently, except album items: only one of them
+// carries the caption, so the album is dropped once collected if none addressed
+// the bot.
+func (u *UserAuthenticator) authenticateGroup(c tele.Context, next tele.HandlerFunc) error {
+	ctx := c.Get("requestContext").(context.Context)
+	addressed := AddressesBot(c)
+	if !addressed && !isAlbumItem(c.Message()) {
+		return nil
+	}
+	chat := c.Chat()
+	access := u.AppConfig.Groups.Access(chat.ID)
+	if access != config.GroupAccessMembers && access != config.GroupAccessEveryone {
+		slog.DebugContext(ctx, "Ignoring group without access", "chat_id", chat.ID, "access", access)
+		return nil
+	}
+
+	var speaker models.User
+	if u.UserRepo.CheckIfUserExists(c.Sender().ID) {
+		speaker, _ = u.UserRepo.GetUser(c.Sender().ID)
+	} else if access == config.GroupAccessEveryone {
+		// Members need an account for their own memory. Talking in an open group
+		// does not grant private access, so they start inactive.
+		var err error
+		speaker, err = u.UserRepo.Register(
+			c.Sender().ID,
+			c.Sender().FirstName,
+			c.Sender().LastName,
+			c.Sender().Username,
+			c.Sender().ID,
+			false,
+			u.AppConfig.DefaultModel.ModelId,
+		)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error registering group member", "error", err)
+			return nil
+		}
+	}
+	if speaker.Id == 0 || (!speaker.Active && access != config.GroupAccessEveryone) {
+		if !addressed {
+			return nil
+		}
+		return c.Reply("Only approved users can talk to me in this group.")
+	}
+
+	var group models.User
+	if u.UserRepo.CheckIfUserExists(chat.ID) {
+		group, _ = u.UserRepo.GetUser(chat.ID)
+	} else {
+		var err error
+		group, err = u.UserRepo.RegisterGroup(chat.ID, chat.Title, u.AppConfig.DefaultModel.ModelId)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error registering group", "error", err)
+			return nil
+		}
+	}
+	if !group.Active {
+		slog.DebugContext(ctx, "Ignoring blocked group", "chat_id", chat.ID)
+		return nil
+	}
+
+	slog.DebugContext(ctx, "Group member authenticated", "group", group.Id, "speaker", speaker.Id)
+	c.Set("user", group)
+	c.Set("speaker", speaker)
+	ctx = context.WithValue(ctx, "user_id", group.Id)
+	ctx = context.WithValue(ctx, "speaker_id", speaker.Id)
+	c.Set("requestContext", ctx)
+	return next(c)
+}
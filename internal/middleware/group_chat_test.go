@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+
+	tele "gopkg.in/telebot.v3"
+	"vadimgribanov.com/tg-gpt/internal/config"
+	"vadimgribanov.com/tg-gpt/internal/models"
+)
+
+type fakeUserRepo map[int64]models.User
+
+func (r fakeUserRepo) Register(id int64, firstName, lastName, username string, chatID int64, active bool, model string) (models.User, error) {
+	r[id] = models.User{Id: id, FirstName: firstName, ChatId: chatID, Active: active}
+	return r[id], nil
+}
+
+func (r fakeUserRepo) RegisterGroup(chatID int64, title, model string) (models.User, error) {
+	r[chatID] = models.User{Id: chatID, ChatId: chatID, Active: true, IsGroup: true}
+	return r[chatID], nil
+}
+
+func (r fakeUserRepo) CheckIfUserExists(id int64) bool {
+	_, ok := r[id]
+	return ok
+}
+
+func (r fakeUserRepo) GetUser(id int64) (models.User, error) {
+	return r[id], nil
+}
+
+func (r fakeUserRepo) PromoteAdmins([]int64) error {
+	return nil
+}
+
+func TestGroupAlbumItemsReachHandlersWithoutMention(t *testing.T) {
+	bot, calls := newFakeTelegramBot(t)
+	auth := &UserAuthenticator{
+		UserRepo:  fakeUserRepo{5: {Id: 5, Active: true}, 6: {Id: 6}},
+		AppConfig: config.Config{Groups: config.GroupConfig{Default: config.GroupAccessMembers}},
+	}
+	var handled []int
+	handler := auth.Middleware()(func(c tele.Context) error {
+		handled = append(handled, c.Message().ID)
+		return nil
+	})
+	run := func(msg *tele.Message) {
+		t.Helper()
+		msg.Chat = &tele.Chat{ID: -1001, Type: tele.ChatSuperGroup}
+		c := bot.NewContext(tele.Update{Message: msg})
+		c.Set("requestContext", context.Background())
+		if err := handler(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run(&tele.Message{ID: 1, Text: "hello everyone", Sender: &tele.User{ID: 5}})
+	run(&tele.Message{ID: 2, AlbumID: "album", Photo: &tele.Photo{}, Sender: &tele.User{ID: 5}})
+	run(&tele.Message{ID: 3, AlbumID: "album", Document: &tele.Document{}, Sender: &tele.User{ID: 5}})
+	// Members who may not talk to the bot are not told so for every album item.
+	run(&tele.Message{ID: 4, AlbumID: "other", Photo: &tele.Photo{}, Sender: &tele.User{ID: 6}})
+
+	if len(handled) != 2 || handled[0] != 2 || handled[1] != 3 {
+		t.Fatalf("handled messages: %v", handled)
+	}
+	if sent := calls(); len(sent) != 0 {
+		t.Fatalf("unaddressed messages must get no reply: %v", sent)
+	}
+}
@@ -0,0 +1,10 @@
+package models
+
+// Blob is stored content, such as an image the user sent, addressed by the SHA-256
+// hash of its bytes.
+type Blob struct {
+	Hash      string
+	MediaType string
+	Data      []byte
+	CreatedAt int64
+}
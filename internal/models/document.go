@@ -0,0 +1,23 @@
+package models
+
+// Document is a file the user uploaded into their knowledge base.
+type Document struct {
+	ID         int64
+	UserID     int64
+	Name       string
+	MimeType   string
+	ChunkCount int64
+	CreatedAt  int64
+}
+
+type DocumentChunk struct {
+	ID             int64
+	DocumentID     int64
+	UserID         int64
+	ChunkIndex     int64
+	Content        string
+	Embedding      []float32
+	EmbeddingModel string
+	// DocumentName is the name of the document the chunk belongs to.
+	DocumentName string
+}
@@ -22,7 +22,9 @@ type TraceEvent struct {
 	Payload     json.RawMessage
 	TgMessageID *int64
 	Model       string
-	CreatedAt   int64
+	// SpeakerID is the group member who wrote a user_msg; zero in private chats.
+	SpeakerID int64
+	CreatedAt int64
 }
 
 type UserMsgPayload struct {
@@ -33,6 +35,11 @@ type UserMsgPayload struct {
 type ModelMsgPayload struct {
 	Content   string         `json:"content"`
 	ToolCalls []llm.ToolCall `json:"tool_calls,omitempty"`
+	// FallbackFrom is the requested model when a fallback model answered instead.
+	FallbackFrom string `json:"fallback_from,omitempty"`
+	// TgMessageIDs are the Telegram messages a long answer was split into, in
+	// order; the event's TgMessageID is the last of them.
+	TgMessageIDs []int64 `json:"tg_message_ids,omitempty"`
 }
 
 type ToolResultPayload struct {
@@ -0,0 +1,26 @@
+package models
+
+type UsageEntry struct {
+	ID                int64
+	UserID            int64
+	DialogID          int64
+	Model             string
+	InputTokens       int64
+	OutputTokens      int64
+	CachedInputTokens int64
+	CostUSD           float64
+	// TranscribedSeconds is the length of speech transcribed, for speech-to-text
+	// entries.
+	TranscribedSeconds int64
+	CreatedAt          int64
+}
+
+// UsageSummary aggregates ledger entries for one model.
+type UsageSummary struct {
+	Model              string
+	InputTokens        int64
+	OutputTokens       int64
+	CachedInputTokens  int64
+	CostUSD            float64
+	TranscribedSeconds int64
+}
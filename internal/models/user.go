@@ -1,5 +1,10 @@
 package models
 
+const (
+	UserRoleUser  = "user"
+	UserRoleAdmin = "admin"
+)
+
 type User struct {
 	Id                   int64
 	FirstName            string
@@ -12,5 +17,16 @@ type User struct {
 	CurrentDialogId      int64
 	LastInteraction      int64
 	Active               bool
-	CurrentModel         string
+	Role                 string
+	// IsGroup marks the shared account of a group chat. Its id is the group's chat
+	// id, and it owns the group's dialog, model and budget.
+	IsGroup      bool
+	CurrentModel string
+	// ThreadID is the forum topic of the current update. It is not stored on the
+	// user: when set, CurrentDialogId and LastInteraction are the topic's.
+	ThreadID int64
+}
+
+func (u User) IsAdmin() bool {
+	return u.Role == UserRoleAdmin
 }
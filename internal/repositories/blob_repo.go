@@ -0,0 +1,157 @@
+package repositories
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"vadimgribanov.com/tg-gpt/internal/database"
+	"vadimgribanov.com/tg-gpt/internal/llm"
+	"vadimgribanov.com/tg-gpt/internal/models"
+)
+
+type BlobRepo struct {
+	db *database.DB
+}
+
+func NewBlobRepo(db *database.DB) *BlobRepo {
+	return &BlobRepo{db: db}
+}
+
+// Put stores data under its content hash and returns the hash. Storing the same
+// content again is a no-op.
+func (r *BlobRepo) Put(mediaType string, data []byte) (string, error) {
+	hash := llm.BlobHash(data)
+	_, err := r.db.Exec(
+		`INSERT OR IGNORE INTO blobs (hash, media_type, data, size) VALUES (?, ?, ?, ?)`,
+		hash, mediaType, data, len(data),
+	)
+	if err != nil {
+		return "", fmt.Errorf("insert blob: %w", err)
+	}
+	return hash, nil
+}
+
+func (r *BlobRepo) Get(hash string) (*models.Blob, error) {
+	var b models.Blob
+	err := r.db.QueryRow(
+		`SELECT hash, media_type, data, created_at FROM blobs WHERE hash = ?`, hash,
+	).Scan(&b.Hash, &b.MediaType, &b.Data, &b.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get blob: %w", err)
+	}
+	return &b, nil
+}
+
+// MigrateInlineImages moves base64 images of user messages recorded before the
+// blob store existed into blobs, leaving blob URLs in the trace and pending inputs.
+// It runs once per database.
+func (r *BlobRepo) MigrateInlineImages() error {
+	return r.db.RunOnce("inline_images_to_blobs", migrateInlineImagesTx)
+}
+
+func migrateInlineImagesTx(tx *sql.Tx) error {
+	tables := []struct {
+		name  string
+		where string
+		parts func(payload []byte) (any, []llm.ContentPart, error)
+	}{
+		{"trace_events", "event_type = 'user_msg'", func(payload []byte) (any, []llm.ContentPart, error) {
+			var p models.UserMsgPayload
+			err := json.Unmarshal(payload, &p)
+			return &p, p.MultiContent, err
+		}},
+		{"pending_user_inputs", "1 = 1", func(payload []byte) (any, []llm.ContentPart, error) {
+			var m llm.Message
+			err := json.Unmarshal(payload, &m)
+			return &m, m.Parts, err
+		}},
+	}
+	for _, table := range tables {
+		// Only ids are collected up front: the payloads are what makes these rows large.
+		ids, err := queryIDsTx(tx, `SELECT id FROM `+table.name+` WHERE `+table.where+` AND payload LIKE '%"data:%'`)
+		if err != nil {
+			return err
+		}
+		if len(ids) > 0 {
+			slog.Info("Moving inline images to blobs", "table", table.name, "rows", len(ids))
+		}
+		for _, id := range ids {
+			var payload string
+			if err := tx.QueryRow(`SELECT payload FROM `+table.name+` WHERE id = ?`, id).Scan(&payload); err != nil {
+				return err
+			}
+			decoded, parts, err := table.parts([]byte(payload))
+			if err != nil {
+				slog.Warn("Skipping unreadable payload", "table", table.name, "id", id, "error", err)
+				continue
+			}
+			changed, err := storeInlineImagesTx(tx, parts)
+			if err != nil {
+				return fmt.Errorf("%s %d: %w", table.name, id, err)
+			}
+			if !changed {
+				continue
+			}
+			updated, err := json.Marshal(decoded)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`UPDATE `+table.name+` SET payload = ? WHERE id = ?`, string(updated), id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// storeInlineImagesTx replaces the data URLs of parts in place with blob URLs.
+func storeInlineImagesTx(tx *sql.Tx, parts []llm.ContentPart) (bool, error) {
+	changed := false
+	for i, part := range parts {
+		if part.Type != llm.ContentPartImageURL {
+			continue
+		}
+		mediaType, encoded, ok := llm.ParseBase64DataURL(part.ImageURL)
+		if !ok {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return false, fmt.Errorf("decode image: %w", err)
+		}
+		hash := llm.BlobHash(data)
+		if _, err := tx.Exec(
+			`INSERT OR IGNORE INTO blobs (hash, media_type, data, size) VALUES (?, ?, ?, ?)`,
+			hash, mediaType, data, len(data),
+		); err != nil {
+			return false, fmt.Errorf("insert blob: %w", err)
+		}
+		parts[i].ImageURL = llm.BlobURL(hash)
+		changed = true
+	}
+	return changed, nil
+}
+
+func queryIDsTx(tx *sql.Tx, query string) ([]int64, error) {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,204 @@
+package repositories
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"vadimgribanov.com/tg-gpt/internal/database"
+	"vadimgribanov.com/tg-gpt/internal/models"
+	"vadimgribanov.com/tg-gpt/internal/vec"
+)
+
+type DocumentRepo struct {
+	db *database.DB
+}
+
+func NewDocumentRepo(db *database.DB) *DocumentRepo {
+	return &DocumentRepo{db: db}
+}
+
+type InsertDocumentInput struct {
+	UserID   int64
+	Name     string
+	MimeType string
+	// Chunks and Embeddings are parallel: Embeddings[i] belongs to Chunks[i].
+	Chunks         []string
+	Embeddings     [][]float32
+	EmbeddingModel string
+}
+
+// Insert stores a document together with all of its chunks.
+func (r *DocumentRepo) Insert(in InsertDocumentInput) (int64, error) {
+	if len(in.Chunks) != len(in.Embeddings) {
+		return 0, fmt.Errorf("insert document: %d chunks but %d embeddings", len(in.Chunks), len(in.Embeddings))
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		INSERT INTO documents (user_id, name, mime_type, chunk_count, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, in.UserID, in.Name, in.MimeType, len(in.Chunks), time.Now().Unix())
+	if err != nil {
+		return 0, fmt.Errorf("insert document: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	for i, chunk := range in.Chunks {
+		_, err := tx.Exec(`
+			INSERT INTO document_chunks (document_id, user_id, chunk_index, content, embedding, embedding_model)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, id, in.UserID, i, chunk, vec.Encode(in.Embeddings[i]), in.EmbeddingModel)
+		if err != nil {
+			return 0, fmt.Errorf("insert document chunk: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (r *DocumentRepo) List(userID int64) ([]models.Document, error) {
+	rows, err := r.db.Query(`
+		SELECT id, user_id, name, mime_type, chunk_count, created_at
+		FROM documents
+		WHERE user_id = ?
+		ORDER BY created_at DESC, id DESC
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("list documents: %w", err)
+	}
+	defer rows.Close()
+	var out []models.Document
+	for rows.Next() {
+		var d models.Document
+		if err := rows.Scan(&d.ID, &d.UserID, &d.Name, &d.MimeType, &d.ChunkCount, &d.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan document: %w", err)
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// Delete removes a document and its chunks if it belongs to the given user. Returns
+// an error if no row matched, so callers can surface "not found / unauthorized" to the LLM.
+func (r *DocumentRepo) Delete(id, userID int64) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM documents WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return fmt.Errorf("delete document: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("document not found or unauthorized")
+	}
+	if _, err := tx.Exec(`DELETE FROM document_chunks WHERE document_id = ?`, id); err != nil {
+		return fmt.Errorf("delete document chunks: %w", err)
+	}
+	return tx.Commit()
+}
+
+// ListChunks returns every chunk of a user's documents. Used by the vector branch of
+// retrieval, like EpisodeRepo.ListAll.
+func (r *DocumentRepo) ListChunks(userID int64) ([]models.DocumentChunk, error) {
+	rows, err := r.db.Query(`
+		SELECT c.id, c.document_id, c.user_id, c.chunk_index, c.content, c.embedding, c.embedding_model, d.name
+		FROM document_chunks c
+		JOIN documents d ON d.id = c.document_id
+		WHERE c.user_id = ?
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("list document chunks: %w", err)
+	}
+	defer rows.Close()
+	return scanDocumentChunks(rows)
+}
+
+func (r *DocumentRepo) SearchLexical(userID int64, query string, limit int) ([]int64, error) {
+	matchExpr := buildFTS5Query(query)
+	if matchExpr == "" {
+		return nil, nil
+	}
+	rows, err := r.db.Query(`
+		SELECT c.id
+		FROM document_chunks_fts fts
+		JOIN document_chunks c ON c.id = fts.rowid
+		WHERE document_chunks_fts MATCH ?
+		  AND c.user_id = ?
+		ORDER BY bm25(document_chunks_fts) ASC
+		LIMIT ?
+	`, matchExpr, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("fts document search: %w", err)
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (r *DocumentRepo) GetChunksByIDs(ids []int64) ([]models.DocumentChunk, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	placeholders := strings.Repeat("?,", len(ids))
+	placeholders = placeholders[:len(placeholders)-1]
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := r.db.Query(`
+		SELECT c.id, c.document_id, c.user_id, c.chunk_index, c.content, c.embedding, c.embedding_model, d.name
+		FROM document_chunks c
+		JOIN documents d ON d.id = c.document_id
+		WHERE c.id IN (`+placeholders+`)
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("get document chunks by ids: %w", err)
+	}
+	defer rows.Close()
+	return scanDocumentChunks(rows)
+}
+
+func scanDocumentChunks(rows *sql.Rows) ([]models.DocumentChunk, error) {
+	var out []models.DocumentChunk
+	for rows.Next() {
+		var c models.DocumentChunk
+		var embBytes []byte
+		if err := rows.Scan(
+			&c.ID, &c.DocumentID, &c.UserID, &c.ChunkIndex, &c.Content,
+			&embBytes, &c.EmbeddingModel, &c.DocumentName,
+		); err != nil {
+			return nil, fmt.Errorf("scan document chunk: %w", err)
+		}
+		emb, err := vec.Decode(embBytes)
+		if err != nil {
+			return nil, err
+		}
+		c.Embedding = emb
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
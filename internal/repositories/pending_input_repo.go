@@ -30,6 +30,7 @@ type PendingUserInput struct {
 	DialogID        int64
 	TgMessageID     int64
 	Message         llm.Message
+	SpeakerID       int64
 	Status          string
 	AttachedTraceID *int64
 	CreatedAt       int64
@@ -41,6 +42,8 @@ type InsertPendingInput struct {
 	DialogID    int64
 	TgMessageID int64
 	Message     llm.Message
+	// SpeakerID is the group member who sent the input; zero in private chats.
+	SpeakerID int64
 }
 
 func (r *PendingInputRepo) Insert(ctx context.Context, in InsertPendingInput) (int64, error) {
@@ -48,11 +51,15 @@ func (r *PendingInputRepo) Insert(ctx context.Context, in InsertPendingInput) (i
 	if err != nil {
 		return 0, fmt.Errorf("marshal pending input: %w", err)
 	}
+	var speakerID sql.NullInt64
+	if in.SpeakerID != 0 {
+		speakerID = sql.NullInt64{Int64: in.SpeakerID, Valid: true}
+	}
 	res, err := r.db.ExecContext(
 		ctx,
-		`INSERT INTO pending_user_inputs (user_id, dialog_id, tg_message_id, payload)
-		 VALUES (?, ?, ?, ?)`,
-		in.UserID, in.DialogID, in.TgMessageID, string(payload),
+		`INSERT INTO pending_user_inputs (user_id, dialog_id, tg_message_id, payload, speaker_id)
+		 VALUES (?, ?, ?, ?, ?)`,
+		in.UserID, in.DialogID, in.TgMessageID, string(payload), speakerID,
 	)
 	if err != nil {
 		return 0, fmt.Errorf("insert pending input: %w", err)
@@ -66,7 +73,7 @@ func (r *PendingInputRepo) ListPendingForDialog(ctx context.Context, userID, dia
 	}
 	rows, err := r.db.QueryContext(
 		ctx,
-		`SELECT id, user_id, dialog_id, tg_message_id, payload, status, attached_trace_id, created_at, updated_at
+		`SELECT id, user_id, dialog_id, tg_message_id, payload, speaker_id, status, attached_trace_id, created_at, updated_at
 		 FROM pending_user_inputs
 		 WHERE user_id = ? AND dialog_id = ? AND status = ?
 		 ORDER BY tg_message_id ASC, id ASC
@@ -85,7 +92,7 @@ func (r *PendingInputRepo) ListPendingForDialogTx(tx *sql.Tx, userID, dialogID i
 		limit = 100
 	}
 	rows, err := tx.Query(
-		`SELECT id, user_id, dialog_id, tg_message_id, payload, status, attached_trace_id, created_at, updated_at
+		`SELECT id, user_id, dialog_id, tg_message_id, payload, speaker_id, status, attached_trace_id, created_at, updated_at
 		 FROM pending_user_inputs
 		 WHERE user_id = ? AND dialog_id = ? AND status = ?
 		 ORDER BY tg_message_id ASC, id ASC
@@ -145,13 +152,14 @@ func scanPendingInputs(rows *sql.Rows) ([]PendingUserInput, error) {
 	for rows.Next() {
 		var input PendingUserInput
 		var payload string
-		var attachedTraceID sql.NullInt64
+		var attachedTraceID, speakerID sql.NullInt64
 		if err := rows.Scan(
 			&input.ID,
 			&input.UserID,
 			&input.DialogID,
 			&input.TgMessageID,
 			&payload,
+			&speakerID,
 			&input.Status,
 			&attachedTraceID,
 			&input.CreatedAt,
@@ -162,6 +170,7 @@ func scanPendingInputs(rows *sql.Rows) ([]PendingUserInput, error) {
 		if err := json.Unmarshal([]byte(payload), &input.Message); err != nil {
 			return nil, fmt.Errorf("parse pending input payload: %w", err)
 		}
+		input.SpeakerID = speakerID.Int64
 		if attachedTraceID.Valid {
 			v := attachedTraceID.Int64
 			input.AttachedTraceID = &v
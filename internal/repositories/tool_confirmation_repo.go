@@ -0,0 +1,194 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"vadimgribanov.com/tg-gpt/internal/database"
+)
+
+const (
+	ToolConfirmationPending   = "pending"
+	ToolConfirmationConfirmed = "confirmed"
+	ToolConfirmationRejected  = "rejected"
+	ToolConfirmationExpired   = "expired"
+	// ToolConfirmationSuperseded closes a confirmation the user did not answer
+	// before writing to the dialog again.
+	ToolConfirmationSuperseded = "superseded"
+)
+
+type ToolConfirmationRepo struct {
+	db *database.DB
+}
+
+func NewToolConfirmationRepo(db *database.DB) *ToolConfirmationRepo {
+	return &ToolConfirmationRepo{db: db}
+}
+
+// ToolConfirmation is a tool call waiting for the user's approval. ChatID and
+// TgMessageID locate the message with the Confirm/Reject buttons.
+type ToolConfirmation struct {
+	ID          int64
+	UserID      int64
+	DialogID    int64
+	MemberID    int64
+	UserTraceID int64
+	ToolCallID  string
+	ToolName    string
+	Arguments   string
+	ChatID      int64
+	TgMessageID int64
+	Status      string
+	ExpiresAt   int64
+	CreatedAt   int64
+}
+
+type InsertToolConfirmation struct {
+	UserID      int64
+	DialogID    int64
+	MemberID    int64
+	UserTraceID int64
+	ToolCallID  string
+	ToolName    string
+	Arguments   string
+	ExpiresAt   int64
+}
+
+const toolConfirmationColumns = `id, user_id, dialog_id, member_id, user_trace_id, tool_call_id, tool_name, arguments,
+	chat_id, tg_message_id, status, expires_at, created_at`
+
+func (r *ToolConfirmationRepo) Insert(ctx context.Context, in InsertToolConfirmation) (int64, error) {
+	res, err := r.db.ExecContext(
+		ctx,
+		`INSERT INTO tool_confirmations (user_id, dialog_id, member_id, user_trace_id, tool_call_id, tool_name, arguments, expires_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		in.UserID, in.DialogID, in.MemberID, in.UserTraceID, in.ToolCallID, in.ToolName, in.Arguments, in.ExpiresAt,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("insert tool confirmation: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+// SetMessage records where the confirmation was asked.
+func (r *ToolConfirmationRepo) SetMessage(ctx context.Context, id, chatID, tgMessageID int64) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		`UPDATE tool_confirmations SET chat_id = ?, tg_message_id = ?, updated_at = strftime('%s', 'now') WHERE id = ?`,
+		chatID, tgMessageID, id,
+	)
+	if err != nil {
+		return fmt.Errorf("set tool confirmation message: %w", err)
+	}
+	return nil
+}
+
+// Get returns the confirmation, or nil if there is none with this id.
+func (r *ToolConfirmationRepo) Get(ctx context.Context, id int64) (*ToolConfirmation, error) {
+	row := r.db.QueryRowContext(ctx, `SELECT `+toolConfirmationColumns+` FROM tool_confirmations WHERE id = ?`, id)
+	confirmation, err := scanToolConfirmation(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get tool confirmation: %w", err)
+	}
+	return &confirmation, nil
+}
+
+// Resolve moves a pending confirmation to status. It reports false when the
+// confirmation was no longer pending.
+func (r *ToolConfirmationRepo) Resolve(ctx context.Context, id int64, status string) (bool, error) {
+	res, err := r.db.ExecContext(
+		ctx,
+		`UPDATE tool_confirmations SET status = ?, updated_at = strftime('%s', 'now') WHERE id = ? AND status = ?`,
+		status, id, ToolConfirmationPending,
+	)
+	if err != nil {
+		return false, fmt.Errorf("resolve tool confirmation: %w", err)
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (r *ToolConfirmationRepo) ResolveTx(tx *sql.Tx, id int64, status string) (bool, error) {
+	res, err := tx.Exec(
+		`UPDATE tool_confirmations SET status = ?, updated_at = strftime('%s', 'now') WHERE id = ? AND status = ?`,
+		status, id, ToolConfirmationPending,
+	)
+	if err != nil {
+		return false, fmt.Errorf("resolve tool confirmation: %w", err)
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (r *ToolConfirmationRepo) CountPendingForDialog(ctx context.Context, userID, dialogID int64) (int, error) {
+	var n int
+	err := r.db.QueryRowContext(
+		ctx,
+		`SELECT COUNT(*) FROM tool_confirmations WHERE user_id = ? AND dialog_id = ? AND status = ?`,
+		userID, dialogID, ToolConfirmationPending,
+	).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("count pending tool confirmations: %w", err)
+	}
+	return n, nil
+}
+
+func (r *ToolConfirmationRepo) ListPendingForDialogTx(tx *sql.Tx, userID, dialogID int64) ([]ToolConfirmation, error) {
+	rows, err := tx.Query(
+		`SELECT `+toolConfirmationColumns+` FROM tool_confirmations
+		 WHERE user_id = ? AND dialog_id = ? AND status = ?
+		 ORDER BY id ASC`,
+		userID, dialogID, ToolConfirmationPending,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list pending tool confirmations: %w", err)
+	}
+	defer rows.Close()
+	return scanToolConfirmations(rows)
+}
+
+// ListExpired returns the pending confirmations whose time ran out at now.
+func (r *ToolConfirmationRepo) ListExpired(ctx context.Context, now int64) ([]ToolConfirmation, error) {
+	rows, err := r.db.QueryContext(
+		ctx,
+		`SELECT `+toolConfirmationColumns+` FROM tool_confirmations
+		 WHERE status = ? AND expires_at <= ?
+		 ORDER BY id ASC`,
+		ToolConfirmationPending, now,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list expired tool confirmations: %w", err)
+	}
+	defer rows.Close()
+	return scanToolConfirmations(rows)
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanToolConfirmation(row rowScanner) (ToolConfirmation, error) {
+	var c ToolConfirmation
+	err := row.Scan(
+		&c.ID, &c.UserID, &c.DialogID, &c.MemberID, &c.UserTraceID, &c.ToolCallID, &c.ToolName, &c.Arguments,
+		&c.ChatID, &c.TgMessageID, &c.Status, &c.ExpiresAt, &c.CreatedAt,
+	)
+	return c, err
+}
+
+func scanToolConfirmations(rows *sql.Rows) ([]ToolConfirmation, error) {
+	var out []ToolConfirmation
+	for rows.Next() {
+		c, err := scanToolConfirmation(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan tool confirmation: %w", err)
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"math"
 
 	"vadimgribanov.com/tg-gpt/internal/database"
 	"vadimgribanov.com/tg-gpt/internal/models"
@@ -24,6 +25,8 @@ type AppendEventInput struct {
 	Payload     any
 	TgMessageID *int64
 	Model       string
+	// SpeakerID attributes a user_msg to a group member; zero leaves it unset.
+	SpeakerID int64
 }
 
 // Append inserts a single trace event with a monotonic turn_index for (user_id, dialog_id).
@@ -57,11 +60,15 @@ func (r *TraceRepo) Append(in AppendEventInput) (int64, error) {
 	if in.Model != "" {
 		model = sql.NullString{String: in.Model, Valid: true}
 	}
+	var speakerID sql.NullInt64
+	if in.SpeakerID != 0 {
+		speakerID = sql.NullInt64{Int64: in.SpeakerID, Valid: true}
+	}
 
 	res, err := tx.Exec(
-		`INSERT INTO trace_events (user_id, dialog_id, turn_index, event_type, payload, tg_message_id, model)
-		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		in.UserID, in.DialogID, nextIdx, in.EventType, string(payloadBytes), tgMsgID, model,
+		`INSERT INTO trace_events (user_id, dialog_id, turn_index, event_type, payload, tg_message_id, model, speaker_id)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		in.UserID, in.DialogID, nextIdx, in.EventType, string(payloadBytes), tgMsgID, model, speakerID,
 	)
 	if err != nil {
 		return 0, fmt.Errorf("insert trace_event: %w", err)
@@ -119,11 +126,15 @@ func appendTraceEventTx(tx *sql.Tx, in AppendEventInput, turnIndex int64) (int64
 	if in.Model != "" {
 		model = sql.NullString{String: in.Model, Valid: true}
 	}
+	var speakerID sql.NullInt64
+	if in.SpeakerID != 0 {
+		speakerID = sql.NullInt64{Int64: in.SpeakerID, Valid: true}
+	}
 
 	res, err := tx.Exec(
-		`INSERT INTO trace_events (user_id, dialog_id, turn_index, event_type, payload, tg_message_id, model)
-		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		in.UserID, in.DialogID, turnIndex, in.EventType, string(payloadBytes), tgMsgID, model,
+		`INSERT INTO trace_events (user_id, dialog_id, turn_index, event_type, payload, tg_message_id, model, speaker_id)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		in.UserID, in.DialogID, turnIndex, in.EventType, string(payloadBytes), tgMsgID, model, speakerID,
 	)
 	if err != nil {
 		return 0, fmt.Errorf("insert trace_event: %w", err)
@@ -140,7 +151,7 @@ func appendTraceEventTx(tx *sql.Tx, in AppendEventInput, turnIndex int64) (int64
 // Used by CloseDialog summarization.
 func (r *TraceRepo) GetAllForDialog(userID, dialogID int64) ([]models.TraceEvent, error) {
 	rows, err := r.db.Query(
-		`SELECT id, user_id, dialog_id, turn_index, event_type, payload, tg_message_id, model, created_at
+		`SELECT id, user_id, dialog_id, turn_index, event_type, payload, tg_message_id, model, speaker_id, created_at
 		 FROM trace_events
 		 WHERE user_id = ? AND dialog_id = ?
 		 ORDER BY turn_index ASC`,
@@ -153,19 +164,64 @@ func (r *TraceRepo) GetAllForDialog(userID, dialogID int64) ([]models.TraceEvent
 	return scanTraceEvents(rows)
 }
 
+// GetUserMsgsFrom returns the user_msg events of the dialog from the event fromID
+// on, in turn order.
+func (r *TraceRepo) GetUserMsgsFrom(userID, dialogID, fromID int64) ([]models.TraceEvent, error) {
+	rows, err := r.db.Query(
+		`SELECT id, user_id, dialog_id, turn_index, event_type, payload, tg_message_id, model, speaker_id, created_at
+		 FROM trace_events
+		 WHERE user_id = ? AND dialog_id = ? AND id >= ? AND event_type = ?
+		 ORDER BY turn_index ASC`,
+		userID, dialogID, fromID, models.EventTypeUserMsg,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query user messages: %w", err)
+	}
+	defer rows.Close()
+	return scanTraceEvents(rows)
+}
+
 // GetRecent returns the last `limit` events for (user_id, dialog_id), oldest first.
+// A branch dialog is continued backwards into its parent from the branch point, so
+// the events of every dialog on its lineage count towards the limit.
 func (r *TraceRepo) GetRecent(userID, dialogID int64, limit int) ([]models.TraceEvent, error) {
+	var out []models.TraceEvent
+	maxTurnIndex := int64(math.MaxInt64)
+	for len(out) < limit {
+		segment, err := r.getRecentUpTo(userID, dialogID, maxTurnIndex, limit-len(out))
+		if err != nil {
+			return nil, err
+		}
+		out = append(segment, out...)
+
+		var parentDialogID, parentTurnIndex int64
+		err = r.db.QueryRow(
+			`SELECT parent_dialog_id, parent_turn_index FROM dialog_branches WHERE user_id = ? AND dialog_id = ?`,
+			userID, dialogID,
+		).Scan(&parentDialogID, &parentTurnIndex)
+		if err == sql.ErrNoRows {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("query dialog branch: %w", err)
+		}
+		dialogID, maxTurnIndex = parentDialogID, parentTurnIndex
+	}
+	return out, nil
+}
+
+func (r *TraceRepo) getRecentUpTo(userID, dialogID, maxTurnIndex int64, limit int) ([]models.TraceEvent, error) {
 	rows, err := r.db.Query(
-		`SELECT id, user_id, dialog_id, turn_index, event_type, payload, tg_message_id, model, created_at
+		`SELECT id, user_id, dialog_id, turn_index, event_type, payload, tg_message_id, model, speaker_id, created_at
 		 FROM (
-			 SELECT id, user_id, dialog_id, turn_index, event_type, payload, tg_message_id, model, created_at
+			 SELECT id, user_id, dialog_id, turn_index, event_type, payload, tg_message_id, model, speaker_id, created_at
 			 FROM trace_events
-			 WHERE user_id = ? AND dialog_id = ?
+			 WHERE user_id = ? AND dialog_id = ? AND turn_index <= ?
 			 ORDER BY turn_index DESC
 			 LIMIT ?
 		 )
 		 ORDER BY turn_index ASC`,
-		userID, dialogID, limit,
+		userID, dialogID, maxTurnIndex, limit,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("query recent trace: %w", err)
@@ -175,6 +231,73 @@ func (r *TraceRepo) GetRecent(userID, dialogID int64, limit int) ([]models.Trace
 	return scanTraceEvents(rows)
 }
 
+// GetByTgMessageID returns the event of the given type recorded for a Telegram
+// message, or nil when no dialog of the user holds it.
+func (r *TraceRepo) GetByTgMessageID(userID, tgMessageID int64, eventType string) (*models.TraceEvent, error) {
+	rows, err := r.db.Query(
+		`SELECT id, user_id, dialog_id, turn_index, event_type, payload, tg_message_id, model, speaker_id, created_at
+		 FROM trace_events
+		 WHERE user_id = ? AND tg_message_id = ? AND event_type = ?
+		 ORDER BY id DESC
+		 LIMIT 1`,
+		userID, tgMessageID, eventType,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query trace by tg message id: %w", err)
+	}
+	defer rows.Close()
+
+	events, err := scanTraceEvents(rows)
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+	return &events[0], nil
+}
+
+// GetLastAnswerTgMessageIDs returns the Telegram messages of the last answer
+// recorded after turnIndex, or nil when none was sent.
+func (r *TraceRepo) GetLastAnswerTgMessageIDs(userID, dialogID, turnIndex int64) ([]int64, error) {
+	var tgMsgID sql.NullInt64
+	var payload string
+	err := r.db.QueryRow(
+		`SELECT tg_message_id, payload FROM trace_events
+		 WHERE user_id = ? AND dialog_id = ? AND turn_index > ? AND event_type = ? AND tg_message_id IS NOT NULL
+		 ORDER BY turn_index DESC
+		 LIMIT 1`,
+		userID, dialogID, turnIndex, models.EventTypeModelMsg,
+	).Scan(&tgMsgID, &payload)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query last answer: %w", err)
+	}
+	var answer models.ModelMsgPayload
+	if err := json.Unmarshal([]byte(payload), &answer); err != nil {
+		return nil, fmt.Errorf("decode last answer: %w", err)
+	}
+	if len(answer.TgMessageIDs) > 0 {
+		return answer.TgMessageIDs, nil
+	}
+	return []int64{tgMsgID.Int64}, nil
+}
+
+// HasUserMsgAfter reports whether the dialog went on past the given event.
+func (r *TraceRepo) HasUserMsgAfter(userID, dialogID, turnIndex int64) (bool, error) {
+	var exists bool
+	err := r.db.QueryRow(
+		`SELECT EXISTS (
+			 SELECT 1 FROM trace_events
+			 WHERE user_id = ? AND dialog_id = ? AND turn_index > ? AND event_type = ?
+		 )`,
+		userID, dialogID, turnIndex, models.EventTypeUserMsg,
+	).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("query later user_msg: %w", err)
+	}
+	return exists, nil
+}
+
 // PopLatestExchange removes and returns the most recent user_msg event and any subsequent
 // events for that user (used by /retry). Returns the user_msg payload so the caller can replay it.
 func (r *TraceRepo) PopLatestExchange(userID, dialogID int64) (models.TraceEvent, error) {
@@ -185,11 +308,11 @@ func (r *TraceRepo) PopLatestExchange(userID, dialogID int64) (models.TraceEvent
 	defer tx.Rollback()
 
 	var userMsg models.TraceEvent
-	var tgMsgID sql.NullInt64
+	var tgMsgID, speakerID sql.NullInt64
 	var model sql.NullString
 	var payload string
 	err = tx.QueryRow(
-		`SELECT id, user_id, dialog_id, turn_index, event_type, payload, tg_message_id, model, created_at
+		`SELECT id, user_id, dialog_id, turn_index, event_type, payload, tg_message_id, model, speaker_id, created_at
 		 FROM trace_events
 		 WHERE user_id = ? AND dialog_id = ? AND event_type = ?
 		 ORDER BY turn_index DESC
@@ -197,7 +320,7 @@ func (r *TraceRepo) PopLatestExchange(userID, dialogID int64) (models.TraceEvent
 		userID, dialogID, models.EventTypeUserMsg,
 	).Scan(
 		&userMsg.ID, &userMsg.UserID, &userMsg.DialogID, &userMsg.TurnIndex,
-		&userMsg.EventType, &payload, &tgMsgID, &model, &userMsg.CreatedAt,
+		&userMsg.EventType, &payload, &tgMsgID, &model, &speakerID, &userMsg.CreatedAt,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -213,6 +336,7 @@ func (r *TraceRepo) PopLatestExchange(userID, dialogID int64) (models.TraceEvent
 	if model.Valid {
 		userMsg.Model = model.String
 	}
+	userMsg.SpeakerID = speakerID.Int64
 
 	_, err = tx.Exec(
 		`DELETE FROM trace_events
@@ -238,12 +362,12 @@ func scanTraceEvents(rows *sql.Rows) ([]models.TraceEvent, error) {
 	var out []models.TraceEvent
 	for rows.Next() {
 		var e models.TraceEvent
-		var tgMsgID sql.NullInt64
+		var tgMsgID, speakerID sql.NullInt64
 		var model sql.NullString
 		var payload string
 		if err := rows.Scan(
 			&e.ID, &e.UserID, &e.DialogID, &e.TurnIndex,
-			&e.EventType, &payload, &tgMsgID, &model, &e.CreatedAt,
+			&e.EventType, &payload, &tgMsgID, &model, &speakerID, &e.CreatedAt,
 		); err != nil {
 			return nil, fmt.Errorf("scan trace_event: %w", err)
 		}
@@ -255,6 +379,7 @@ func scanTraceEvents(rows *sql.Rows) ([]models.TraceEvent, error) {
 		if model.Valid {
 			e.Model = model.String
 		}
+		e.SpeakerID = speakerID.Int64
 		out = append(out, e)
 	}
 	return out, rows.Err()
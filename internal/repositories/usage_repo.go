@@ -0,0 +1,151 @@
+package repositories
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"vadimgribanov.com/tg-gpt/internal/database"
+	"vadimgribanov.com/tg-gpt/internal/models"
+)
+
+type UsageRepo struct {
+	db *database.DB
+}
+
+func NewUsageRepo(db *database.DB) *UsageRepo {
+	return &UsageRepo{db: db}
+}
+
+func (repo *UsageRepo) Record(entry models.UsageEntry) (int64, error) {
+	res, err := repo.db.Exec(
+		`INSERT INTO usage_ledger (user_id, dialog_id, model, input_tokens, output_tokens, cached_input_tokens, cost_usd, transcribed_seconds)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.UserID, entry.DialogID, entry.Model, entry.InputTokens, entry.OutputTokens, entry.CachedInputTokens, entry.CostUSD, entry.TranscribedSeconds,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record usage: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+// Totals returns the user's tokens (input + output) and cost in [from, to).
+func (repo *UsageRepo) Totals(userID, from, to int64) (int64, float64, error) {
+	var tokens int64
+	var cost float64
+	err := repo.db.QueryRow(
+		`SELECT COALESCE(SUM(input_tokens + output_tokens), 0), COALESCE(SUM(cost_usd), 0)
+		 FROM usage_ledger
+		 WHERE user_id = ? AND created_at >= ? AND created_at < ?`,
+		userID, from, to,
+	).Scan(&tokens, &cost)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to total usage: %w", err)
+	}
+	return tokens, cost, nil
+}
+
+// TranscribedSeconds returns the seconds of speech transcribed for the user in
+// [from, to).
+func (repo *UsageRepo) TranscribedSeconds(userID, from, to int64) (int64, error) {
+	var seconds int64
+	err := repo.db.QueryRow(
+		`SELECT COALESCE(SUM(transcribed_seconds), 0)
+		 FROM usage_ledger
+		 WHERE user_id = ? AND created_at >= ? AND created_at < ?`,
+		userID, from, to,
+	).Scan(&seconds)
+	if err != nil {
+		return 0, fmt.Errorf("failed to total transcribed seconds: %w", err)
+	}
+	return seconds, nil
+}
+
+// SummarizeByModel aggregates the user's usage in [from, to) per model, most
+// expensive first.
+func (repo *UsageRepo) SummarizeByModel(userID, from, to int64) ([]models.UsageSummary, error) {
+	rows, err := repo.db.Query(
+		`SELECT model, SUM(input_tokens), SUM(output_tokens), SUM(cached_input_tokens), SUM(cost_usd), SUM(transcribed_seconds)
+		 FROM usage_ledger
+		 WHERE user_id = ? AND created_at >= ? AND created_at < ?
+		 GROUP BY model
+		 ORDER BY SUM(cost_usd) DESC, model`,
+		userID, from, to,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to summarize usage: %w", err)
+	}
+	defer rows.Close()
+
+	var out []models.UsageSummary
+	for rows.Next() {
+		var s models.UsageSummary
+		if err := rows.Scan(&s.Model, &s.InputTokens, &s.OutputTokens, &s.CachedInputTokens, &s.CostUSD, &s.TranscribedSeconds); err != nil {
+			return nil, fmt.Errorf("failed to scan usage summary: %w", err)
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// BudgetOverride holds the limits an admin set for a user in place of the
+// configured ones. Zero means unlimited.
+type BudgetOverride struct {
+	DailyTokens                 int64
+	MonthlyTokens               int64
+	DailyUSD                    float64
+	MonthlyUSD                  float64
+	DailyTranscriptionMinutes   float64
+	MonthlyTranscriptionMinutes float64
+}
+
+// GetBudgetOverride returns the user's override, or nil when there is none.
+func (repo *UsageRepo) GetBudgetOverride(userID int64) (*BudgetOverride, error) {
+	var o BudgetOverride
+	err := repo.db.QueryRow(
+		`SELECT daily_tokens, monthly_tokens, daily_usd, monthly_usd, daily_transcription_minutes, monthly_transcription_minutes
+		 FROM budget_overrides
+		 WHERE user_id = ?`,
+		userID,
+	).Scan(&o.DailyTokens, &o.MonthlyTokens, &o.DailyUSD, &o.MonthlyUSD, &o.DailyTranscriptionMinutes, &o.MonthlyTranscriptionMinutes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get budget override: %w", err)
+	}
+	return &o, nil
+}
+
+func (repo *UsageRepo) SetBudgetOverride(userID int64, o BudgetOverride) error {
+	_, err := repo.db.Exec(
+		`INSERT INTO budget_overrides (user_id, daily_tokens, monthly_tokens, daily_usd, monthly_usd, daily_transcription_minutes, monthly_transcription_minutes)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)
+		 ON CONFLICT(user_id) DO UPDATE SET
+			daily_tokens = excluded.daily_tokens,
+			monthly_tokens = excluded.monthly_tokens,
+			daily_usd = excluded.daily_usd,
+			monthly_usd = excluded.monthly_usd,
+			daily_transcription_minutes = excluded.daily_transcription_minutes,
+			monthly_transcription_minutes = excluded.monthly_transcription_minutes,
+			updated_at = strftime('%s', 'now')`,
+		userID, o.DailyTokens, o.MonthlyTokens, o.DailyUSD, o.MonthlyUSD, o.DailyTranscriptionMinutes, o.MonthlyTranscriptionMinutes,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set budget override: %w", err)
+	}
+	return nil
+}
+
+// DeleteBudgetOverride reports whether the user had an override.
+func (repo *UsageRepo) DeleteBudgetOverride(userID int64) (bool, error) {
+	res, err := repo.db.Exec(`DELETE FROM budget_overrides WHERE user_id = ?`, userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete budget override: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
@@ -3,6 +3,7 @@ package repositories
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 
 	"vadimgribanov.com/tg-gpt/internal/database"
@@ -38,12 +39,36 @@ func (repo *UserRepo) Register(userId int64, firstName string, lastName string,
 		ChatId:          chatId,
 		LastInteraction: now,
 		Active:          active,
+		Role:            models.UserRoleUser,
 		CurrentModel:    modelId,
 	}
 
 	return newUser, nil
 }
 
+// RegisterGroup creates the shared account of a group chat, keyed by its chat id.
+func (repo *UserRepo) RegisterGroup(chatID int64, title string, modelId string) (models.User, error) {
+	now := time.Now().Unix()
+	_, err := repo.db.Exec(
+		`INSERT INTO users (id, first_name, chat_id, last_interaction, active, is_group, current_model)
+		 VALUES (?, ?, ?, ?, true, true, ?)`,
+		chatID, title, chatID, now, modelId,
+	)
+	if err != nil {
+		return models.User{}, fmt.Errorf("failed to register group: %w", err)
+	}
+	return models.User{
+		Id:              chatID,
+		FirstName:       title,
+		ChatId:          chatID,
+		LastInteraction: now,
+		Active:          true,
+		Role:            models.UserRoleUser,
+		IsGroup:         true,
+		CurrentModel:    modelId,
+	}, nil
+}
+
 func (repo *UserRepo) CheckIfUserExists(userId int64) bool {
 	query := `SELECT COUNT(*) FROM users WHERE id = ?`
 	var count int
@@ -51,49 +76,153 @@ func (repo *UserRepo) CheckIfUserExists(userId int64) bool {
 	return err == nil && count > 0
 }
 
-func (repo *UserRepo) GetUser(userId int64) (models.User, error) {
-	query := `
-		SELECT id, first_name, last_name, username, chat_id, transcribed_seconds, 
-			   number_of_input_tokens, number_of_output_tokens, current_dialog_id, 
-			   last_interaction, active, current_model
-		FROM users WHERE id = ?
-	`
+const userColumns = `id, first_name, last_name, username, chat_id, transcribed_seconds,
+	number_of_input_tokens, number_of_output_tokens, current_dialog_id,
+	last_interaction, active, role, is_group, current_model`
 
+func scanUser(row interface{ Scan(...any) error }) (models.User, error) {
 	var user models.User
 	var lastName, username sql.NullString
-
-	err := repo.db.QueryRow(query, userId).Scan(
+	err := row.Scan(
 		&user.Id, &user.FirstName, &lastName, &username, &user.ChatId,
 		&user.TranscribedSeconds, &user.NumberOfInputTokens, &user.NumberOfOutputTokens,
-		&user.CurrentDialogId, &user.LastInteraction, &user.Active, &user.CurrentModel,
+		&user.CurrentDialogId, &user.LastInteraction, &user.Active, &user.Role, &user.IsGroup, &user.CurrentModel,
 	)
+	if err != nil {
+		return models.User{}, err
+	}
+	if lastName.Valid {
+		user.LastName = lastName.String
+	}
+	if username.Valid {
+		user.Username = username.String
+	}
+	return user, nil
+}
 
+func (repo *UserRepo) GetUser(userId int64) (models.User, error) {
+	user, err := scanUser(repo.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, userId))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return models.User{}, fmt.Errorf("user not found")
 		}
 		return models.User{}, fmt.Errorf("failed to get user: %w", err)
 	}
+	return user, nil
+}
 
-	if lastName.Valid {
-		user.LastName = lastName.String
+// ListUsers returns all users, most recently active first.
+func (repo *UserRepo) ListUsers() ([]models.User, error) {
+	return repo.queryUsers(`SELECT ` + userColumns + ` FROM users ORDER BY last_interaction DESC`)
+}
+
+func (repo *UserRepo) ListAdmins() ([]models.User, error) {
+	return repo.queryUsers(`SELECT `+userColumns+` FROM users WHERE role = ? AND active = true`, models.UserRoleAdmin)
+}
+
+// ListActive returns active people; group chats are left out.
+func (repo *UserRepo) ListActive() ([]models.User, error) {
+	return repo.queryUsers(`SELECT ` + userColumns + ` FROM users WHERE active = true AND is_group = false`)
+}
+
+func (repo *UserRepo) queryUsers(query string, args ...any) ([]models.User, error) {
+	rows, err := repo.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
 	}
-	if username.Valid {
-		user.Username = username.String
+	defer rows.Close()
+	var out []models.User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		out = append(out, user)
 	}
+	return out, rows.Err()
+}
 
-	return user, nil
+func (repo *UserRepo) SetActive(userID int64, active bool) error {
+	res, err := repo.db.Exec(
+		`UPDATE users
+		 SET active = ?, updated_at = strftime('%s', 'now')
+		 WHERE id = ?`,
+		active, userID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set user active: %w", err)
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return fmt.Errorf("user not found")
+	}
+	return nil
+}
+
+// PromoteAdmins gives the admin role to the given users and activates them. Ids
+// that have not registered yet are ignored.
+func (repo *UserRepo) PromoteAdmins(userIDs []int64) error {
+	for _, userID := range userIDs {
+		_, err := repo.db.Exec(
+			`UPDATE users
+			 SET role = ?, active = true, updated_at = strftime('%s', 'now')
+			 WHERE id = ?`,
+			models.UserRoleAdmin, userID,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to promote admin: %w", err)
+		}
+	}
+	return nil
 }
 
-func (repo *UserRepo) Touch(userID int64, ts int64) error {
+// DemoteAdminsExcept takes the admin role from everyone but the given users, so
+// that ids removed from ADMIN_USER_ID lose it on the next start.
+func (repo *UserRepo) DemoteAdminsExcept(userIDs []int64) error {
+	query := `UPDATE users
+		 SET role = ?, updated_at = strftime('%s', 'now')
+		 WHERE role = ?`
+	args := []any{models.UserRoleUser, models.UserRoleAdmin}
+	if len(userIDs) > 0 {
+		query += ` AND id NOT IN (?` + strings.Repeat(", ?", len(userIDs)-1) + `)`
+		for _, userID := range userIDs {
+			args = append(args, userID)
+		}
+	}
+	if _, err := repo.db.Exec(query, args...); err != nil {
+		return fmt.Errorf("failed to demote admins: %w", err)
+	}
+	return nil
+}
+
+// Touch records activity in the given forum topic, or in the chat itself when
+// threadID is zero. Topics time out independently of the chat.
+func (repo *UserRepo) Touch(userID, threadID int64, ts int64) error {
+	query := `UPDATE users
+		 SET last_interaction = ?, updated_at = strftime('%s', 'now')
+		 WHERE id = ?`
+	args := []any{ts, userID}
+	if threadID != 0 {
+		query = `UPDATE chat_threads
+		 SET last_interaction = ?, updated_at = strftime('%s', 'now')
+		 WHERE user_id = ? AND thread_id = ?`
+		args = append(args, threadID)
+	}
+	if _, err := repo.db.Exec(query, args...); err != nil {
+		return fmt.Errorf("failed to touch user: %w", err)
+	}
+	return nil
+}
+
+func (repo *UserRepo) AddTranscribedSeconds(userID, seconds int64) error {
 	_, err := repo.db.Exec(
 		`UPDATE users
-		 SET last_interaction = ?, updated_at = strftime('%s', 'now')
+		 SET transcribed_seconds = transcribed_seconds + ?,
+		     updated_at = strftime('%s', 'now')
 		 WHERE id = ?`,
-		ts, userID,
+		seconds, userID,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to touch user: %w", err)
+		return fmt.Errorf("failed to add transcribed seconds: %w", err)
 	}
 	return nil
 }
@@ -126,24 +255,141 @@ func (repo *UserRepo) SetCurrentModel(userID int64, model string) error {
 	return nil
 }
 
-func (repo *UserRepo) StartNewDialogCAS(userID, expectedDialogID, ts int64) (int64, bool, error) {
-	res, err := repo.db.Exec(
-		`UPDATE users
-		 SET current_dialog_id = current_dialog_id + 1,
-		     last_interaction = ?,
-		     updated_at = strftime('%s', 'now')
-		 WHERE id = ? AND current_dialog_id = ?`,
-		ts, userID, expectedDialogID,
+// ApplyThread points user at the dialog of a forum topic: CurrentDialogId and
+// LastInteraction become the topic's. A topic seen for the first time gets a
+// fresh dialog.
+func (repo *UserRepo) ApplyThread(user models.User, threadID int64) (models.User, error) {
+	var dialogID, lastInteraction int64
+	err := repo.db.QueryRow(
+		`SELECT current_dialog_id, last_interaction FROM chat_threads WHERE user_id = ? AND thread_id = ?`,
+		user.Id, threadID,
+	).Scan(&dialogID, &lastInteraction)
+	if err == sql.ErrNoRows {
+		if err := repo.createThread(user.Id, threadID); err != nil {
+			return models.User{}, err
+		}
+		return repo.ApplyThread(user, threadID)
+	}
+	if err != nil {
+		return models.User{}, fmt.Errorf("failed to get thread: %w", err)
+	}
+	user.ThreadID = threadID
+	user.CurrentDialogId = dialogID
+	user.LastInteraction = lastInteraction
+	return user, nil
+}
+
+func (repo *UserRepo) createThread(userID, threadID int64) error {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	dialogID, err := allocateDialogIDTx(tx, userID)
+	if err != nil {
+		return err
+	}
+	// A concurrent update may have created the topic first; its dialog wins.
+	_, err = tx.Exec(
+		`INSERT INTO chat_threads (user_id, thread_id, current_dialog_id, last_interaction)
+		 VALUES (?, ?, ?, ?)
+		 ON CONFLICT(user_id, thread_id) DO NOTHING`,
+		userID, threadID, dialogID, time.Now().Unix(),
 	)
 	if err != nil {
-		return 0, false, fmt.Errorf("failed to start new dialog: %w", err)
+		return fmt.Errorf("failed to create thread: %w", err)
 	}
-	affected, err := res.RowsAffected()
+	return tx.Commit()
+}
+
+// StartNewDialogCAS moves the chat, or one of its forum topics when threadID is
+// not zero, to a fresh dialog if its current dialog is still expectedDialogID.
+func (repo *UserRepo) StartNewDialogCAS(userID, threadID, expectedDialogID, ts int64) (int64, bool, error) {
+	tx, err := repo.db.Begin()
 	if err != nil {
 		return 0, false, err
 	}
-	if affected == 0 {
-		return 0, false, nil
+	defer tx.Rollback()
+
+	newDialogID, err := allocateDialogIDTx(tx, userID)
+	if err != nil {
+		return 0, false, err
+	}
+	ok, err := setCurrentDialogTx(tx, userID, threadID, expectedDialogID, newDialogID, ts)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, false, err
+	}
+	return newDialogID, true, nil
+}
+
+// ForkDialogCAS moves the chat, or one of its forum topics, to a new branch dialog
+// if its current dialog is still expectedDialogID. The branch continues the parent
+// dialog after the event at parentTurnIndex; the parent itself is left untouched.
+func (repo *UserRepo) ForkDialogCAS(userID, threadID, expectedDialogID, parentDialogID, parentTurnIndex, ts int64) (int64, bool, error) {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	branchID, err := allocateDialogIDTx(tx, userID)
+	if err != nil {
+		return 0, false, err
+	}
+	ok, err := setCurrentDialogTx(tx, userID, threadID, expectedDialogID, branchID, ts)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO dialog_branches (user_id, dialog_id, parent_dialog_id, parent_turn_index)
+		 VALUES (?, ?, ?, ?)`,
+		userID, branchID, parentDialogID, parentTurnIndex,
+	)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to record dialog branch: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, false, err
+	}
+	return branchID, true, nil
+}
+
+// allocateDialogIDTx hands out the next dialog id of a user. Ids are shared by the
+// chat and all of its topics so trace rows never mix.
+func allocateDialogIDTx(tx *sql.Tx, userID int64) (int64, error) {
+	var id int64
+	err := tx.QueryRow(
+		`UPDATE users SET last_dialog_id = last_dialog_id + 1 WHERE id = ? RETURNING last_dialog_id`,
+		userID,
+	).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to allocate dialog id: %w", err)
+	}
+	return id, nil
+}
+
+func setCurrentDialogTx(tx *sql.Tx, userID, threadID, expectedDialogID, newDialogID, ts int64) (bool, error) {
+	query := `UPDATE users
+		 SET current_dialog_id = ?, last_interaction = ?, updated_at = strftime('%s', 'now')
+		 WHERE id = ? AND current_dialog_id = ?`
+	args := []any{newDialogID, ts, userID, expectedDialogID}
+	if threadID != 0 {
+		query = `UPDATE chat_threads
+		 SET current_dialog_id = ?, last_interaction = ?, updated_at = strftime('%s', 'now')
+		 WHERE user_id = ? AND current_dialog_id = ? AND thread_id = ?`
+		args = append(args, threadID)
+	}
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return false, fmt.Errorf("failed to switch dialog: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
 	}
-	return expectedDialogID + 1, true, nil
+	return affected > 0, nil
 }
@@ -0,0 +1,181 @@
+package repositories
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"vadimgribanov.com/tg-gpt/internal/database"
+)
+
+func newTestDB(t *testing.T) *database.DB {
+	t.Helper()
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Logf("close db: %v", err)
+		}
+	})
+	if err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestDemoteAdminsExceptKeepsOnlyListedAdmins(t *testing.T) {
+	repo := NewUserRepo(newTestDB(t))
+	for _, id := range []int64{1, 2, 3} {
+		if _, err := repo.Register(id, "User", "", "", id, true, "test-model"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.PromoteAdmins([]int64{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 was dropped from ADMIN_USER_ID and 3 added.
+	if err := repo.PromoteAdmins([]int64{1, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.DemoteAdminsExcept([]int64{1, 3}); err != nil {
+		t.Fatal(err)
+	}
+	admins := adminIDs(t, repo)
+	if len(admins) != 2 || admins[0] != 1 || admins[1] != 3 {
+		t.Fatalf("admins: %v", admins)
+	}
+	if user, err := repo.GetUser(2); err != nil || !user.Active {
+		t.Fatalf("a demoted admin stays an approved user: %#v %v", user, err)
+	}
+
+	if err := repo.DemoteAdminsExcept(nil); err != nil {
+		t.Fatal(err)
+	}
+	if admins := adminIDs(t, repo); len(admins) != 0 {
+		t.Fatalf("admins without ADMIN_USER_ID: %v", admins)
+	}
+}
+
+func adminIDs(t *testing.T, repo *UserRepo) []int64 {
+	t.Helper()
+	admins, err := repo.ListAdmins()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int64, 0, len(admins))
+	for _, admin := range admins {
+		ids = append(ids, admin.Id)
+	}
+	return ids
+}
+
+func TestApplyThreadGivesEveryTopicItsOwnDialog(t *testing.T) {
+	repo := NewUserRepo(newTestDB(t))
+	chat, err := repo.RegisterGroup(-1001, "Forum", "test-model")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := repo.ApplyThread(chat, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := repo.ApplyThread(chat, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ThreadID != 10 || second.ThreadID != 20 {
+		t.Fatalf("thread ids: %d %d", first.ThreadID, second.ThreadID)
+	}
+	if first.CurrentDialogId == second.CurrentDialogId ||
+		first.CurrentDialogId == chat.CurrentDialogId || second.CurrentDialogId == chat.CurrentDialogId {
+		t.Fatalf("dialogs: chat %d, topics %d and %d", chat.CurrentDialogId, first.CurrentDialogId, second.CurrentDialogId)
+	}
+	again, err := repo.ApplyThread(chat, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.CurrentDialogId != first.CurrentDialogId {
+		t.Fatalf("a topic must keep its dialog: %d, was %d", again.CurrentDialogId, first.CurrentDialogId)
+	}
+}
+
+func TestStartNewDialogCASTimesOutOneTopicOnly(t *testing.T) {
+	repo := NewUserRepo(newTestDB(t))
+	chat, err := repo.RegisterGroup(-1001, "Forum", "test-model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := repo.ApplyThread(chat, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := repo.ApplyThread(chat, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newDialogID, ok, err := repo.StartNewDialogCAS(chat.Id, 10, first.CurrentDialogId, time.Now().Unix())
+	if err != nil || !ok {
+		t.Fatalf("new dialog: %v %v", ok, err)
+	}
+	if now, _ := repo.ApplyThread(chat, 10); now.CurrentDialogId != newDialogID {
+		t.Fatalf("timed out topic: dialog %d, want %d", now.CurrentDialogId, newDialogID)
+	}
+	if now, _ := repo.ApplyThread(chat, 20); now.CurrentDialogId != second.CurrentDialogId {
+		t.Fatalf("other topic moved: dialog %d, was %d", now.CurrentDialogId, second.CurrentDialogId)
+	}
+	if now, _ := repo.GetUser(chat.Id); now.CurrentDialogId != chat.CurrentDialogId {
+		t.Fatalf("general topic moved: dialog %d, was %d", now.CurrentDialogId, chat.CurrentDialogId)
+	}
+
+	// A stale expectation loses the race and leaves the topic alone.
+	if _, ok, err := repo.StartNewDialogCAS(chat.Id, 10, first.CurrentDialogId, time.Now().Unix()); err != nil || ok {
+		t.Fatalf("stale new dialog: %v %v", ok, err)
+	}
+}
+
+func TestDialogIDsAreNeverReusedAcrossTopics(t *testing.T) {
+	repo := NewUserRepo(newTestDB(t))
+	chat, err := repo.RegisterGroup(-1001, "Forum", "test-model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[int64]string{chat.CurrentDialogId: "chat"}
+	record := func(what string, dialogID int64) {
+		t.Helper()
+		if earlier, ok := seen[dialogID]; ok {
+			t.Fatalf("dialog %d of %s was already used by %s", dialogID, what, earlier)
+		}
+		seen[dialogID] = what
+	}
+
+	topic, err := repo.ApplyThread(chat, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record("topic 10", topic.CurrentDialogId)
+	chatDialogID, ok, err := repo.StartNewDialogCAS(chat.Id, 0, chat.CurrentDialogId, time.Now().Unix())
+	if err != nil || !ok {
+		t.Fatalf("new chat dialog: %v %v", ok, err)
+	}
+	record("chat timeout", chatDialogID)
+	other, err := repo.ApplyThread(chat, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record("topic 20", other.CurrentDialogId)
+	branchID, ok, err := repo.ForkDialogCAS(chat.Id, 10, topic.CurrentDialogId, topic.CurrentDialogId, 0, time.Now().Unix())
+	if err != nil || !ok {
+		t.Fatalf("fork: %v %v", ok, err)
+	}
+	record("topic 10 branch", branchID)
+	topicDialogID, ok, err := repo.StartNewDialogCAS(chat.Id, 20, other.CurrentDialogId, time.Now().Unix())
+	if err != nil || !ok {
+		t.Fatalf("new topic dialog: %v %v", ok, err)
+	}
+	record("topic 20 timeout", topicDialogID)
+}
@@ -3,6 +3,7 @@ package services
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
 	"sync"
@@ -18,6 +19,7 @@ type ConversationRunner struct {
 	db         *database.DB
 	pending    *repositories.PendingInputRepo
 	trace      *repositories.TraceRepo
+	images     *ImageStore
 	text       *TextService
 	maxPending int
 
@@ -34,27 +36,42 @@ type activeConversation struct {
 	cancel        context.CancelFunc
 	pendingSignal bool
 	streamers     map[int64]*telegram_utils.TelegramStreamer
+	// decisions are the user's answers to tool confirmations, carried out
+	// before the next turn.
+	decisions []confirmationDecision
+}
+
+type confirmationDecision struct {
+	confirmationID int64
+	approve        bool
+	streamer       *telegram_utils.TelegramStreamer
 }
 
 func NewConversationRunner(
 	db *database.DB,
 	pending *repositories.PendingInputRepo,
 	trace *repositories.TraceRepo,
+	images *ImageStore,
 	text *TextService,
 ) *ConversationRunner {
 	return &ConversationRunner{
 		db:         db,
 		pending:    pending,
 		trace:      trace,
+		images:     images,
 		text:       text,
 		maxPending: 100,
 		active:     make(map[conversationKey]*activeConversation),
 	}
 }
 
+// Submit queues a message for the user's current dialog and starts a turn unless
+// one is already running. In group chats user is the group and speakerID is the
+// member who sent the message; it is zero in private chats.
 func (r *ConversationRunner) Submit(
 	ctx context.Context,
 	user models.User,
+	speakerID int64,
 	tgMessageID int64,
 	msg llm.Message,
 	streamer *telegram_utils.TelegramStreamer,
@@ -64,12 +81,18 @@ func (r *ConversationRunner) Submit(
 		return err
 	}
 	user = preparedUser
+	// Pending inputs and the trace keep images as blob references.
+	msg, err = r.images.Externalize(msg)
+	if err != nil {
+		return err
+	}
 	key := conversationKey{userID: user.Id, dialogID: user.CurrentDialogId}
 	if _, err := r.pending.Insert(ctx, repositories.InsertPendingInput{
 		UserID:      user.Id,
 		DialogID:    user.CurrentDialogId,
 		TgMessageID: tgMessageID,
 		Message:     msg,
+		SpeakerID:   speakerID,
 	}); err != nil {
 		return err
 	}
@@ -99,6 +122,41 @@ func (r *ConversationRunner) Submit(
 	return nil
 }
 
+// Decide queues the user's answer to a tool confirmation of the user's current
+// dialog. Once the dialog waits for no more answers the paused turn resumes,
+// answering through streamer.
+func (r *ConversationRunner) Decide(
+	ctx context.Context,
+	user models.User,
+	confirmationID int64,
+	approve bool,
+	streamer *telegram_utils.TelegramStreamer,
+) error {
+	if r.text.confirmations == nil {
+		return ErrConfirmationNotPending
+	}
+	decision := confirmationDecision{confirmationID: confirmationID, approve: approve, streamer: streamer}
+	key := conversationKey{userID: user.Id, dialogID: user.CurrentDialogId}
+
+	r.mu.Lock()
+	if active := r.active[key]; active != nil {
+		active.decisions = append(active.decisions, decision)
+		r.mu.Unlock()
+		return nil
+	}
+	runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	active := &activeConversation{
+		cancel:    cancel,
+		streamers: make(map[int64]*telegram_utils.TelegramStreamer),
+		decisions: []confirmationDecision{decision},
+	}
+	r.active[key] = active
+	r.mu.Unlock()
+
+	go r.run(runCtx, key, user, active)
+	return nil
+}
+
 func (r *ConversationRunner) CancelCurrentDialog(ctx context.Context, user models.User) error {
 	return r.CancelDialog(ctx, user.Id, user.CurrentDialogId)
 }
@@ -129,19 +187,43 @@ func (r *ConversationRunner) run(ctx context.Context, key conversationKey, user
 		r.mu.Unlock()
 	}()
 
+	drainNewInputs := func(ctx context.Context) ([]UserInput, error) {
+		return r.attachPendingInputs(ctx, key.userID, key.dialogID)
+	}
 	for {
 		if ctx.Err() != nil {
 			return
 		}
 
+		resume, resumeStreamer := r.carryOutDecision(ctx, active)
+
+		if err := r.refuseOverBudget(ctx, key, user, active); err != nil {
+			slog.ErrorContext(ctx, "Failed to refuse queued inputs", "error", err, "user_id", key.userID, "dialog_id", key.dialogID)
+			return
+		}
 		inputs, err := r.attachPendingInputs(ctx, key.userID, key.dialogID)
 		if err != nil {
 			slog.ErrorContext(ctx, "Failed to attach pending inputs", "error", err, "user_id", key.userID, "dialog_id", key.dialogID)
 			return
 		}
-		if len(inputs) == 0 {
+
+		var streamer *telegram_utils.TelegramStreamer
+		if len(inputs) > 0 {
+			mctx := TurnContext{
+				UserID:      key.userID,
+				DialogID:    key.dialogID,
+				UserTraceID: inputs[0].TraceID,
+				MemberID:    inputs[len(inputs)-1].SpeakerID,
+			}
+			streamer = r.takeStreamer(active, inputs)
+			_, err = r.text.RunAttachedTurn(ctx, user, mctx, inputs, streamer, drainNewInputs)
+		} else if resume != nil {
+			// New inputs would have carried the turn on by themselves.
+			streamer = resumeStreamer
+			_, err = r.text.ResumeTurn(ctx, user, *resume, streamer, drainNewInputs)
+		} else {
 			r.mu.Lock()
-			if active.pendingSignal {
+			if active.pendingSignal || len(active.decisions) > 0 {
 				active.pendingSignal = false
 				r.mu.Unlock()
 				continue
@@ -152,20 +234,14 @@ func (r *ConversationRunner) run(ctx context.Context, key conversationKey, user
 			r.mu.Unlock()
 			return
 		}
-
-		mctx := TurnContext{
-			UserID:      key.userID,
-			DialogID:    key.dialogID,
-			UserTraceID: inputs[0].TraceID,
-		}
-		streamer := r.takeStreamer(active, inputs)
-		_, err = r.text.RunAttachedTurn(ctx, user, mctx, inputs, streamer, func(ctx context.Context) ([]UserInput, error) {
-			return r.attachPendingInputs(ctx, key.userID, key.dialogID)
-		})
 		if err != nil {
 			if ctx.Err() != nil {
 				return
 			}
+			if errors.Is(err, ErrBudgetExceeded) {
+				slog.InfoContext(ctx, "Conversation turn refused", "error", err, "user_id", key.userID, "dialog_id", key.dialogID)
+				return
+			}
 			if streamer != nil {
 				if noticeErr := streamer.SendStatus("Failed to answer the message"); noticeErr != nil {
 					slog.ErrorContext(ctx, "Failed to send async error notice", "error", noticeErr, "user_id", key.userID, "dialog_id", key.dialogID)
@@ -177,6 +253,57 @@ func (r *ConversationRunner) run(ctx context.Context, key conversationKey, user
 	}
 }
 
+// refuseOverBudget discards the queued messages of a user whose budget is used up
+// before they are recorded in the dialog, and tells the user why.
+func (r *ConversationRunner) refuseOverBudget(ctx context.Context, key conversationKey, user models.User, active *activeConversation) error {
+	pending, err := r.pending.ListPendingForDialog(ctx, key.userID, key.dialogID, r.maxPending)
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+	status, err := r.text.CheckBudget(ctx, user)
+	if !errors.Is(err, ErrBudgetExceeded) {
+		return nil
+	}
+	slog.InfoContext(ctx, "Budget exceeded, refusing queued inputs", "user_id", key.userID, "dialog_id", key.dialogID, "count", len(pending))
+	if err := r.pending.DiscardForDialog(ctx, key.userID, key.dialogID); err != nil {
+		return err
+	}
+	refused := make([]UserInput, 0, len(pending))
+	for _, input := range pending {
+		refused = append(refused, UserInput{TgMessageID: input.TgMessageID})
+	}
+	sendNotice(ctx, r.takeStreamer(active, refused), budgetRefusal(status))
+	return nil
+}
+
+// carryOutDecision carries out the oldest queued answer to a tool confirmation.
+// It returns the turn to resume when that was the last answer the turn waited for.
+func (r *ConversationRunner) carryOutDecision(ctx context.Context, active *activeConversation) (*TurnContext, *telegram_utils.TelegramStreamer) {
+	r.mu.Lock()
+	if len(active.decisions) == 0 {
+		r.mu.Unlock()
+		return nil, nil
+	}
+	decision := active.decisions[0]
+	active.decisions = active.decisions[1:]
+	r.mu.Unlock()
+
+	confirmation, stillPending, err := r.text.confirmations.Decide(ctx, decision.confirmationID, decision.approve)
+	if errors.Is(err, ErrConfirmationNotPending) {
+		slog.InfoContext(ctx, "Tool confirmation was answered after it was closed", "confirmation_id", decision.confirmationID)
+		return nil, nil
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to carry out tool confirmation", "error", err, "confirmation_id", decision.confirmationID)
+		return nil, nil
+	}
+	if stillPending {
+		return nil, nil
+	}
+	mctx := confirmationTurn(*confirmation)
+	return &mctx, decision.streamer
+}
+
 func (r *ConversationRunner) takeStreamer(active *activeConversation, inputs []UserInput) *telegram_utils.TelegramStreamer {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -194,6 +321,7 @@ func (r *ConversationRunner) takeStreamer(active *activeConversation, inputs []U
 
 func (r *ConversationRunner) attachPendingInputs(ctx context.Context, userID, dialogID int64) ([]UserInput, error) {
 	var attached []UserInput
+	var superseded []repositories.ToolConfirmation
 	err := r.db.WithTx(ctx, func(tx *sql.Tx) error {
 		pending, err := r.pending.ListPendingForDialogTx(tx, userID, dialogID, r.maxPending)
 		if err != nil {
@@ -202,6 +330,13 @@ func (r *ConversationRunner) attachPendingInputs(ctx context.Context, userID, di
 		if len(pending) == 0 {
 			return nil
 		}
+		if r.text.confirmations != nil {
+			// The results of unanswered calls have to precede the new messages.
+			superseded, err = r.text.confirmations.supersedeTx(tx, userID, dialogID)
+			if err != nil {
+				return err
+			}
+		}
 
 		events := make([]repositories.AppendEventInput, 0, len(pending))
 		for _, input := range pending {
@@ -210,6 +345,7 @@ func (r *ConversationRunner) attachPendingInputs(ctx context.Context, userID, di
 				EventType:   models.EventTypeUserMsg,
 				Payload:     models.UserMsgPayload{Content: input.Message.Content, MultiContent: input.Message.Parts},
 				TgMessageID: &tgMsgID,
+				SpeakerID:   input.SpeakerID,
 			})
 		}
 		traceIDs, err := r.trace.AppendBatchTx(tx, userID, dialogID, events)
@@ -228,6 +364,7 @@ func (r *ConversationRunner) attachPendingInputs(ctx context.Context, userID, di
 				TraceID:     traceIDs[i],
 				TgMessageID: input.TgMessageID,
 				Message:     input.Message,
+				SpeakerID:   input.SpeakerID,
 			})
 		}
 		return nil
@@ -235,5 +372,11 @@ func (r *ConversationRunner) attachPendingInputs(ctx context.Context, userID, di
 	if err != nil {
 		return nil, err
 	}
+	if len(superseded) > 0 {
+		r.text.confirmations.closeQuestions(ctx, superseded)
+	}
+	for i := range attached {
+		attached[i].Message = r.images.Resolve(attached[i].Message)
+	}
 	return attached, nil
 }
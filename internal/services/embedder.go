@@ -37,3 +37,34 @@ func (e *Embedder) Embed(ctx context.Context, text string) ([]float32, error) {
 	}
 	return vec.Normalize(resp.Data[0].Embedding), nil
 }
+
+// embedBatchSize keeps a single embeddings request well under the API's input limits.
+const embedBatchSize = 64
+
+// EmbedAll embeds many texts with as few requests as possible. The result is
+// parallel to texts.
+func (e *Embedder) EmbedAll(ctx context.Context, texts []string) ([][]float32, error) {
+	out := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += embedBatchSize {
+		batch := texts[start:min(start+embedBatchSize, len(texts))]
+		resp, err := e.client.CreateEmbeddings(ctx, openai.EmbeddingRequest{
+			Input: batch,
+			Model: openai.EmbeddingModel(e.model),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("openai embed: %w", err)
+		}
+		if len(resp.Data) != len(batch) {
+			return nil, fmt.Errorf("openai embed: got %d embeddings for %d texts", len(resp.Data), len(batch))
+		}
+		embeddings := make([][]float32, len(batch))
+		for _, data := range resp.Data {
+			if data.Index < 0 || data.Index >= len(batch) {
+				return nil, fmt.Errorf("openai embed: unexpected index %d", data.Index)
+			}
+			embeddings[data.Index] = vec.Normalize(data.Embedding)
+		}
+		out = append(out, embeddings...)
+	}
+	return out, nil
+}
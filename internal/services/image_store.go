@@ -0,0 +1,92 @@
+package services
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+
+	"vadimgribanov.com/tg-gpt/internal/llm"
+	"vadimgribanov.com/tg-gpt/internal/repositories"
+)
+
+// missingImageText replaces an image whose blob is gone, so the model still knows
+// the user sent one.
+const missingImageText = "[An image the user sent is no longer available]"
+
+// ImageStore keeps images out of the trace and pending inputs: inline data URLs are
+// stored once as blobs and messages carry blob URLs, which are resolved back into
+// data URLs before a request is built.
+type ImageStore struct {
+	blobs *repositories.BlobRepo
+}
+
+func NewImageStore(blobs *repositories.BlobRepo) *ImageStore {
+	return &ImageStore{blobs: blobs}
+}
+
+// Externalize returns msg with its inline images stored as blobs and replaced by
+// blob URLs. Parts that are not base64 data URLs are left as they are.
+func (s *ImageStore) Externalize(msg llm.Message) (llm.Message, error) {
+	if !hasImageParts(msg) {
+		return msg, nil
+	}
+	parts := make([]llm.ContentPart, len(msg.Parts))
+	copy(parts, msg.Parts)
+	for i, part := range parts {
+		if part.Type != llm.ContentPartImageURL {
+			continue
+		}
+		mediaType, encoded, ok := llm.ParseBase64DataURL(part.ImageURL)
+		if !ok {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return llm.Message{}, fmt.Errorf("decode image: %w", err)
+		}
+		hash, err := s.blobs.Put(mediaType, data)
+		if err != nil {
+			return llm.Message{}, err
+		}
+		parts[i].ImageURL = llm.BlobURL(hash)
+	}
+	msg.Parts = parts
+	return msg, nil
+}
+
+// Resolve returns msg with its blob URLs turned back into data URLs. An image that
+// cannot be loaded becomes a text note rather than failing the whole request.
+func (s *ImageStore) Resolve(msg llm.Message) llm.Message {
+	if !hasImageParts(msg) {
+		return msg
+	}
+	parts := make([]llm.ContentPart, len(msg.Parts))
+	copy(parts, msg.Parts)
+	for i, part := range parts {
+		if part.Type != llm.ContentPartImageURL {
+			continue
+		}
+		hash, ok := llm.ParseBlobURL(part.ImageURL)
+		if !ok {
+			continue
+		}
+		blob, err := s.blobs.Get(hash)
+		if err != nil || blob == nil {
+			slog.Warn("Image blob unavailable", "hash", hash, "error", err)
+			parts[i] = llm.ContentPart{Type: llm.ContentPartText, Text: missingImageText}
+			continue
+		}
+		parts[i].ImageURL = fmt.Sprintf("data:%s;base64,%s", blob.MediaType, base64.StdEncoding.EncodeToString(blob.Data))
+	}
+	msg.Parts = parts
+	return msg
+}
+
+func hasImageParts(msg llm.Message) bool {
+	for _, part := range msg.Parts {
+		if part.Type == llm.ContentPartImageURL {
+			return true
+		}
+	}
+	return false
+}
@@ -3,18 +3,24 @@ package services
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
+	"time"
 
 	openai "github.com/sashabaranov/go-openai"
 	"vadimgribanov.com/tg-gpt/internal/adapters"
 	"vadimgribanov.com/tg-gpt/internal/config"
 	"vadimgribanov.com/tg-gpt/internal/llm"
 	"vadimgribanov.com/tg-gpt/internal/vendors/anthropic"
+	"vadimgribanov.com/tg-gpt/internal/vendors/gemini"
 )
 
 type LLMClientProxy struct {
 	supportedModels map[string]config.LLMModel
 	providers       map[llm.Provider]ProviderClient
+	endpoints       map[llm.Provider]string
+	retry           RetryPolicy
 	OpenaiClient    *openai.Client
 }
 
@@ -23,20 +29,85 @@ type ProviderClient interface {
 }
 
 func NewLLMClientProxy() *LLMClientProxy {
-	return &LLMClientProxy{supportedModels: make(map[string]config.LLMModel), providers: make(map[llm.Provider]ProviderClient)}
+	return &LLMClientProxy{
+		supportedModels: make(map[string]config.LLMModel),
+		providers:       make(map[llm.Provider]ProviderClient),
+		endpoints:       make(map[llm.Provider]string),
+		retry:           RetryPolicy{MaxAttempts: 1},
+	}
 }
 
-func NewClientProxyFromConfig(config *config.Config) *LLMClientProxy {
+// NewClientProxyFromConfig registers the configured models. It fails when a model's
+// base_url cannot get an endpoint of its own, which would send its requests to
+// another endpoint instead.
+func NewClientProxyFromConfig(config *config.Config) (*LLMClientProxy, error) {
 	proxy := NewLLMClientProxy()
+	proxy.retry = RetryPolicy{
+		MaxAttempts:    config.Retry.MaxAttempts,
+		InitialBackoff: time.Duration(config.Retry.InitialBackoffMs) * time.Millisecond,
+		MaxBackoff:     time.Duration(config.Retry.MaxBackoffMs) * time.Millisecond,
+	}
 	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
 	proxy.OpenaiClient = client
 	anthropicClient := anthropic.NewClient(os.Getenv("ANTHROPIC_API_KEY"))
+	geminiClient := gemini.NewClient(os.Getenv("GEMINI_API_KEY"))
 	proxy.registerProvider(adapters.NewOpenaiAdapter(client))
 	proxy.registerProvider(adapters.NewAnthropicAdapter(anthropicClient))
+	proxy.registerProvider(adapters.NewGeminiAdapter(geminiClient))
 	for _, model := range config.Models {
+		if model.BaseURL != "" {
+			if err := proxy.registerCompatibleProvider(model); err != nil {
+				return nil, fmt.Errorf("model %s: %w", model.ModelId, err)
+			}
+		}
 		proxy.registerAvailableModel(model)
 	}
-	return proxy
+	return proxy, nil
+}
+
+// registerCompatibleProvider creates an OpenAI-compatible client for the model's
+// endpoint. The first model declaring a provider name defines its endpoint; later
+// models with the same name reuse that client and must name the same base_url.
+func (p *LLMClientProxy) registerCompatibleProvider(model config.LLMModel) error {
+	provider := llm.Provider(model.Provider)
+	if existing, ok := p.endpoints[provider]; ok {
+		if existing != model.BaseURL {
+			return fmt.Errorf("provider %q is already registered with base_url %s", provider, existing)
+		}
+		return nil
+	}
+	if provider == "" {
+		return fmt.Errorf("base_url %s needs a provider name", model.BaseURL)
+	}
+	if _, ok := p.providers[provider]; ok {
+		return fmt.Errorf("base_url %s needs its own provider name, %q is built in", model.BaseURL, provider)
+	}
+	clientConfig := openai.DefaultConfig("")
+	if model.APIKeyEnv != "" {
+		clientConfig = openai.DefaultConfig(os.Getenv(model.APIKeyEnv))
+	}
+	clientConfig.BaseURL = model.BaseURL
+	if len(model.Headers) > 0 {
+		clientConfig.HTTPClient = &http.Client{Transport: &headerTransport{headers: model.Headers, base: http.DefaultTransport}}
+	}
+	p.endpoints[provider] = model.BaseURL
+	p.registerProvider(adapters.NewOpenaiCompatibleAdapter(provider, openai.NewClientWithConfig(clientConfig)))
+	return nil
+}
+
+// headerTransport adds static headers to every request, e.g. a gateway token
+// that an OpenAI-compatible proxy expects next to or instead of the API key.
+type headerTransport struct {
+	headers map[string]string
+	base    http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	return t.base.RoundTrip(req)
 }
 
 func (p *LLMClientProxy) IsClientRegistered(name string) bool {
@@ -72,10 +143,82 @@ func (p *LLMClientProxy) getClient(modelId string) (ProviderClient, error) {
 	return p.providers[provider], nil
 }
 
+// Capabilities returns what the adapter reports for the model, with any overrides
+// declared for it in config applied on top. Unknown models report no capabilities.
+func (p *LLMClientProxy) Capabilities(modelId string) llm.Capabilities {
+	client, err := p.getClient(modelId)
+	if err != nil {
+		return llm.Capabilities{}
+	}
+	caps := client.Capabilities(modelId)
+	overrides := p.supportedModels[modelId].Capabilities
+	if overrides.FunctionTools != nil {
+		caps.FunctionTools = *overrides.FunctionTools
+	}
+	if overrides.Vision != nil {
+		caps.Vision = *overrides.Vision
+	}
+	if overrides.ToolChoice != nil {
+		caps.ToolChoice = *overrides.ToolChoice
+	}
+	return caps
+}
+
+// Stream opens a stream for the request's model, retrying transient failures with
+// backoff and then moving down the model's fallback list. A stream counts as
+// failed only until it produces its first output, so a retry never duplicates text
+// the user has already seen. Every attempt is shaped to the capabilities of the
+// model it goes to. The returned stream implements FallbackStream.
 func (p *LLMClientProxy) Stream(ctx context.Context, request llm.Request) (llm.Stream, error) {
-	client, err := p.getClient(request.Model)
+	if _, err := p.getClient(request.Model); err != nil {
+		return nil, err
+	}
+	candidates := append([]string{request.Model}, p.supportedModels[request.Model].Fallbacks...)
+	var lastErr error
+	for _, model := range candidates {
+		client, err := p.getClient(model)
+		if err != nil {
+			slog.WarnContext(ctx, "Skipping unknown fallback model", "model", request.Model, "fallback", model)
+			continue
+		}
+		for attempt := 1; attempt <= max(p.retry.MaxAttempts, 1); attempt++ {
+			if attempt > 1 {
+				if err := sleepContext(ctx, p.retry.backoff(attempt-1)); err != nil {
+					return nil, err
+				}
+			}
+			stream, err := p.openStream(ctx, client, model, request)
+			if err == nil {
+				return stream, nil
+			}
+			lastErr = err
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			transient := isTransientLLMError(err)
+			slog.WarnContext(ctx, "LLM request failed", "model", model, "attempt", attempt, "transient", transient, "error", err)
+			if !transient {
+				break
+			}
+		}
+	}
+	return nil, lastErr
+}
+
+func (p *LLMClientProxy) openStream(ctx context.Context, client ProviderClient, model string, request llm.Request) (llm.Stream, error) {
+	request.Model = model
+	request, dropped := ShapeRequest(request, p.Capabilities(model))
+	if len(dropped) > 0 {
+		slog.DebugContext(ctx, "Dropped unsupported request features", "model", model, "dropped", dropped)
+	}
+	stream, err := client.Stream(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	buffered, err := primeStream(stream)
 	if err != nil {
+		stream.Close()
 		return nil, err
 	}
-	return client.Stream(ctx, request)
+	return &primedStream{Stream: stream, buffered: buffered, model: model}, nil
 }
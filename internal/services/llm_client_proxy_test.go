@@ -0,0 +1,200 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"vadimgribanov.com/tg-gpt/internal/config"
+	"vadimgribanov.com/tg-gpt/internal/llm"
+)
+
+func newCompatibleEndpoint(t *testing.T, reply string, seen *http.Header) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.Error(w, "unexpected path "+r.URL.Path, http.StatusNotFound)
+			return
+		}
+		*seen = r.Header.Clone()
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":%q}}]}\n\n", reply)
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/v1"
+}
+
+func streamText(t *testing.T, proxy *LLMClientProxy, model string) string {
+	t.Helper()
+	stream, err := proxy.Stream(context.Background(), llm.Request{
+		Model:    model,
+		Messages: []llm.Message{{Role: llm.RoleUser, Content: "hi"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	text := ""
+	for stream.Next() {
+		text += stream.Event().TextDelta
+	}
+	return text
+}
+
+func TestClientProxyRoutesModelsToCompatibleEndpoints(t *testing.T) {
+	t.Setenv("VLLM_API_KEY", "vllm-secret")
+	var ollamaHeaders, vllmHeaders http.Header
+	ollamaURL := newCompatibleEndpoint(t, "from ollama", &ollamaHeaders)
+	vllmURL := newCompatibleEndpoint(t, "from vllm", &vllmHeaders)
+
+	proxy, err := NewClientProxyFromConfig(&config.Config{Models: []config.LLMModel{
+		{ModelId: "gpt-5.5", Provider: "openai"},
+		{ModelId: "llama3.2", Provider: "ollama", BaseURL: ollamaURL},
+		{ModelId: "qwen3", Provider: "ollama", BaseURL: ollamaURL},
+		{ModelId: "mistral", Provider: "vllm", BaseURL: vllmURL, APIKeyEnv: "VLLM_API_KEY", Headers: map[string]string{"X-Gateway": "tg-gpt"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := streamText(t, proxy, "llama3.2"); got != "from ollama" {
+		t.Fatalf("llama3.2: got %q", got)
+	}
+	if got := streamText(t, proxy, "qwen3"); got != "from ollama" {
+		t.Fatalf("qwen3 must reuse the ollama endpoint: got %q", got)
+	}
+	if got := streamText(t, proxy, "mistral"); got != "from vllm" {
+		t.Fatalf("mistral: got %q", got)
+	}
+	if vllmHeaders.Get("Authorization") != "Bearer vllm-secret" || vllmHeaders.Get("X-Gateway") != "tg-gpt" {
+		t.Fatalf("vllm headers: %#v", vllmHeaders)
+	}
+	if ollamaHeaders.Get("X-Gateway") != "" {
+		t.Fatalf("headers must not leak across endpoints: %#v", ollamaHeaders)
+	}
+	if client, err := proxy.getClient("gpt-5.5"); err != nil || client.Provider() != llm.ProviderOpenAI {
+		t.Fatalf("hosted openai model must keep the default client: %v", err)
+	}
+}
+
+func TestClientProxyCapabilitiesApplyConfigOverrides(t *testing.T) {
+	noVision := false
+	proxy, err := NewClientProxyFromConfig(&config.Config{Models: []config.LLMModel{
+		{ModelId: "gpt-5.5", Provider: "openai"},
+		{ModelId: "llama3.2", Provider: "ollama", BaseURL: "http://localhost:11434/v1", Capabilities: config.ModelCapabilities{Vision: &noVision}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if caps := proxy.Capabilities("gpt-5.5"); !caps.Vision || !caps.FunctionTools {
+		t.Fatalf("gpt-5.5: %#v", caps)
+	}
+	if caps := proxy.Capabilities("llama3.2"); caps.Vision || !caps.FunctionTools || !caps.ToolChoice {
+		t.Fatalf("llama3.2 overrides: %#v", caps)
+	}
+	if caps := proxy.Capabilities("unknown"); caps != (llm.Capabilities{}) {
+		t.Fatalf("unknown model: %#v", caps)
+	}
+}
+
+// newFlakyEndpoint fails the first len(failures) requests with the given statuses
+// and streams reply afterwards.
+func newFlakyEndpoint(t *testing.T, reply string, failures ...int) (string, *int) {
+	t.Helper()
+	hits := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if hits <= len(failures) {
+			http.Error(w, `{"error":{"message":"try again"}}`, failures[hits-1])
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":%q}}]}\n\n", reply)
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/v1", &hits
+}
+
+func newFallbackProxy(t *testing.T, primaryURL, fallbackURL string) *LLMClientProxy {
+	t.Helper()
+	proxy, err := NewClientProxyFromConfig(&config.Config{
+		Retry: config.RetryConfig{MaxAttempts: 3, InitialBackoffMs: 1, MaxBackoffMs: 2},
+		Models: []config.LLMModel{
+			{ModelId: "primary", Provider: "primary", BaseURL: primaryURL, Fallbacks: []string{"missing", "fallback"}},
+			{ModelId: "fallback", Provider: "fallback", BaseURL: fallbackURL},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proxy
+}
+
+func TestClientProxyRejectsEndpointsWithoutTheirOwnProvider(t *testing.T) {
+	for _, models := range [][]config.LLMModel{
+		{{ModelId: "llama3.2", BaseURL: "http://localhost:11434/v1"}},
+		{{ModelId: "gpt-5.5", Provider: "openai", BaseURL: "http://localhost:11434/v1"}},
+		{
+			{ModelId: "llama3.2", Provider: "local", BaseURL: "http://localhost:11434/v1"},
+			{ModelId: "mistral", Provider: "local", BaseURL: "http://localhost:8000/v1"},
+		},
+	} {
+		if _, err := NewClientProxyFromConfig(&config.Config{Models: models}); err == nil {
+			t.Fatalf("models %#v must not load", models)
+		}
+	}
+}
+
+func TestClientProxyRetriesTransientErrors(t *testing.T) {
+	primaryURL, primaryHits := newFlakyEndpoint(t, "from primary", http.StatusTooManyRequests, http.StatusBadGateway)
+	fallbackURL, fallbackHits := newFlakyEndpoint(t, "from fallback")
+	proxy := newFallbackProxy(t, primaryURL, fallbackURL)
+
+	stream, err := proxy.Stream(context.Background(), llm.Request{Model: "primary", Messages: []llm.Message{{Role: llm.RoleUser, Content: "hi"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if served := stream.(FallbackStream).ServedModel(); served != "primary" {
+		t.Fatalf("served model: %s", served)
+	}
+	if stream.Next(); stream.Event().TextDelta != "from primary" {
+		t.Fatalf("buffered first event: %#v", stream.Event())
+	}
+	if *primaryHits != 3 || *fallbackHits != 0 {
+		t.Fatalf("hits: primary=%d fallback=%d", *primaryHits, *fallbackHits)
+	}
+}
+
+func TestClientProxyFallsBackAfterRetriesAreExhausted(t *testing.T) {
+	primaryURL, primaryHits := newFlakyEndpoint(t, "", http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	fallbackURL, _ := newFlakyEndpoint(t, "from fallback")
+	proxy := newFallbackProxy(t, primaryURL, fallbackURL)
+
+	if got := streamText(t, proxy, "primary"); got != "from fallback" {
+		t.Fatalf("got %q", got)
+	}
+	if *primaryHits != 3 {
+		t.Fatalf("primary hits: %d", *primaryHits)
+	}
+}
+
+func TestClientProxyDoesNotRetryPermanentErrors(t *testing.T) {
+	primaryURL, primaryHits := newFlakyEndpoint(t, "", http.StatusBadRequest)
+	fallbackURL, _ := newFlakyEndpoint(t, "from fallback")
+	proxy := newFallbackProxy(t, primaryURL, fallbackURL)
+
+	stream, err := proxy.Stream(context.Background(), llm.Request{Model: "primary", Messages: []llm.Message{{Role: llm.RoleUser, Content: "hi"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	if served := stream.(FallbackStream).ServedModel(); served != "fallback" || *primaryHits != 1 {
+		t.Fatalf("served=%s primary hits=%d", served, *primaryHits)
+	}
+}
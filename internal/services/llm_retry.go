@@ -0,0 +1,142 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	"vadimgribanov.com/tg-gpt/internal/llm"
+	"vadimgribanov.com/tg-gpt/internal/vendors/anthropic"
+	"vadimgribanov.com/tg-gpt/internal/vendors/gemini"
+)
+
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 1; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, p.MaxBackoff)
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// isTransientLLMError reports whether retrying the same request may succeed:
+// rate limits, server-side failures, overload events and dropped connections.
+func isTransientLLMError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var openaiAPIErr *openai.APIError
+	if errors.As(err, &openaiAPIErr) {
+		return isTransientStatus(openaiAPIErr.HTTPStatusCode)
+	}
+	var openaiReqErr *openai.RequestError
+	if errors.As(err, &openaiReqErr) {
+		return isTransientStatus(openaiReqErr.HTTPStatusCode)
+	}
+	var anthropicStatusErr *anthropic.StatusError
+	if errors.As(err, &anthropicStatusErr) {
+		return isTransientStatus(anthropicStatusErr.StatusCode)
+	}
+	var anthropicStreamErr *anthropic.StreamError
+	if errors.As(err, &anthropicStreamErr) {
+		switch anthropicStreamErr.Type {
+		case anthropic.ErrorTypeOverloaded, anthropic.ErrorTypeAPI, anthropic.ErrorTypeRateLimit:
+			return true
+		}
+		return false
+	}
+	var geminiStatusErr *gemini.StatusError
+	if errors.As(err, &geminiStatusErr) {
+		return isTransientStatus(geminiStatusErr.StatusCode)
+	}
+	var geminiAPIErr *gemini.APIError
+	if errors.As(err, &geminiAPIErr) {
+		return isTransientStatus(geminiAPIErr.Code)
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func isTransientStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code == http.StatusRequestTimeout || code >= http.StatusInternalServerError
+}
+
+// primeStream reads events until the first one carrying output (text, a tool call
+// or the end of the response). Failures up to that point have not reached the
+// user yet, so the request can still be retried or sent to a fallback model.
+func primeStream(stream llm.Stream) ([]llm.StreamEvent, error) {
+	var buffered []llm.StreamEvent
+	for stream.Next() {
+		event := stream.Event()
+		buffered = append(buffered, event)
+		if event.TextDelta != "" || event.ToolCall != nil || len(event.ToolCalls) > 0 || event.Done {
+			return buffered, nil
+		}
+	}
+	if err := stream.Err(); err != nil && !errors.Is(err, io.EOF) {
+		return buffered, err
+	}
+	return buffered, nil
+}
+
+// FallbackStream is returned by LLMClientProxy.Stream and tells which model
+// actually answered.
+type FallbackStream interface {
+	llm.Stream
+	ServedModel() string
+}
+
+type primedStream struct {
+	llm.Stream
+	buffered []llm.StreamEvent
+	current  llm.StreamEvent
+	model    string
+}
+
+func (s *primedStream) Next() bool {
+	if len(s.buffered) > 0 {
+		s.current = s.buffered[0]
+		s.buffered = s.buffered[1:]
+		return true
+	}
+	if !s.Stream.Next() {
+		return false
+	}
+	s.current = s.Stream.Event()
+	return true
+}
+
+func (s *primedStream) Event() llm.StreamEvent {
+	return s.current
+}
+
+func (s *primedStream) ServedModel() string {
+	return s.model
+}
@@ -0,0 +1,190 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"time"
+
+	"vadimgribanov.com/tg-gpt/internal/config"
+	"vadimgribanov.com/tg-gpt/internal/llm"
+	"vadimgribanov.com/tg-gpt/internal/mcp"
+)
+
+const (
+	mcpToolNameSeparator = "__"
+	// maxToolNameLen is the longest function name the providers accept.
+	maxToolNameLen      = 64
+	maxMCPToolOutputLen = 8000
+)
+
+var (
+	mcpServerNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	invalidToolNameRunes = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+)
+
+// MCPToolProvider offers the tools of an MCP server to the model. The tools are
+// discovered once on connecting; each is named <server>__<tool> so that servers
+// cannot clash with each other or with the built-in tools.
+type MCPToolProvider struct {
+	name    string
+	client  *mcp.Client
+	timeout time.Duration
+	tools   []llm.Tool
+	// remoteNames maps the offered tool names to the names the server knows.
+	remoteNames map[string]string
+	// readOnly holds the tools the server marked read-only; only they run in
+	// parallel with other calls.
+	readOnly map[string]bool
+	// destructive holds the tools that may delete or overwrite things.
+	destructive map[string]bool
+}
+
+// ConnectMCPServer connects to the server described by cfg and discovers its tools.
+func ConnectMCPServer(ctx context.Context, cfg config.MCPServerConfig) (*MCPToolProvider, error) {
+	if !mcpServerNamePattern.MatchString(cfg.Name) {
+		return nil, fmt.Errorf("mcp server name %q must consist of letters, digits, _ and -", cfg.Name)
+	}
+	timeout := time.Duration(cfg.TimeoutSeconds) * time.Second
+	connectCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var client *mcp.Client
+	var err error
+	switch {
+	case cfg.Command != "" && cfg.URL != "":
+		return nil, fmt.Errorf("mcp server %s: set either command or url, not both", cfg.Name)
+	case cfg.Command != "":
+		client, err = mcp.NewStdioClient(connectCtx, cfg.Command, cfg.Args, cfg.Env)
+	case cfg.URL != "":
+		headers := make(map[string]string, len(cfg.Headers)+1)
+		for key, value := range cfg.Headers {
+			headers[key] = value
+		}
+		if cfg.APIKeyEnv != "" {
+			headers["Authorization"] = "Bearer " + os.Getenv(cfg.APIKeyEnv)
+		}
+		client, err = mcp.NewHTTPClient(connectCtx, cfg.URL, headers)
+	default:
+		return nil, fmt.Errorf("mcp server %s: command or url is required", cfg.Name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connect to mcp server %s: %w", cfg.Name, err)
+	}
+
+	provider, err := NewMCPToolProvider(connectCtx, cfg.Name, client, timeout)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return provider, nil
+}
+
+// NewMCPToolProvider lists the tools of a connected server. timeout limits each
+// tool call.
+func NewMCPToolProvider(ctx context.Context, name string, client *mcp.Client, timeout time.Duration) (*MCPToolProvider, error) {
+	remoteTools, err := client.ListTools(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("mcp server %s: %w", name, err)
+	}
+	p := &MCPToolProvider{
+		name:        name,
+		client:      client,
+		timeout:     timeout,
+		remoteNames: make(map[string]string, len(remoteTools)),
+		readOnly:    make(map[string]bool),
+		destructive: make(map[string]bool),
+	}
+	for _, tool := range remoteTools {
+		toolName := mcpToolName(name, tool.Name)
+		if _, ok := p.remoteNames[toolName]; ok {
+			slog.Warn("Skipping MCP tool with a clashing name", "server", name, "tool", tool.Name)
+			continue
+		}
+		parameters := tool.InputSchema
+		if parameters == nil {
+			parameters = map[string]any{"type": "object", "properties": map[string]any{}}
+		}
+		p.remoteNames[toolName] = tool.Name
+		p.readOnly[toolName] = tool.ReadOnly()
+		p.destructive[toolName] = tool.Destructive()
+		p.tools = append(p.tools, llm.Tool{
+			Name:        toolName,
+			Description: tool.Description,
+			Parameters:  parameters,
+		})
+	}
+	slog.Info("Connected to MCP server", "server", name, "tools", len(p.tools))
+	return p, nil
+}
+
+// mcpToolName prefixes a tool with its server and replaces what function names
+// may not contain.
+func mcpToolName(server, tool string) string {
+	name := server + mcpToolNameSeparator + invalidToolNameRunes.ReplaceAllString(tool, "_")
+	if len(name) > maxToolNameLen {
+		name = name[:maxToolNameLen]
+	}
+	return name
+}
+
+func (p *MCPToolProvider) Tools() []llm.Tool {
+	return p.tools
+}
+
+// Sequential runs the tools not marked read-only one at a time, since nothing is
+// known about what they change.
+func (p *MCPToolProvider) Sequential(toolName string) bool {
+	return !p.readOnly[toolName]
+}
+
+// Destructive asks the user before running tools the server did not mark as
+// harmless.
+func (p *MCPToolProvider) Destructive(toolName string) bool {
+	return p.destructive[toolName]
+}
+
+// HandleToolCall proxies the call to the server. Failures of the tool or the
+// server are returned as errors, so that they are reported to the model and count
+// towards the tool failure limit like those of any other tool.
+func (p *MCPToolProvider) HandleToolCall(ctx context.Context, mctx TurnContext, toolCall llm.ToolCall) (string, error) {
+	remoteName, ok := p.remoteNames[toolCall.Name]
+	if !ok {
+		return "", fmt.Errorf("unknown tool of mcp server %s: %s", p.name, toolCall.Name)
+	}
+	arguments := json.RawMessage(toolCall.Arguments)
+	if len(arguments) == 0 {
+		arguments = json.RawMessage("{}")
+	}
+	if !json.Valid(arguments) {
+		return "", fmt.Errorf("invalid arguments for %s", toolCall.Name)
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	result, err := p.client.CallTool(callCtx, remoteName, arguments)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			return "", fmt.Errorf("the tool %s did not answer within %s", toolCall.Name, p.timeout)
+		}
+		if ctx.Err() != nil {
+			return "", err
+		}
+		slog.WarnContext(ctx, "MCP tool call failed", "server", p.name, "tool", remoteName, "error", err)
+		return "", fmt.Errorf("the tool %s failed: %w", toolCall.Name, err)
+	}
+	output := truncateString(result.Text(), maxMCPToolOutputLen)
+	if result.IsError {
+		return "", fmt.Errorf("the tool %s reported an error: %s", toolCall.Name, output)
+	}
+	return output, nil
+}
+
+// Close disconnects from the server.
+func (p *MCPToolProvider) Close() error {
+	return p.client.Close()
+}
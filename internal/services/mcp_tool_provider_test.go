@@ -0,0 +1,156 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"vadimgribanov.com/tg-gpt/internal/config"
+	"vadimgribanov.com/tg-gpt/internal/llm"
+	"vadimgribanov.com/tg-gpt/internal/models"
+)
+
+// newTestMCPServer serves a streamable HTTP MCP server with a lookup tool, a tool
+// that reports an error and a tool that never answers.
+func newTestMCPServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+			Params struct {
+				Name      string            `json:"name"`
+				Arguments map[string]string `json:"arguments"`
+			} `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil || len(msg.ID) == 0 {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		var result any
+		switch msg.Method {
+		case "initialize":
+			result = map[string]any{"protocolVersion": "2025-06-18", "serverInfo": map[string]any{"name": "docs"}}
+		case "tools/list":
+			result = map[string]any{"tools": []map[string]any{
+				{"name": "lookup.page", "description": "Look up a docs page", "inputSchema": map[string]any{"type": "object"}},
+				{"name": "broken"},
+				{"name": "hang"},
+			}}
+		case "tools/call":
+			if msg.Params.Name == "hang" {
+				<-r.Context().Done()
+				return
+			}
+			if msg.Params.Name == "broken" {
+				result = map[string]any{"content": []map[string]any{{"type": "text", "text": "index unavailable"}}, "isError": true}
+				break
+			}
+			result = map[string]any{"content": []map[string]any{{"type": "text", "text": "page about " + msg.Params.Arguments["topic"]}}}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "id": msg.ID, "result": result})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestMCPToolCallIsProxiedAndRecordedAsToolResult(t *testing.T) {
+	h := newTextServiceIntegrationHarness(t, [][]llm.StreamEvent{
+		{{ToolCalls: []llm.ToolCall{{ID: "call_1", Name: "docs__lookup_page", Arguments: `{"topic":"retries"}`}}}},
+		{{TextDelta: "Here is what the docs say."}},
+	})
+	provider, err := ConnectMCPServer(context.Background(), config.MCPServerConfig{
+		Name:           "docs",
+		URL:            newTestMCPServer(t).URL,
+		TimeoutSeconds: 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+	if err := h.tools.Register(provider); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = h.textService.handleLLMRequest(context.Background(), h.user, 201, llm.Message{
+		Role:    llm.RoleUser,
+		Content: "how do retries work?",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offered := map[string]bool{}
+	for _, tool := range h.llmClient.requestsSnapshot()[0].Tools {
+		offered[tool.Name] = true
+	}
+	if !offered["docs__lookup_page"] || !offered["docs__hang"] || !offered["save_memory"] {
+		t.Fatalf("offered tools: %v", offered)
+	}
+	events := h.traceEvents(t, h.user.CurrentDialogId)
+	if len(events) != 4 || events[2].EventType != models.EventTypeToolResult {
+		t.Fatalf("trace events: %#v", events)
+	}
+	result := decodePayload[models.ToolResultPayload](t, events[2].Payload)
+	if result.Name != "docs__lookup_page" || result.Result != "page about retries" {
+		t.Fatalf("tool result: %#v", result)
+	}
+}
+
+func TestMCPToolCallTimesOut(t *testing.T) {
+	provider, err := ConnectMCPServer(context.Background(), config.MCPServerConfig{
+		Name:           "docs",
+		URL:            newTestMCPServer(t).URL,
+		TimeoutSeconds: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+
+	_, err = provider.HandleToolCall(context.Background(), TurnContext{}, llm.ToolCall{Name: "docs__hang"})
+	if err == nil || err.Error() != "the tool docs__hang did not answer within 1s" {
+		t.Fatalf("error: %v", err)
+	}
+}
+
+func TestMCPToolErrorCountsAsToolFailure(t *testing.T) {
+	brokenCall := []llm.StreamEvent{{ToolCalls: []llm.ToolCall{{ID: "call_1", Name: "docs__broken", Arguments: "{}"}}}}
+	h := newTextServiceIntegrationHarness(t, [][]llm.StreamEvent{
+		brokenCall, brokenCall, brokenCall,
+		{{TextDelta: "The docs are unavailable right now."}},
+	})
+	provider, err := ConnectMCPServer(context.Background(), config.MCPServerConfig{
+		Name:           "docs",
+		URL:            newTestMCPServer(t).URL,
+		TimeoutSeconds: 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+	if err := h.tools.Register(provider); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := h.textService.handleLLMRequest(context.Background(), h.user, 201, llm.Message{
+		Role:    llm.RoleUser,
+		Content: "look it up",
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	events := h.traceEvents(t, h.user.CurrentDialogId)
+	result := decodePayload[models.ToolResultPayload](t, events[2].Payload)
+	if !isToolErrorResult(result.Result) || !strings.Contains(result.Result, "index unavailable") {
+		t.Fatalf("tool result: %#v", result)
+	}
+	requests := h.llmClient.requestsSnapshot()
+	if len(requests) != 4 || len(requests[3].Tools) != 0 {
+		t.Fatalf("three failures of the server must withdraw tools: %d requests", len(requests))
+	}
+}
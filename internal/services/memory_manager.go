@@ -21,8 +21,10 @@ type MemoryConfig struct {
 	FactConfidenceMin   float64
 	PrefConfidenceMin   float64
 	SemanticDedupCosine float64
+	DocumentMinCosine   float64
 	FactsTopK           int
 	EpisodesTopK        int
+	DocumentsTopK       int
 	EpisodeMinTurns     int
 	RecentTraceEvents   int
 }
@@ -32,6 +34,8 @@ type MemoryManager struct {
 	prefs      *repositories.PreferenceRepo
 	facts      *repositories.FactRepo
 	episodes   *repositories.EpisodeRepo
+	documents  *repositories.DocumentRepo
+	images     *ImageStore
 	embedder   *Embedder
 	extractor  *Extractor
 	summarizer *Summarizer
@@ -43,6 +47,8 @@ func NewMemoryManager(
 	prefs *repositories.PreferenceRepo,
 	facts *repositories.FactRepo,
 	episodes *repositories.EpisodeRepo,
+	documents *repositories.DocumentRepo,
+	images *ImageStore,
 	embedder *Embedder,
 	extractor *Extractor,
 	summarizer *Summarizer,
@@ -53,6 +59,8 @@ func NewMemoryManager(
 		prefs:      prefs,
 		facts:      facts,
 		episodes:   episodes,
+		documents:  documents,
+		images:     images,
 		embedder:   embedder,
 		extractor:  extractor,
 		summarizer: summarizer,
@@ -64,23 +72,40 @@ type TurnContext struct {
 	UserID      int64
 	DialogID    int64
 	UserTraceID int64
+	// MemberID is the group member the turn answers. Preferences and facts are
+	// read and written for them rather than for the group that owns the dialog.
+	MemberID int64
+}
+
+// MemoryUserID returns whose preferences and facts the turn uses.
+func (c TurnContext) MemoryUserID() int64 {
+	if c.MemberID != 0 {
+		return c.MemberID
+	}
+	return c.UserID
 }
 
 type RetrievedMemory struct {
 	Preferences []models.Preference
 	Facts       []models.Fact
 	Episodes    []models.Episode
+	Documents   []models.DocumentChunk
 	RecentTrace []models.TraceEvent
 }
 
 // BeginTurn writes the user_msg trace event and returns a TurnContext that subsequent
 // calls thread through. The returned UserTraceID is the source_trace_id for any
-// candidates promoted from this turn.
+// candidates promoted from this turn. speakerID is the group member who wrote the
+// message, or zero in private chats. Images are recorded as blob references.
 func (m *MemoryManager) BeginTurn(
-	userID, dialogID int64,
+	userID, dialogID, speakerID int64,
 	msg llm.Message,
 	tgMsgID int64,
 ) (TurnContext, error) {
+	msg, err := m.images.Externalize(msg)
+	if err != nil {
+		return TurnContext{}, fmt.Errorf("store images: %w", err)
+	}
 	payload := models.UserMsgPayload{
 		Content:      msg.Content,
 		MultiContent: msg.Parts,
@@ -95,52 +120,121 @@ func (m *MemoryManager) BeginTurn(
 		EventType:   models.EventTypeUserMsg,
 		Payload:     payload,
 		TgMessageID: tgPtr,
+		SpeakerID:   speakerID,
 	})
 	if err != nil {
 		return TurnContext{}, fmt.Errorf("append user_msg: %w", err)
 	}
-	return TurnContext{UserID: userID, DialogID: dialogID, UserTraceID: id}, nil
+	return TurnContext{UserID: userID, DialogID: dialogID, UserTraceID: id, MemberID: speakerID}, nil
 }
 
 // PopForRetry deletes the most recent user_msg event and everything after it in the
-// current dialog, returning the popped user message so it can be replayed.
-func (m *MemoryManager) PopForRetry(userID, dialogID int64) (llm.Message, int64, error) {
+// current dialog, returning the popped user message so it can be replayed. The
+// returned input has no TraceID since its event is gone.
+func (m *MemoryManager) PopForRetry(userID, dialogID int64) (UserInput, error) {
 	e, err := m.trace.PopLatestExchange(userID, dialogID)
 	if err != nil {
-		return llm.Message{}, 0, err
+		return UserInput{}, err
+	}
+	input, err := m.userInputFromEvent(e)
+	if err != nil {
+		return UserInput{}, err
+	}
+	input.TraceID = 0
+	return input, nil
+}
+
+// TurnInputs returns the user messages a turn answers, starting with the one at
+// mctx.UserTraceID, e.g. to carry on a turn after it paused.
+func (m *MemoryManager) TurnInputs(mctx TurnContext) ([]UserInput, error) {
+	events, err := m.trace.GetUserMsgsFrom(mctx.UserID, mctx.DialogID, mctx.UserTraceID)
+	if err != nil {
+		return nil, err
+	}
+	inputs := make([]UserInput, 0, len(events))
+	for _, e := range events {
+		input, err := m.userInputFromEvent(e)
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, input)
 	}
+	return inputs, nil
+}
+
+func (m *MemoryManager) userInputFromEvent(e models.TraceEvent) (UserInput, error) {
 	var p models.UserMsgPayload
 	if err := json.Unmarshal(e.Payload, &p); err != nil {
-		return llm.Message{}, 0, fmt.Errorf("parse user_msg payload: %w", err)
+		return UserInput{}, fmt.Errorf("parse user_msg payload: %w", err)
+	}
+	input := UserInput{
+		TraceID:   e.ID,
+		Message:   llm.Message{Role: llm.RoleUser},
+		SpeakerID: e.SpeakerID,
 	}
-	var tgMsgID int64
 	if e.TgMessageID != nil {
-		tgMsgID = *e.TgMessageID
+		input.TgMessageID = *e.TgMessageID
 	}
-	msg := llm.Message{Role: llm.RoleUser}
 	if len(p.MultiContent) > 0 {
-		msg.Parts = p.MultiContent
+		input.Message.Parts = p.MultiContent
 	} else {
-		msg.Content = p.Content
+		input.Message.Content = p.Content
+	}
+	input.Message = m.images.Resolve(input.Message)
+	return input, nil
+}
+
+// FindByTgMessage returns the event of the given type recorded for a Telegram
+// message and whether the dialog holding it went on with another user message. A
+// nil event means the message is not part of any dialog, e.g. a notice.
+func (m *MemoryManager) FindByTgMessage(userID, tgMessageID int64, eventType string) (*models.TraceEvent, bool, error) {
+	event, err := m.trace.GetByTgMessageID(userID, tgMessageID, eventType)
+	if err != nil || event == nil {
+		return nil, false, err
+	}
+	continued, err := m.trace.HasUserMsgAfter(userID, event.DialogID, event.TurnIndex)
+	if err != nil {
+		return nil, false, err
 	}
-	return msg, tgMsgID, nil
+	return event, continued, nil
+}
+
+// PopForEdit removes the latest exchange of the dialog like PopForRetry and returns
+// the Telegram messages its answer was sent as, so the re-run can replace them.
+func (m *MemoryManager) PopForEdit(userID, dialogID, userTurnIndex int64) ([]int64, error) {
+	answerTgMsgIDs, err := m.trace.GetLastAnswerTgMessageIDs(userID, dialogID, userTurnIndex)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := m.trace.PopLatestExchange(userID, dialogID); err != nil {
+		return nil, err
+	}
+	return answerTgMsgIDs, nil
 }
 
 // AppendModelMsg records the assistant's response (with any tool calls) as a model_msg event.
+// model is the model that produced the response; fallbackFrom is the requested model
+// when a fallback answered instead, and empty otherwise. tgMsgIDs are the Telegram
+// messages the response was sent as.
 func (m *MemoryManager) AppendModelMsg(
 	mctx TurnContext,
 	content string,
 	toolCalls []llm.ToolCall,
 	model string,
-	tgMsgID int64,
+	fallbackFrom string,
+	tgMsgIDs []int64,
 ) (int64, error) {
 	payload := models.ModelMsgPayload{
-		Content:   content,
-		ToolCalls: toolCalls,
+		Content:      content,
+		ToolCalls:    toolCalls,
+		FallbackFrom: fallbackFrom,
 	}
 	var tgPtr *int64
-	if tgMsgID != 0 {
-		tgPtr = &tgMsgID
+	if len(tgMsgIDs) > 0 {
+		tgPtr = &tgMsgIDs[len(tgMsgIDs)-1]
+	}
+	if len(tgMsgIDs) > 1 {
+		payload.TgMessageIDs = tgMsgIDs
 	}
 	return m.trace.Append(repositories.AppendEventInput{
 		UserID:      mctx.UserID,
@@ -201,11 +295,13 @@ func (m *MemoryManager) RecordReminderFire(
 }
 
 // Retrieve performs scoped retrieval for the given query: all preferences,
-// top-K facts (hybrid FTS5 + cosine via RRF), and the last N trace events.
+// top-K facts, episodes and document chunks (hybrid FTS5 + cosine via RRF), and the
+// last N trace events. Preferences and facts belong to the member being answered;
+// episodes, documents and the trace belong to whoever owns the dialog.
 func (m *MemoryManager) Retrieve(ctx context.Context, mctx TurnContext, query string) (RetrievedMemory, error) {
 	var out RetrievedMemory
 
-	prefs, err := m.prefs.GetAll(mctx.UserID)
+	prefs, err := m.prefs.GetAll(mctx.MemoryUserID())
 	if err != nil {
 		return out, fmt.Errorf("get preferences: %w", err)
 	}
@@ -217,7 +313,7 @@ func (m *MemoryManager) Retrieve(ctx context.Context, mctx TurnContext, query st
 	}
 	out.RecentTrace = recent
 
-	if facts, err := m.retrieveFacts(ctx, mctx.UserID, query); err != nil {
+	if facts, err := m.retrieveFacts(ctx, mctx.MemoryUserID(), query); err != nil {
 		slog.WarnContext(ctx, "fact retrieval failed; continuing without facts", "error", err)
 	} else {
 		out.Facts = facts
@@ -229,9 +325,88 @@ func (m *MemoryManager) Retrieve(ctx context.Context, mctx TurnContext, query st
 		out.Episodes = eps
 	}
 
+	if chunks, err := m.retrieveDocumentChunks(ctx, mctx.UserID, query, m.cfg.DocumentsTopK); err != nil {
+		slog.WarnContext(ctx, "document retrieval failed; continuing without documents", "error", err)
+	} else {
+		out.Documents = chunks
+	}
+
 	return out, nil
 }
 
+func (m *MemoryManager) retrieveDocumentChunks(ctx context.Context, userID int64, query string, topK int) ([]models.DocumentChunk, error) {
+	q := strings.TrimSpace(query)
+	if len(q) < 3 || topK == 0 {
+		return nil, nil
+	}
+
+	const candidateLimit = 20
+
+	lexicalIDs, err := m.documents.SearchLexical(userID, q, candidateLimit)
+	if err != nil {
+		return nil, fmt.Errorf("lexical document search: %w", err)
+	}
+
+	all, err := m.documents.ListChunks(userID)
+	if err != nil {
+		return nil, fmt.Errorf("list document chunks: %w", err)
+	}
+
+	var vectorIDs []int64
+	if len(all) > 0 {
+		queryEmb, err := m.embedder.Embed(ctx, q)
+		if err != nil {
+			slog.WarnContext(ctx, "query embedding failed; falling back to lexical only", "error", err)
+		} else {
+			type scored struct {
+				id    int64
+				score float32
+			}
+			scoredAll := make([]scored, 0, len(all))
+			for _, c := range all {
+				if c.EmbeddingModel != m.embedder.Model() {
+					continue
+				}
+				// Every chunk is someone's nearest neighbour; only close ones count.
+				score := vec.Cosine(queryEmb, c.Embedding)
+				if score < float32(m.cfg.DocumentMinCosine) {
+					continue
+				}
+				scoredAll = append(scoredAll, scored{id: c.ID, score: score})
+			}
+			sort.Slice(scoredAll, func(i, j int) bool { return scoredAll[i].score > scoredAll[j].score })
+			limit := candidateLimit
+			if limit > len(scoredAll) {
+				limit = len(scoredAll)
+			}
+			vectorIDs = make([]int64, 0, limit)
+			for i := 0; i < limit; i++ {
+				vectorIDs = append(vectorIDs, scoredAll[i].id)
+			}
+		}
+	}
+
+	fusedIDs := rrfFuse(lexicalIDs, vectorIDs, topK)
+	if len(fusedIDs) == 0 {
+		return nil, nil
+	}
+	chunks, err := m.documents.GetChunksByIDs(fusedIDs)
+	if err != nil {
+		return nil, fmt.Errorf("load fused document chunks: %w", err)
+	}
+	idx := make(map[int64]models.DocumentChunk, len(chunks))
+	for _, c := range chunks {
+		idx[c.ID] = c
+	}
+	ordered := make([]models.DocumentChunk, 0, len(fusedIDs))
+	for _, id := range fusedIDs {
+		if c, ok := idx[id]; ok {
+			ordered = append(ordered, c)
+		}
+	}
+	return ordered, nil
+}
+
 func (m *MemoryManager) retrieveEpisodes(ctx context.Context, userID int64, query string) ([]models.Episode, error) {
 	q := strings.TrimSpace(query)
 	if len(q) < 3 || m.cfg.EpisodesTopK == 0 {
@@ -424,6 +599,12 @@ func (m *MemoryManager) AssemblePrompt(systemHeader string, retrieved RetrievedM
 			fmt.Fprintf(&sys, "- %s: %s\n", date, e.Summary)
 		}
 	}
+	if len(retrieved.Documents) > 0 {
+		sys.WriteString("\n## Relevant excerpts from the user's documents\n")
+		for _, c := range retrieved.Documents {
+			fmt.Fprintf(&sys, "### %s, part %d\n%s\n", c.DocumentName, c.ChunkIndex+1, c.Content)
+		}
+	}
 
 	messages := []llm.Message{
 		{Role: llm.RoleSystem, Content: sys.String()},
@@ -437,6 +618,10 @@ func (m *MemoryManager) AssemblePrompt(systemHeader string, retrieved RetrievedM
 		}
 	}
 	messages = appendTraceMessages(messages, retrieved.RecentTrace[start:])
+	// The trace references images by blob URL; models need the images themselves.
+	for i := range messages {
+		messages[i] = m.images.Resolve(messages[i])
+	}
 	return messages
 }
 
@@ -526,9 +711,10 @@ func traceEventToMessage(e models.TraceEvent) (llm.Message, bool) {
 		return llm.Message{
 			Role: llm.RoleTool,
 			ToolResult: &llm.ToolResult{
-				CallID: p.ToolCallID,
-				Name:   p.Name,
-				Output: p.Result,
+				CallID:  p.ToolCallID,
+				Name:    p.Name,
+				Output:  p.Result,
+				IsError: isToolErrorResult(p.Result),
 			},
 		}, true
 	}
@@ -581,6 +767,49 @@ func (m *MemoryManager) DeleteEpisode(userID, id int64) error {
 	return m.episodes.Delete(id, userID)
 }
 
+// AddDocument embeds the chunks of an uploaded file and stores them in the user's
+// knowledge base. Like EndTurn it is designed to run in a goroutine, so failures are
+// logged but never returned.
+func (m *MemoryManager) AddDocument(ctx context.Context, userID int64, name, mimeType string, chunks []string) {
+	if len(chunks) == 0 {
+		return
+	}
+	embeddings, err := m.embedder.EmbedAll(ctx, chunks)
+	if err != nil {
+		slog.WarnContext(ctx, "AddDocument: embed failed", "error", err, "name", name)
+		return
+	}
+	id, err := m.documents.Insert(repositories.InsertDocumentInput{
+		UserID:         userID,
+		Name:           name,
+		MimeType:       mimeType,
+		Chunks:         chunks,
+		Embeddings:     embeddings,
+		EmbeddingModel: m.embedder.Model(),
+	})
+	if err != nil {
+		slog.WarnContext(ctx, "AddDocument: insert failed", "error", err, "name", name)
+		return
+	}
+	slog.InfoContext(ctx, "document stored", "user_id", userID, "document_id", id, "chunks", len(chunks))
+}
+
+// SearchDocuments returns the document chunks most relevant to query (used by the
+// search_documents tool).
+func (m *MemoryManager) SearchDocuments(ctx context.Context, userID int64, query string, limit int) ([]models.DocumentChunk, error) {
+	return m.retrieveDocumentChunks(ctx, userID, query, limit)
+}
+
+// ListDocuments returns the documents in a user's knowledge base.
+func (m *MemoryManager) ListDocuments(userID int64) ([]models.Document, error) {
+	return m.documents.List(userID)
+}
+
+// DeleteDocument removes one document and its chunks after verifying it belongs to the user.
+func (m *MemoryManager) DeleteDocument(userID, id int64) error {
+	return m.documents.Delete(id, userID)
+}
+
 // CloseDialog summarizes the given (user, dialog) and writes one episodic_memory row.
 // Idempotent: skips if an episode already exists for that dialog or if fewer than
 // EpisodeMinTurns turns are present. Failures are logged but never returned — the
@@ -661,7 +890,7 @@ func (m *MemoryManager) promote(ctx context.Context, mctx TurnContext, c Candida
 		}
 		traceID := mctx.UserTraceID
 		return m.prefs.Upsert(repositories.UpsertPreferenceInput{
-			UserID:        mctx.UserID,
+			UserID:        mctx.MemoryUserID(),
 			Key:           c.Key,
 			Value:         c.Value,
 			Source:        models.PreferenceSourceInferred,
@@ -673,7 +902,7 @@ func (m *MemoryManager) promote(ctx context.Context, mctx TurnContext, c Candida
 			return nil
 		}
 		hash := contentHash(c.Content)
-		if existing, err := m.facts.GetByContentHash(mctx.UserID, hash); err != nil {
+		if existing, err := m.facts.GetByContentHash(mctx.MemoryUserID(), hash); err != nil {
 			return fmt.Errorf("hash lookup: %w", err)
 		} else if existing != nil {
 			return nil
@@ -684,7 +913,7 @@ func (m *MemoryManager) promote(ctx context.Context, mctx TurnContext, c Candida
 			return fmt.Errorf("embed fact: %w", err)
 		}
 
-		sameSubject, err := m.facts.ListActiveBySubject(mctx.UserID, c.Subject)
+		sameSubject, err := m.facts.ListActiveBySubject(mctx.MemoryUserID(), c.Subject)
 		if err != nil {
 			return fmt.Errorf("list same subject: %w", err)
 		}
@@ -698,7 +927,7 @@ func (m *MemoryManager) promote(ctx context.Context, mctx TurnContext, c Candida
 		}
 
 		_, err = m.facts.Insert(repositories.InsertFactInput{
-			UserID:         mctx.UserID,
+			UserID:         mctx.MemoryUserID(),
 			Subject:        c.Subject,
 			Content:        c.Content,
 			ContentHash:    hash,
@@ -22,7 +22,7 @@ func NewMemoryService(prefs *repositories.PreferenceRepo, memoryManager *MemoryM
 	return &MemoryService{prefs: prefs, memoryManager: memoryManager}
 }
 
-func (s *MemoryService) GetMemoryTools() []llm.Tool {
+func (s *MemoryService) Tools() []llm.Tool {
 	return []llm.Tool{
 		{
 			Name:        "save_memory",
@@ -123,15 +123,72 @@ func (s *MemoryService) GetMemoryTools() []llm.Tool {
 				"required": []string{"episode_id"},
 			},
 		},
+		{
+			Name:        "search_documents",
+			Description: "Search the files the user uploaded (PDFs, notes, code) and return the most relevant excerpts. Use it when the answer may be in the user's documents.",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"query": map[string]interface{}{
+						"type":        "string",
+						"description": "What to look for, in natural language or keywords.",
+					},
+				},
+				"required": []string{"query"},
+			},
+		},
+		{
+			Name:        "list_documents",
+			Description: "List the documents stored in the user's knowledge base. Each entry has an ID, upload date, and file name.",
+			Parameters: map[string]interface{}{
+				"type":       "object",
+				"properties": map[string]interface{}{},
+			},
+		},
+		{
+			Name:        "delete_document",
+			Description: "Delete a stored document by its ID. Use after list_documents to find the right ID.",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"document_id": map[string]interface{}{
+						"type":        "integer",
+						"description": "The ID of the document to delete (from list_documents).",
+					},
+				},
+				"required": []string{"document_id"},
+			},
+		},
 	}
 }
 
+// Sequential keeps tools that change memory from running alongside other calls,
+// so that a lookup in the same step sees a consistent state.
+func (s *MemoryService) Sequential(toolName string) bool {
+	switch toolName {
+	case "save_memory", "delete_memory", "save_fact", "forget_about", "forget_episode", "delete_document":
+		return true
+	}
+	return false
+}
+
+// Destructive makes the tools that delete what the user saved ask first.
+func (s *MemoryService) Destructive(toolName string) bool {
+	switch toolName {
+	case "delete_memory", "forget_about", "forget_episode", "delete_document":
+		return true
+	}
+	return false
+}
+
 func (s *MemoryService) HandleToolCall(ctx context.Context, mctx TurnContext, toolCall llm.ToolCall) (string, error) {
 	switch toolCall.Name {
 	case "list_memories":
-		return s.handleListMemories(mctx.UserID)
+		return s.handleListMemories(mctx.MemoryUserID())
 	case "list_episodes":
 		return s.handleListEpisodes(mctx.UserID)
+	case "list_documents":
+		return s.handleListDocuments(mctx.UserID)
 	}
 
 	if strings.TrimSpace(toolCall.Arguments) == "" {
@@ -147,15 +204,19 @@ func (s *MemoryService) HandleToolCall(ctx context.Context, mctx TurnContext, to
 	case "save_memory":
 		return s.handleSaveMemory(mctx, toolCall.Arguments)
 	case "get_memory":
-		return s.handleGetMemory(mctx.UserID, toolCall.Arguments)
+		return s.handleGetMemory(mctx.MemoryUserID(), toolCall.Arguments)
 	case "delete_memory":
-		return s.handleDeleteMemory(mctx.UserID, toolCall.Arguments)
+		return s.handleDeleteMemory(mctx.MemoryUserID(), toolCall.Arguments)
 	case "save_fact":
 		return s.handleSaveFact(ctx, mctx, toolCall.Arguments)
 	case "forget_about":
-		return s.handleForgetAbout(mctx.UserID, toolCall.Arguments)
+		return s.handleForgetAbout(mctx.MemoryUserID(), toolCall.Arguments)
 	case "forget_episode":
 		return s.handleForgetEpisode(mctx.UserID, toolCall.Arguments)
+	case "search_documents":
+		return s.handleSearchDocuments(ctx, mctx.UserID, toolCall.Arguments)
+	case "delete_document":
+		return s.handleDeleteDocument(mctx.UserID, toolCall.Arguments)
 	default:
 		return "", fmt.Errorf("unknown tool call: %s", toolCall.Name)
 	}
@@ -175,14 +236,14 @@ func (s *MemoryService) handleSaveMemory(mctx TurnContext, arguments string) (st
 	}
 	traceID := mctx.UserTraceID
 	err := s.prefs.Upsert(repositories.UpsertPreferenceInput{
-		UserID:        mctx.UserID,
+		UserID:        mctx.MemoryUserID(),
 		Key:           args.Key,
 		Value:         args.Content,
 		Source:        models.PreferenceSourceExplicit,
 		SourceTraceID: &traceID,
 	})
 	if err != nil {
-		slog.Error("Failed to save preference", "error", err, "user_id", mctx.UserID)
+		slog.Error("Failed to save preference", "error", err, "user_id", mctx.MemoryUserID())
 		return "Failed to save preference", err
 	}
 	return fmt.Sprintf("Preference saved: %s = %s", args.Key, args.Content), nil
@@ -272,7 +333,7 @@ func (s *MemoryService) handleSaveFact(ctx context.Context, mctx TurnContext, ar
 		Confidence: 1.0,
 	})
 	if err != nil {
-		slog.ErrorContext(ctx, "Failed to save fact", "error", err, "user_id", mctx.UserID)
+		slog.ErrorContext(ctx, "Failed to save fact", "error", err, "user_id", mctx.MemoryUserID())
 		return "Failed to save fact", err
 	}
 	return fmt.Sprintf("Fact saved about %s: %s", args.Subject, args.Content), nil
@@ -310,3 +371,63 @@ func (s *MemoryService) handleForgetEpisode(userID int64, arguments string) (str
 	}
 	return fmt.Sprintf("Episode deleted: %d", args.EpisodeID), nil
 }
+
+// searchDocumentsLimit is how many excerpts search_documents returns.
+const searchDocumentsLimit = 5
+
+func (s *MemoryService) handleSearchDocuments(ctx context.Context, userID int64, arguments string) (string, error) {
+	var args struct {
+		Query string `json:"query"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return "", fmt.Errorf("invalid arguments for search_documents: %w", err)
+	}
+	if strings.TrimSpace(args.Query) == "" {
+		return "query is required", nil
+	}
+	chunks, err := s.memoryManager.SearchDocuments(ctx, userID, args.Query, searchDocumentsLimit)
+	if err != nil {
+		return "", err
+	}
+	if len(chunks) == 0 {
+		return "No matching excerpts in the user's documents.", nil
+	}
+	var b strings.Builder
+	for _, c := range chunks {
+		fmt.Fprintf(&b, "### %s (document ID %d), part %d\n%s\n\n", c.DocumentName, c.DocumentID, c.ChunkIndex+1, c.Content)
+	}
+	return b.String(), nil
+}
+
+func (s *MemoryService) handleListDocuments(userID int64) (string, error) {
+	docs, err := s.memoryManager.ListDocuments(userID)
+	if err != nil {
+		return "", err
+	}
+	if len(docs) == 0 {
+		return "No documents stored.", nil
+	}
+	var b strings.Builder
+	b.WriteString("Documents:\n")
+	for _, d := range docs {
+		date := time.Unix(d.CreatedAt, 0).Format("2006-01-02")
+		fmt.Fprintf(&b, "- ID %d (%s): %s, %d part(s)\n", d.ID, date, d.Name, d.ChunkCount)
+	}
+	return b.String(), nil
+}
+
+func (s *MemoryService) handleDeleteDocument(userID int64, arguments string) (string, error) {
+	var args struct {
+		DocumentID int64 `json:"document_id"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return "", fmt.Errorf("invalid arguments for delete_document: %w", err)
+	}
+	if args.DocumentID == 0 {
+		return "document_id is required", nil
+	}
+	if err := s.memoryManager.DeleteDocument(userID, args.DocumentID); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Document deleted: %d", args.DocumentID), nil
+}
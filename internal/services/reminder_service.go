@@ -3,6 +3,7 @@ package services
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"strconv"
@@ -64,7 +65,7 @@ func (s *ReminderService) SetScheduledActionRunner(actionRunner ScheduledActionR
 // *time.Location at parse time.
 const isoLocalLayout = "2006-01-02T15:04:05"
 
-func (s *ReminderService) GetReminderTools() []llm.Tool {
+func (s *ReminderService) Tools() []llm.Tool {
 	return []llm.Tool{
 		{
 			Name:        "create_one_shot_reminder",
@@ -166,7 +167,20 @@ func (s *ReminderService) GetReminderTools() []llm.Tool {
 	}
 }
 
-func (s *ReminderService) HandleToolCall(userID int64, toolCall llm.ToolCall) (string, error) {
+// Sequential runs the tools that create or cancel reminders one at a time.
+func (s *ReminderService) Sequential(toolName string) bool {
+	return toolName != "list_reminders"
+}
+
+// Destructive makes cancelling a reminder ask first.
+func (s *ReminderService) Destructive(toolName string) bool {
+	return toolName == "cancel_reminder"
+}
+
+// HandleToolCall runs a reminder tool for the member the turn answers, who gets the
+// reminders delivered.
+func (s *ReminderService) HandleToolCall(ctx context.Context, mctx TurnContext, toolCall llm.ToolCall) (string, error) {
+	userID := mctx.MemoryUserID()
 	if toolCall.Name == "list_reminders" {
 		return s.handleListReminders(userID)
 	}
@@ -515,7 +529,7 @@ func (s *ReminderService) fireReminder(ctx context.Context, reminder models.Remi
 		return
 	}
 
-	if err := s.userRepo.Touch(user.Id, time.Now().Unix()); err != nil {
+	if err := s.userRepo.Touch(user.Id, 0, time.Now().Unix()); err != nil {
 		slog.ErrorContext(ctx, "Failed to update user last interaction", "error", err, "user_id", reminder.UserID)
 	}
 
@@ -543,6 +557,10 @@ func (s *ReminderService) fireScheduledAction(ctx context.Context, user models.U
 	}
 
 	response, err := s.actionRunner.RunScheduledAction(ctx, user, reminder)
+	if errors.Is(err, ErrBudgetExceeded) {
+		slog.InfoContext(ctx, "Scheduled action skipped over budget", "reminder_id", reminder.ID)
+		response, err = fmt.Sprintf("Skipped scheduled action \"%s\": your budget is used up.", reminder.Message), nil
+	}
 	if err != nil {
 		slog.ErrorContext(ctx, "Failed to run scheduled action", "error", err, "reminder_id", reminder.ID)
 		s.releaseReminderClaim(ctx, reminder.ID)
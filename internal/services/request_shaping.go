@@ -0,0 +1,108 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"vadimgribanov.com/tg-gpt/internal/llm"
+)
+
+type DroppedFeature string
+
+const (
+	DroppedTools      DroppedFeature = "tools"
+	DroppedImages     DroppedFeature = "images"
+	DroppedToolChoice DroppedFeature = "tool_choice"
+)
+
+const imagePlaceholder = "[image omitted: the current model cannot view images]"
+
+// ShapeRequest degrades a request to what the model supports. Tools are removed
+// and earlier tool calls/results are flattened into plain text for models without
+// function calling, images are replaced by a placeholder for text-only models, and
+// ToolChoice is cleared when the model does not accept it. The input request is
+// not modified.
+func ShapeRequest(request llm.Request, caps llm.Capabilities) (llm.Request, []DroppedFeature) {
+	var dropped []DroppedFeature
+	if !caps.FunctionTools {
+		if len(request.Tools) > 0 {
+			dropped = append(dropped, DroppedTools)
+		}
+		request.Tools = nil
+		request.ToolChoice = ""
+		request.Messages = flattenToolMessages(request.Messages)
+	}
+	if !caps.ToolChoice && request.ToolChoice != "" {
+		dropped = append(dropped, DroppedToolChoice)
+		request.ToolChoice = ""
+	}
+	if !caps.Vision {
+		var replaced bool
+		request.Messages, replaced = replaceImageParts(request.Messages)
+		if replaced {
+			dropped = append(dropped, DroppedImages)
+		}
+	}
+	return request, dropped
+}
+
+func flattenToolMessages(messages []llm.Message) []llm.Message {
+	out := make([]llm.Message, 0, len(messages))
+	for _, msg := range messages {
+		switch {
+		case msg.Role == llm.RoleTool && msg.ToolResult != nil:
+			out = append(out, llm.Message{
+				Role:    llm.RoleUser,
+				Content: fmt.Sprintf("[result of %s]\n%s", msg.ToolResult.Name, msg.ToolResult.Output),
+			})
+		case msg.Role == llm.RoleAssistant && len(msg.ToolCalls) > 0:
+			if strings.TrimSpace(msg.Content) == "" {
+				continue
+			}
+			msg.ToolCalls = nil
+			out = append(out, msg)
+		default:
+			out = append(out, msg)
+		}
+	}
+	return out
+}
+
+func replaceImageParts(messages []llm.Message) ([]llm.Message, bool) {
+	replaced := false
+	out := make([]llm.Message, len(messages))
+	for i, msg := range messages {
+		out[i] = msg
+		if len(msg.Parts) == 0 {
+			continue
+		}
+		parts := make([]llm.ContentPart, len(msg.Parts))
+		for j, part := range msg.Parts {
+			if part.Type == llm.ContentPartImageURL {
+				part = llm.ContentPart{Type: llm.ContentPartText, Text: imagePlaceholder}
+				replaced = true
+			}
+			parts[j] = part
+		}
+		out[i].Parts = parts
+	}
+	return out, replaced
+}
+
+// droppedFeaturesNotice explains to the user what the model could not handle.
+// ToolChoice is an implementation detail and is not reported.
+func droppedFeaturesNotice(model string, dropped []DroppedFeature) string {
+	var lines []string
+	for _, feature := range dropped {
+		switch feature {
+		case DroppedTools:
+			lines = append(lines, "memory, reminders and web search are unavailable")
+		case DroppedImages:
+			lines = append(lines, "images were not shown to it")
+		}
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Note: %s doesn't support everything in this request: %s.", model, strings.Join(lines, "; "))
+}
@@ -0,0 +1,64 @@
+package services
+
+import (
+	"slices"
+	"testing"
+
+	"vadimgribanov.com/tg-gpt/internal/llm"
+)
+
+func TestShapeRequestDegradesForTextOnlyModelWithoutTools(t *testing.T) {
+	request := llm.Request{
+		Model: "llama3.2",
+		Messages: []llm.Message{
+			{Role: llm.RoleSystem, Content: "system prompt"},
+			{Role: llm.RoleUser, Parts: []llm.ContentPart{
+				{Type: llm.ContentPartText, Text: "what is this?"},
+				{Type: llm.ContentPartImageURL, ImageURL: "data:image/jpeg;base64,/9j/4AAQ"},
+			}},
+			{Role: llm.RoleAssistant, ToolCalls: []llm.ToolCall{{ID: "call_1", Name: "web_search", Arguments: "{}"}}},
+			{Role: llm.RoleTool, ToolResult: &llm.ToolResult{CallID: "call_1", Name: "web_search", Output: "a cat"}},
+		},
+		Tools:      []llm.Tool{{Name: "web_search"}},
+		ToolChoice: llm.ToolChoiceAuto,
+	}
+
+	shaped, dropped := ShapeRequest(request, llm.Capabilities{})
+
+	if !slices.Equal(dropped, []DroppedFeature{DroppedTools, DroppedImages}) {
+		t.Fatalf("dropped: %v", dropped)
+	}
+	if shaped.Tools != nil || shaped.ToolChoice != "" {
+		t.Fatalf("tools must be stripped: %#v", shaped)
+	}
+	if len(shaped.Messages) != 3 {
+		t.Fatalf("messages: %#v", shaped.Messages)
+	}
+	if part := shaped.Messages[1].Parts[1]; part.Type != llm.ContentPartText || part.Text != imagePlaceholder {
+		t.Fatalf("image part: %#v", part)
+	}
+	if result := shaped.Messages[2]; result.Role != llm.RoleUser || result.Content != "[result of web_search]\na cat" {
+		t.Fatalf("flattened tool result: %#v", result)
+	}
+	if request.Messages[1].Parts[1].Type != llm.ContentPartImageURL {
+		t.Fatal("input request must not be modified")
+	}
+}
+
+func TestShapeRequestOnlyClearsToolChoice(t *testing.T) {
+	request := llm.Request{
+		Messages:   []llm.Message{{Role: llm.RoleUser, Content: "hi"}},
+		Tools:      []llm.Tool{{Name: "web_search"}},
+		ToolChoice: llm.ToolChoiceAuto,
+	}
+	shaped, dropped := ShapeRequest(request, llm.Capabilities{FunctionTools: true, Vision: true})
+	if !slices.Equal(dropped, []DroppedFeature{DroppedToolChoice}) {
+		t.Fatalf("dropped: %v", dropped)
+	}
+	if len(shaped.Tools) != 1 || shaped.ToolChoice != "" {
+		t.Fatalf("shaped: %#v", shaped)
+	}
+	if droppedFeaturesNotice("m", dropped) != "" {
+		t.Fatal("tool_choice alone must not be reported to the user")
+	}
+}
@@ -3,15 +3,19 @@ package services
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	openai "github.com/sashabaranov/go-openai"
+	"vadimgribanov.com/tg-gpt/internal/config"
 	"vadimgribanov.com/tg-gpt/internal/database"
 	"vadimgribanov.com/tg-gpt/internal/llm"
 	"vadimgribanov.com/tg-gpt/internal/models"
@@ -65,6 +69,50 @@ func TestTextServiceIntegrationSimpleTextTurnPersistsTraceAndUsage(t *testing.T)
 	if updated.NumberOfInputTokens != 3 || updated.NumberOfOutputTokens != 4 {
 		t.Fatalf("usage: got input=%d output=%d", updated.NumberOfInputTokens, updated.NumberOfOutputTokens)
 	}
+
+	report, err := h.usageService.Report(h.user.Id, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Today) != 1 || len(report.Month) != 1 {
+		t.Fatalf("usage report: %#v", report)
+	}
+	today := report.Today[0]
+	if today.Model != "test-model" || today.InputTokens != 3 || today.OutputTokens != 4 || today.CostUSD != 46.0/1_000_000 {
+		t.Fatalf("ledger entry: %#v", today)
+	}
+}
+
+func TestTextServiceIntegrationFailedTurnStillRecordsUsage(t *testing.T) {
+	h := newTextServiceIntegrationHarness(t, [][]llm.StreamEvent{
+		{
+			{Usage: &llm.Usage{InputTokens: 30, OutputTokens: 5}},
+			{ToolCalls: []llm.ToolCall{{ID: "call_1", Name: "list_reminders", Arguments: "{}"}}},
+		},
+	})
+	h.llmClient.exhaustedErr = errors.New("provider unavailable")
+
+	if _, err := h.textService.handleLLMRequest(context.Background(), h.user, 151, llm.Message{
+		Role:    llm.RoleUser,
+		Content: "what are my reminders?",
+	}, nil); err == nil {
+		t.Fatal("expected the second round to fail the turn")
+	}
+
+	updated, err := h.userRepo.GetUser(h.user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.NumberOfInputTokens != 30 || updated.NumberOfOutputTokens != 5 {
+		t.Fatalf("usage: got input=%d output=%d", updated.NumberOfInputTokens, updated.NumberOfOutputTokens)
+	}
+	report, err := h.usageService.Report(h.user.Id, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Today) != 1 || report.Today[0].InputTokens != 30 || report.Today[0].OutputTokens != 5 {
+		t.Fatalf("the first round must reach the ledger: %#v", report.Today)
+	}
 }
 
 func TestTextServiceIntegrationToolLoopPersistsProtocolOrderedTrace(t *testing.T) {
@@ -139,6 +187,130 @@ func TestTextServiceIntegrationToolLoopPersistsProtocolOrderedTrace(t *testing.T
 	}
 }
 
+func TestTextServiceIntegrationFeedsToolErrorsBackToModel(t *testing.T) {
+	badCall := []llm.StreamEvent{{ToolCalls: []llm.ToolCall{{ID: "call_bad", Name: "cancel_reminder", Arguments: `{"reminder_id":"abc"}`}}}}
+	h := newTextServiceIntegrationHarness(t, [][]llm.StreamEvent{
+		badCall,
+		{{ToolCalls: []llm.ToolCall{{ID: "call_other", Name: "not_offered", Arguments: "{}"}}}},
+		{{TextDelta: "I could not find that reminder."}},
+	})
+
+	answer, err := h.textService.handleLLMRequest(context.Background(), h.user, 201, llm.Message{
+		Role:    llm.RoleUser,
+		Content: "cancel my reminder",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer != "I could not find that reminder." {
+		t.Fatalf("answer: %q", answer)
+	}
+
+	events := h.traceEvents(t, h.user.CurrentDialogId)
+	if len(events) != 6 {
+		t.Fatalf("trace events len: got %d want 6: %#v", len(events), events)
+	}
+	badResult := decodePayload[models.ToolResultPayload](t, events[2].Payload)
+	if badResult.ToolCallID != "call_bad" || !strings.Contains(badResult.Result, `"ok":false`) || !strings.Contains(badResult.Result, "invalid reminder ID") {
+		t.Fatalf("bad call result: %#v", badResult)
+	}
+	otherResult := decodePayload[models.ToolResultPayload](t, events[4].Payload)
+	if !strings.Contains(otherResult.Result, "tool is not available in this mode: not_offered") {
+		t.Fatalf("unavailable tool result: %#v", otherResult)
+	}
+
+	requests := h.llmClient.requestsSnapshot()
+	if len(requests) != 3 {
+		t.Fatalf("llm requests: got %d want 3", len(requests))
+	}
+	second := requests[1].Messages
+	if last := second[len(second)-1]; last.ToolResult == nil || last.ToolResult.Output != badResult.Result {
+		t.Fatalf("second request does not carry the error: %#v", last)
+	}
+	if requests[2].ToolChoice != llm.ToolChoiceAuto {
+		t.Fatalf("two failures must not withdraw tools: %q", requests[2].ToolChoice)
+	}
+}
+
+func TestTextServiceIntegrationWithdrawsToolsAfterRepeatedFailures(t *testing.T) {
+	badCall := []llm.StreamEvent{{ToolCalls: []llm.ToolCall{{ID: "call_bad", Name: "cancel_reminder", Arguments: `{"reminder_id":"abc"}`}}}}
+	h := newTextServiceIntegrationHarness(t, [][]llm.StreamEvent{
+		badCall, badCall, badCall,
+		{{TextDelta: "Cancelling does not work right now."}},
+	})
+
+	answer, err := h.textService.handleLLMRequest(context.Background(), h.user, 201, llm.Message{
+		Role:    llm.RoleUser,
+		Content: "cancel my reminder",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer != "Cancelling does not work right now." {
+		t.Fatalf("answer: %q", answer)
+	}
+
+	requests := h.llmClient.requestsSnapshot()
+	if len(requests) != 4 {
+		t.Fatalf("llm requests: got %d want 4", len(requests))
+	}
+	last := requests[3]
+	if len(last.Tools) != 0 || last.ToolChoice != "" {
+		t.Fatalf("tools must be withdrawn after failures: %d tools, choice %q", len(last.Tools), last.ToolChoice)
+	}
+	for _, msg := range last.Messages {
+		if len(msg.ToolCalls) > 0 || msg.ToolResult != nil {
+			t.Fatalf("earlier tool calls must be flattened once tools are withdrawn: %#v", msg)
+		}
+	}
+	notice := last.Messages[len(last.Messages)-1]
+	if notice.Role != llm.RoleSystem || !strings.Contains(notice.Content, "the last 3 tool calls failed") {
+		t.Fatalf("withdrawal notice: %#v", notice)
+	}
+}
+
+func TestTextServiceIntegrationStopsRunawayToolLoop(t *testing.T) {
+	var streams [][]llm.StreamEvent
+	for i := 0; i <= maxToolRounds; i++ {
+		streams = append(streams, []llm.StreamEvent{{ToolCalls: []llm.ToolCall{{
+			ID:        fmt.Sprintf("call_%d", i),
+			Name:      "list_memories",
+			Arguments: "{}",
+		}}}})
+	}
+	h := newTextServiceIntegrationHarness(t, streams)
+
+	answer, err := h.textService.handleLLMRequest(context.Background(), h.user, 201, llm.Message{
+		Role:    llm.RoleUser,
+		Content: "what do you remember?",
+	}, nil)
+	if err != nil {
+		t.Fatalf("a runaway tool loop must still end the turn with an answer: %v", err)
+	}
+	if answer != toolLoopApology {
+		t.Fatalf("answer: %q", answer)
+	}
+
+	requests := h.llmClient.requestsSnapshot()
+	if len(requests) != maxToolRounds+1 {
+		t.Fatalf("llm requests: got %d want %d", len(requests), maxToolRounds+1)
+	}
+	if len(requests[maxToolRounds-1].Tools) == 0 || len(requests[maxToolRounds].Tools) != 0 {
+		t.Fatalf("tools: %d then %d", len(requests[maxToolRounds-1].Tools), len(requests[maxToolRounds].Tools))
+	}
+	// The call made after tools were withdrawn is dropped, and the turn ends
+	// with a plain answer so the trace stays a valid history.
+	events := h.traceEvents(t, h.user.CurrentDialogId)
+	last := events[len(events)-1]
+	if last.EventType != models.EventTypeModelMsg {
+		t.Fatalf("last event: %s", last.EventType)
+	}
+	payload := decodePayload[models.ModelMsgPayload](t, last.Payload)
+	if len(payload.ToolCalls) != 0 || payload.Content != toolLoopApology {
+		t.Fatalf("last model_msg: %#v", payload)
+	}
+}
+
 func TestTextServiceIntegrationRetryReplacesLastExchange(t *testing.T) {
 	h := newTextServiceIntegrationHarness(t, [][]llm.StreamEvent{
 		{{TextDelta: "first answer"}},
@@ -153,15 +325,15 @@ func TestTextServiceIntegrationRetryReplacesLastExchange(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	userMsg, tgMsgID, err := h.memoryManager.PopForRetry(h.user.Id, h.user.CurrentDialogId)
+	input, err := h.memoryManager.PopForRetry(h.user.Id, h.user.CurrentDialogId)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if tgMsgID != 301 || userMsg.Content != "try this" {
-		t.Fatalf("popped message: tg=%d msg=%#v", tgMsgID, userMsg)
+	if input.TgMessageID != 301 || input.Message.Content != "try this" {
+		t.Fatalf("popped message: %#v", input)
 	}
 
-	if err := h.textService.RetryWithMessage(context.Background(), h.user, tgMsgID, userMsg, nil); err != nil {
+	if err := h.textService.RetryWithMessage(context.Background(), h.user, input, nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -175,14 +347,114 @@ func TestTextServiceIntegrationRetryReplacesLastExchange(t *testing.T) {
 	}
 }
 
+func TestTextServiceIntegrationShapesRequestForModelCapabilities(t *testing.T) {
+	h := newTextServiceIntegrationHarness(t, [][]llm.StreamEvent{
+		{{TextDelta: "I can't see the image."}},
+	})
+	h.llmClient.capabilities = &llm.Capabilities{}
+
+	_, err := h.textService.handleLLMRequest(context.Background(), h.user, 401, llm.Message{
+		Role: llm.RoleUser,
+		Parts: []llm.ContentPart{
+			{Type: llm.ContentPartText, Text: "what is this?"},
+			{Type: llm.ContentPartImageURL, ImageURL: "data:image/jpeg;base64,/9j/4AAQ"},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := h.llmClient.requestsSnapshot()
+	if len(requests) != 1 {
+		t.Fatalf("llm requests: got %d want 1", len(requests))
+	}
+	if requests[0].Tools != nil || requests[0].ToolChoice != "" {
+		t.Fatalf("tools must be stripped: %#v", requests[0].Tools)
+	}
+	last := requests[0].Messages[len(requests[0].Messages)-1]
+	for _, part := range last.Parts {
+		if part.Type == llm.ContentPartImageURL {
+			t.Fatalf("image must be replaced: %#v", last)
+		}
+	}
+
+	events := h.traceEvents(t, h.user.CurrentDialogId)
+	userPayload := decodePayload[models.UserMsgPayload](t, events[0].Payload)
+	if len(userPayload.MultiContent) != 2 || userPayload.MultiContent[1].Type != llm.ContentPartImageURL {
+		t.Fatalf("trace must keep the original image: %#v", userPayload)
+	}
+}
+
+func TestTextServiceIntegrationRecordsFallbackModel(t *testing.T) {
+	h := newTextServiceIntegrationHarness(t, [][]llm.StreamEvent{
+		{{TextDelta: "answered by the fallback"}},
+	})
+	h.llmClient.servedModel = "fallback-model"
+
+	_, err := h.textService.handleLLMRequest(context.Background(), h.user, 501, llm.Message{
+		Role:    llm.RoleUser,
+		Content: "hello",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := h.traceEvents(t, h.user.CurrentDialogId)
+	if events[1].Model != "fallback-model" {
+		t.Fatalf("model_msg model: got %q", events[1].Model)
+	}
+	payload := decodePayload[models.ModelMsgPayload](t, events[1].Payload)
+	if payload.FallbackFrom != "test-model" {
+		t.Fatalf("fallback_from: got %q", payload.FallbackFrom)
+	}
+}
+
 type textServiceIntegrationHarness struct {
 	db            *database.DB
 	user          models.User
 	userRepo      *repositories.UserRepo
 	traceRepo     *repositories.TraceRepo
 	memoryManager *MemoryManager
+	usageService  *UsageService
+	tools         *ToolRegistry
 	textService   *TextService
 	llmClient     *fakeLLMClient
+	embeddings    *fakeEmbeddings
+}
+
+// fakeEmbeddings answers embedding requests with the vectors tests set per text.
+// Other texts get a vector unrelated to every test document.
+type fakeEmbeddings struct {
+	mu      sync.Mutex
+	vectors map[string][]float32
+}
+
+func (e *fakeEmbeddings) set(text string, vector []float32) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.vectors[text] = vector
+}
+
+func (e *fakeEmbeddings) serve(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Input []string `json:"input"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response := openai.EmbeddingResponse{Object: "list"}
+	e.mu.Lock()
+	for i, text := range request.Input {
+		vector, ok := e.vectors[text]
+		if !ok {
+			vector = []float32{0, 0, 1}
+		}
+		response.Data = append(response.Data, openai.Embedding{Object: "embedding", Embedding: vector, Index: i})
+	}
+	e.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
 }
 
 func newTextServiceIntegrationHarness(t *testing.T, streams [][]llm.StreamEvent) *textServiceIntegrationHarness {
@@ -207,8 +479,14 @@ func newTextServiceIntegrationHarness(t *testing.T, streams [][]llm.StreamEvent)
 	factRepo := repositories.NewFactRepo(db)
 	episodeRepo := repositories.NewEpisodeRepo(db)
 	reminderRepo := repositories.NewReminderRepo(db)
+	usageRepo := repositories.NewUsageRepo(db)
 
+	embeddings := &fakeEmbeddings{vectors: map[string][]float32{}}
 	openaiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/embeddings") {
+			embeddings.serve(w, r)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 		_, _ = w.Write([]byte(`{"id":"test","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"{\"candidates\":[]}"}}]}`))
 	}))
@@ -222,6 +500,8 @@ func newTextServiceIntegrationHarness(t *testing.T, streams [][]llm.StreamEvent)
 		prefRepo,
 		factRepo,
 		episodeRepo,
+		repositories.NewDocumentRepo(db),
+		NewImageStore(repositories.NewBlobRepo(db)),
 		NewEmbedder(openaiClient, "test-embedding"),
 		NewExtractor(openaiClient, "test-extractor"),
 		NewSummarizer(openaiClient, "test-summarizer"),
@@ -229,8 +509,10 @@ func newTextServiceIntegrationHarness(t *testing.T, streams [][]llm.StreamEvent)
 			FactConfidenceMin:   0.8,
 			PrefConfidenceMin:   0.8,
 			SemanticDedupCosine: 0.95,
+			DocumentMinCosine:   0.35,
 			FactsTopK:           3,
 			EpisodesTopK:        3,
+			DocumentsTopK:       3,
 			EpisodeMinTurns:     2,
 			RecentTraceEvents:   20,
 		},
@@ -241,12 +523,21 @@ func newTextServiceIntegrationHarness(t *testing.T, streams [][]llm.StreamEvent)
 		models:  map[string]struct{}{"test-model": {}},
 		streams: streams,
 	}
+	usageService := NewUsageService(usageRepo, []config.LLMModel{
+		{ModelId: "test-model", Price: config.ModelPrice{InputPerMillion: 2, CachedInputPerMillion: 1, OutputPerMillion: 10}},
+	}, config.BudgetConfig{})
+	tools := NewToolRegistry(map[ToolMode][]string{ToolModeScheduledAction: {"web_search"}})
+	for _, provider := range []ToolProvider{memoryService, reminderService} {
+		if err := tools.Register(provider); err != nil {
+			t.Fatal(err)
+		}
+	}
 	textService := NewTextService(
 		llmClient,
 		userRepo,
-		memoryService,
+		usageService,
+		tools,
 		memoryManager,
-		reminderService,
 		nil,
 		int64(time.Hour.Seconds()),
 		"test-model",
@@ -263,8 +554,11 @@ func newTextServiceIntegrationHarness(t *testing.T, streams [][]llm.StreamEvent)
 		userRepo:      userRepo,
 		traceRepo:     traceRepo,
 		memoryManager: memoryManager,
+		usageService:  usageService,
+		tools:         tools,
 		textService:   textService,
 		llmClient:     llmClient,
+		embeddings:    embeddings,
 	}
 }
 
@@ -277,6 +571,19 @@ func (h *textServiceIntegrationHarness) traceEvents(t *testing.T, dialogID int64
 	return events
 }
 
+// recordExchange stores a user message and the bot's answer as if both had been sent
+// to Telegram with the given message ids.
+func (h *textServiceIntegrationHarness) recordExchange(t *testing.T, userTgID int64, question string, answerTgID int64, answer string) {
+	t.Helper()
+	mctx, err := h.memoryManager.BeginTurn(h.user.Id, h.user.CurrentDialogId, 0, llm.Message{Role: llm.RoleUser, Content: question}, userTgID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.memoryManager.AppendModelMsg(mctx, answer, nil, "test-model", "", []int64{answerTgID}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func decodePayload[T any](t *testing.T, payload json.RawMessage) T {
 	t.Helper()
 	var out T
@@ -287,10 +594,23 @@ func decodePayload[T any](t *testing.T, payload json.RawMessage) T {
 }
 
 type fakeLLMClient struct {
-	mu       sync.Mutex
-	models   map[string]struct{}
-	streams  [][]llm.StreamEvent
-	requests []llm.Request
+	mu           sync.Mutex
+	models       map[string]struct{}
+	capabilities *llm.Capabilities
+	servedModel  string
+	streams      [][]llm.StreamEvent
+	// exhaustedErr fails the requests made after the streams ran out.
+	exhaustedErr error
+	requests     []llm.Request
+}
+
+func (c *fakeLLMClient) Capabilities(modelID string) llm.Capabilities {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.capabilities != nil {
+		return *c.capabilities
+	}
+	return llm.Capabilities{FunctionTools: true, Vision: true, ToolChoice: true}
 }
 
 func (c *fakeLLMClient) IsClientRegistered(modelID string) bool {
@@ -305,10 +625,16 @@ func (c *fakeLLMClient) Stream(ctx context.Context, request llm.Request) (llm.St
 	defer c.mu.Unlock()
 	c.requests = append(c.requests, request)
 	if len(c.streams) == 0 {
+		if c.exhaustedErr != nil {
+			return nil, c.exhaustedErr
+		}
 		return &fakeStream{err: io.EOF}, nil
 	}
 	events := c.streams[0]
 	c.streams = c.streams[1:]
+	if c.servedModel != "" {
+		return &primedStream{Stream: &fakeStream{events: events, err: io.EOF}, model: c.servedModel}, nil
+	}
 	return &fakeStream{events: events, err: io.EOF}, nil
 }
 
@@ -345,3 +671,450 @@ func (s *fakeStream) Err() error {
 func (s *fakeStream) Close() error {
 	return nil
 }
+
+func TestTextServiceIntegrationBudgetRefusesOrDowngrades(t *testing.T) {
+	h := newTextServiceIntegrationHarness(t, [][]llm.StreamEvent{
+		{{TextDelta: "cheap answer"}},
+	})
+	if _, err := repositories.NewUsageRepo(h.db).Record(models.UsageEntry{
+		UserID: h.user.Id, DialogID: h.user.CurrentDialogId, Model: "test-model", InputTokens: 900, OutputTokens: 200, CostUSD: 1.5,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	budget := config.BudgetConfig{Default: config.BudgetLimits{DailyUSD: 1}, WarnAt: 0.8}
+	h.textService.usageService = NewUsageService(repositories.NewUsageRepo(h.db), nil, budget)
+
+	_, err := h.textService.RunScheduledAction(context.Background(), h.user, models.Reminder{Message: "news digest"})
+	if !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("expected budget error, got %v", err)
+	}
+	if requests := h.llmClient.requestsSnapshot(); len(requests) != 0 {
+		t.Fatalf("refused turn must not reach the model: %#v", requests)
+	}
+	if events := h.traceEvents(t, h.user.CurrentDialogId); len(events) != 0 {
+		t.Fatalf("refused turn must not be recorded: %#v", events)
+	}
+
+	budget.DowngradeModel = "cheap-model"
+	h.llmClient.models["cheap-model"] = struct{}{}
+	h.textService.usageService = NewUsageService(repositories.NewUsageRepo(h.db), nil, budget)
+	if _, err := h.textService.handleLLMRequest(context.Background(), h.user, 601, llm.Message{Role: llm.RoleUser, Content: "hi"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if requests := h.llmClient.requestsSnapshot(); len(requests) != 1 || requests[0].Model != "cheap-model" {
+		t.Fatalf("expected a downgraded request: %#v", requests)
+	}
+}
+
+func TestConversationRunnerRefusesQueuedInputsOverBudget(t *testing.T) {
+	h := newTextServiceIntegrationHarness(t, nil)
+	if _, err := repositories.NewUsageRepo(h.db).Record(models.UsageEntry{
+		UserID: h.user.Id, DialogID: h.user.CurrentDialogId, Model: "test-model", InputTokens: 900, OutputTokens: 200, CostUSD: 1.5,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	budget := config.BudgetConfig{Default: config.BudgetLimits{DailyUSD: 1}}
+	h.textService.usageService = NewUsageService(repositories.NewUsageRepo(h.db), nil, budget)
+	pending := repositories.NewPendingInputRepo(h.db)
+	runner := NewConversationRunner(h.db, pending, h.traceRepo, NewImageStore(repositories.NewBlobRepo(h.db)), h.textService)
+
+	if err := runner.Submit(context.Background(), h.user, 0, 801, llm.Message{Role: llm.RoleUser, Content: "hi"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for runner.IsActive(h.user.Id, h.user.CurrentDialogId) {
+		if time.Now().After(deadline) {
+			t.Fatal("conversation did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if events := h.traceEvents(t, h.user.CurrentDialogId); len(events) != 0 {
+		t.Fatalf("refused input must not be recorded: %#v", events)
+	}
+	left, err := pending.ListPendingForDialog(context.Background(), h.user.Id, h.user.CurrentDialogId, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Fatalf("refused input must not stay queued: %#v", left)
+	}
+}
+
+func TestTextServiceIntegrationGroupTurnUsesSpeakerMemory(t *testing.T) {
+	h := newTextServiceIntegrationHarness(t, [][]llm.StreamEvent{
+		{{TextDelta: "Hi Vadim"}},
+	})
+	group, err := h.userRepo.RegisterGroup(-1001, "Team", "test-model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repositories.NewPreferenceRepo(h.db).Upsert(repositories.UpsertPreferenceInput{
+		UserID: h.user.Id, Key: "language", Value: "Polish", Source: models.PreferenceSourceExplicit,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.textService.RetryWithMessage(context.Background(), group, UserInput{
+		TgMessageID: 701,
+		Message:     llm.Message{Role: llm.RoleUser, Content: "Vadim: hi"},
+		SpeakerID:   h.user.Id,
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := h.traceRepo.GetAllForDialog(group.Id, group.CurrentDialogId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].SpeakerID != h.user.Id || events[1].SpeakerID != 0 {
+		t.Fatalf("group trace: %#v", events)
+	}
+	if own := h.traceEvents(t, h.user.CurrentDialogId); len(own) != 0 {
+		t.Fatalf("member's private dialog must stay empty: %#v", own)
+	}
+	system := h.llmClient.requestsSnapshot()[0].Messages[0].Content
+	if !strings.Contains(system, "language: Polish") || !strings.Contains(system, "Group chat mode") {
+		t.Fatalf("system prompt must carry the speaker's preferences: %s", system)
+	}
+}
+
+func TestTextServiceIntegrationReplyToOlderAnswerBranchesDialog(t *testing.T) {
+	h := newTextServiceIntegrationHarness(t, [][]llm.StreamEvent{
+		{{TextDelta: "branch answer"}},
+	})
+	h.recordExchange(t, 801, "first question", 802, "first answer")
+	h.recordExchange(t, 803, "second question", 804, "second answer")
+
+	if _, branched, err := h.textService.BranchFromReply(context.Background(), h.user, 804); err != nil || branched {
+		t.Fatalf("reply to the latest answer must not branch: branched=%v err=%v", branched, err)
+	}
+	user, branched, err := h.textService.BranchFromReply(context.Background(), h.user, 802)
+	if err != nil || !branched {
+		t.Fatalf("reply to an older answer must branch: branched=%v err=%v", branched, err)
+	}
+	if user.CurrentDialogId == h.user.CurrentDialogId {
+		t.Fatalf("branch must get its own dialog id: %d", user.CurrentDialogId)
+	}
+
+	if _, err := h.textService.handleLLMRequest(context.Background(), user, 805, llm.Message{
+		Role:    llm.RoleUser,
+		Content: "another take",
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var contents []string
+	for _, msg := range h.llmClient.requestsSnapshot()[0].Messages[1:] {
+		contents = append(contents, msg.Content)
+	}
+	if got, want := strings.Join(contents, "|"), "first question|first answer|another take"; got != want {
+		t.Fatalf("branch prompt: got %q want %q", got, want)
+	}
+	if parent := h.traceEvents(t, h.user.CurrentDialogId); len(parent) != 4 {
+		t.Fatalf("parent dialog must be preserved: %#v", parent)
+	}
+	input, err := h.memoryManager.PopForRetry(user.Id, user.CurrentDialogId)
+	if err != nil || input.TgMessageID != 805 {
+		t.Fatalf("retry must pop the branch's own message: %#v err=%v", input, err)
+	}
+}
+
+func TestTextServiceIntegrationReplyInGroupDoesNotBranch(t *testing.T) {
+	h := newTextServiceIntegrationHarness(t, nil)
+	group, err := h.userRepo.RegisterGroup(-1001, "Team", "test-model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, exchange := range []struct {
+		userTgID, answerTgID int64
+	}{{801, 802}, {803, 804}} {
+		mctx, err := h.memoryManager.BeginTurn(group.Id, group.CurrentDialogId, h.user.Id, llm.Message{Role: llm.RoleUser, Content: "Vadim: question"}, exchange.userTgID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := h.memoryManager.AppendModelMsg(mctx, "answer", nil, "test-model", "", []int64{exchange.answerTgID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	user, branched, err := h.textService.BranchFromReply(context.Background(), group, 802)
+	if err != nil || branched {
+		t.Fatalf("a reply in a group must not branch: branched=%v err=%v", branched, err)
+	}
+	if user.CurrentDialogId != group.CurrentDialogId {
+		t.Fatalf("dialog changed: %d -> %d", group.CurrentDialogId, user.CurrentDialogId)
+	}
+}
+
+func TestTextServiceIntegrationTopicMessageIsAnsweredInItsOwnDialog(t *testing.T) {
+	h := newTextServiceIntegrationHarness(t, [][]llm.StreamEvent{
+		{{TextDelta: "topic answer"}},
+		{{TextDelta: "second topic answer"}},
+	})
+	chat, err := h.userRepo.RegisterGroup(-1001, "Forum", "test-model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mctx, err := h.memoryManager.BeginTurn(chat.Id, chat.CurrentDialogId, h.user.Id, llm.Message{Role: llm.RoleUser, Content: "Vadim: general question"}, 1001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.memoryManager.AppendModelMsg(mctx, "general answer", nil, "test-model", "", []int64{1002}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tgMessageID := range []int64{1003, 1005} {
+		topic, err := h.userRepo.ApplyThread(chat, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if topic.CurrentDialogId == chat.CurrentDialogId {
+			t.Fatal("a topic must not share the general dialog")
+		}
+		if err := h.textService.RetryWithMessage(context.Background(), topic, UserInput{
+			TgMessageID: tgMessageID,
+			Message:     llm.Message{Role: llm.RoleUser, Content: "Vadim: topic question"},
+			SpeakerID:   h.user.Id,
+		}, nil); err != nil {
+			t.Fatal(err)
+		}
+		events, err := h.traceRepo.GetAllForDialog(chat.Id, topic.CurrentDialogId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 2*(i+1) {
+			t.Fatalf("topic dialog after message %d: %#v", i+1, events)
+		}
+	}
+
+	if general, err := h.traceRepo.GetAllForDialog(chat.Id, chat.CurrentDialogId); err != nil || len(general) != 2 {
+		t.Fatalf("general dialog must be left alone: %#v %v", general, err)
+	}
+	requests := h.llmClient.requestsSnapshot()
+	for _, request := range requests {
+		for _, msg := range request.Messages {
+			if strings.Contains(msg.Content, "general") {
+				t.Fatalf("topic request carries the general topic: %#v", request.Messages)
+			}
+		}
+	}
+	if last := requests[1].Messages; !strings.Contains(last[len(last)-2].Content, "topic answer") {
+		t.Fatalf("second topic message must continue the topic dialog: %#v", last)
+	}
+}
+
+func TestTextServiceIntegrationEditRerunsLatestOrForksOlderMessage(t *testing.T) {
+	h := newTextServiceIntegrationHarness(t, nil)
+	h.recordExchange(t, 901, "first question", 902, "first answer")
+	h.recordExchange(t, 903, "second question", 904, "second answer")
+
+	turn, ok, err := h.textService.PrepareEdit(context.Background(), h.user, 903)
+	if err != nil || !ok {
+		t.Fatalf("edit of the latest message: ok=%v err=%v", ok, err)
+	}
+	if turn.User.CurrentDialogId != h.user.CurrentDialogId || len(turn.AnswerTgMessageIDs) != 1 || turn.AnswerTgMessageIDs[0] != 904 {
+		t.Fatalf("latest edit must stay in the dialog and rewrite the answer: %#v", turn)
+	}
+	if events := h.traceEvents(t, h.user.CurrentDialogId); len(events) != 2 {
+		t.Fatalf("latest exchange must be popped: %#v", events)
+	}
+
+	h.recordExchange(t, 903, "second question, edited", 904, "new second answer")
+	turn, ok, err = h.textService.PrepareEdit(context.Background(), h.user, 901)
+	if err != nil || !ok {
+		t.Fatalf("edit of an older message: ok=%v err=%v", ok, err)
+	}
+	if turn.User.CurrentDialogId == h.user.CurrentDialogId || len(turn.AnswerTgMessageIDs) != 0 {
+		t.Fatalf("older edit must fork into a fresh answer: %#v", turn)
+	}
+	recent, err := h.traceRepo.GetRecent(h.user.Id, turn.User.CurrentDialogId, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recent) != 0 {
+		t.Fatalf("branch must start before the edited message: %#v", recent)
+	}
+	if events := h.traceEvents(t, h.user.CurrentDialogId); len(events) != 4 {
+		t.Fatalf("parent dialog must be preserved: %#v", events)
+	}
+}
+
+func TestTextServiceIntegrationEditReplacesEveryPartOfASplitAnswer(t *testing.T) {
+	h := newTextServiceIntegrationHarness(t, nil)
+	mctx, err := h.memoryManager.BeginTurn(h.user.Id, h.user.CurrentDialogId, 0, llm.Message{Role: llm.RoleUser, Content: "tell me everything"}, 920)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.memoryManager.AppendModelMsg(mctx, "a very long answer", nil, "test-model", "", []int64{921, 922, 923}); err != nil {
+		t.Fatal(err)
+	}
+
+	turn, ok, err := h.textService.PrepareEdit(context.Background(), h.user, 920)
+	if err != nil || !ok {
+		t.Fatalf("edit: ok=%v err=%v", ok, err)
+	}
+	if fmt.Sprint(turn.AnswerTgMessageIDs) != "[921 922 923]" {
+		t.Fatalf("every part of the answer must be replaced: %v", turn.AnswerTgMessageIDs)
+	}
+}
+
+func TestTextServiceIntegrationGroupEditOfOlderMessageKeepsSharedDialog(t *testing.T) {
+	h := newTextServiceIntegrationHarness(t, nil)
+	group, err := h.userRepo.RegisterGroup(-1001, "Team", "test-model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, exchange := range []struct {
+		userTgID, answerTgID int64
+	}{{911, 912}, {913, 914}} {
+		mctx, err := h.memoryManager.BeginTurn(group.Id, group.CurrentDialogId, h.user.Id, llm.Message{Role: llm.RoleUser, Content: "Vadim: question"}, exchange.userTgID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := h.memoryManager.AppendModelMsg(mctx, "answer", nil, "test-model", "", []int64{exchange.answerTgID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok, err := h.textService.PrepareEdit(context.Background(), group, 911); !errors.Is(err, ErrGroupEditNotLatest) || ok {
+		t.Fatalf("older edit in a group: ok=%v err=%v", ok, err)
+	}
+	reloaded, err := h.userRepo.GetUser(group.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.CurrentDialogId != group.CurrentDialogId {
+		t.Fatalf("group dialog changed: %d -> %d", group.CurrentDialogId, reloaded.CurrentDialogId)
+	}
+
+	turn, ok, err := h.textService.PrepareEdit(context.Background(), group, 913)
+	if err != nil || !ok {
+		t.Fatalf("latest edit in a group: ok=%v err=%v", ok, err)
+	}
+	if turn.User.CurrentDialogId != group.CurrentDialogId || len(turn.AnswerTgMessageIDs) != 1 || turn.AnswerTgMessageIDs[0] != 914 {
+		t.Fatalf("latest edit must be re-run in place: %#v", turn)
+	}
+}
+
+func TestTextServiceIntegrationInjectsRelevantDocumentChunks(t *testing.T) {
+	h := newTextServiceIntegrationHarness(t, [][]llm.StreamEvent{
+		{{TextDelta: "Two years."}},
+		{{TextDelta: "You're welcome."}},
+	})
+	if _, err := repositories.NewDocumentRepo(h.db).Insert(repositories.InsertDocumentInput{
+		UserID:         h.user.Id,
+		Name:           "manual.pdf",
+		Chunks:         []string{"The warranty covers the device for 24 months.", "Clean the filter weekly."},
+		Embeddings:     [][]float32{{1, 0, 0}, {0, 1, 0}},
+		EmbeddingModel: "test-embedding",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Close to the warranty excerpt and remotely related to the other one.
+	h.embeddings.set("how long is the warranty?", []float32{0.95, 0.3, 0})
+
+	if _, err := h.textService.handleLLMRequest(context.Background(), h.user, 1001, llm.Message{
+		Role:    llm.RoleUser,
+		Content: "how long is the warranty?",
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	system := h.llmClient.requestsSnapshot()[0].Messages[0].Content
+	if !strings.Contains(system, "### manual.pdf, part 1\nThe warranty covers the device for 24 months.") {
+		t.Fatalf("system prompt must carry the matching excerpt: %s", system)
+	}
+	if strings.Contains(system, "Clean the filter") {
+		t.Fatalf("system prompt must skip unrelated excerpts: %s", system)
+	}
+
+	if _, err := h.textService.handleLLMRequest(context.Background(), h.user, 1003, llm.Message{
+		Role:    llm.RoleUser,
+		Content: "thanks",
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	system = h.llmClient.requestsSnapshot()[1].Messages[0].Content
+	if strings.Contains(system, "manual.pdf") {
+		t.Fatalf("a message unrelated to the documents must not get excerpts: %s", system)
+	}
+}
+
+func TestTextServiceIntegrationStoresImagesAsBlobReferences(t *testing.T) {
+	h := newTextServiceIntegrationHarness(t, [][]llm.StreamEvent{
+		{{TextDelta: "A cat."}},
+	})
+	imageURL := "data:image/png;base64,iVBORw0KGgo="
+
+	_, err := h.textService.handleLLMRequest(context.Background(), h.user, 401, llm.Message{
+		Role: llm.RoleUser,
+		Parts: []llm.ContentPart{
+			{Type: llm.ContentPartText, Text: "what is this?"},
+			{Type: llm.ContentPartImageURL, ImageURL: imageURL},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := h.traceEvents(t, h.user.CurrentDialogId)
+	stored := decodePayload[models.UserMsgPayload](t, events[0].Payload).MultiContent[1].ImageURL
+	if _, ok := llm.ParseBlobURL(stored); !ok {
+		t.Fatalf("trace must reference the image blob, got %q", stored)
+	}
+	history := h.memoryManager.AssemblePrompt("", RetrievedMemory{RecentTrace: events})
+	if got := history[1].Parts[1].ImageURL; got != imageURL {
+		t.Fatalf("rebuilt history image: got %q want %q", got, imageURL)
+	}
+}
+
+func TestTextServiceIntegrationMigratesInlineImagesToBlobs(t *testing.T) {
+	h := newTextServiceIntegrationHarness(t, nil)
+	imageURL := "data:image/jpeg;base64,/9j/4AAQ"
+	_, err := h.traceRepo.Append(repositories.AppendEventInput{
+		UserID:    h.user.Id,
+		DialogID:  h.user.CurrentDialogId,
+		EventType: models.EventTypeUserMsg,
+		Payload: models.UserMsgPayload{MultiContent: []llm.ContentPart{
+			{Type: llm.ContentPartText, Text: "look"},
+			{Type: llm.ContentPartImageURL, ImageURL: imageURL},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobRepo := repositories.NewBlobRepo(h.db)
+	if err := blobRepo.MigrateInlineImages(); err != nil {
+		t.Fatal(err)
+	}
+
+	events := h.traceEvents(t, h.user.CurrentDialogId)
+	if strings.Contains(string(events[0].Payload), "base64") {
+		t.Fatalf("inline image must be moved out of the trace: %s", events[0].Payload)
+	}
+	history := h.memoryManager.AssemblePrompt("", RetrievedMemory{RecentTrace: events})
+	if got := history[1].Parts[1].ImageURL; got != imageURL {
+		t.Fatalf("migrated image: got %q want %q", got, imageURL)
+	}
+
+	// Later starts skip the scan: the migration is recorded as done.
+	if _, err := h.traceRepo.Append(repositories.AppendEventInput{
+		UserID:    h.user.Id,
+		DialogID:  h.user.CurrentDialogId,
+		EventType: models.EventTypeUserMsg,
+		Payload: models.UserMsgPayload{MultiContent: []llm.ContentPart{
+			{Type: llm.ContentPartImageURL, ImageURL: imageURL},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := blobRepo.MigrateInlineImages(); err != nil {
+		t.Fatal(err)
+	}
+	events = h.traceEvents(t, h.user.CurrentDialogId)
+	if !strings.Contains(string(events[1].Payload), "base64") {
+		t.Fatalf("migration must run once: %s", events[1].Payload)
+	}
+}
@@ -0,0 +1,315 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+	"vadimgribanov.com/tg-gpt/internal/database"
+	"vadimgribanov.com/tg-gpt/internal/llm"
+	"vadimgribanov.com/tg-gpt/internal/models"
+	"vadimgribanov.com/tg-gpt/internal/repositories"
+	"vadimgribanov.com/tg-gpt/internal/telegram_utils"
+)
+
+const (
+	// ToolConfirmButton and ToolRejectButton are the unique ids of the buttons
+	// answering a confirmation; their data is the confirmation id.
+	ToolConfirmButton = "tool_confirm"
+	ToolRejectButton  = "tool_reject"
+
+	toolConfirmationSweepInterval = time.Minute
+	maxConfirmationArgumentsLen   = 500
+)
+
+var (
+	ErrConfirmationNotPending = errors.New("confirmation is no longer pending")
+	ErrNotConfirmationOwner   = errors.New("confirmation belongs to another user")
+
+	errAwaitingConfirmation    = errors.New("waiting for the user to confirm")
+	errConfirmationUnavailable = errors.New("this tool needs the user's confirmation, which cannot be asked for here")
+	errToolCallRejected        = errors.New("the user rejected this action, it was not performed")
+	errConfirmationExpired     = errors.New("the user did not confirm this action in time, it was not performed")
+	errConfirmationSuperseded  = errors.New("the user wrote again instead of confirming this action, it was not performed")
+)
+
+// ToolConfirmationService holds back tool calls the registry marks destructive
+// until the user confirms them with inline buttons. A turn that made such calls
+// ends after asking; the results are recorded once the user answers, the request
+// expires or the user writes again, and the turn resumes after the last answer.
+type ToolConfirmationService struct {
+	db            *database.DB
+	repo          *repositories.ToolConfirmationRepo
+	trace         *repositories.TraceRepo
+	tools         *ToolRegistry
+	memoryManager *MemoryManager
+	// bot edits the question once it is closed; nil leaves it as it is.
+	bot     *tele.Bot
+	timeout time.Duration
+}
+
+func NewToolConfirmationService(
+	db *database.DB,
+	repo *repositories.ToolConfirmationRepo,
+	trace *repositories.TraceRepo,
+	tools *ToolRegistry,
+	memoryManager *MemoryManager,
+	bot *tele.Bot,
+	timeout time.Duration,
+) *ToolConfirmationService {
+	return &ToolConfirmationService{
+		db:            db,
+		repo:          repo,
+		trace:         trace,
+		tools:         tools,
+		memoryManager: memoryManager,
+		bot:           bot,
+		timeout:       timeout,
+	}
+}
+
+// Request stores a confirmation for toolCall and asks the user about it.
+func (s *ToolConfirmationService) Request(ctx context.Context, mctx TurnContext, toolCall llm.ToolCall, streamer *telegram_utils.TelegramStreamer) error {
+	id, err := s.repo.Insert(ctx, repositories.InsertToolConfirmation{
+		UserID:      mctx.UserID,
+		DialogID:    mctx.DialogID,
+		MemberID:    mctx.MemberID,
+		UserTraceID: mctx.UserTraceID,
+		ToolCallID:  toolCall.ID,
+		ToolName:    toolCall.Name,
+		Arguments:   toolCall.Arguments,
+		ExpiresAt:   time.Now().Add(s.timeout).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	markup := &tele.ReplyMarkup{}
+	data := strconv.FormatInt(id, 10)
+	markup.Inline(markup.Row(
+		markup.Data("Confirm", ToolConfirmButton, data),
+		markup.Data("Reject", ToolRejectButton, data),
+	))
+	question := fmt.Sprintf("%s\n\nThis request expires in %d min.",
+		describeToolCall(toolCall.Name, toolCall.Arguments), int(s.timeout.Minutes()))
+	msg, err := streamer.SendPrompt(question, markup)
+	if err != nil {
+		// Nobody can answer a question that was never asked.
+		if _, resolveErr := s.repo.Resolve(ctx, id, repositories.ToolConfirmationExpired); resolveErr != nil {
+			slog.ErrorContext(ctx, "Error closing unasked confirmation", "error", resolveErr, "confirmation_id", id)
+		}
+		return fmt.Errorf("ask for confirmation: %w", err)
+	}
+	if err := s.repo.SetMessage(ctx, id, msg.Chat.ID, int64(msg.ID)); err != nil {
+		// The question is out and can be answered; it just stays as it is once closed.
+		slog.ErrorContext(ctx, "Error recording confirmation question", "error", err, "confirmation_id", id)
+	}
+	return nil
+}
+
+// Authorize returns the pending confirmation id of userID's chat if senderID may
+// answer it: the user in a private chat, the member whose request it was in a
+// group.
+func (s *ToolConfirmationService) Authorize(ctx context.Context, id, userID, senderID int64) (*repositories.ToolConfirmation, error) {
+	confirmation, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if confirmation == nil || confirmation.Status != repositories.ToolConfirmationPending {
+		return nil, ErrConfirmationNotPending
+	}
+	if confirmation.UserID != userID || confirmationTurn(*confirmation).MemoryUserID() != senderID {
+		return nil, ErrNotConfirmationOwner
+	}
+	return confirmation, nil
+}
+
+// Decide carries out the user's answer: the tool runs if approve is set, and
+// either way the result is recorded in the dialog. It reports whether the dialog
+// still waits for answers to other confirmations. It has to run on the dialog's
+// conversation so that the result lands right after the call.
+func (s *ToolConfirmationService) Decide(ctx context.Context, id int64, approve bool) (*repositories.ToolConfirmation, bool, error) {
+	confirmation, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return nil, false, err
+	}
+	if confirmation == nil {
+		return nil, false, ErrConfirmationNotPending
+	}
+	status := repositories.ToolConfirmationRejected
+	if approve {
+		status = repositories.ToolConfirmationConfirmed
+	}
+	ok, err := s.repo.Resolve(ctx, id, status)
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		return nil, false, ErrConfirmationNotPending
+	}
+
+	mctx := confirmationTurn(*confirmation)
+	var result string
+	outcome := "Rejected."
+	if approve {
+		toolCall := llm.ToolCall{ID: confirmation.ToolCallID, Name: confirmation.ToolName, Arguments: confirmation.Arguments}
+		called := s.tools.HandleToolCalls(ctx, mctx, []llm.ToolCall{toolCall})[0]
+		result, outcome = called.Output, "Confirmed."
+		if called.Err != nil {
+			slog.WarnContext(ctx, "Confirmed tool call failed, reporting it to the model", "tool", toolCall.Name, "error", called.Err)
+			result, outcome = toolErrorResult(called.Err), "Confirmed, but it failed."
+		}
+	} else {
+		result = toolErrorResult(errToolCallRejected)
+	}
+	if _, err := s.memoryManager.AppendToolResult(mctx, confirmation.ToolCallID, confirmation.ToolName, result); err != nil {
+		return nil, false, err
+	}
+	s.closeQuestion(ctx, *confirmation, outcome)
+
+	remaining, err := s.repo.CountPendingForDialog(ctx, confirmation.UserID, confirmation.DialogID)
+	if err != nil {
+		return nil, false, err
+	}
+	return confirmation, remaining > 0, nil
+}
+
+// Supersede closes the open confirmations of a dialog the user wrote to again.
+func (s *ToolConfirmationService) Supersede(ctx context.Context, userID, dialogID int64) error {
+	var closed []repositories.ToolConfirmation
+	err := s.db.WithTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		closed, err = s.supersedeTx(tx, userID, dialogID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.closeQuestions(ctx, closed)
+	return nil
+}
+
+// supersedeTx closes the open confirmations of a dialog the user wrote to again,
+// recording that the calls did not run ahead of the new input. The questions are
+// to be closed with closeQuestions once tx commits.
+func (s *ToolConfirmationService) supersedeTx(tx *sql.Tx, userID, dialogID int64) ([]repositories.ToolConfirmation, error) {
+	pending, err := s.repo.ListPendingForDialogTx(tx, userID, dialogID)
+	if err != nil || len(pending) == 0 {
+		return nil, err
+	}
+	var closed []repositories.ToolConfirmation
+	var events []repositories.AppendEventInput
+	for _, confirmation := range pending {
+		ok, err := s.repo.ResolveTx(tx, confirmation.ID, repositories.ToolConfirmationSuperseded)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			closed = append(closed, confirmation)
+			events = append(events, unperformedToolResult(confirmation, errConfirmationSuperseded))
+		}
+	}
+	if _, err := s.trace.AppendBatchTx(tx, userID, dialogID, events); err != nil {
+		return nil, err
+	}
+	return closed, nil
+}
+
+func (s *ToolConfirmationService) closeQuestions(ctx context.Context, superseded []repositories.ToolConfirmation) {
+	for _, confirmation := range superseded {
+		s.closeQuestion(ctx, confirmation, "Not answered, nothing was done.")
+	}
+}
+
+// ExpireDue closes the confirmations whose time ran out by now. The turns they
+// belong to stay finished; the model learns of it with the next message.
+func (s *ToolConfirmationService) ExpireDue(ctx context.Context, now time.Time) error {
+	expired, err := s.repo.ListExpired(ctx, now.Unix())
+	if err != nil {
+		return err
+	}
+	for _, confirmation := range expired {
+		closed := false
+		err := s.db.WithTx(ctx, func(tx *sql.Tx) error {
+			ok, err := s.repo.ResolveTx(tx, confirmation.ID, repositories.ToolConfirmationExpired)
+			if err != nil || !ok {
+				return err
+			}
+			closed = true
+			_, err = s.trace.AppendBatchTx(tx, confirmation.UserID, confirmation.DialogID, []repositories.AppendEventInput{
+				unperformedToolResult(confirmation, errConfirmationExpired),
+			})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("expire confirmation %d: %w", confirmation.ID, err)
+		}
+		if closed {
+			s.closeQuestion(ctx, confirmation, "Expired, nothing was done.")
+		}
+	}
+	return nil
+}
+
+// StartExpiry expires confirmations in the background until ctx is done. The
+// first pass catches the ones that ran out while the bot was down.
+func (s *ToolConfirmationService) StartExpiry(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(toolConfirmationSweepInterval)
+		defer ticker.Stop()
+		for {
+			if err := s.ExpireDue(ctx, time.Now()); err != nil {
+				slog.ErrorContext(ctx, "Error expiring tool confirmations", "error", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// closeQuestion replaces the buttons of the question with its outcome.
+func (s *ToolConfirmationService) closeQuestion(ctx context.Context, confirmation repositories.ToolConfirmation, outcome string) {
+	if s.bot == nil || confirmation.TgMessageID == 0 {
+		return
+	}
+	question := &tele.StoredMessage{
+		MessageID: strconv.FormatInt(confirmation.TgMessageID, 10),
+		ChatID:    confirmation.ChatID,
+	}
+	text := describeToolCall(confirmation.ToolName, confirmation.Arguments) + "\n\n" + outcome
+	if _, err := s.bot.Edit(question, text); err != nil {
+		slog.WarnContext(ctx, "Error closing confirmation question", "error", err, "confirmation_id", confirmation.ID)
+	}
+}
+
+func confirmationTurn(confirmation repositories.ToolConfirmation) TurnContext {
+	return TurnContext{
+		UserID:      confirmation.UserID,
+		DialogID:    confirmation.DialogID,
+		UserTraceID: confirmation.UserTraceID,
+		MemberID:    confirmation.MemberID,
+	}
+}
+
+func unperformedToolResult(confirmation repositories.ToolConfirmation, reason error) repositories.AppendEventInput {
+	return repositories.AppendEventInput{
+		EventType: models.EventTypeToolResult,
+		Payload: models.ToolResultPayload{
+			ToolCallID: confirmation.ToolCallID,
+			Name:       confirmation.ToolName,
+			Result:     toolErrorResult(reason),
+		},
+	}
+}
+
+func describeToolCall(name, arguments string) string {
+	return fmt.Sprintf("Allow %s?\n%s", name, truncateString(arguments, maxConfirmationArgumentsLen))
+}
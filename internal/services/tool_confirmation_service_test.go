@@ -0,0 +1,270 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"vadimgribanov.com/tg-gpt/internal/llm"
+	"vadimgribanov.com/tg-gpt/internal/models"
+	"vadimgribanov.com/tg-gpt/internal/repositories"
+)
+
+func newToolConfirmationHarness(t *testing.T, streams [][]llm.StreamEvent) (*textServiceIntegrationHarness, *ToolConfirmationService, *repositories.ToolConfirmationRepo) {
+	t.Helper()
+	h := newTextServiceIntegrationHarness(t, streams)
+	repo := repositories.NewToolConfirmationRepo(h.db)
+	confirmations := NewToolConfirmationService(h.db, repo, h.traceRepo, h.tools, h.memoryManager, nil, 15*time.Minute)
+	h.textService.SetToolConfirmations(confirmations)
+	return h, confirmations, repo
+}
+
+// pauseForConfirmation records a turn whose model step called list_reminders and
+// cancel_reminder, with the cancellation waiting for the user, the way a turn
+// asking through Telegram leaves it.
+func pauseForConfirmation(t *testing.T, h *textServiceIntegrationHarness, repo *repositories.ToolConfirmationRepo, expiresAt time.Time) (TurnContext, int64) {
+	t.Helper()
+	mctx, err := h.memoryManager.BeginTurn(h.user.Id, h.user.CurrentDialogId, 0, llm.Message{Role: llm.RoleUser, Content: "cancel my reminders"}, 201)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := []llm.ToolCall{
+		{ID: "call_list", Name: "list_reminders", Arguments: "{}"},
+		{ID: "call_cancel", Name: "cancel_reminder", Arguments: `{"reminder_id":"abc"}`},
+	}
+	if _, err := h.memoryManager.AppendModelMsg(mctx, "", calls, "test-model", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.memoryManager.AppendToolResult(mctx, "call_list", "list_reminders", "[]"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := repo.Insert(context.Background(), repositories.InsertToolConfirmation{
+		UserID:      mctx.UserID,
+		DialogID:    mctx.DialogID,
+		UserTraceID: mctx.UserTraceID,
+		ToolCallID:  "call_cancel",
+		ToolName:    "cancel_reminder",
+		Arguments:   `{"reminder_id":"abc"}`,
+		ExpiresAt:   expiresAt.Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mctx, id
+}
+
+func TestToolConfirmationDestructiveCallFailsWhenNobodyCanConfirm(t *testing.T) {
+	h, _, _ := newToolConfirmationHarness(t, [][]llm.StreamEvent{
+		{{ToolCalls: []llm.ToolCall{{ID: "call_cancel", Name: "cancel_reminder", Arguments: `{"reminder_id":"1"}`}}}},
+		{{TextDelta: "I need you to confirm that."}},
+	})
+
+	if _, err := h.textService.handleLLMRequest(context.Background(), h.user, 201, llm.Message{
+		Role:    llm.RoleUser,
+		Content: "cancel my reminder",
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	events := h.traceEvents(t, h.user.CurrentDialogId)
+	result := decodePayload[models.ToolResultPayload](t, events[2].Payload)
+	if !strings.Contains(result.Result, errConfirmationUnavailable.Error()) {
+		t.Fatalf("cancel result: %#v", result)
+	}
+}
+
+func TestToolConfirmationDecisionRunsToolAndResumesTurn(t *testing.T) {
+	h, confirmations, repo := newToolConfirmationHarness(t, [][]llm.StreamEvent{
+		{{TextDelta: "That reminder id is not valid."}},
+	})
+	ctx := context.Background()
+	mctx, id := pauseForConfirmation(t, h, repo, time.Now().Add(time.Hour))
+
+	if _, err := confirmations.Authorize(ctx, id, h.user.Id, h.user.Id+1); err != ErrNotConfirmationOwner {
+		t.Fatalf("authorize stranger: %v", err)
+	}
+	if _, err := confirmations.Authorize(ctx, id, h.user.Id, h.user.Id); err != nil {
+		t.Fatalf("authorize owner: %v", err)
+	}
+
+	confirmation, stillPending, err := confirmations.Decide(ctx, id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stillPending || confirmation.ToolCallID != "call_cancel" {
+		t.Fatalf("decision: %#v pending=%v", confirmation, stillPending)
+	}
+	if _, _, err := confirmations.Decide(ctx, id, false); err != ErrConfirmationNotPending {
+		t.Fatalf("second decision: %v", err)
+	}
+
+	answer, err := h.textService.ResumeTurn(ctx, h.user, mctx, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer != "That reminder id is not valid." {
+		t.Fatalf("answer: %q", answer)
+	}
+
+	events := h.traceEvents(t, h.user.CurrentDialogId)
+	types := make([]string, len(events))
+	for i, event := range events {
+		types[i] = event.EventType
+	}
+	want := "user_msg model_msg tool_result tool_result model_msg"
+	if strings.Join(types, " ") != want {
+		t.Fatalf("trace: %v, want %s", types, want)
+	}
+	// The confirmed call really ran: the reminder service rejected the id.
+	result := decodePayload[models.ToolResultPayload](t, events[3].Payload)
+	if result.ToolCallID != "call_cancel" || !strings.Contains(result.Result, "invalid reminder ID") {
+		t.Fatalf("confirmed call result: %#v", result)
+	}
+	requests := h.llmClient.requestsSnapshot()
+	last := requests[0].Messages[len(requests[0].Messages)-1]
+	if last.ToolResult == nil || last.ToolResult.CallID != "call_cancel" {
+		t.Fatalf("resumed request does not end with the decision: %#v", last)
+	}
+}
+
+func TestToolConfirmationResumedTurnRetrievesMemoryForTheOriginalMessage(t *testing.T) {
+	h, confirmations, repo := newToolConfirmationHarness(t, [][]llm.StreamEvent{
+		{{TextDelta: "Done."}},
+	})
+	ctx := context.Background()
+	if _, err := repositories.NewDocumentRepo(h.db).Insert(repositories.InsertDocumentInput{
+		UserID:         h.user.Id,
+		Name:           "notes.txt",
+		Chunks:         []string{"Reminders are cancelled by id."},
+		Embeddings:     [][]float32{{1, 0, 0}},
+		EmbeddingModel: "test-embedding",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	h.embeddings.set("cancel my reminders", []float32{1, 0, 0})
+	mctx, id := pauseForConfirmation(t, h, repo, time.Now().Add(time.Hour))
+
+	if _, _, err := confirmations.Decide(ctx, id, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.textService.ResumeTurn(ctx, h.user, mctx, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	system := h.llmClient.requestsSnapshot()[0].Messages[0].Content
+	if !strings.Contains(system, "Reminders are cancelled by id.") {
+		t.Fatalf("resumed turn must retrieve memory for the paused message: %s", system)
+	}
+}
+
+func TestToolConfirmationRejectionIsReportedToModel(t *testing.T) {
+	h, confirmations, repo := newToolConfirmationHarness(t, nil)
+	_, id := pauseForConfirmation(t, h, repo, time.Now().Add(time.Hour))
+
+	if _, _, err := confirmations.Decide(context.Background(), id, false); err != nil {
+		t.Fatal(err)
+	}
+	events := h.traceEvents(t, h.user.CurrentDialogId)
+	result := decodePayload[models.ToolResultPayload](t, events[len(events)-1].Payload)
+	if !strings.Contains(result.Result, errToolCallRejected.Error()) {
+		t.Fatalf("rejected call result: %#v", result)
+	}
+}
+
+func TestToolConfirmationNewMessageSupersedesPendingCalls(t *testing.T) {
+	h, confirmations, repo := newToolConfirmationHarness(t, [][]llm.StreamEvent{
+		{{TextDelta: "Sure, never mind."}},
+	})
+	ctx := context.Background()
+	_, id := pauseForConfirmation(t, h, repo, time.Now().Add(time.Hour))
+
+	if _, err := h.textService.handleLLMRequest(ctx, h.user, 202, llm.Message{
+		Role:    llm.RoleUser,
+		Content: "actually, keep them",
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	events := h.traceEvents(t, h.user.CurrentDialogId)
+	result := decodePayload[models.ToolResultPayload](t, events[3].Payload)
+	if events[3].EventType != models.EventTypeToolResult || !strings.Contains(result.Result, errConfirmationSuperseded.Error()) {
+		t.Fatalf("superseded call result: %s %#v", events[3].EventType, result)
+	}
+	if events[4].EventType != models.EventTypeUserMsg {
+		t.Fatalf("new message must follow the results: %s", events[4].EventType)
+	}
+	confirmation, err := repo.Get(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confirmation.Status != repositories.ToolConfirmationSuperseded {
+		t.Fatalf("status: %s", confirmation.Status)
+	}
+	if _, _, err := confirmations.Decide(ctx, id, true); err != ErrConfirmationNotPending {
+		t.Fatalf("late decision: %v", err)
+	}
+}
+
+func TestToolConfirmationDialogTimeoutSupersedesPendingCalls(t *testing.T) {
+	h, _, repo := newToolConfirmationHarness(t, nil)
+	ctx := context.Background()
+	_, id := pauseForConfirmation(t, h, repo, time.Now().Add(time.Hour))
+
+	user := h.user
+	user.LastInteraction = time.Now().Add(-2 * time.Hour).Unix()
+	moved, err := h.textService.PrepareUserForInput(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.CurrentDialogId == h.user.CurrentDialogId {
+		t.Fatal("timed out dialog must be left")
+	}
+	if confirmation, _ := repo.Get(ctx, id); confirmation.Status != repositories.ToolConfirmationSuperseded {
+		t.Fatalf("status: %s", confirmation.Status)
+	}
+}
+
+func TestToolConfirmationBranchSupersedesPendingCalls(t *testing.T) {
+	h, _, repo := newToolConfirmationHarness(t, nil)
+	ctx := context.Background()
+	h.recordExchange(t, 101, "hi", 102, "hello")
+	_, id := pauseForConfirmation(t, h, repo, time.Now().Add(time.Hour))
+
+	branched, ok, err := h.textService.BranchFromReply(ctx, h.user, 102)
+	if err != nil || !ok {
+		t.Fatalf("branch: ok=%v err=%v", ok, err)
+	}
+	if branched.CurrentDialogId == h.user.CurrentDialogId {
+		t.Fatal("reply to an older answer must branch")
+	}
+	if confirmation, _ := repo.Get(ctx, id); confirmation.Status != repositories.ToolConfirmationSuperseded {
+		t.Fatalf("status: %s", confirmation.Status)
+	}
+}
+
+func TestToolConfirmationExpires(t *testing.T) {
+	h, confirmations, repo := newToolConfirmationHarness(t, nil)
+	ctx := context.Background()
+	now := time.Now()
+	_, id := pauseForConfirmation(t, h, repo, now.Add(time.Minute))
+
+	if err := confirmations.ExpireDue(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	if confirmation, _ := repo.Get(ctx, id); confirmation.Status != repositories.ToolConfirmationPending {
+		t.Fatalf("expired early: %s", confirmation.Status)
+	}
+
+	if err := confirmations.ExpireDue(ctx, now.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if confirmation, _ := repo.Get(ctx, id); confirmation.Status != repositories.ToolConfirmationExpired {
+		t.Fatalf("status: %s", confirmation.Status)
+	}
+	events := h.traceEvents(t, h.user.CurrentDialogId)
+	result := decodePayload[models.ToolResultPayload](t, events[len(events)-1].Payload)
+	if result.ToolCallID != "call_cancel" || !strings.Contains(result.Result, errConfirmationExpired.Error()) {
+		t.Fatalf("expired call result: %#v", result)
+	}
+}
@@ -0,0 +1,194 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"vadimgribanov.com/tg-gpt/internal/config"
+	"vadimgribanov.com/tg-gpt/internal/llm"
+)
+
+// ToolProvider is a service offering tools to the model. HandleToolCall is only
+// called for the tools the provider lists.
+type ToolProvider interface {
+	Tools() []llm.Tool
+	HandleToolCall(ctx context.Context, mctx TurnContext, toolCall llm.ToolCall) (string, error)
+}
+
+// SequentialToolProvider is implemented by providers with tools that must not run
+// alongside other tool calls, e.g. because they write memory. Tools of providers
+// without it run in parallel.
+type SequentialToolProvider interface {
+	Sequential(toolName string) bool
+}
+
+// DestructiveToolProvider is implemented by providers with tools whose effects
+// cannot be undone, e.g. deleting memories. Such calls wait for the user to
+// confirm them.
+type DestructiveToolProvider interface {
+	Destructive(toolName string) bool
+}
+
+const (
+	defaultParallelToolCalls = 4
+	defaultToolCallTimeout   = 60 * time.Second
+)
+
+// ToolMode names a set of tools offered together.
+type ToolMode string
+
+const (
+	// ToolModeChat is used for conversations with the user.
+	ToolModeChat ToolMode = "chat"
+	// ToolModeScheduledAction is used when a reminder runs its action unattended.
+	ToolModeScheduledAction ToolMode = "scheduled_action"
+)
+
+// ToolRegistry collects the tools of all providers and dispatches tool calls to
+// the provider that owns the tool.
+type ToolRegistry struct {
+	tools     []llm.Tool
+	providers map[string]ToolProvider
+	// modes lists the tool names offered in each mode; a mode without an entry
+	// offers every registered tool.
+	modes map[ToolMode][]string
+	// parallelism caps how many tool calls of one step run at the same time.
+	parallelism int
+	callTimeout time.Duration
+}
+
+func NewToolRegistry(modes map[ToolMode][]string) *ToolRegistry {
+	return &ToolRegistry{
+		providers:   make(map[string]ToolProvider),
+		modes:       modes,
+		parallelism: defaultParallelToolCalls,
+		callTimeout: defaultToolCallTimeout,
+	}
+}
+
+// NewToolRegistryFromConfig creates a registry with the tool modes and limits of
+// the config.
+func NewToolRegistryFromConfig(cfg config.ToolsConfig) *ToolRegistry {
+	modes := make(map[ToolMode][]string, len(cfg.Modes))
+	for mode, names := range cfg.Modes {
+		modes[ToolMode(mode)] = names
+	}
+	r := NewToolRegistry(modes)
+	r.parallelism = cfg.ParallelCalls
+	r.callTimeout = time.Duration(cfg.CallTimeoutSeconds) * time.Second
+	return r
+}
+
+// Register adds the tools of a provider. A tool name can only be registered once.
+func (r *ToolRegistry) Register(provider ToolProvider) error {
+	tools := provider.Tools()
+	for _, tool := range tools {
+		if _, ok := r.providers[tool.Name]; ok {
+			return fmt.Errorf("tool %s is already registered", tool.Name)
+		}
+	}
+	for _, tool := range tools {
+		r.providers[tool.Name] = provider
+		r.tools = append(r.tools, tool)
+	}
+	return nil
+}
+
+// Tools returns the definitions of the tools offered in mode, in registration
+// order. Names configured for the mode that no provider registered are skipped.
+func (r *ToolRegistry) Tools(mode ToolMode) []llm.Tool {
+	names, ok := r.modes[mode]
+	if !ok {
+		return r.tools
+	}
+	allowed := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		allowed[name] = struct{}{}
+	}
+	var out []llm.Tool
+	for _, tool := range r.tools {
+		if _, ok := allowed[tool.Name]; ok {
+			out = append(out, tool)
+		}
+	}
+	return out
+}
+
+// WarnUnknownTools logs the tool names configured for a mode that no provider
+// registered, e.g. a typo or a tool whose service is not set up.
+func (r *ToolRegistry) WarnUnknownTools() {
+	for mode, names := range r.modes {
+		for _, name := range names {
+			if _, ok := r.providers[name]; !ok {
+				slog.Warn("Configured tool is not registered", "mode", mode, "tool", name)
+			}
+		}
+	}
+}
+
+// HandleToolCall runs a tool call with the provider that registered the tool.
+func (r *ToolRegistry) HandleToolCall(ctx context.Context, mctx TurnContext, toolCall llm.ToolCall) (string, error) {
+	provider, ok := r.providers[toolCall.Name]
+	if !ok {
+		return "Unknown tool", fmt.Errorf("unknown tool: %s", toolCall.Name)
+	}
+	return provider.HandleToolCall(ctx, mctx, toolCall)
+}
+
+// ToolCallResult is the outcome of one tool call.
+type ToolCallResult struct {
+	Output string
+	Err    error
+}
+
+// HandleToolCalls runs the tool calls the model made in one step and returns
+// their results in the order of the calls. Runs of parallel tools execute
+// concurrently, at most parallelism at a time; a sequential tool waits for the
+// calls before it and holds back the calls after it. Each call is limited to
+// callTimeout.
+func (r *ToolRegistry) HandleToolCalls(ctx context.Context, mctx TurnContext, toolCalls []llm.ToolCall) []ToolCallResult {
+	results := make([]ToolCallResult, len(toolCalls))
+	slots := make(chan struct{}, max(r.parallelism, 1))
+	var wg sync.WaitGroup
+	for i, toolCall := range toolCalls {
+		if !r.parallel(toolCall.Name) {
+			wg.Wait()
+			results[i] = r.handleWithTimeout(ctx, mctx, toolCall)
+			continue
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i] = r.handleWithTimeout(ctx, mctx, toolCall)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// Destructive reports whether a call of the tool needs the user's confirmation.
+func (r *ToolRegistry) Destructive(toolName string) bool {
+	destructive, ok := r.providers[toolName].(DestructiveToolProvider)
+	return ok && destructive.Destructive(toolName)
+}
+
+func (r *ToolRegistry) parallel(toolName string) bool {
+	sequential, ok := r.providers[toolName].(SequentialToolProvider)
+	return !ok || !sequential.Sequential(toolName)
+}
+
+func (r *ToolRegistry) handleWithTimeout(ctx context.Context, mctx TurnContext, toolCall llm.ToolCall) ToolCallResult {
+	callCtx, cancel := context.WithTimeout(ctx, r.callTimeout)
+	defer cancel()
+	output, err := r.HandleToolCall(callCtx, mctx, toolCall)
+	if err != nil && errors.Is(callCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		err = fmt.Errorf("tool call timed out after %s: %w", r.callTimeout, err)
+	}
+	return ToolCallResult{Output: output, Err: err}
+}
@@ -0,0 +1,211 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"vadimgribanov.com/tg-gpt/internal/llm"
+)
+
+type fakeToolProvider struct {
+	names []string
+	calls []string
+}
+
+func (p *fakeToolProvider) Tools() []llm.Tool {
+	tools := make([]llm.Tool, 0, len(p.names))
+	for _, name := range p.names {
+		tools = append(tools, llm.Tool{Name: name})
+	}
+	return tools
+}
+
+func (p *fakeToolProvider) HandleToolCall(ctx context.Context, mctx TurnContext, toolCall llm.ToolCall) (string, error) {
+	p.calls = append(p.calls, toolCall.Name)
+	return "done: " + toolCall.Name, nil
+}
+
+func TestToolRegistryDispatchesToProviderAndFiltersModes(t *testing.T) {
+	memory := &fakeToolProvider{names: []string{"save_memory", "get_memory"}}
+	search := &fakeToolProvider{names: []string{"web_search"}}
+	registry := NewToolRegistry(map[ToolMode][]string{ToolModeScheduledAction: {"web_search", "missing"}})
+	for _, provider := range []ToolProvider{memory, search} {
+		if err := registry.Register(provider); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := registry.Tools(ToolModeChat); len(got) != 3 || got[0].Name != "save_memory" || got[2].Name != "web_search" {
+		t.Fatalf("chat tools: %#v", got)
+	}
+	if got := registry.Tools(ToolModeScheduledAction); len(got) != 1 || got[0].Name != "web_search" {
+		t.Fatalf("scheduled action tools: %#v", got)
+	}
+
+	result, err := registry.HandleToolCall(context.Background(), TurnContext{}, llm.ToolCall{Name: "web_search"})
+	if err != nil || result != "done: web_search" || len(search.calls) != 1 || len(memory.calls) != 0 {
+		t.Fatalf("dispatch: %q %v, search calls %v, memory calls %v", result, err, search.calls, memory.calls)
+	}
+	if _, err := registry.HandleToolCall(context.Background(), TurnContext{}, llm.ToolCall{Name: "nope"}); err == nil {
+		t.Fatal("unknown tool must fail")
+	}
+}
+
+func TestToolRegistryRejectsDuplicateToolNames(t *testing.T) {
+	registry := NewToolRegistry(nil)
+	if err := registry.Register(&fakeToolProvider{names: []string{"web_search"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Register(&fakeToolProvider{names: []string{"other", "web_search"}}); err == nil {
+		t.Fatal("duplicate tool name must be rejected")
+	}
+	if got := registry.Tools(ToolModeChat); len(got) != 1 {
+		t.Fatalf("a rejected provider must not add any tool: %#v", got)
+	}
+}
+
+// funcToolProvider runs every tool with handle and declares the tools in
+// sequential as not parallelizable.
+type funcToolProvider struct {
+	names      []string
+	sequential map[string]bool
+	handle     func(ctx context.Context, toolCall llm.ToolCall) (string, error)
+}
+
+func (p *funcToolProvider) Tools() []llm.Tool {
+	tools := make([]llm.Tool, 0, len(p.names))
+	for _, name := range p.names {
+		tools = append(tools, llm.Tool{Name: name})
+	}
+	return tools
+}
+
+func (p *funcToolProvider) HandleToolCall(ctx context.Context, mctx TurnContext, toolCall llm.ToolCall) (string, error) {
+	return p.handle(ctx, toolCall)
+}
+
+func (p *funcToolProvider) Sequential(toolName string) bool {
+	return p.sequential[toolName]
+}
+
+func TestToolRegistryRunsParallelCallsConcurrentlyInOrder(t *testing.T) {
+	// Every search waits until all three are running, which only works if they
+	// run at the same time.
+	var started sync.WaitGroup
+	started.Add(3)
+	registry := NewToolRegistry(nil)
+	registry.Register(&funcToolProvider{
+		names: []string{"web_search"},
+		handle: func(ctx context.Context, toolCall llm.ToolCall) (string, error) {
+			started.Done()
+			started.Wait()
+			return "results for " + toolCall.Arguments, nil
+		},
+	})
+
+	calls := []llm.ToolCall{
+		{Name: "web_search", Arguments: "a"},
+		{Name: "web_search", Arguments: "b"},
+		{Name: "web_search", Arguments: "c"},
+	}
+	done := make(chan []ToolCallResult)
+	go func() { done <- registry.HandleToolCalls(context.Background(), TurnContext{}, calls) }()
+	select {
+	case results := <-done:
+		for i, want := range []string{"results for a", "results for b", "results for c"} {
+			if results[i].Output != want || results[i].Err != nil {
+				t.Fatalf("result %d: %#v", i, results[i])
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("parallel calls did not run concurrently")
+	}
+}
+
+func TestToolRegistrySequentialToolIsABarrier(t *testing.T) {
+	var mu sync.Mutex
+	var log []string
+	record := func(entry string) {
+		mu.Lock()
+		log = append(log, entry)
+		mu.Unlock()
+	}
+	registry := NewToolRegistry(nil)
+	registry.Register(&funcToolProvider{
+		names:      []string{"get_memory", "save_memory"},
+		sequential: map[string]bool{"save_memory": true},
+		handle: func(ctx context.Context, toolCall llm.ToolCall) (string, error) {
+			record("start " + toolCall.ID)
+			time.Sleep(10 * time.Millisecond)
+			record("end " + toolCall.ID)
+			return toolCall.ID, nil
+		},
+	})
+
+	results := registry.HandleToolCalls(context.Background(), TurnContext{}, []llm.ToolCall{
+		{ID: "read1", Name: "get_memory"},
+		{ID: "read2", Name: "get_memory"},
+		{ID: "write", Name: "save_memory"},
+		{ID: "read3", Name: "get_memory"},
+	})
+	for i, want := range []string{"read1", "read2", "write", "read3"} {
+		if results[i].Output != want {
+			t.Fatalf("result %d: %#v", i, results[i])
+		}
+	}
+	position := make(map[string]int, len(log))
+	for i, entry := range log {
+		position[entry] = i
+	}
+	if position["start write"] < position["end read1"] || position["start write"] < position["end read2"] {
+		t.Fatalf("write started before the reads before it finished: %v", log)
+	}
+	if position["start read3"] < position["end write"] {
+		t.Fatalf("read after the write started early: %v", log)
+	}
+}
+
+func TestToolRegistryBoundsParallelismAndTimesOutCalls(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	registry := NewToolRegistry(nil)
+	registry.parallelism = 2
+	registry.callTimeout = 50 * time.Millisecond
+	registry.Register(&funcToolProvider{
+		names: []string{"web_search", "hang"},
+		handle: func(ctx context.Context, toolCall llm.ToolCall) (string, error) {
+			if toolCall.Name == "hang" {
+				<-ctx.Done()
+				return "", ctx.Err()
+			}
+			mu.Lock()
+			running++
+			maxRunning = max(maxRunning, running)
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return "ok", nil
+		},
+	})
+
+	var calls []llm.ToolCall
+	for i := 0; i < 6; i++ {
+		calls = append(calls, llm.ToolCall{ID: fmt.Sprint(i), Name: "web_search"})
+	}
+	calls = append(calls, llm.ToolCall{ID: "slow", Name: "hang"})
+	results := registry.HandleToolCalls(context.Background(), TurnContext{}, calls)
+
+	if maxRunning > 2 {
+		t.Fatalf("ran %d calls at once, limit is 2", maxRunning)
+	}
+	last := results[len(results)-1]
+	if last.Err == nil || !strings.Contains(last.Err.Error(), "timed out after 50ms") {
+		t.Fatalf("hanging call: %#v", last)
+	}
+}
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+	"vadimgribanov.com/tg-gpt/internal/config"
+)
+
+// Transcriber turns speech into text. fileName carries the audio format, e.g.
+// voice.ogg or note.mp4; language is an ISO-639-1 hint and may be empty.
+type Transcriber interface {
+	Transcribe(ctx context.Context, audio io.Reader, fileName, language string) (string, error)
+}
+
+// NewTranscriberFromConfig returns the configured speech-to-text backend. client
+// serves the openai backend.
+func NewTranscriberFromConfig(cfg config.STTConfig, client *openai.Client) (Transcriber, error) {
+	switch cfg.Backend {
+	case "openai":
+		return NewOpenAITranscriber(client, cfg.Model), nil
+	case "whispercpp":
+		if cfg.BaseURL == "" {
+			return nil, fmt.Errorf("whispercpp transcriber needs base_url")
+		}
+		return NewWhisperCppTranscriber(cfg.BaseURL), nil
+	}
+	return nil, fmt.Errorf("unknown speech-to-text backend: %q", cfg.Backend)
+}
+
+// OpenAITranscriber uses the OpenAI transcription endpoint or a compatible one.
+type OpenAITranscriber struct {
+	client *openai.Client
+	model  string
+}
+
+func NewOpenAITranscriber(client *openai.Client, model string) *OpenAITranscriber {
+	return &OpenAITranscriber{client: client, model: model}
+}
+
+func (t *OpenAITranscriber) Transcribe(ctx context.Context, audio io.Reader, fileName, language string) (string, error) {
+	response, err := t.client.CreateTranscription(ctx, openai.AudioRequest{
+		Reader:   audio,
+		FilePath: fileName,
+		Model:    t.model,
+		Language: language,
+	})
+	if err != nil {
+		return "", err
+	}
+	return response.Text, nil
+}
+
+// WhisperCppTranscriber posts audio to a whisper.cpp server's /inference endpoint.
+// Formats other than WAV need the server to run with --convert.
+type WhisperCppTranscriber struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+func NewWhisperCppTranscriber(baseURL string) *WhisperCppTranscriber {
+	return &WhisperCppTranscriber{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+	}
+}
+
+func (t *WhisperCppTranscriber) Transcribe(ctx context.Context, audio io.Reader, fileName, language string) (string, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	file, err := form.CreateFormFile("file", fileName)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(file, audio); err != nil {
+		return "", fmt.Errorf("read audio: %w", err)
+	}
+	fields := map[string]string{"response_format": "json", "temperature": "0"}
+	if language != "" {
+		fields["language"] = language
+	}
+	for name, value := range fields {
+		if err := form.WriteField(name, value); err != nil {
+			return "", err
+		}
+	}
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.baseURL+"/inference", &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("whisper.cpp request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("whisper.cpp: status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var out struct {
+		Text  string `json:"text"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("decode whisper.cpp response: %w", err)
+	}
+	if out.Error != "" {
+		return "", fmt.Errorf("whisper.cpp: %s", out.Error)
+	}
+	return strings.TrimSpace(out.Text), nil
+}
+
+// languageCodes maps language names, as the response_language preference usually
+// holds them, to the ISO-639-1 codes transcribers take.
+var languageCodes = map[string]string{
+	"english": "en", "russian": "ru", "ukrainian": "uk", "belarusian": "be", "german": "de",
+	"french": "fr", "spanish": "es", "italian": "it", "portuguese": "pt", "dutch": "nl",
+	"polish": "pl", "czech": "cs", "swedish": "sv", "norwegian": "no", "danish": "da",
+	"finnish": "fi", "greek": "el", "turkish": "tr", "arabic": "ar", "hebrew": "he",
+	"hindi": "hi", "chinese": "zh", "japanese": "ja", "korean": "ko", "vietnamese": "vi",
+	"indonesian": "id", "thai": "th", "serbian": "sr", "romanian": "ro", "hungarian": "hu",
+	"georgian": "ka", "armenian": "hy", "kazakh": "kk",
+}
+
+// transcriptionLanguage turns a response_language preference into a language
+// hint. Values it does not recognize give no hint rather than a wrong one.
+func transcriptionLanguage(preference string) string {
+	value := strings.ToLower(strings.TrimSpace(preference))
+	if code, ok := languageCodes[value]; ok {
+		return code
+	}
+	// Locale-style values such as "en" or "pt-BR".
+	code, _, _ := strings.Cut(strings.ReplaceAll(value, "_", "-"), "-")
+	for _, known := range languageCodes {
+		if code == known {
+			return code
+		}
+	}
+	return ""
+}
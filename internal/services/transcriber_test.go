@@ -0,0 +1,57 @@
+package services
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTranscriptionLanguage(t *testing.T) {
+	cases := map[string]string{
+		"French":   "fr",
+		" russian": "ru",
+		"pt-BR":    "pt",
+		"en_US":    "en",
+		"Klingon":  "",
+		"":         "",
+	}
+	for preference, want := range cases {
+		if got := transcriptionLanguage(preference); got != want {
+			t.Fatalf("%q: got %q want %q", preference, got, want)
+		}
+	}
+}
+
+func TestWhisperCppTranscriberPostsAudioWithLanguage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/inference" {
+			t.Errorf("path: got %s", r.URL.Path)
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			t.Errorf("form file: %v", err)
+			return
+		}
+		audio, _ := io.ReadAll(file)
+		if header.Filename != "video_note.mp4" || string(audio) != "audio bytes" {
+			t.Errorf("file: got %s with %q", header.Filename, audio)
+		}
+		if got := r.FormValue("language"); got != "de" {
+			t.Errorf("language: got %q", got)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"text":" Hallo Welt\n"}`))
+	}))
+	defer server.Close()
+
+	text, err := NewWhisperCppTranscriber(server.URL+"/").Transcribe(context.Background(), strings.NewReader("audio bytes"), "video_note.mp4", "de")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "Hallo Welt" {
+		t.Fatalf("text: got %q", text)
+	}
+}
@@ -0,0 +1,232 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"vadimgribanov.com/tg-gpt/internal/config"
+	"vadimgribanov.com/tg-gpt/internal/llm"
+	"vadimgribanov.com/tg-gpt/internal/models"
+	"vadimgribanov.com/tg-gpt/internal/repositories"
+)
+
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+type UsageService struct {
+	repo   *repositories.UsageRepo
+	prices map[string]config.ModelPrice
+	budget config.BudgetConfig
+}
+
+func NewUsageService(repo *repositories.UsageRepo, modelConfigs []config.LLMModel, budget config.BudgetConfig) *UsageService {
+	prices := make(map[string]config.ModelPrice, len(modelConfigs))
+	for _, model := range modelConfigs {
+		prices[model.ModelId] = model.Price
+	}
+	return &UsageService{repo: repo, prices: prices, budget: budget}
+}
+
+// Cost prices the usage with the model's price table. Models without a price
+// cost nothing.
+func (s *UsageService) Cost(model string, usage llm.Usage) float64 {
+	price := s.prices[model]
+	cachedPrice := price.CachedInputPerMillion
+	if cachedPrice == 0 {
+		cachedPrice = price.InputPerMillion
+	}
+	uncached := usage.InputTokens - usage.CachedInputTokens
+	return (float64(uncached)*price.InputPerMillion +
+		float64(usage.CachedInputTokens)*cachedPrice +
+		float64(usage.OutputTokens)*price.OutputPerMillion) / 1_000_000
+}
+
+func (s *UsageService) RecordTurn(userID, dialogID int64, model string, usage llm.Usage) error {
+	_, err := s.repo.Record(models.UsageEntry{
+		UserID:            userID,
+		DialogID:          dialogID,
+		Model:             model,
+		InputTokens:       usage.InputTokens,
+		OutputTokens:      usage.OutputTokens,
+		CachedInputTokens: usage.CachedInputTokens,
+		CostUSD:           s.Cost(model, usage),
+	})
+	return err
+}
+
+// TranscriptionUsageModel is the ledger model name of speech-to-text entries.
+const TranscriptionUsageModel = "speech-to-text"
+
+// RecordTranscription adds seconds of transcribed speech to the user's ledger.
+func (s *UsageService) RecordTranscription(userID, dialogID, seconds int64) error {
+	_, err := s.repo.Record(models.UsageEntry{
+		UserID:             userID,
+		DialogID:           dialogID,
+		Model:              TranscriptionUsageModel,
+		TranscribedSeconds: seconds,
+	})
+	return err
+}
+
+// TranscriptionQuotaExceeded returns the period whose transcription limit a
+// recording of the given length would go over, or "" when it fits.
+func (s *UsageService) TranscriptionQuotaExceeded(userID, seconds int64, now time.Time) (string, error) {
+	limits, err := s.limitsFor(userID)
+	if err != nil {
+		return "", err
+	}
+	if limits.DailyTranscriptionMinutes == 0 && limits.MonthlyTranscriptionMinutes == 0 {
+		return "", nil
+	}
+	dayStart, monthStart, end := usagePeriods(now)
+	for _, period := range []struct {
+		name    string
+		start   int64
+		minutes float64
+	}{
+		{BudgetPeriodDaily, dayStart, limits.DailyTranscriptionMinutes},
+		{BudgetPeriodMonthly, monthStart, limits.MonthlyTranscriptionMinutes},
+	} {
+		if period.minutes <= 0 {
+			continue
+		}
+		used, err := s.repo.TranscribedSeconds(userID, period.start, end)
+		if err != nil {
+			return "", err
+		}
+		if float64(used+seconds) > period.minutes*60 {
+			return period.name, nil
+		}
+	}
+	return "", nil
+}
+
+// TranscriptionRefusal tells the user their recording was not transcribed.
+func TranscriptionRefusal(period string) string {
+	if period == BudgetPeriodDaily {
+		return "Sorry, this would go over your daily limit for voice transcription. It resets at midnight UTC."
+	}
+	return "Sorry, this would go over your monthly limit for voice transcription. It resets on the 1st (UTC)."
+}
+
+type UsageReport struct {
+	Today []models.UsageSummary
+	Month []models.UsageSummary
+}
+
+// Report summarizes the user's spending for the current UTC day and month.
+func (s *UsageService) Report(userID int64, now time.Time) (UsageReport, error) {
+	dayStart, monthStart, end := usagePeriods(now)
+	today, err := s.repo.SummarizeByModel(userID, dayStart, end)
+	if err != nil {
+		return UsageReport{}, err
+	}
+	month, err := s.repo.SummarizeByModel(userID, monthStart, end)
+	if err != nil {
+		return UsageReport{}, err
+	}
+	return UsageReport{Today: today, Month: month}, nil
+}
+
+// usagePeriods returns the start of the current UTC day and month and an exclusive
+// end that includes the current second.
+func usagePeriods(now time.Time) (int64, int64, int64) {
+	now = now.UTC()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return dayStart.Unix(), monthStart.Unix(), now.Unix() + 1
+}
+
+const (
+	BudgetPeriodDaily   = "daily"
+	BudgetPeriodMonthly = "monthly"
+)
+
+// BudgetStatus describes the user's most consumed budget limit.
+type BudgetStatus struct {
+	Fraction float64
+	Period   string
+}
+
+func (b BudgetStatus) Exceeded() bool {
+	return b.Fraction >= 1
+}
+
+// Limits returns the user's effective limits and whether an admin set them in
+// place of the configured ones.
+func (s *UsageService) Limits(userID int64) (config.BudgetLimits, bool, error) {
+	override, err := s.repo.GetBudgetOverride(userID)
+	if err != nil {
+		return config.BudgetLimits{}, false, err
+	}
+	if override != nil {
+		return config.BudgetLimits(*override), true, nil
+	}
+	if limits, ok := s.budget.Users[userID]; ok {
+		return limits, false, nil
+	}
+	return s.budget.Default, false, nil
+}
+
+// SetLimits replaces the user's configured limits until ResetLimits.
+func (s *UsageService) SetLimits(userID int64, limits config.BudgetLimits) error {
+	return s.repo.SetBudgetOverride(userID, repositories.BudgetOverride(limits))
+}
+
+// ResetLimits drops the limits set with SetLimits, reporting whether there were any.
+func (s *UsageService) ResetLimits(userID int64) (bool, error) {
+	return s.repo.DeleteBudgetOverride(userID)
+}
+
+func (s *UsageService) limitsFor(userID int64) (config.BudgetLimits, error) {
+	limits, _, err := s.Limits(userID)
+	return limits, err
+}
+
+// BudgetStatus compares the user's usage in the current UTC day and month against
+// their limits. Users without limits always get a zero status.
+func (s *UsageService) BudgetStatus(userID int64, now time.Time) (BudgetStatus, error) {
+	limits, err := s.limitsFor(userID)
+	if err != nil {
+		return BudgetStatus{}, err
+	}
+	if limits == (config.BudgetLimits{}) {
+		return BudgetStatus{}, nil
+	}
+	dayStart, monthStart, end := usagePeriods(now)
+	dayTokens, dayCost, err := s.repo.Totals(userID, dayStart, end)
+	if err != nil {
+		return BudgetStatus{}, err
+	}
+	monthTokens, monthCost, err := s.repo.Totals(userID, monthStart, end)
+	if err != nil {
+		return BudgetStatus{}, err
+	}
+
+	var status BudgetStatus
+	consider := func(used, limit float64, period string) {
+		if limit > 0 && used/limit > status.Fraction {
+			status = BudgetStatus{Fraction: used / limit, Period: period}
+		}
+	}
+	consider(float64(dayTokens), float64(limits.DailyTokens), BudgetPeriodDaily)
+	consider(dayCost, limits.DailyUSD, BudgetPeriodDaily)
+	consider(float64(monthTokens), float64(limits.MonthlyTokens), BudgetPeriodMonthly)
+	consider(monthCost, limits.MonthlyUSD, BudgetPeriodMonthly)
+	return status, nil
+}
+
+func (s *UsageService) DowngradeModel() string {
+	return s.budget.DowngradeModel
+}
+
+// ShouldWarn reports whether a turn moved the user across the warning threshold.
+func (s *UsageService) ShouldWarn(before, after BudgetStatus) bool {
+	return before.Fraction < s.budget.WarnAt && after.Fraction >= s.budget.WarnAt
+}
+
+func budgetRefusal(status BudgetStatus) string {
+	if status.Period == BudgetPeriodDaily {
+		return "Sorry, you've used up your daily budget. It resets at midnight UTC."
+	}
+	return "Sorry, you've used up your monthly budget. It resets on the 1st (UTC)."
+}
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"vadimgribanov.com/tg-gpt/internal/config"
+	"vadimgribanov.com/tg-gpt/internal/llm"
+	"vadimgribanov.com/tg-gpt/internal/models"
+	"vadimgribanov.com/tg-gpt/internal/repositories"
+)
+
+func TestUsageServiceCostUsesCachedInputPrice(t *testing.T) {
+	service := NewUsageService(nil, []config.LLMModel{
+		{ModelId: "cached", Price: config.ModelPrice{InputPerMillion: 2, CachedInputPerMillion: 0.5, OutputPerMillion: 8}},
+		{ModelId: "uncached", Price: config.ModelPrice{InputPerMillion: 2, OutputPerMillion: 8}},
+	}, config.BudgetConfig{})
+	usage := llm.Usage{InputTokens: 1_000_000, CachedInputTokens: 400_000, OutputTokens: 250_000}
+
+	if got := service.Cost("cached", usage); got != 0.6*2+0.4*0.5+0.25*8 {
+		t.Fatalf("cached model cost: %v", got)
+	}
+	if got := service.Cost("uncached", usage); got != 2+0.25*8 {
+		t.Fatalf("cached tokens must fall back to the input price: %v", got)
+	}
+	if got := service.Cost("unpriced", usage); got != 0 {
+		t.Fatalf("unpriced model cost: %v", got)
+	}
+}
+
+func TestUsageServiceBudgetStatusUsesUserOverrides(t *testing.T) {
+	h := newTextServiceIntegrationHarness(t, nil)
+	repo := repositories.NewUsageRepo(h.db)
+	if _, err := repo.Record(models.UsageEntry{UserID: h.user.Id, Model: "test-model", InputTokens: 800, OutputTokens: 100, CostUSD: 0.1}); err != nil {
+		t.Fatal(err)
+	}
+	service := NewUsageService(repo, nil, config.BudgetConfig{
+		Default: config.BudgetLimits{DailyUSD: 0.05},
+		Users:   map[int64]config.BudgetLimits{h.user.Id: {MonthlyTokens: 1000}},
+		WarnAt:  0.8,
+	})
+
+	status, err := service.BudgetStatus(h.user.Id, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Period != BudgetPeriodMonthly || status.Fraction != 0.9 || status.Exceeded() {
+		t.Fatalf("status: %#v", status)
+	}
+	if !service.ShouldWarn(BudgetStatus{Fraction: 0.5}, status) || service.ShouldWarn(status, status) {
+		t.Fatal("warning must fire once when crossing the threshold")
+	}
+	if other, err := service.BudgetStatus(h.user.Id+1, time.Now()); err != nil || other.Fraction != 0 {
+		t.Fatalf("user without usage: %#v %v", other, err)
+	}
+
+	// Limits set by an admin replace the configured ones until reset.
+	if err := service.SetLimits(h.user.Id, config.BudgetLimits{DailyTokens: 600}); err != nil {
+		t.Fatal(err)
+	}
+	if limits, overridden, err := service.Limits(h.user.Id); err != nil || !overridden || limits != (config.BudgetLimits{DailyTokens: 600}) {
+		t.Fatalf("admin limits: %#v %v %v", limits, overridden, err)
+	}
+	if status, err := service.BudgetStatus(h.user.Id, time.Now()); err != nil || status.Period != BudgetPeriodDaily || !status.Exceeded() {
+		t.Fatalf("status with admin limits: %#v %v", status, err)
+	}
+	if reset, err := service.ResetLimits(h.user.Id); err != nil || !reset {
+		t.Fatalf("reset: %v %v", reset, err)
+	}
+	if limits, overridden, err := service.Limits(h.user.Id); err != nil || overridden || limits.MonthlyTokens != 1000 {
+		t.Fatalf("limits after reset: %#v %v %v", limits, overridden, err)
+	}
+}
+
+func TestUsageServiceTranscriptionQuota(t *testing.T) {
+	h := newTextServiceIntegrationHarness(t, nil)
+	repo := repositories.NewUsageRepo(h.db)
+	service := NewUsageService(repo, nil, config.BudgetConfig{
+		Default: config.BudgetLimits{DailyTranscriptionMinutes: 2, MonthlyTranscriptionMinutes: 10},
+	})
+	if err := service.RecordTranscription(h.user.Id, h.user.CurrentDialogId, 90); err != nil {
+		t.Fatal(err)
+	}
+
+	if period, err := service.TranscriptionQuotaExceeded(h.user.Id, 30, time.Now()); err != nil || period != "" {
+		t.Fatalf("recording within the daily limit: %q %v", period, err)
+	}
+	if period, err := service.TranscriptionQuotaExceeded(h.user.Id, 31, time.Now()); err != nil || period != BudgetPeriodDaily {
+		t.Fatalf("recording over the daily limit: %q %v", period, err)
+	}
+
+	report, err := service.Report(h.user.Id, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Today) != 1 || report.Today[0].Model != TranscriptionUsageModel || report.Today[0].TranscribedSeconds != 90 {
+		t.Fatalf("report: %#v", report.Today)
+	}
+}
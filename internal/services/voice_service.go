@@ -2,23 +2,185 @@ package services
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/sashabaranov/go-openai"
+	"vadimgribanov.com/tg-gpt/internal/config"
+	"vadimgribanov.com/tg-gpt/internal/repositories"
+	"vadimgribanov.com/tg-gpt/internal/telegram_utils"
+)
+
+const (
+	// ReplyModePreference is the preference holding how a user wants answers:
+	// ReplyModeVoice adds a voice note after the text, anything else is text only.
+	ReplyModePreference = "reply_mode"
+	ReplyModeVoice      = "voice"
+	ReplyModeText       = "text"
+
+	// maxSpeechRunes keeps each synthesized part under the 4096 character input
+	// limit of the OpenAI speech endpoint.
+	maxSpeechRunes = 4000
+	// maxVoiceNotes caps how many voice notes one answer is spoken in; the rest of
+	// a longer answer is left to the text.
+	maxVoiceNotes       = 3
+	speechTruncatedNote = "The rest of the answer is in the text above."
 )
 
 type VoiceService struct {
-	Client *openai.Client
+	transcriber  Transcriber
+	speechClient *openai.Client
+	tts          config.TTSConfig
+	prefs        *repositories.PreferenceRepo
+}
+
+func NewVoiceService(transcriber Transcriber, client *openai.Client, tts config.TTSConfig, prefs *repositories.PreferenceRepo) *VoiceService {
+	speechClient := client
+	if tts.BaseURL != "" {
+		clientConfig := openai.DefaultConfig("")
+		if tts.APIKeyEnv != "" {
+			clientConfig = openai.DefaultConfig(os.Getenv(tts.APIKeyEnv))
+		}
+		clientConfig.BaseURL = tts.BaseURL
+		speechClient = openai.NewClientWithConfig(clientConfig)
+	}
+	return &VoiceService{
+		transcriber:  transcriber,
+		speechClient: speechClient,
+		tts:          tts,
+		prefs:        prefs,
+	}
+}
+
+// Transcribe turns the user's speech into text, hinting the transcriber with the
+// language of their response_language preference. fileName carries the audio
+// format, e.g. voice.ogg for voice messages.
+func (h *VoiceService) Transcribe(ctx context.Context, userID int64, audio io.Reader, fileName string) (string, error) {
+	language := ""
+	pref, err := h.prefs.Get(userID, "response_language")
+	if err != nil {
+		slog.WarnContext(ctx, "Error reading response language, transcribing without a hint", "error", err)
+	} else if pref != nil {
+		language = transcriptionLanguage(pref.PrefValue)
+	}
+	return h.transcriber.Transcribe(ctx, audio, fileName, language)
+}
+
+// VoiceRepliesEnabled reports whether the user asked for spoken answers.
+func (h *VoiceService) VoiceRepliesEnabled(userID int64) (bool, error) {
+	pref, err := h.prefs.Get(userID, ReplyModePreference)
+	if err != nil || pref == nil {
+		return false, err
+	}
+	return strings.EqualFold(strings.TrimSpace(pref.PrefValue), ReplyModeVoice), nil
+}
+
+func (h *VoiceService) SetVoiceReplies(userID int64, enabled bool) error {
+	mode := ReplyModeText
+	if enabled {
+		mode = ReplyModeVoice
+	}
+	return h.prefs.Upsert(repositories.UpsertPreferenceInput{
+		UserID: userID,
+		Key:    ReplyModePreference,
+		Value:  mode,
+		Source: "explicit",
+	})
 }
 
-func (h *VoiceService) OnVoiceHandler(ctx context.Context, voiceFileReader io.ReadCloser) (string, error) {
-	response, err := h.Client.CreateTranscription(ctx, openai.AudioRequest{
-		Reader:   voiceFileReader,
-		FilePath: "voice.ogg",
-		Model:    openai.Whisper1,
+// ReplyWithVoice speaks answer as OGG/Opus voice notes replying to the answered
+// message, if the user turned voice replies on. Failures are logged and never
+// returned: the text answer has already been delivered.
+func (h *VoiceService) ReplyWithVoice(ctx context.Context, userID int64, answer string, streamer *telegram_utils.TelegramStreamer) {
+	enabled, err := h.VoiceRepliesEnabled(userID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading reply mode", "error", err)
+		return
+	}
+	if !enabled {
+		return
+	}
+	for _, part := range speechParts(answer) {
+		audio, err := h.synthesize(ctx, part)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error synthesizing voice reply", "error", err)
+			return
+		}
+		err = streamer.SendVoice(audio)
+		audio.Close()
+		if err != nil {
+			slog.ErrorContext(ctx, "Error sending voice reply", "error", err)
+			return
+		}
+	}
+}
+
+func (h *VoiceService) synthesize(ctx context.Context, text string) (io.ReadCloser, error) {
+	response, err := h.speechClient.CreateSpeech(ctx, openai.CreateSpeechRequest{
+		Model:          openai.SpeechModel(h.tts.Model),
+		Voice:          openai.SpeechVoice(h.tts.Voice),
+		Input:          text,
+		ResponseFormat: openai.SpeechResponseFormatOpus,
 	})
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("create speech: %w", err)
+	}
+	return response, nil
+}
+
+var (
+	codeBlockPattern = regexp.MustCompile("(?s)```.*?```")
+	linkPattern      = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+	markupPattern    = regexp.MustCompile("[*_`#>~|]+")
+)
+
+// speechParts turns a Markdown answer into the texts to speak: code blocks are
+// left out, markup is stripped, and long answers are split at paragraph or
+// sentence boundaries into at most maxVoiceNotes parts.
+func speechParts(answer string) []string {
+	text := codeBlockPattern.ReplaceAllString(answer, "(code is in the text above)")
+	text = linkPattern.ReplaceAllString(text, "$1")
+	text = markupPattern.ReplaceAllString(text, "")
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil
+	}
+
+	var parts []string
+	for text != "" {
+		if len(parts) == maxVoiceNotes-1 && utf8.RuneCountInString(text) > maxSpeechRunes {
+			part := splitSpeech(text, maxSpeechRunes-utf8.RuneCountInString(speechTruncatedNote)-1)
+			parts = append(parts, part+" "+speechTruncatedNote)
+			break
+		}
+		part := splitSpeech(text, maxSpeechRunes)
+		parts = append(parts, part)
+		text = strings.TrimSpace(text[len(part):])
+	}
+	return parts
+}
+
+// splitSpeech returns the leading part of text that fits into size runes, cut at
+// the last paragraph, sentence or word boundary within it.
+func splitSpeech(text string, size int) string {
+	if utf8.RuneCountInString(text) <= size {
+		return text
+	}
+	end := 0
+	for i := 0; i < size; i++ {
+		_, width := utf8.DecodeRuneInString(text[end:])
+		end += width
+	}
+	head := text[:end]
+	for _, sep := range []string{"\n\n", ". ", "! ", "? ", "\n", " "} {
+		if cut := strings.LastIndex(head, sep); cut >= len(head)/2 {
+			return head[:cut+len(strings.TrimRight(sep, " \n"))]
+		}
 	}
-	return response.Text, nil
+	return head
 }
@@ -0,0 +1,49 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSpeechPartsStripsMarkdown(t *testing.T) {
+	parts := speechParts("## Result\nUse **bold** and see [the docs](https://example.com).\n```go\nfmt.Println(1)\n```")
+	if len(parts) != 1 {
+		t.Fatalf("parts: %q", parts)
+	}
+	want := "Result\nUse bold and see the docs.\n(code is in the text above)"
+	if parts[0] != want {
+		t.Fatalf("speech text: got %q want %q", parts[0], want)
+	}
+}
+
+func TestSpeechPartsSplitsLongAnswersAtSentences(t *testing.T) {
+	sentence := strings.Repeat("word ", 99) + "end. "
+	answer := strings.Repeat(sentence, 20) // 10000 characters
+
+	parts := speechParts(answer)
+	if len(parts) != 3 {
+		t.Fatalf("parts len: got %d want 3", len(parts))
+	}
+	for i, part := range parts {
+		if n := utf8.RuneCountInString(part); n > maxSpeechRunes {
+			t.Fatalf("part %d has %d runes", i, n)
+		}
+		if !strings.HasSuffix(part, "end.") && i < len(parts)-1 {
+			t.Fatalf("part %d must end at a sentence: %q", i, part[len(part)-20:])
+		}
+	}
+}
+
+func TestSpeechPartsLeavesTheRestOfVeryLongAnswersToText(t *testing.T) {
+	answer := strings.Repeat(strings.Repeat("word ", 99)+"end. ", 40) // 20000 characters
+
+	parts := speechParts(answer)
+	if len(parts) != maxVoiceNotes {
+		t.Fatalf("parts len: got %d want %d", len(parts), maxVoiceNotes)
+	}
+	last := parts[len(parts)-1]
+	if !strings.HasSuffix(last, speechTruncatedNote) || utf8.RuneCountInString(last) > maxSpeechRunes {
+		t.Fatalf("last part must mention the text and fit the limit: %d runes", utf8.RuneCountInString(last))
+	}
+}
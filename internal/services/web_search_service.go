@@ -35,7 +35,7 @@ func NewWebSearchService(apiKey string) *WebSearchService {
 	}
 }
 
-func (s *WebSearchService) GetWebSearchTools() []llm.Tool {
+func (s *WebSearchService) Tools() []llm.Tool {
 	return []llm.Tool{
 		{
 			Name:        "web_search",
@@ -76,7 +76,7 @@ func (s *WebSearchService) GetWebSearchTools() []llm.Tool {
 	}
 }
 
-func (s *WebSearchService) HandleToolCall(ctx context.Context, toolCall llm.ToolCall) (string, error) {
+func (s *WebSearchService) HandleToolCall(ctx context.Context, mctx TurnContext, toolCall llm.ToolCall) (string, error) {
 	if toolCall.Name != "web_search" {
 		return "", fmt.Errorf("unknown web search tool call: %s", toolCall.Name)
 	}
@@ -105,7 +105,7 @@ func TestWebSearchEmptyTavilyResponseReturnsToolResult(t *testing.T) {
 		}, nil
 	})}
 
-	result, err := service.HandleToolCall(context.Background(), llm.ToolCall{
+	result, err := service.HandleToolCall(context.Background(), TurnContext{}, llm.ToolCall{
 		Name:      "web_search",
 		Arguments: `{"query":"test"}`,
 	})
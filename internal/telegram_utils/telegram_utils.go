@@ -3,6 +3,7 @@ package telegram_utils
 import (
 	"context"
 	"errors"
+	"io"
 	"log/slog"
 	"strings"
 
@@ -34,12 +35,43 @@ func (t *TelegramStreamer) HasOutput() bool {
 	return t.currentMessage != nil || strings.TrimSpace(t.accumulatedMessage) != ""
 }
 
+// ReplaceMessages makes the answer overwrite messages, an earlier reply of the bot,
+// instead of being posted as a new reply. The answer starts in the first of them;
+// the others are deleted so that no part of the earlier reply is left behind.
+func (t *TelegramStreamer) ReplaceMessages(messages []*tele.Message) {
+	if len(messages) == 0 {
+		return
+	}
+	t.currentMessage = messages[0]
+	for _, message := range messages[1:] {
+		if err := t.c.Bot().Delete(message); err != nil {
+			ctx := t.c.Get("requestContext").(context.Context)
+			slog.WarnContext(ctx, "Error deleting replaced message", "error", err, "message_id", message.ID)
+		}
+	}
+}
+
+// MessageIDs returns the Telegram messages the answer was sent as, in order, or
+// nil before anything was sent.
+func (t *TelegramStreamer) MessageIDs() []int64 {
+	var ids []int64
+	for _, message := range t.messages {
+		if message != nil {
+			ids = append(ids, int64(message.ID))
+		}
+	}
+	if t.currentMessage != nil {
+		ids = append(ids, int64(t.currentMessage.ID))
+	}
+	return ids
+}
+
 func (t *TelegramStreamer) SendStatus(text string) error {
 	ctx := t.c.Get("requestContext").(context.Context)
 	if t.HasOutput() || strings.TrimSpace(text) == "" {
 		return nil
 	}
-	msg, err := t.c.Bot().Reply(t.replyTo, text, &tele.SendOptions{ParseMode: tele.ModeDefault})
+	msg, err := t.c.Bot().Reply(t.replyTo, text, t.sendOptions(tele.ModeDefault))
 	if err != nil {
 		slog.ErrorContext(ctx, "Error sending status message", "error", err, "message", text)
 		return err
@@ -48,6 +80,37 @@ func (t *TelegramStreamer) SendStatus(text string) error {
 	return nil
 }
 
+// SendNotice replies with a standalone message that the streamed answer will not
+// overwrite, unlike SendStatus.
+func (t *TelegramStreamer) SendNotice(text string) error {
+	_, err := t.c.Bot().Reply(t.replyTo, text, t.sendOptions(tele.ModeDefault))
+	return err
+}
+
+// SendPrompt replies with a standalone message carrying inline buttons, e.g. a
+// question for the user, and returns it.
+func (t *TelegramStreamer) SendPrompt(text string, markup *tele.ReplyMarkup) (*tele.Message, error) {
+	opts := t.sendOptions(tele.ModeDefault)
+	opts.ReplyMarkup = markup
+	return t.c.Bot().Reply(t.replyTo, text, opts)
+}
+
+// SendVoice replies with an OGG/Opus voice note, e.g. the spoken answer.
+func (t *TelegramStreamer) SendVoice(audio io.Reader) error {
+	voice := &tele.Voice{File: tele.FromReader(audio), MIME: "audio/ogg"}
+	_, err := t.c.Bot().Reply(t.replyTo, voice, t.sendOptions(tele.ModeDefault))
+	return err
+}
+
+// sendOptions keeps replies in the forum topic of the message being answered.
+func (t *TelegramStreamer) sendOptions(mode tele.ParseMode) *tele.SendOptions {
+	opts := &tele.SendOptions{ParseMode: mode}
+	if t.replyTo != nil && t.replyTo.TopicMessage {
+		opts.ThreadID = t.replyTo.ThreadID
+	}
+	return opts
+}
+
 func (t *TelegramStreamer) SendEvent(event llm.StreamEvent) error {
 	ctx := t.c.Get("requestContext").(context.Context)
 	slog.DebugContext(ctx, "Streaming event", "event", event)
@@ -86,13 +149,17 @@ func (t *TelegramStreamer) Flush() error {
 
 	var err error
 	if t.currentMessage == nil {
-		t.currentMessage, err = t.c.Bot().Reply(t.replyTo, FixMarkdown(t.accumulatedMessage), &tele.SendOptions{ParseMode: tele.ModeMarkdown})
+		t.currentMessage, err = t.c.Bot().Reply(t.replyTo, FixMarkdown(t.accumulatedMessage), t.sendOptions(tele.ModeMarkdown))
 		if err != nil {
-			t.currentMessage, err = t.c.Bot().Reply(t.replyTo, t.accumulatedMessage, &tele.SendOptions{ParseMode: tele.ModeDefault})
+			t.currentMessage, err = t.c.Bot().Reply(t.replyTo, t.accumulatedMessage, t.sendOptions(tele.ModeDefault))
 			slog.ErrorContext(ctx, "Error sending message", "error", err, "message", t.accumulatedMessage)
 		}
 	} else {
 		_, err = t.c.Bot().Edit(t.currentMessage, FixMarkdown(t.accumulatedMessage), &tele.SendOptions{ParseMode: tele.ModeMarkdown})
+		// A replaced message may already read the same as the new answer.
+		if errors.Is(err, tele.ErrSameMessageContent) {
+			err = nil
+		}
 		if err != nil {
 			_, err = t.c.Bot().Edit(t.currentMessage, t.accumulatedMessage, &tele.SendOptions{ParseMode: tele.ModeDefault})
 			slog.ErrorContext(ctx, "Error editing message", "error", err, "message", t.accumulatedMessage)
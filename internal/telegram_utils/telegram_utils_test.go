@@ -0,0 +1,83 @@
+package telegram_utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	tele "gopkg.in/telebot.v3"
+	"vadimgribanov.com/tg-gpt/internal/llm"
+)
+
+type botCall struct {
+	method    string
+	messageID any
+}
+
+// newFakeBotContext returns the context of a message in chat 1 whose bot answers
+// every call with a new message and records the calls.
+func newFakeBotContext(t *testing.T) (tele.Context, func() []botCall) {
+	t.Helper()
+	var mu sync.Mutex
+	var calls []botCall
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		calls = append(calls, botCall{method: r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:], messageID: payload["message_id"]})
+		id := 100 + len(calls)
+		mu.Unlock()
+		fmt.Fprintf(w, `{"ok":true,"result":{"message_id":%d,"date":0,"chat":{"id":1}}}`, id)
+	}))
+	t.Cleanup(server.Close)
+	bot, err := tele.NewBot(tele.Settings{URL: server.URL, Token: "test", Offline: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := bot.NewContext(tele.Update{Message: &tele.Message{ID: 1, Chat: &tele.Chat{ID: 1}}})
+	c.Set("requestContext", context.Background())
+	return c, func() []botCall {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]botCall(nil), calls...)
+	}
+}
+
+func TestStreamerRecordsAndReplacesEveryPartOfALongAnswer(t *testing.T) {
+	c, calls := newFakeBotContext(t)
+	streamer := NewTelegramStreamer(c, c.Message())
+	for i := 0; i < 3; i++ {
+		if err := streamer.SendEvent(llm.StreamEvent{TextDelta: strings.Repeat("a", 2000)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := streamer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	ids := streamer.MessageIDs()
+	if len(ids) != 2 || ids[0] == ids[1] {
+		t.Fatalf("a split answer must record both messages: %v", ids)
+	}
+
+	before := len(calls())
+	rerun := NewTelegramStreamer(c, c.Message())
+	rerun.ReplaceMessages([]*tele.Message{{ID: int(ids[0]), Chat: c.Chat()}, {ID: int(ids[1]), Chat: c.Chat()}})
+	if err := rerun.SendEvent(llm.StreamEvent{TextDelta: strings.Repeat("b", 300)}); err != nil {
+		t.Fatal(err)
+	}
+	after := calls()[before:]
+	if len(after) != 2 || after[0].method != "deleteMessage" || fmt.Sprint(after[0].messageID) != fmt.Sprint(ids[1]) {
+		t.Fatalf("the later part of the old answer must be deleted first: %#v", after)
+	}
+	if after[1].method != "editMessageText" || fmt.Sprint(after[1].messageID) != fmt.Sprint(ids[0]) {
+		t.Fatalf("the new answer must start in the first part: %#v", after)
+	}
+	if got := rerun.MessageIDs(); len(got) != 1 || got[0] != ids[0] {
+		t.Fatalf("re-run answer messages: %v", got)
+	}
+}
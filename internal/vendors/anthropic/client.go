@@ -7,20 +7,48 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
 )
 
+const defaultBaseURL = "https://api.anthropic.com"
+
 type Client struct {
 	baseURL    string
 	apiKey     string
 	httpClient *http.Client
 }
 
+type ClientConfig struct {
+	APIKey     string
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+func DefaultConfig(apiKey string) ClientConfig {
+	return ClientConfig{
+		APIKey:     apiKey,
+		BaseURL:    defaultBaseURL,
+		HTTPClient: &http.Client{},
+	}
+}
+
 func NewClient(apiKey string) *Client {
+	return NewClientWithConfig(DefaultConfig(apiKey))
+}
+
+func NewClientWithConfig(config ClientConfig) *Client {
+	if config.BaseURL == "" {
+		config.BaseURL = defaultBaseURL
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{}
+	}
 	return &Client{
-		baseURL:    "https://api.anthropic.com",
-		apiKey:     apiKey,
-		httpClient: &http.Client{},
+		baseURL:    strings.TrimRight(config.BaseURL, "/"),
+		apiKey:     config.APIKey,
+		httpClient: config.HTTPClient,
 	}
 }
 
@@ -39,16 +67,74 @@ func (c *Client) CreateMessagesStream(ctx context.Context, request CreateMessage
 }
 
 type CreateMessageRequest struct {
-	Model     string    `json:"model"`
-	Messages  []Message `json:"messages"`
-	Stream    bool      `json:"stream"`
-	MaxTokens int       `json:"max_tokens"`
-	System    string    `json:"system"`
+	Model      string      `json:"model"`
+	Messages   []Message   `json:"messages"`
+	Stream     bool        `json:"stream"`
+	MaxTokens  int         `json:"max_tokens"`
+	System     string      `json:"system,omitempty"`
+	Tools      []Tool      `json:"tools,omitempty"`
+	ToolChoice *ToolChoice `json:"tool_choice,omitempty"`
 }
 
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role    string         `json:"role"`
+	Content []ContentBlock `json:"content"`
+}
+
+const (
+	ContentBlockTypeText       = "text"
+	ContentBlockTypeImage      = "image"
+	ContentBlockTypeToolUse    = "tool_use"
+	ContentBlockTypeToolResult = "tool_result"
+)
+
+// ContentBlock is a single entry of a message's content array. Only the fields
+// relevant to Type are populated; the rest are omitted on the wire.
+type ContentBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+
+	// image
+	Source *ImageSource `json:"source,omitempty"`
+
+	// tool_use
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+
+	// tool_result
+	ToolUseID string `json:"tool_use_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+	IsError   bool   `json:"is_error,omitempty"`
+}
+
+const (
+	ImageSourceTypeBase64 = "base64"
+	ImageSourceTypeURL    = "url"
+)
+
+// ImageSource is either inline base64 data (MediaType + Data) or a public URL.
+type ImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+type Tool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	InputSchema map[string]any `json:"input_schema"`
+}
+
+const (
+	ToolChoiceAuto = "auto"
+	ToolChoiceAny  = "any"
+	ToolChoiceNone = "none"
+)
+
+type ToolChoice struct {
+	Type string `json:"type"`
 }
 
 func (c *Client) rawRequest(ctx context.Context, payload []byte) (*http.Response, error) {
@@ -64,11 +150,24 @@ func (c *Client) rawRequest(ctx context.Context, payload []byte) (*http.Response
 		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
-		return resp, fmt.Errorf("server returned non-200 status: %d %s", resp.StatusCode, resp.Status)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: strings.TrimSpace(string(body))}
 	}
 	return resp, nil
 }
 
+// StatusError is returned when the API answers with a non-200 status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server returned non-200 status: %s: %s", e.Status, e.Body)
+}
+
 type StreamedResponse struct {
 	resp   *http.Response
 	reader *bufio.Reader
@@ -148,16 +247,18 @@ func unmarshalEventData[T any](data []byte) (T, error) {
 type MessageStartData struct {
 	Type    string `json:"type"`
 	Message struct {
-		ID           string   `json:"id"`
-		Type         string   `json:"type"`
-		Role         string   `json:"role"`
-		Content      []string `json:"content"`
-		Model        string   `json:"model"`
-		StopReason   string   `json:"stop_reason"`
-		StopSequence string   `json:"stop_sequence"`
+		ID           string         `json:"id"`
+		Type         string         `json:"type"`
+		Role         string         `json:"role"`
+		Content      []ContentBlock `json:"content"`
+		Model        string         `json:"model"`
+		StopReason   string         `json:"stop_reason"`
+		StopSequence string         `json:"stop_sequence"`
 		Usage        struct {
-			InputTokens  int `json:"input_tokens"`
-			OutputTokens int `json:"output_tokens"`
+			InputTokens              int `json:"input_tokens"`
+			OutputTokens             int `json:"output_tokens"`
+			CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+			CacheReadInputTokens     int `json:"cache_read_input_tokens"`
 		} `json:"usage"`
 	} `json:"message"`
 }
@@ -166,8 +267,11 @@ type ContentBlockStartData struct {
 	Type         string `json:"type"`
 	Index        int    `json:"index"`
 	ContentBlock struct {
-		Type string `json:"type"`
-		Text string `json:"text"`
+		Type  string          `json:"type"`
+		Text  string          `json:"text"`
+		ID    string          `json:"id"`
+		Name  string          `json:"name"`
+		Input json.RawMessage `json:"input"`
 	} `json:"content_block"`
 }
 
@@ -181,9 +285,17 @@ type ContentBlockDeltaData struct {
 	Delta TextDelta `json:"delta"`
 }
 
+const (
+	DeltaTypeText      = "text_delta"
+	DeltaTypeInputJSON = "input_json_delta"
+)
+
+// TextDelta carries either a text_delta (Text) or an input_json_delta
+// (PartialJSON) for a streamed tool_use block.
 type TextDelta struct {
-	Type string `json:"type"`
-	Text string `json:"text"`
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	PartialJSON string `json:"partial_json"`
 }
 
 type ContentBlockStopData struct {
@@ -209,9 +321,22 @@ type MessageStopData struct {
 }
 
 type ErrorData struct {
-	Type  string `json:"type"`
-	Error struct {
-		Type    string `json:"type"`
-		Message string `json:"message"`
-	} `json:"error"`
+	Type  string      `json:"type"`
+	Error StreamError `json:"error"`
 }
+
+// StreamError is an error event sent mid-stream, e.g. overloaded_error.
+type StreamError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("anthropic stream error: %s: %s", e.Type, e.Message)
+}
+
+const (
+	ErrorTypeOverloaded = "overloaded_error"
+	ErrorTypeAPI        = "api_error"
+	ErrorTypeRateLimit  = "rate_limit_error"
+)
@@ -0,0 +1,227 @@
+package gemini
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const defaultBaseURL = "https://generativelanguage.googleapis.com"
+
+type Client struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+}
+
+type ClientConfig struct {
+	APIKey     string
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+func DefaultConfig(apiKey string) ClientConfig {
+	return ClientConfig{
+		APIKey:     apiKey,
+		BaseURL:    defaultBaseURL,
+		HTTPClient: &http.Client{},
+	}
+}
+
+func NewClient(apiKey string) *Client {
+	return NewClientWithConfig(DefaultConfig(apiKey))
+}
+
+func NewClientWithConfig(config ClientConfig) *Client {
+	if config.BaseURL == "" {
+		config.BaseURL = defaultBaseURL
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{}
+	}
+	return &Client{
+		baseURL:    strings.TrimRight(config.BaseURL, "/"),
+		apiKey:     config.APIKey,
+		httpClient: config.HTTPClient,
+	}
+}
+
+// StreamGenerateContent calls models/{model}:streamGenerateContent with alt=sse and
+// returns a stream of partial GenerateContentResponse chunks.
+func (c *Client) StreamGenerateContent(ctx context.Context, model string, request GenerateContentRequest) (*StreamedResponse, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := fmt.Sprintf("%s/v1beta/models/%s:streamGenerateContent?alt=sse", c.baseURL, url.PathEscape(model))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-goog-api-key", c.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: strings.TrimSpace(string(body))}
+	}
+	return NewStreamedResponse(resp), nil
+}
+
+type GenerateContentRequest struct {
+	Contents          []Content   `json:"contents"`
+	SystemInstruction *Content    `json:"systemInstruction,omitempty"`
+	Tools             []Tool      `json:"tools,omitempty"`
+	ToolConfig        *ToolConfig `json:"toolConfig,omitempty"`
+}
+
+const (
+	RoleUser  = "user"
+	RoleModel = "model"
+)
+
+type Content struct {
+	Role  string `json:"role,omitempty"`
+	Parts []Part `json:"parts"`
+}
+
+// Part is one element of a Content. Exactly one of Text, InlineData, FunctionCall or
+// FunctionResponse is set.
+type Part struct {
+	Text             string            `json:"text,omitempty"`
+	InlineData       *Blob             `json:"inlineData,omitempty"`
+	FunctionCall     *FunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *FunctionResponse `json:"functionResponse,omitempty"`
+	ThoughtSignature string            `json:"thoughtSignature,omitempty"`
+}
+
+type Blob struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+type FunctionCall struct {
+	ID   string          `json:"id,omitempty"`
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+type FunctionResponse struct {
+	ID       string          `json:"id,omitempty"`
+	Name     string          `json:"name"`
+	Response json.RawMessage `json:"response"`
+}
+
+type Tool struct {
+	FunctionDeclarations []FunctionDeclaration `json:"functionDeclarations,omitempty"`
+}
+
+type FunctionDeclaration struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Parameters  map[string]any `json:"parameters,omitempty"`
+}
+
+const (
+	FunctionCallingModeAuto = "AUTO"
+	FunctionCallingModeAny  = "ANY"
+	FunctionCallingModeNone = "NONE"
+)
+
+type ToolConfig struct {
+	FunctionCallingConfig FunctionCallingConfig `json:"functionCallingConfig"`
+}
+
+type FunctionCallingConfig struct {
+	Mode string `json:"mode"`
+}
+
+type GenerateContentResponse struct {
+	Candidates    []Candidate    `json:"candidates"`
+	UsageMetadata *UsageMetadata `json:"usageMetadata,omitempty"`
+	Error         *APIError      `json:"error,omitempty"`
+}
+
+type Candidate struct {
+	Content      Content `json:"content"`
+	FinishReason string  `json:"finishReason,omitempty"`
+	Index        int     `json:"index"`
+}
+
+// UsageMetadata is cumulative for the whole response; every chunk repeats the
+// running totals rather than a delta.
+type UsageMetadata struct {
+	PromptTokenCount        int `json:"promptTokenCount"`
+	CandidatesTokenCount    int `json:"candidatesTokenCount"`
+	CachedContentTokenCount int `json:"cachedContentTokenCount"`
+	ThoughtsTokenCount      int `json:"thoughtsTokenCount"`
+	TotalTokenCount         int `json:"totalTokenCount"`
+}
+
+// APIError is an error reported inside the stream. Code mirrors the HTTP status
+// the request would have failed with (429, 503, ...).
+type APIError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("gemini stream error: %d %s: %s", e.Code, e.Status, e.Message)
+}
+
+// StatusError is returned when the API answers with a non-200 status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server returned non-200 status: %s: %s", e.Status, e.Body)
+}
+
+type StreamedResponse struct {
+	resp   *http.Response
+	reader *bufio.Reader
+}
+
+func NewStreamedResponse(resp *http.Response) *StreamedResponse {
+	return &StreamedResponse{resp: resp, reader: bufio.NewReader(resp.Body)}
+}
+
+func (s *StreamedResponse) Close() {
+	s.resp.Body.Close()
+}
+
+// Recv returns the next chunk. At the end of the stream it returns io.EOF.
+func (s *StreamedResponse) Recv() (GenerateContentResponse, error) {
+	for {
+		rawLine, err := s.reader.ReadBytes('\n')
+		if err != nil {
+			return GenerateContentResponse{}, err
+		}
+		dataLine, ok := bytes.CutPrefix(bytes.TrimSpace(rawLine), []byte("data: "))
+		if !ok {
+			continue
+		}
+		var chunk GenerateContentResponse
+		if err := json.Unmarshal(dataLine, &chunk); err != nil {
+			return GenerateContentResponse{}, err
+		}
+		if chunk.Error != nil {
+			return GenerateContentResponse{}, chunk.Error
+		}
+		return chunk, nil
+	}
+}